@@ -16,6 +16,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -24,12 +25,14 @@ import (
 	"fmt"
 	"github.com/isrc-cas/gt/conn/msquic"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
 	"os"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -195,6 +198,11 @@ type dialer struct {
 	stun      string
 	tlsConfig *tls.Config
 	dialFn    func() (conn net.Conn, err error)
+	// quicDialer 使所有隧道共享同一个 QUIC connection
+	quicDialer *connection.QuicDialer
+	timeout    time.Duration
+	// verified 为 true 表示连接使用 TLS 并且验证了服务端的证书
+	verified bool
 }
 
 func (d *dialer) init(c *Client, remote string, stun string) (err error) {
@@ -205,6 +213,7 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		return
 	}
 	d.stun = stun
+	d.timeout = c.Config().RemoteTimeout.Duration
 	c.Logger.Info().Str("remote", remote).Str("stun", stun).Msg("remote url")
 	switch u.Scheme {
 	case "tls":
@@ -230,6 +239,15 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		if c.Config().RemoteCertInsecure {
 			tlsConfig.InsecureSkipVerify = true
 		}
+		d.verified = !tlsConfig.InsecureSkipVerify
+		err = setRemoteClientCert(c, tlsConfig)
+		if err != nil {
+			return
+		}
+		if len(tlsConfig.Certificates) > 0 {
+			// 服务端只对使用该协议的连接请求客户端证书
+			tlsConfig.NextProtos = []string{predef.TunnelALPN}
+		}
 		d.host = u.Host
 		d.tlsConfig = tlsConfig
 		d.dialFn = d.tlsDial
@@ -262,6 +280,15 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		if c.Config().RemoteCertInsecure {
 			tlsConfig.InsecureSkipVerify = true
 		}
+		d.verified = !tlsConfig.InsecureSkipVerify
+		err = setRemoteClientCert(c, tlsConfig)
+		if err != nil {
+			return
+		}
+		if len(tlsConfig.Certificates) > 0 && c.Config().OpenBBR {
+			err = errors.New("-remoteClientCert option is not supported when -bbr option is set")
+			return
+		}
 		d.host = u.Host
 		d.tlsConfig = tlsConfig
 		//quic-go只有Cubic一种拥塞控制算法
@@ -269,6 +296,7 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 		if c.Config().OpenBBR {
 			d.dialFn = d.msquicDial
 		} else {
+			d.quicDialer = connection.NewQuicDialer(d.host, d.tlsConfig)
 			d.dialFn = d.quicDial
 		}
 	default:
@@ -277,8 +305,18 @@ func (d *dialer) init(c *Client, remote string, stun string) (err error) {
 	return
 }
 
-func (d *dialer) initWithRemote(c *Client) (err error) {
-	return d.init(c, c.Config().Remote[c.chosenRemoteLabel], c.Config().RemoteSTUN)
+// setRemoteClientCert 使隧道向服务端出示 -remoteClientCert 客户端证书
+func setRemoteClientCert(c *Client, tlsConfig *tls.Config) (err error) {
+	if len(c.Config().RemoteClientCert) == 0 && len(c.Config().RemoteClientKey) == 0 {
+		return
+	}
+	crt, err := tls.LoadX509KeyPair(c.Config().RemoteClientCert, c.Config().RemoteClientKey)
+	if err != nil {
+		err = fmt.Errorf("invalid client cert (-remoteClientCert option) and key (-remoteClientKey option), cause %s", err.Error())
+		return
+	}
+	tlsConfig.Certificates = []tls.Certificate{crt}
+	return
 }
 
 func (d *dialer) initWithRemoteAPI(c *Client) (err error) {
@@ -321,21 +359,79 @@ func (d *dialer) initWithRemoteAPI(c *Client) (err error) {
 }
 
 func (d *dialer) dial() (conn net.Conn, err error) {
-	return net.Dial("tcp", d.host)
+	return net.DialTimeout("tcp", d.host, d.timeout)
 }
 
 func (d *dialer) tlsDial() (conn net.Conn, err error) {
-	return tls.Dial("tcp", d.host, d.tlsConfig)
+	return tls.DialWithDialer(&net.Dialer{Timeout: d.timeout}, "tcp", d.host, d.tlsConfig)
 }
 
 func (d *dialer) quicDial() (conn net.Conn, err error) {
-	return connection.QuicDial(d.host, d.tlsConfig)
+	ctx := context.Background()
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	return d.quicDialer.DialContext(ctx)
 }
 
 func (d *dialer) msquicDial() (conn net.Conn, err error) {
 	return msquic.MsquicDial(d.host, d.tlsConfig)
 }
 
+// chooseRemote 使用智能切换策略在 -remote 中选择建立隧道的服务端
+func (c *Client) chooseRemote() (err error) {
+	var hasQuic bool
+	var enterSwitch bool
+	if len(c.Config().Remote) >= 2 {
+		enterSwitch = true
+		for index, remote := range c.Config().Remote {
+			var u *url.URL
+			u, err = url.Parse(remote)
+			if err != nil {
+				err = fmt.Errorf("remote url (-remote option) '%s' is invalid, cause %s", remote, err.Error())
+				return
+			}
+			if u.Scheme == "quic" {
+				c.Logger.Info().Str("remote", remote).Msg("waiting...intelligent switch are sending probes to get network conditions...")
+				hasQuic = true
+				if len(u.Port()) < 1 {
+					u.Host = net.JoinHostPort(u.Host, "443")
+				}
+				var avgRtt, pktLoss float64
+				avgRtt, pktLoss, err = connection.GetQuicProbesResults(u.Host)
+				if err != nil {
+					c.Logger.Error().Err(err).Msg("can not use QUIC connection to detect network conditions")
+					return err
+				}
+
+				c.Logger.Info().Float64("averageRTT", avgRtt).Float64("lossRate", pktLoss).Msg("QUIC probes get network conditions with")
+				var networkCondition = []float64{0, 0, 0, 0, avgRtt, pktLoss, 0, 0, 0, 0}
+				result := connection.PredictWithRttAndLoss(networkCondition)
+				if result[1] > result[0] {
+					c.chosenRemoteLabel = index
+				} else {
+					if index == 0 {
+						c.chosenRemoteLabel = 1
+					} else {
+						c.chosenRemoteLabel = 0
+					}
+				}
+			}
+		}
+		if !hasQuic {
+			c.chosenRemoteLabel = 0
+		}
+	} else {
+		c.chosenRemoteLabel = 0
+	}
+	if enterSwitch {
+		c.Logger.Info().Str("remote", c.Config().Remote[c.chosenRemoteLabel]).Msg("intelligent switch strategy finally choose to establish with")
+	}
+	return
+}
+
 // Start runs the client agent.
 func (c *Client) Start() (err error) {
 	c.Logger.Info().Msg(predef.Version)
@@ -382,61 +478,14 @@ func (c *Client) Start() (err error) {
 		return
 	}
 
-	var dialer dialer
+	var pools []*remotePool
 	if len(c.Config().Remote) > 0 {
-		var hasQuic bool
-		var enterSwitch bool
 		for index, _ := range c.Config().Remote {
 			if !strings.Contains(c.Config().Remote[index], "://") {
 				c.Config().Remote[index] = "tcp://" + c.Config().Remote[index]
 			}
 		}
-		if len(c.Config().Remote) >= 2 {
-			enterSwitch = true
-			for index, remote := range c.Config().Remote {
-				var u *url.URL
-				u, err = url.Parse(remote)
-				if err != nil {
-					err = fmt.Errorf("remote url (-remote option) '%s' is invalid, cause %s", remote, err.Error())
-					return
-				}
-				if u.Scheme == "quic" {
-					c.Logger.Info().Str("remote", remote).Msg("waiting...intelligent switch are sending probes to get network conditions...")
-					hasQuic = true
-					if len(u.Port()) < 1 {
-						u.Host = net.JoinHostPort(u.Host, "443")
-					}
-					var avgRtt, pktLoss float64
-					avgRtt, pktLoss, err = connection.GetQuicProbesResults(u.Host)
-					if err != nil {
-						c.Logger.Error().Err(err).Msg("can not use QUIC connection to detect network conditions")
-						return err
-					}
-
-					c.Logger.Info().Float64("averageRTT", avgRtt).Float64("lossRate", pktLoss).Msg("QUIC probes get network conditions with")
-					var networkCondition = []float64{0, 0, 0, 0, avgRtt, pktLoss, 0, 0, 0, 0}
-					result := connection.PredictWithRttAndLoss(networkCondition)
-					if result[1] > result[0] {
-						c.chosenRemoteLabel = index
-					} else {
-						if index == 0 {
-							c.chosenRemoteLabel = 1
-						} else {
-							c.chosenRemoteLabel = 0
-						}
-					}
-				}
-			}
-			if !hasQuic {
-				c.chosenRemoteLabel = 0
-			}
-		} else {
-			c.chosenRemoteLabel = 0
-		}
-		if enterSwitch {
-			c.Logger.Info().Str("remote", c.Config().Remote[c.chosenRemoteLabel]).Msg("intelligent switch strategy finally choose to establish with")
-		}
-		err = dialer.initWithRemote(c)
+		pools, err = c.initRemotePools()
 		if err != nil {
 			return
 		}
@@ -447,6 +496,7 @@ func (c *Client) Start() (err error) {
 			err = fmt.Errorf("remote api url (-remoteAPI option) '%s' must begin with http:// or https://", c.Config().RemoteAPI)
 			return
 		}
+		var dialer dialer
 		for len(dialer.host) == 0 {
 			if atomic.LoadUint32(&c.closing) == 1 {
 				err = errors.New("client is closing")
@@ -459,8 +509,11 @@ func (c *Client) Start() (err error) {
 			c.Logger.Error().Err(err).Msg("failed to query server address")
 			time.Sleep(c.Config().ReconnectDelay.Duration)
 		}
+		r := &remote{url: c.Config().RemoteAPI, weight: 1}
+		r.dialer.Store(&dialer)
+		pools = []*remotePool{newRemotePool(remoteStrategySwitch, []*remote{r}, c.Config().RemoteFailures)}
 	}
-	if len(dialer.host) == 0 {
+	if len(pools) == 0 {
 		err = errors.New("option -remote or -remoteAPI must be specified")
 		return
 	}
@@ -475,16 +528,25 @@ func (c *Client) Start() (err error) {
 	} else if c.Config().RemoteIdleConnections > c.Config().RemoteConnections {
 		c.Config().RemoteIdleConnections = c.Config().RemoteConnections
 	}
-	c.idleManager = newIdleManager(c.Config().RemoteIdleConnections)
+	for _, p := range pools {
+		p.idleManager = newIdleManager(c.Config().RemoteIdleConnections)
+	}
+	c.remotePools = pools
 
 	conf4Log := *c.Config()
 	conf4Log.Secret = "******"
 	conf4Log.Password = "******"
 	conf4Log.SigningKey = "******"
 	c.Logger.Info().Msg(spew.Sdump(conf4Log))
-	for i := uint(1); i <= c.Config().RemoteConnections; i++ {
-		go c.connectLoop(dialer, i)
-		c.waitTunnelsShutdown.Add(1)
+	for k, p := range pools {
+		// 每个隧道池的 connID 互不相同
+		for i := uint(1); i <= c.Config().RemoteConnections; i++ {
+			go c.connectLoop(p, uint(k)*c.Config().RemoteConnections+i)
+			c.waitTunnelsShutdown.Add(1)
+		}
+		if len(p.remotes) > 1 && c.Config().RemoteHealthCheckInterval.Duration > 0 {
+			go c.healthCheckLoop(p, c.Config().RemoteHealthCheckInterval.Duration)
+		}
 	}
 	c.apiServer.Start()
 
@@ -501,7 +563,7 @@ func (c *Client) Start() (err error) {
 			return
 		}
 		c.Logger.Info().Str("addr", c.tcpForwardListener.Addr().String()).Msg("Listening TCP forward")
-		go c.tcpForwardStart(dialer)
+		go c.tcpForwardStart(*pools[0].pick().dialer.Load())
 	}
 
 	return
@@ -511,11 +573,29 @@ func (c *Client) Config() *Config {
 	return c.config.Load()
 }
 
-func (c *Client) GetConnectionPoolStatus() (status map[uint]Status) {
-	if c.idleManager == nil {
+// TURNCredential returns the TURN credential sent by the server, ok is false if the server did not send one
+func (c *Client) TURNCredential() (username, password string, ok bool) {
+	cred := c.turnCredential.Load()
+	if cred == nil {
 		return
 	}
-	return c.idleManager.GetConnectionStatus()
+	return cred.username, cred.password, true
+}
+
+func (c *Client) GetConnectionPoolStatus() (status map[uint]Status) {
+	for _, p := range c.remotePools {
+		if p.idleManager == nil {
+			continue
+		}
+		if status == nil {
+			status = p.idleManager.GetConnectionStatus()
+			continue
+		}
+		for k, v := range p.idleManager.GetConnectionStatus() {
+			status[k] = v
+		}
+	}
+	return
 }
 
 func (c *Client) GetConnectionPoolNetInfo() (pools []PoolInfo) {
@@ -547,8 +627,10 @@ func (c *Client) Close() {
 		p.Close()
 	}
 	c.peersRWMtx.Unlock()
-	if c.idleManager != nil {
-		c.idleManager.Close()
+	for _, p := range c.remotePools {
+		if p.idleManager != nil {
+			p.idleManager.Close()
+		}
 	}
 	c.Logger.Info().Err(c.apiServer.Close()).Msg("api server close")
 	if c.tcpForwardListener != nil {
@@ -578,8 +660,10 @@ func (c *Client) ShutdownWithoutClosingLogger() {
 	}
 	c.peersRWMtx.Unlock()
 
-	if c.idleManager != nil {
-		c.idleManager.Close()
+	for _, p := range c.remotePools {
+		if p.idleManager != nil {
+			p.idleManager.Close()
+		}
 	}
 	c.waitTunnelsShutdown.Wait()
 
@@ -589,15 +673,19 @@ func (c *Client) ShutdownWithoutClosingLogger() {
 	}
 }
 
-func (c *Client) initConn(d dialer, connID uint) (result *conn, err error) {
+func (c *Client) initConn(p *remotePool, r *remote, connID uint) (result *conn, err error) {
 	c.initConnMtx.Lock()
 	defer c.initConnMtx.Unlock()
 
+	d := r.dialer.Load()
 	conn, err := d.dialFn()
 	if err != nil {
 		return
 	}
 	result = newConn(conn, c)
+	result.pool = p
+	result.remote = r
+	result.verifiedRemote = d.verified
 	result.stuns = append(result.stuns, d.stun)
 	result.Logger = c.Logger.With().Uint("connID", connID).Logger()
 	err = result.init()
@@ -607,7 +695,7 @@ func (c *Client) initConn(d dialer, connID uint) (result *conn, err error) {
 	return
 }
 
-func (c *Client) connect(d dialer, connID uint) (closing bool) {
+func (c *Client) connect(p *remotePool, connID uint) (closing bool) {
 	defer func() {
 		if !predef.Debug {
 			if e := recover(); e != nil {
@@ -616,21 +704,26 @@ func (c *Client) connect(d dialer, connID uint) (closing bool) {
 		}
 	}()
 
-	c.idleManager.initMtx.Lock()
-	exit := c.idleManager.Init(connID)
+	p.idleManager.initMtx.Lock()
+	exit := p.idleManager.Init(connID)
 	if !exit {
-		c.Logger.Info().Uint("connID", connID).Msg("trying to connect to remote")
-		conn, err := c.initConn(d, connID)
+		r := p.pick()
+		c.Logger.Info().Uint("connID", connID).Str("remote", r.url).Msg("trying to connect to remote")
+		conn, err := c.initConn(p, r, connID)
 		if err == nil {
-			c.idleManager.SetIdle(connID)
-			c.idleManager.initMtx.Unlock()
+			p.idleManager.SetIdle(connID)
+			p.idleManager.initMtx.Unlock()
 			conn.readLoop(connID)
 		} else {
-			c.idleManager.initMtx.Unlock()
-			c.Logger.Error().Err(err).Uint("connID", connID).Msg("failed to connect to remote")
+			p.idleManager.initMtx.Unlock()
+			c.Logger.Error().Err(err).Uint("connID", connID).Str("remote", r.url).Msg("failed to connect to remote")
+		}
+		// 隧道没有启动时记录失败，连续失败的服务端被切换
+		if (err != nil || !conn.started) && p.fail(r) && len(p.remotes) > 1 {
+			c.Logger.Warn().Str("remote", r.url).Msg("remote is unavailable, switch to other remotes")
 		}
 	} else {
-		c.idleManager.initMtx.Unlock()
+		p.idleManager.initMtx.Unlock()
 		c.Logger.Info().Uint("connID", connID).Msg("wait to connect to remote")
 	}
 
@@ -638,15 +731,17 @@ func (c *Client) connect(d dialer, connID uint) (closing bool) {
 		return true
 	}
 	time.Sleep(c.Config().ReconnectDelay.Duration)
-	c.idleManager.SetWait(connID)
-	c.idleManager.WaitIdle(connID)
+	p.idleManager.SetWait(connID)
+	p.idleManager.WaitIdle(connID)
 
 	for len(c.Config().RemoteAPI) > 0 {
 		if atomic.LoadUint32(&c.closing) == 1 {
 			return true
 		}
+		d := &dialer{}
 		err := d.initWithRemoteAPI(c)
 		if err == nil {
+			p.remotes[0].dialer.Store(d)
 			break
 		}
 		c.Logger.Error().Uint("connID", connID).Err(err).Msg("failed to query server address")
@@ -655,9 +750,9 @@ func (c *Client) connect(d dialer, connID uint) (closing bool) {
 	return
 }
 
-func (c *Client) connectLoop(d dialer, connID uint) {
+func (c *Client) connectLoop(p *remotePool, connID uint) {
 	for atomic.LoadUint32(&c.closing) == 0 {
-		if c.connect(d, connID) {
+		if c.connect(p, connID) {
 			break
 		}
 	}
@@ -751,6 +846,20 @@ func parseServices(config *Config) (result services, err error) {
 				configServices[i].RemoteTCPRandom = &x.Value
 			}
 		}
+		for _, x := range config.RemoteUDPPort {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].RemoteUDPPort = x.Value
+			}
+		}
+		for _, x := range config.RemoteUDPRandom {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].RemoteUDPRandom = &x.Value
+			}
+		}
 		for _, x := range config.LocalTimeout {
 			if configServicesLen == 1 ||
 				(x.Position > config.Local[i].Position &&
@@ -765,6 +874,146 @@ func parseServices(config *Config) (result services, err error) {
 				configServices[i].UseLocalAsHTTPHost = x.Value
 			}
 		}
+		for _, x := range config.LocalProxyProtocol {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalProxyProtocol = x.Value
+			}
+		}
+		for _, x := range config.ForwardedHeaders {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].ForwardedHeaders = x.Value
+			}
+		}
+		for _, x := range config.CustomDomain {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].CustomDomain = x.Value
+			}
+		}
+		for _, x := range config.LocalTLS {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalTLS = x.Value
+			}
+		}
+		for _, x := range config.LocalCA {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalCA = x.Value
+			}
+		}
+		for _, x := range config.LocalServerName {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalServerName = x.Value
+			}
+		}
+		for _, x := range config.LocalCert {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalCert = x.Value
+			}
+		}
+		for _, x := range config.LocalKey {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalKey = x.Value
+			}
+		}
+		for _, x := range config.LocalCertInsecure {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].LocalCertInsecure = x.Value
+			}
+		}
+		for _, x := range config.GroupSecret {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].GroupSecret = x.Value
+			}
+		}
+		for _, x := range config.GroupWeight {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].GroupWeight = x.Value
+			}
+		}
+		for _, x := range config.Allow {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].Allow = append(configServices[i].Allow, x.Value)
+			}
+		}
+		for _, x := range config.Deny {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].Deny = append(configServices[i].Deny, x.Value)
+			}
+		}
+		for _, x := range config.AuthBasic {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthBasic = append(configServices[i].AuthBasic, x.Value)
+			}
+		}
+		for _, x := range config.AuthHtpasswd {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthHtpasswd = x.Value
+			}
+		}
+		for _, x := range config.AuthBearer {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthBearer = append(configServices[i].AuthBearer, x.Value)
+			}
+		}
+		for _, x := range config.AuthOIDCIssuer {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthOIDCIssuer = x.Value
+			}
+		}
+		for _, x := range config.AuthOIDCClientID {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthOIDCClientID = x.Value
+			}
+		}
+		for _, x := range config.AuthOIDCClientSecret {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthOIDCClientSecret = x.Value
+			}
+		}
+		for _, x := range config.AuthOIDCEmail {
+			if configServicesLen == 1 ||
+				(x.Position > config.Local[i].Position &&
+					(i == configServicesLen-1 || x.Position < config.Local[i+1].Position)) {
+				configServices[i].AuthOIDCEmails = append(configServices[i].AuthOIDCEmails, x.Value)
+			}
+		}
 		for _, x := range config.HostPrefix {
 			if configServicesLen == 1 ||
 				(x.Position > config.Local[i].Position &&
@@ -789,6 +1038,10 @@ func parseServices(config *Config) (result services, err error) {
 			result[i].RemoteTCPRandom = new(bool)
 			*result[i].RemoteTCPRandom = result[i].LocalURL.Scheme == "tcp" && result[i].RemoteTCPPort == 0
 		}
+		if result[i].RemoteUDPRandom == nil {
+			result[i].RemoteUDPRandom = new(bool)
+			*result[i].RemoteUDPRandom = result[i].LocalURL.Scheme == "udp" && result[i].RemoteUDPPort == 0
+		}
 		if (result[i].LocalURL.Scheme == "http" || result[i].LocalURL.Scheme == "https") &&
 			result[i].HostPrefix == "" {
 			if !usedIDASHostPrefix {
@@ -819,8 +1072,21 @@ func parseServices(config *Config) (result services, err error) {
 				err = errors.New("-remoteTCPPort or -remoteTCPRandom option should be set when local url (-local option) begin with tcp://")
 				return
 			}
+		case "udp":
+			if result[i].LocalURL.Port() == "" {
+				err = errors.New("-local option should contain port when local url (-local option) begin with udp://")
+				return
+			}
+			if result[i].RemoteUDPPort == 0 && !*result[i].RemoteUDPRandom {
+				err = errors.New("-remoteUDPPort or -remoteUDPRandom option should be set when local url (-local option) begin with udp://")
+				return
+			}
+			if result[i].LocalProxyProtocol {
+				err = errors.New("-localProxyProtocol option is not supported when local url (-local option) begin with udp://")
+				return
+			}
 		default:
-			err = fmt.Errorf("local url (-local option) '%s' must begin with http://, https:// or tcp://", result[i].LocalURL.String())
+			err = fmt.Errorf("local url (-local option) '%s' must begin with http://, https://, tcp:// or udp://", result[i].LocalURL.String())
 			return
 		}
 
@@ -830,6 +1096,126 @@ func parseServices(config *Config) (result services, err error) {
 			err = fmt.Errorf("host prefix (-hostPrefix option) '%s' is invalid", result[i].HostPrefix)
 			return
 		}
+
+		// 处理 CustomDomain
+		if len(result[i].CustomDomain) > 0 {
+			if result[i].LocalURL.Scheme != "http" && result[i].LocalURL.Scheme != "https" {
+				err = fmt.Errorf("custom domain (-customDomain option) '%s' needs an http or https local url", result[i].CustomDomain)
+				return
+			}
+			domain := util.NormalizeDomain(result[i].CustomDomain)
+			if domain == "" {
+				err = fmt.Errorf("custom domain (-customDomain option) '%s' is invalid", result[i].CustomDomain)
+				return
+			}
+			result[i].CustomDomain = domain
+		}
+
+		// 处理 LocalTLS
+		if result[i].LocalTLS {
+			if result[i].LocalURL.Scheme != "https" {
+				err = fmt.Errorf("-localTLS option of service '%s' needs an https local url", result[i].LocalURL.String())
+				return
+			}
+			result[i].localTLSConfig, err = newLocalTLSConfig(&result[i])
+			if err != nil {
+				return
+			}
+		} else if len(result[i].LocalCA) > 0 || len(result[i].LocalServerName) > 0 ||
+			len(result[i].LocalCert) > 0 || len(result[i].LocalKey) > 0 || result[i].LocalCertInsecure {
+			err = fmt.Errorf("-localCA, -localServerName, -localCert, -localKey and -localCertInsecure options of service '%s' need -localTLS option", result[i].LocalURL.String())
+			return
+		}
+
+		// 处理 Group
+		if len(result[i].GroupSecret) > 0 {
+			if len(result[i].GroupSecret) > math.MaxUint8 {
+				err = fmt.Errorf("group secret (-groupSecret option) of service '%s' is too long", result[i].LocalURL.String())
+				return
+			}
+			switch {
+			case result[i].LocalURL.Scheme == "udp":
+				err = errors.New("-groupSecret option is not supported when local url (-local option) begin with udp://")
+				return
+			case result[i].LocalURL.Scheme == "tcp" && (result[i].RemoteTCPPort == 0 || *result[i].RemoteTCPRandom):
+				err = errors.New("-remoteTCPPort option should be set and -remoteTCPRandom option should not be set when -groupSecret option is set")
+				return
+			case len(result[i].CustomDomain) > 0:
+				err = errors.New("-customDomain option is not supported when -groupSecret option is set")
+				return
+			}
+			if result[i].GroupWeight == 0 {
+				result[i].GroupWeight = 1
+			}
+		} else if result[i].GroupWeight > 0 {
+			err = fmt.Errorf("-groupWeight option of service '%s' needs -groupSecret option", result[i].LocalURL.String())
+			return
+		}
+
+		// 处理 Allow 与 Deny
+		if len(result[i].Allow) > 0 || len(result[i].Deny) > 0 {
+			if len(result[i].Allow) > predef.MaxACLEntries || len(result[i].Deny) > predef.MaxACLEntries {
+				err = fmt.Errorf("service '%s' can have at most %d -allow and %d -deny options", result[i].LocalURL.String(), predef.MaxACLEntries, predef.MaxACLEntries)
+				return
+			}
+			result[i].allow, err = parseIPPrefixes(result[i].Allow)
+			if err != nil {
+				return
+			}
+			result[i].deny, err = parseIPPrefixes(result[i].Deny)
+			if err != nil {
+				return
+			}
+		}
+
+		// 处理认证，服务端只能在 http 服务之前进行认证
+		if len(result[i].AuthBasic) > 0 || len(result[i].AuthHtpasswd) > 0 || len(result[i].AuthBearer) > 0 ||
+			len(result[i].AuthOIDCIssuer) > 0 || len(result[i].AuthOIDCClientID) > 0 ||
+			len(result[i].AuthOIDCClientSecret) > 0 || len(result[i].AuthOIDCEmails) > 0 {
+			if result[i].LocalURL.Scheme != "http" && !result[i].LocalTLS {
+				err = fmt.Errorf("auth options of service '%s' need an http local url or -localTLS option", result[i].LocalURL.String())
+				return
+			}
+			err = parseAuth(&result[i])
+			if err != nil {
+				return
+			}
+		}
+
+		// 处理 Routes，按路径长度降序排列以便最长前缀匹配
+		if len(result[i].Routes) > 0 {
+			if result[i].LocalURL.Scheme != "http" {
+				err = fmt.Errorf("routes of service '%s' need an http local url", result[i].LocalURL.String())
+				return
+			}
+			routes := make([]route, len(result[i].Routes))
+			copy(routes, result[i].Routes)
+			for j := range routes {
+				if !strings.HasPrefix(routes[j].Path, "/") {
+					err = fmt.Errorf("path of route '%s' must begin with /", routes[j].Path)
+					return
+				}
+				if routes[j].LocalURL.URL == nil || routes[j].LocalURL.Scheme != "http" {
+					err = fmt.Errorf("local url of route '%s' must begin with http://", routes[j].Path)
+					return
+				}
+				u := *routes[j].LocalURL.URL
+				if !strings.Contains(u.Host, ":") {
+					u.Host += ":80"
+				}
+				routes[j].LocalURL.URL = &u
+			}
+			sort.SliceStable(routes, func(a, b int) bool {
+				return len(routes[a].Path) > len(routes[b].Path)
+			})
+			for j := 1; j < len(routes); j++ {
+				if routes[j].Path == routes[j-1].Path {
+					err = fmt.Errorf("duplicated route path: %v", routes[j].Path)
+					return
+				}
+			}
+			result[i].Routes = routes
+		}
 	}
 
 	// HostPrefix 不能重复
@@ -840,12 +1226,57 @@ func parseServices(config *Config) (result services, err error) {
 				err = fmt.Errorf("duplicated host-prefix: %v", result[i].HostPrefix)
 				return
 			}
+			if len(result[i].CustomDomain) > 0 &&
+				result[i].CustomDomain == result[j].CustomDomain {
+				err = fmt.Errorf("duplicated custom domain: %v", result[i].CustomDomain)
+				return
+			}
 		}
 	}
 
 	return
 }
 
+// newLocalTLSConfig 生成连接本地 https 服务时使用的 tls 配置
+func newLocalTLSConfig(s *service) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{
+		ServerName:         s.LocalURL.Hostname(),
+		InsecureSkipVerify: s.LocalCertInsecure,
+	}
+	if len(s.LocalServerName) > 0 {
+		tlsConfig.ServerName = s.LocalServerName
+	}
+	if len(s.LocalCA) > 0 {
+		var cf []byte
+		cf, err = os.ReadFile(s.LocalCA)
+		if err != nil {
+			err = fmt.Errorf("failed to read local CA file (-localCA option) '%s', cause %s", s.LocalCA, err.Error())
+			return
+		}
+		roots := x509.NewCertPool()
+		ok := roots.AppendCertsFromPEM(cf)
+		if !ok {
+			err = fmt.Errorf("failed to parse local CA file (-localCA option) '%s'", s.LocalCA)
+			return
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if len(s.LocalCert) > 0 || len(s.LocalKey) > 0 {
+		if len(s.LocalCert) == 0 || len(s.LocalKey) == 0 {
+			err = errors.New("-localCert and -localKey options should be set together")
+			return
+		}
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(s.LocalCert, s.LocalKey)
+		if err != nil {
+			err = fmt.Errorf("failed to load local cert (-localCert option) '%s' and key (-localKey option) '%s', cause %s", s.LocalCert, s.LocalKey, err.Error())
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
 // GetTCPForwardListenerAddrPort 获取 tcp forward listener 地址，返回值可能为空
 func (c *Client) GetTCPForwardListenerAddrPort() (addrPort netip.AddrPort) {
 	if c.tcpForwardListener == nil {
@@ -918,7 +1349,7 @@ func (c *Client) ReloadServices() (err error) {
 	buf := pool.BytesPool.Get().([]byte)
 	defer pool.BytesPool.Put(buf)
 	i := copy(buf, connection.ServicesBytes)
-	n := gen(conf, services, buf[i:])
+	i += putShortString(buf[i:], conf.ID)
 
 	conf4Log := conf
 	conf4Log.Secret = "******"
@@ -933,6 +1364,8 @@ func (c *Client) ReloadServices() (err error) {
 	c.tunnelsRWMtx.RLock()
 	defer c.tunnelsRWMtx.RUnlock()
 	for t := range c.tunnels {
+		// 凭证使用每个隧道握手时的 nonce
+		n := t.genCredential(conf, services, buf[i:])
 		_, err = t.Write(buf[:n+i])
 		if err != nil {
 			return
@@ -15,8 +15,17 @@
 package client
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/isrc-cas/gt/config"
+	"github.com/isrc-cas/gt/predef"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
 )
 
 func TestClientWaitUntilReady(t *testing.T) {
@@ -37,3 +46,283 @@ func TestClientWaitUntilReady(t *testing.T) {
 		t.Fatal("err == timeout")
 	}
 }
+
+func TestParseServicesCustomDomain(t *testing.T) {
+	args := []string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://127.0.0.1:8080",
+		"-customDomain", "WWW.Customer.com.",
+		"-local", "tcp://127.0.0.1:22",
+		"-remoteTCPPort", "2222",
+	}
+	conf := defaultConfig()
+	err := config.ParseFlags(args, &conf, &conf.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss[0].CustomDomain != "www.customer.com" || ss[1].CustomDomain != "" {
+		t.Fatalf("invalid custom domains: %v", ss)
+	}
+
+	buf := make([]byte, 1024)
+	n := genOptions(conf, ss, buf)
+	expected := append([]byte(nil), predef.OptionAndNextOption...)
+	expected = append(expected, predef.FlowControl...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.BindDomain...)
+	expected = append(expected, byte(len("www.customer.com")))
+	expected = append(expected, "www.customer.com"...)
+	expected = append(expected, predef.IDAsHostPrefix...)
+	expected = append(expected, predef.OpenTCPPort...)
+	expected = append(expected, 0, 2222>>8, 2222&0xFF)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("invalid options %v", buf[:n])
+	}
+
+	conf.Local = nil
+	conf.CustomDomain = nil
+	cases := []struct {
+		local  string
+		domain string
+	}{
+		{"http://127.0.0.1:8080", "customer"},
+		{"http://127.0.0.1:8080", "bad_domain.com"},
+		{"tcp://127.0.0.1:22", "ssh.customer.com"},
+	}
+	for _, c := range cases {
+		local, _ := url.Parse(c.local)
+		conf.Services = services{{LocalURL: clientURL{URL: local}, RemoteTCPPort: 2222, CustomDomain: c.domain}}
+		_, err = parseServices(&conf)
+		if err == nil {
+			t.Fatalf("custom domain %q of %s should be invalid", c.domain, c.local)
+		}
+	}
+}
+
+func TestParseServicesRoutes(t *testing.T) {
+	data := `
+- local: http://127.0.0.1:8080
+  routes:
+    - path: /api
+      local: http://127.0.0.1:3000
+    - path: /api/v2/
+      local: http://localhost
+      stripPrefix: true
+`
+	conf := defaultConfig()
+	err := yaml.Unmarshal([]byte(data), &conf.Services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := ss[0].Routes
+	if len(routes) != 2 || routes[0].Path != "/api/v2/" || routes[1].Path != "/api" {
+		t.Fatalf("routes are not sorted: %v", routes)
+	}
+	if routes[0].LocalURL.Host != "localhost:80" || !routes[0].StripPrefix {
+		t.Fatalf("invalid route: %v", routes[0].String())
+	}
+
+	cases := []string{
+		"- local: tcp://127.0.0.1:22\n  remoteTCPPort: 2222\n  routes: [{path: /api, local: 'http://127.0.0.1:3000'}]",
+		"- local: http://127.0.0.1:8080\n  routes: [{path: api, local: 'http://127.0.0.1:3000'}]",
+		"- local: http://127.0.0.1:8080\n  routes: [{path: /api, local: 'https://127.0.0.1:3000'}]",
+		"- local: http://127.0.0.1:8080\n  routes: [{path: /api, local: 'http://a'}, {path: /api, local: 'http://b'}]",
+	}
+	for _, c := range cases {
+		conf = defaultConfig()
+		err = yaml.Unmarshal([]byte(c), &conf.Services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseServices(&conf)
+		if err == nil {
+			t.Fatalf("routes should be invalid: %s", c)
+		}
+	}
+}
+
+func TestParseServicesLocalTLS(t *testing.T) {
+	data := `
+- local: https://127.0.0.1:8443
+  localTLS: true
+  localServerName: local.internal
+  localCertInsecure: true
+`
+	conf := defaultConfig()
+	err := yaml.Unmarshal([]byte(data), &conf.Services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := ss[0].localTLSConfig
+	if tlsConfig == nil || tlsConfig.ServerName != "local.internal" || !tlsConfig.InsecureSkipVerify {
+		t.Fatalf("invalid tls config: %v", tlsConfig)
+	}
+
+	cases := []string{
+		"- local: http://127.0.0.1:8080\n  localTLS: true",
+		"- local: https://127.0.0.1:8443\n  localCertInsecure: true",
+		"- local: https://127.0.0.1:8443\n  localTLS: true\n  localCert: client.crt",
+		"- local: https://127.0.0.1:8443\n  localTLS: true\n  localCA: not-exist.crt",
+	}
+	for _, c := range cases {
+		conf = defaultConfig()
+		err = yaml.Unmarshal([]byte(c), &conf.Services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseServices(&conf)
+		if err == nil {
+			t.Fatalf("local tls options should be invalid: %s", c)
+		}
+	}
+}
+
+func TestParseServicesACL(t *testing.T) {
+	args := []string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://127.0.0.1:8080",
+		"-allow", "10.0.0.0/8",
+		"-deny", "10.0.0.1",
+		"-local", "tcp://127.0.0.1:22",
+		"-remoteTCPPort", "2222",
+		"-deny", "2001:db8::/32",
+	}
+	conf := defaultConfig()
+	err := config.ParseFlags(args, &conf, &conf.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss[0].allow) != 1 || len(ss[0].deny) != 1 || len(ss[1].allow) != 0 || len(ss[1].deny) != 1 {
+		t.Fatalf("invalid acls: %v", ss)
+	}
+
+	buf := make([]byte, 1024)
+	n := genOptions(conf, ss, buf)
+	expected := append([]byte(nil), predef.OptionAndNextOption...)
+	expected = append(expected, predef.FlowControl...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.SetACL...)
+	expected = append(expected, 1, 4, 10, 0, 0, 0, 8, 1, 4, 10, 0, 0, 1, 32)
+	expected = append(expected, predef.IDAsHostPrefix...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.SetACL...)
+	expected = append(expected, 0, 1, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32)
+	expected = append(expected, predef.OpenTCPPort...)
+	expected = append(expected, 0, 2222>>8, 2222&0xFF)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("invalid options %v", buf[:n])
+	}
+
+	cases := []string{
+		"- local: http://127.0.0.1:8080\n  allow: [10.0.0.0/33]",
+		"- local: http://127.0.0.1:8080\n  deny: [example.com]",
+	}
+	for _, c := range cases {
+		conf = defaultConfig()
+		err = yaml.Unmarshal([]byte(c), &conf.Services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseServices(&conf)
+		if err == nil {
+			t.Fatalf("acl should be invalid: %s", c)
+		}
+	}
+}
+
+func TestParseServicesAuth(t *testing.T) {
+	args := []string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://127.0.0.1:8080",
+		"-authBasic", "user1:password1",
+		"-authBearer", "token1",
+		"-authOIDCIssuer", "https://accounts.example.com",
+		"-authOIDCClientID", "client1",
+		"-authOIDCEmail", "@example.com",
+	}
+	conf := defaultConfig()
+	err := config.ParseFlags(args, &conf, &conf.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := parseServices(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss[0].authBasic) != 1 || len(ss[0].authBearer) != 1 || len(ss[0].AuthOIDCEmails) != 1 {
+		t.Fatalf("invalid auth: %v", ss)
+	}
+	user, hash, _ := strings.Cut(ss[0].authBasic[0], ":")
+	if user != "user1" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("password1")) != nil {
+		t.Fatalf("invalid basic auth %s", ss[0].authBasic[0])
+	}
+	if s := ss[0].String(); strings.Contains(s, "password1") || strings.Contains(s, "token1") {
+		t.Fatalf("secrets should not be printed: %s", s)
+	}
+
+	buf := make([]byte, 1024)
+	n := genOptions(conf, ss, buf)
+	token := sha256.Sum256([]byte("token1"))
+	expected := append([]byte(nil), predef.OptionAndNextOption...)
+	expected = append(expected, predef.FlowControl...)
+	expected = append(expected, predef.OptionAndNextOption...)
+	expected = append(expected, predef.SetAuth...)
+	expected = append(expected, 1, byte(len(ss[0].authBasic[0])))
+	expected = append(expected, ss[0].authBasic[0]...)
+	expected = append(expected, 1)
+	expected = append(expected, token[:]...)
+	expected = append(expected, 1, 28)
+	expected = append(expected, "https://accounts.example.com"...)
+	expected = append(expected, 7, 'c', 'l', 'i', 'e', 'n', 't', '1', 0, 1, 12)
+	expected = append(expected, "@example.com"...)
+	expected = append(expected, predef.IDAsHostPrefix...)
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("invalid options %v", buf[:n])
+	}
+
+	cases := []string{
+		"- local: tcp://127.0.0.1:22\n  remoteTCPPort: 2222\n  authBearer: [token1]",
+		"- local: https://127.0.0.1:8443\n  authBearer: [token1]",
+		"- local: http://127.0.0.1:8080\n  authBasic: [user1]",
+		"- local: http://127.0.0.1:8080\n  authBasic: [user1:$2a$invalid]",
+		"- local: http://127.0.0.1:8080\n  authOIDCClientID: client1",
+		"- local: http://127.0.0.1:8080\n  authOIDCIssuer: accounts.example.com\n  authOIDCClientID: client1",
+		"- local: http://127.0.0.1:8080\n  authOIDCIssuer: https://accounts.example.com",
+		"- local: http://127.0.0.1:8080\n  authHtpasswd: /nonexistent/htpasswd",
+	}
+	for _, c := range cases {
+		conf = defaultConfig()
+		err = yaml.Unmarshal([]byte(c), &conf.Services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseServices(&conf)
+		if err == nil {
+			t.Fatalf("auth should be invalid: %s", c)
+		}
+	}
+}
@@ -15,17 +15,26 @@
 package client
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
+	"math"
+	"net/netip"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/isrc-cas/gt/config"
 	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Config is a client config.
@@ -37,25 +46,54 @@ type Config struct {
 
 // Options is the config options for a client.
 type Options struct {
-	Config                string          `arg:"config" yaml:"-" json:"-" usage:"The config file path to load"`
-	ID                    string          `yaml:"id,omitempty" json:",omitempty" usage:"The unique id used to connect to server. Now it's the prefix of the domain."`
-	Secret                string          `yaml:"secret,omitempty" json:",omitempty" usage:"The secret used to verify the id"`
-	ReconnectDelay        config.Duration `yaml:"reconnectDelay,omitempty" json:",omitempty" usage:"The delay before reconnect. Supports values like '30s', '5m'"`
-	Remote                config.Slice[string]          `yaml:"remote,omitempty" json:",omitempty" usage:"The remote server url. Supports tcp:// and tls:// and quic://, default tcp://"`
-	RemoteSTUN            string          `yaml:"remoteSTUN,omitempty" json:",omitempty" usage:"The remote STUN server address"`
-	RemoteAPI             string          `yaml:"remoteAPI,omitempty" json:",omitempty" usage:"The API to get remote server url"`
-	RemoteCert            string          `yaml:"remoteCert,omitempty" json:",omitempty" usage:"The path to remote cert"`
-	RemoteCertInsecure    bool            `yaml:"remoteCertInsecure,omitempty" json:",omitempty" usage:"Accept self-signed SSL certs from remote"`
-	RemoteConnections     uint            `yaml:"remoteConnections,omitempty" json:",omitempty" usage:"The max number of server connections in the pool. Valid value is 1 to 10"`
-	RemoteIdleConnections uint            `yaml:"remoteIdleConnections,omitempty" json:",omitempty" usage:"The number of idle server connections kept in the pool"`
-	RemoteTimeout         config.Duration `yaml:"remoteTimeout,omitempty" json:",omitempty" usage:"The timeout of remote connections. Supports values like '30s', '5m'"`
-
-	HostPrefix         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"hostPrefix"  usage:"The server will recognize this host prefix and forward data to local"`
-	RemoteTCPPort      config.PositionSlice[uint16]        `yaml:"-" json:"-" arg:"remoteTCPPort" usage:"The TCP port that the remote server will open"`
-	RemoteTCPRandom    config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"remoteTCPRandom" usage:"Whether to choose a random tcp port by the remote server"`
-	Local              config.PositionSlice[string]        `yaml:"-" json:"-" arg:"local" usage:"The local service url"`
-	LocalTimeout       config.PositionSlice[time.Duration] `yaml:"-" json:"-" arg:"localTimeout" usage:"The timeout of local connections. Supports values like '30s', '5m'"`
-	UseLocalAsHTTPHost config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"useLocalAsHTTPHost" usage:"Use the local address as host"`
+	Config                    string               `arg:"config" yaml:"-" json:"-" usage:"The config file path to load"`
+	ID                        string               `yaml:"id,omitempty" json:",omitempty" usage:"The unique id used to connect to server. Now it's the prefix of the domain."`
+	Secret                    string               `yaml:"secret,omitempty" json:",omitempty" usage:"The secret used to verify the id"`
+	ReconnectDelay            config.Duration      `yaml:"reconnectDelay,omitempty" json:",omitempty" usage:"The delay before reconnect. Supports values like '30s', '5m'"`
+	Remote                    config.Slice[string] `yaml:"remote,omitempty" json:",omitempty" usage:"The remote server url. Supports tcp:// and tls:// and quic://, default tcp://"`
+	RemoteSTUN                string               `yaml:"remoteSTUN,omitempty" json:",omitempty" usage:"The remote STUN server address"`
+	RemoteAPI                 string               `yaml:"remoteAPI,omitempty" json:",omitempty" usage:"The API to get remote server url"`
+	RemoteCert                string               `yaml:"remoteCert,omitempty" json:",omitempty" usage:"The path to remote cert"`
+	RemoteCertInsecure        bool                 `yaml:"remoteCertInsecure,omitempty" json:",omitempty" usage:"Accept self-signed SSL certs from remote"`
+	RemoteClientCert          string               `yaml:"remoteClientCert,omitempty" json:",omitempty" usage:"The path to the client cert presented to tls:// and quic:// remote servers that verify client certs. The server authenticates the id with it instead of the secret"`
+	RemoteClientKey           string               `yaml:"remoteClientKey,omitempty" json:",omitempty" usage:"The path to the key of -remoteClientCert"`
+	RemoteConnections         uint                 `yaml:"remoteConnections,omitempty" json:",omitempty" usage:"The max number of server connections in the pool. Valid value is 1 to 10"`
+	RemoteIdleConnections     uint                 `yaml:"remoteIdleConnections,omitempty" json:",omitempty" usage:"The number of idle server connections kept in the pool"`
+	RemoteTimeout             config.Duration      `yaml:"remoteTimeout,omitempty" json:",omitempty" usage:"The timeout of remote connections. Supports values like '30s', '5m'"`
+	RemoteStrategy            string               `yaml:"remoteStrategy,omitempty" json:",omitempty" usage:"How the servers of multiple -remote are used. Supports values: switch (choose one by network conditions at startup), failover (use them in order), weight (spread tunnels by -remoteWeight), all (keep tunnels to all of them). Default switch"`
+	RemoteWeight              config.Slice[uint]   `yaml:"remoteWeight,omitempty" json:",omitempty" usage:"The weight of each -remote in the same order when -remoteStrategy is weight. Default 1"`
+	RemoteFailures            uint                 `yaml:"remoteFailures,omitempty" json:",omitempty" usage:"The number of consecutive failed connections before a remote server is considered unavailable and the next one is used"`
+	RemoteHealthCheckInterval config.Duration      `yaml:"remoteHealthCheckInterval,omitempty" json:",omitempty" usage:"The interval to check whether unavailable remote servers are recovered. Supports values like '30s', '5m'"`
+	AllowPlaintextSecret      bool                 `yaml:"allowPlaintextSecret,omitempty" json:",omitempty" usage:"Send the secret in plaintext when the server asks for it in the handshake over tcp:// remotes or with -remoteCertInsecure too. It is always sent over tls:// or quic:// remotes with a verified certificate"`
+
+	HostPrefix           config.PositionSlice[string]        `yaml:"-" json:"-" arg:"hostPrefix"  usage:"The server will recognize this host prefix and forward data to local"`
+	RemoteTCPPort        config.PositionSlice[uint16]        `yaml:"-" json:"-" arg:"remoteTCPPort" usage:"The TCP port that the remote server will open"`
+	RemoteTCPRandom      config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"remoteTCPRandom" usage:"Whether to choose a random tcp port by the remote server"`
+	RemoteUDPPort        config.PositionSlice[uint16]        `yaml:"-" json:"-" arg:"remoteUDPPort" usage:"The UDP port that the remote server will open"`
+	RemoteUDPRandom      config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"remoteUDPRandom" usage:"Whether to choose a random udp port by the remote server"`
+	Local                config.PositionSlice[string]        `yaml:"-" json:"-" arg:"local" usage:"The local service url"`
+	LocalTimeout         config.PositionSlice[time.Duration] `yaml:"-" json:"-" arg:"localTimeout" usage:"The timeout of local connections. Supports values like '30s', '5m'"`
+	UseLocalAsHTTPHost   config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"useLocalAsHTTPHost" usage:"Use the local address as host"`
+	LocalProxyProtocol   config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"localProxyProtocol" usage:"Send a PROXY protocol v2 header with the address of the visitor to the local service"`
+	ForwardedHeaders     config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"forwardedHeaders" usage:"Add X-Forwarded-For, X-Real-IP, X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers to the first request of each HTTP task"`
+	CustomDomain         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"customDomain" usage:"The full hostname like www.example.com that the server routes to this service besides the host prefix. Its ownership is verified with a TXT record or an HTTP token"`
+	LocalTLS             config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"localTLS" usage:"Receive plain HTTP or TLS terminated by the server and open a new TLS connection to the https local service, so the local service does not need the public certificate"`
+	LocalCA              config.PositionSlice[string]        `yaml:"-" json:"-" arg:"localCA" usage:"The path to the CA cert used to verify the https local service when -localTLS is set"`
+	LocalServerName      config.PositionSlice[string]        `yaml:"-" json:"-" arg:"localServerName" usage:"The server name (SNI) sent to and verified against the https local service when -localTLS is set. Default is the host of the local url"`
+	LocalCert            config.PositionSlice[string]        `yaml:"-" json:"-" arg:"localCert" usage:"The path to the client cert presented to the https local service when -localTLS is set"`
+	LocalKey             config.PositionSlice[string]        `yaml:"-" json:"-" arg:"localKey" usage:"The path to the key of the client cert presented to the https local service when -localTLS is set"`
+	LocalCertInsecure    config.PositionSlice[bool]          `yaml:"-" json:"-" arg:"localCertInsecure" usage:"Accept self-signed SSL certs from the https local service when -localTLS is set"`
+	GroupSecret          config.PositionSlice[string]        `yaml:"-" json:"-" arg:"groupSecret" usage:"Serve the host prefix or remote tcp port together with other clients that use the same group secret. The server spreads tasks across them"`
+	GroupWeight          config.PositionSlice[uint8]         `yaml:"-" json:"-" arg:"groupWeight" usage:"The weight of this client in the group. Valid value is 1 to 255, default 1"`
+	Allow                config.PositionSlice[string]        `yaml:"-" json:"-" arg:"allow" usage:"Only visitors from this IP or CIDR like 10.0.0.0/8 can access the service. Can be set multiple times for a service"`
+	Deny                 config.PositionSlice[string]        `yaml:"-" json:"-" arg:"deny" usage:"Visitors from this IP or CIDR like 10.0.0.0/8 can not access the service. Can be set multiple times for a service. Deny takes precedence over allow"`
+	AuthBasic            config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authBasic" usage:"Require visitors of the http service to log in as this 'user:password' or 'user:bcrypt hash' with basic auth on the server. Can be set multiple times for a service"`
+	AuthHtpasswd         config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authHtpasswd" usage:"The path to an htpasswd file with bcrypt hashes of users who can log in to the http service with basic auth"`
+	AuthBearer           config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authBearer" usage:"Require visitors of the http service to send this bearer token in the Authorization header. Can be set multiple times for a service"`
+	AuthOIDCIssuer       config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authOIDCIssuer" usage:"Require visitors of the http service to log in with this OpenID Connect issuer like https://accounts.google.com"`
+	AuthOIDCClientID     config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authOIDCClientID" usage:"The client id registered at the OpenID Connect issuer"`
+	AuthOIDCClientSecret config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authOIDCClientSecret" usage:"The client secret registered at the OpenID Connect issuer"`
+	AuthOIDCEmail        config.PositionSlice[string]        `yaml:"-" json:"-" arg:"authOIDCEmail" usage:"Only the OpenID Connect users with this email or with an email under this domain like @example.com can access the http service. Can be set multiple times for a service"`
 
 	SentryDSN         string               `yaml:"sentryDSN,omitempty" json:",omitempty" usage:"Sentry DSN to use"`
 	SentryLevel       config.Slice[string] `yaml:"sentryLevel,omitempty" json:",omitempty" usage:"Sentry levels: trace, debug, info, warn, error, fatal, panic (default [\"error\", \"fatal\", \"panic\"])"`
@@ -91,7 +129,6 @@ type Options struct {
 	Signal string `arg:"s" yaml:"-" json:"-" usage:"Send signal to client processes. Supports values: reload, restart, stop, kill"`
 
 	OpenBBR bool `yaml:"bbr" usage:"Use bbr as congestion control algorithm (through msquic) when GT use QUIC connection. Default algorithm is Cubic (through quic-go)."`
-
 }
 
 // if you enable web service, it will set 'Config' if not specified
@@ -99,10 +136,12 @@ type Options struct {
 func defaultConfig() Config {
 	return Config{
 		Options: Options{
-			ReconnectDelay:        config.Duration{Duration: 5 * time.Second},
-			RemoteTimeout:         config.Duration{Duration: 45 * time.Second},
-			RemoteConnections:     3,
-			RemoteIdleConnections: 1,
+			ReconnectDelay:            config.Duration{Duration: 5 * time.Second},
+			RemoteTimeout:             config.Duration{Duration: 45 * time.Second},
+			RemoteFailures:            3,
+			RemoteHealthCheckInterval: config.Duration{Duration: 10 * time.Second},
+			RemoteConnections:         3,
+			RemoteIdleConnections:     1,
 
 			SentrySampleRate: 1.0,
 			SentryRelease:    predef.Version,
@@ -161,12 +200,178 @@ func (c clientURL) MarshalJSON() ([]byte, error) {
 }
 
 type service struct {
-	HostPrefix         string          `yaml:"hostPrefix,omitempty" json:",omitempty"`
-	RemoteTCPPort      uint16          `yaml:"remoteTCPPort,omitempty" json:",omitempty"`
-	RemoteTCPRandom    *bool           `yaml:"remoteTCPRandom,omitempty" json:",omitempty"`
-	LocalURL           clientURL       `yaml:"local,omitempty" json:",omitempty"`
-	LocalTimeout       config.Duration `yaml:"localTimeout,omitempty" json:",omitempty"`
-	UseLocalAsHTTPHost bool            `yaml:"useLocalAsHTTPHost,omitempty" json:",omitempty"`
+	HostPrefix           string          `yaml:"hostPrefix,omitempty" json:",omitempty"`
+	RemoteTCPPort        uint16          `yaml:"remoteTCPPort,omitempty" json:",omitempty"`
+	RemoteTCPRandom      *bool           `yaml:"remoteTCPRandom,omitempty" json:",omitempty"`
+	RemoteUDPPort        uint16          `yaml:"remoteUDPPort,omitempty" json:",omitempty"`
+	RemoteUDPRandom      *bool           `yaml:"remoteUDPRandom,omitempty" json:",omitempty"`
+	LocalURL             clientURL       `yaml:"local,omitempty" json:",omitempty"`
+	LocalTimeout         config.Duration `yaml:"localTimeout,omitempty" json:",omitempty"`
+	UseLocalAsHTTPHost   bool            `yaml:"useLocalAsHTTPHost,omitempty" json:",omitempty"`
+	LocalProxyProtocol   bool            `yaml:"localProxyProtocol,omitempty" json:",omitempty"`
+	ForwardedHeaders     bool            `yaml:"forwardedHeaders,omitempty" json:",omitempty"`
+	CustomDomain         string          `yaml:"customDomain,omitempty" json:",omitempty"`
+	Routes               []route         `yaml:"routes,omitempty" json:",omitempty"`
+	LocalTLS             bool            `yaml:"localTLS,omitempty" json:",omitempty"`
+	LocalCA              string          `yaml:"localCA,omitempty" json:",omitempty"`
+	LocalServerName      string          `yaml:"localServerName,omitempty" json:",omitempty"`
+	LocalCert            string          `yaml:"localCert,omitempty" json:",omitempty"`
+	LocalKey             string          `yaml:"localKey,omitempty" json:",omitempty"`
+	LocalCertInsecure    bool            `yaml:"localCertInsecure,omitempty" json:",omitempty"`
+	GroupSecret          string          `yaml:"groupSecret,omitempty" json:",omitempty"`
+	GroupWeight          uint8           `yaml:"groupWeight,omitempty" json:",omitempty"`
+	Allow                []string        `yaml:"allow,omitempty" json:",omitempty"`
+	Deny                 []string        `yaml:"deny,omitempty" json:",omitempty"`
+	AuthBasic            []string        `yaml:"authBasic,omitempty" json:",omitempty"`
+	AuthHtpasswd         string          `yaml:"authHtpasswd,omitempty" json:",omitempty"`
+	AuthBearer           []string        `yaml:"authBearer,omitempty" json:",omitempty"`
+	AuthOIDCIssuer       string          `yaml:"authOIDCIssuer,omitempty" json:",omitempty"`
+	AuthOIDCClientID     string          `yaml:"authOIDCClientID,omitempty" json:",omitempty"`
+	AuthOIDCClientSecret string          `yaml:"authOIDCClientSecret,omitempty" json:",omitempty"`
+	AuthOIDCEmails       []string        `yaml:"authOIDCEmails,omitempty" json:",omitempty"`
+
+	localTLSConfig *tls.Config         // 由 LocalTLS 等选项生成，连接本地 https 服务时使用
+	allow          []netip.Prefix      // 由 Allow 解析得到，在握手中发送给服务端
+	deny           []netip.Prefix      // 由 Deny 解析得到，在握手中发送给服务端
+	authBasic      []string            // 由 AuthBasic 与 AuthHtpasswd 解析得到的 user:bcrypt，在握手中发送给服务端
+	authBearer     [][sha256.Size]byte // AuthBearer 的 sha256，服务端不保存 token 本身
+}
+
+// route 将路径前缀匹配的请求转发到另一个本地服务
+type route struct {
+	Path        string    `yaml:"path" json:",omitempty"`
+	LocalURL    clientURL `yaml:"local" json:",omitempty"`
+	StripPrefix bool      `yaml:"stripPrefix,omitempty" json:",omitempty"`
+}
+
+// parseIPPrefixes 解析 -allow 与 -deny 选项中的 IP 或 CIDR
+func parseIPPrefixes(ss []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range ss {
+		var prefix netip.Prefix
+		prefix, err = util.ParseIPPrefix(s)
+		if err != nil {
+			err = fmt.Errorf("invalid ip or cidr '%s' in -allow or -deny option: %w", s, err)
+			return
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return
+}
+
+// authMethods 返回服务使用的认证方式
+func (s *service) authMethods() (methods []string) {
+	if len(s.authBasic) > 0 {
+		methods = append(methods, "basic")
+	}
+	if len(s.authBearer) > 0 {
+		methods = append(methods, "bearer")
+	}
+	if len(s.AuthOIDCIssuer) > 0 {
+		methods = append(methods, "oidc")
+	}
+	return
+}
+
+// parseAuth 解析服务的认证选项，明文密码在这里使用 bcrypt 哈希
+func parseAuth(s *service) (err error) {
+	s.authBasic = nil
+	s.authBearer = nil
+	entries := s.AuthBasic
+	if len(s.AuthHtpasswd) > 0 {
+		var lines []string
+		lines, err = readHtpasswd(s.AuthHtpasswd)
+		if err != nil {
+			return
+		}
+		entries = append(append([]string(nil), entries...), lines...)
+	}
+	for _, entry := range entries {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || len(user) == 0 || len(password) == 0 {
+			return fmt.Errorf("basic auth (-authBasic option) '%s' should be in the form of user:password", user)
+		}
+		var hash []byte
+		if isBcryptHash(password) {
+			hash = []byte(password)
+			_, err = bcrypt.Cost(hash)
+			if err != nil {
+				return fmt.Errorf("invalid bcrypt hash of user '%s': %w", user, err)
+			}
+		} else {
+			hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				return
+			}
+		}
+		if len(user)+1+len(hash) > math.MaxUint8 {
+			return fmt.Errorf("basic auth user '%s' is too long", user)
+		}
+		s.authBasic = append(s.authBasic, user+":"+string(hash))
+	}
+	for _, token := range s.AuthBearer {
+		if len(token) == 0 {
+			return errors.New("bearer token (-authBearer option) can not be empty")
+		}
+		s.authBearer = append(s.authBearer, sha256.Sum256([]byte(token)))
+	}
+	if len(s.AuthOIDCIssuer) > 0 {
+		u, e := url.Parse(s.AuthOIDCIssuer)
+		if e != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("oidc issuer (-authOIDCIssuer option) '%s' is invalid", s.AuthOIDCIssuer)
+		}
+		if len(s.AuthOIDCClientID) == 0 {
+			return errors.New("-authOIDCClientID option is required when -authOIDCIssuer option is set")
+		}
+		for _, v := range append([]string{s.AuthOIDCIssuer, s.AuthOIDCClientID, s.AuthOIDCClientSecret}, s.AuthOIDCEmails...) {
+			if len(v) > math.MaxUint8 {
+				return fmt.Errorf("oidc option '%s' is too long", v)
+			}
+		}
+		for _, email := range s.AuthOIDCEmails {
+			if len(email) == 0 {
+				return errors.New("oidc email (-authOIDCEmail option) can not be empty")
+			}
+		}
+	} else if len(s.AuthOIDCClientID) > 0 || len(s.AuthOIDCClientSecret) > 0 || len(s.AuthOIDCEmails) > 0 {
+		return errors.New("-authOIDCClientID, -authOIDCClientSecret and -authOIDCEmail options need -authOIDCIssuer option")
+	}
+	if len(s.authBasic) > predef.MaxAuthEntries || len(s.authBearer) > predef.MaxAuthEntries ||
+		len(s.AuthOIDCEmails) > predef.MaxAuthEntries {
+		return fmt.Errorf("service '%s' can have at most %d basic auth users, bearer tokens and oidc emails", s.LocalURL.String(), predef.MaxAuthEntries)
+	}
+	return
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// readHtpasswd 读取 htpasswd 文件，只支持 bcrypt 哈希
+func readHtpasswd(path string) (entries []string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		user, hash, _ := strings.Cut(line, ":")
+		if !isBcryptHash(hash) {
+			return nil, fmt.Errorf("user '%s' in htpasswd file '%s' is not hashed with bcrypt", user, path)
+		}
+		entries = append(entries, line)
+	}
+	return
+}
+
+func (r *route) String() string {
+	s := r.Path + " -> " + r.LocalURL.String()
+	if r.StripPrefix {
+		s += " (stripPrefix)"
+	}
+	return s
 }
 
 func (s *service) String() string {
@@ -182,6 +387,88 @@ func (s *service) String() string {
 		sb.WriteString(", remoteTCPRandom: ")
 		sb.WriteString(fmt.Sprintf("%t", *s.RemoteTCPRandom))
 	}
+	if s.LocalURL.URL != nil && s.LocalURL.Scheme == "udp" {
+		sb.WriteString(", remoteUDPPort: ")
+		sb.WriteString(strconv.Itoa(int(s.RemoteUDPPort)))
+		if s.RemoteUDPRandom != nil {
+			sb.WriteString(", remoteUDPRandom: ")
+			sb.WriteString(fmt.Sprintf("%t", *s.RemoteUDPRandom))
+		}
+	}
+	if s.LocalProxyProtocol {
+		sb.WriteString(", localProxyProtocol: true")
+	}
+	if s.ForwardedHeaders {
+		sb.WriteString(", forwardedHeaders: true")
+	}
+	if s.CustomDomain != "" {
+		sb.WriteString(", customDomain: ")
+		sb.WriteString(s.CustomDomain)
+	}
+	if s.LocalTLS {
+		sb.WriteString(", localTLS: true")
+		if s.LocalCA != "" {
+			sb.WriteString(", localCA: ")
+			sb.WriteString(s.LocalCA)
+		}
+		if s.LocalServerName != "" {
+			sb.WriteString(", localServerName: ")
+			sb.WriteString(s.LocalServerName)
+		}
+		if s.LocalCert != "" {
+			sb.WriteString(", localCert: ")
+			sb.WriteString(s.LocalCert)
+			sb.WriteString(", localKey: ")
+			sb.WriteString(s.LocalKey)
+		}
+		if s.LocalCertInsecure {
+			sb.WriteString(", localCertInsecure: true")
+		}
+	}
+	if s.GroupSecret != "" {
+		// 不输出组密钥，只输出其摘要以便检测变化
+		sb.WriteString(", groupSecret: sha256:")
+		sum := sha256.Sum256([]byte(s.GroupSecret))
+		sb.WriteString(hex.EncodeToString(sum[:4]))
+		sb.WriteString(", groupWeight: ")
+		sb.WriteString(strconv.Itoa(int(s.GroupWeight)))
+	}
+	if len(s.Allow) > 0 {
+		sb.WriteString(", allow: ")
+		sb.WriteString(strings.Join(s.Allow, ","))
+	}
+	if len(s.Deny) > 0 {
+		sb.WriteString(", deny: ")
+		sb.WriteString(strings.Join(s.Deny, ","))
+	}
+	if methods := s.authMethods(); len(methods) > 0 {
+		// 不输出认证的密码与 token，只输出其摘要以便检测变化
+		sb.WriteString(", auth: ")
+		sb.WriteString(strings.Join(methods, ","))
+		sb.WriteString(" sha256:")
+		h := sha256.New()
+		for _, entry := range s.authBasic {
+			h.Write([]byte(entry + "\n"))
+		}
+		for _, token := range s.authBearer {
+			h.Write(token[:])
+		}
+		h.Write([]byte(s.AuthOIDCIssuer + "\n" + s.AuthOIDCClientID + "\n" + s.AuthOIDCClientSecret))
+		for _, email := range s.AuthOIDCEmails {
+			h.Write([]byte("\n" + email))
+		}
+		sb.WriteString(hex.EncodeToString(h.Sum(nil)[:4]))
+	}
+	if len(s.Routes) > 0 {
+		sb.WriteString(", routes: [")
+		for i := range s.Routes {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(s.Routes[i].String())
+		}
+		sb.WriteString("]")
+	}
 	sb.WriteString("}")
 	return sb.String()
 }
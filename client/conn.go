@@ -15,8 +15,13 @@
 package client
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,6 +31,7 @@ import (
 	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/pool"
 	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
 )
 
 type conn struct {
@@ -36,6 +42,22 @@ type conn struct {
 	tasksRWMtx    sync.RWMutex
 	stuns         []string
 	services      atomic.Pointer[services]
+	remoteAddrs   map[uint32]remoteAddr // 只在 readLoop 中读写
+	windows       map[uint32]uint32     // 任务开始前收到的上行窗口，只在 readLoop 中读写
+	pool          *remotePool
+	remote        *remote
+	started       bool // 收到 ReadySignal 后为 true，只在 readLoop 中写
+	handshakeMode byte // 服务端在 SecureHandshake 中要求的凭证，重新加载服务时沿用
+	nonce         [predef.HandshakeNonceSize]byte
+	// 隧道是验证了服务端证书的 tls:// 或 quic://，可以发送明文 secret
+	verifiedRemote bool
+}
+
+// remoteAddr 访问者连接的地址与协议，由服务端在任务开始时发送
+type remoteAddr struct {
+	src   net.Addr
+	dst   net.Addr
+	proto string // http 或者 https
 }
 
 type PoolInfo struct {
@@ -50,37 +72,113 @@ func newConn(c net.Conn, client *Client) *conn {
 			Reader:       pool.GetReader(c),
 			WriteTimeout: client.Config().RemoteTimeout.Duration,
 		},
-		client: client,
-		tasks:  make(map[uint32]*httpTask, 100),
+		client:      client,
+		tasks:       make(map[uint32]*httpTask, 100),
+		remoteAddrs: make(map[uint32]remoteAddr),
+		windows:     make(map[uint32]uint32),
 	}
 	return nc
 }
 
+// errInsecureHandshake 服务端要求发送明文 secret，但隧道不是验证过证书的 tls:// 或 quic://，并且没有设置 -allowPlaintextSecret
+var errInsecureHandshake = errors.New("the server asks for the secret in plaintext, which is only sent over tls:// or quic:// with a verified certificate unless -allowPlaintextSecret is set")
+
 func (c *conn) init() (err error) {
 	buf := c.Connection.Reader.GetBuf()
 	var n int
 	buf[n] = predef.MagicNumber
 	n++
-	buf[n] = 0x01 // version
+	buf[n] = predef.SecureHandshake // version
 	n++
+	n += putShortString(buf[n:], c.client.config.Load().ID)
+	_, err = c.Conn.Write(buf[:n])
+	return
+}
 
-	bufIndex := gen(*c.client.config.Load(), *c.client.services.Load(), buf[n:])
-	_, err = c.Conn.Write(buf[:bufIndex+n])
+// answerChallenge 读取服务端在 SecureHandshake 中回复的 [mode][nonce]，发送凭证与选项
+func (c *conn) answerChallenge() (err error) {
+	config := *c.client.config.Load()
+	if config.RemoteTimeout.Duration > 0 {
+		err = c.Conn.SetReadDeadline(time.Now().Add(config.RemoteTimeout.Duration))
+		if err != nil {
+			return
+		}
+	}
+	mode, err := c.Reader.Peek(1)
+	if err != nil {
+		return
+	}
+	// 服务端拒绝时直接发送错误信号，由 readLoop 读取
+	if mode[0] == 0xFF {
+		return
+	}
+	if mode[0] > predef.HandshakeDigest {
+		err = fmt.Errorf("unknown handshake mode %d", mode[0])
+		return
+	}
+	challenge, err := c.Reader.Peek(1 + predef.HandshakeNonceSize)
+	if err != nil {
+		return
+	}
+	c.handshakeMode = challenge[0]
+	copy(c.nonce[:], challenge[1:])
+	_, err = c.Reader.Discard(len(challenge))
+	if err != nil {
+		return
+	}
+	// 明文 secret 只通过验证过证书的 TLS 发送，避免中间人通过要求明文 secret 降级握手
+	if c.handshakeMode == predef.HandshakeSecret && !c.verifiedRemote && !config.AllowPlaintextSecret {
+		err = errInsecureHandshake
+		return
+	}
+
+	credential := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(credential)
+	n := c.genCredential(config, *c.client.services.Load(), credential)
+	_, err = c.Conn.Write(credential[:n])
 	return
 }
 
-func gen(config Config, services services, buf []byte) (n int) {
-	// id
-	buf[n] = byte(len(config.ID))
-	n++
-	idLen := copy(buf[n:], config.ID)
-	n += idLen
+// genCredential 写入 SecureHandshake 中的 [len][凭证][选项长度 uint16][选项]，凭证由服务端要求的 mode 决定
+func (c *conn) genCredential(config Config, services services, buf []byte) (n int) {
+	options := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(options)
+	optionsLen := genOptions(config, services, options)
 
-	// secret
-	buf[n] = byte(len(config.Secret))
-	n++
-	secretLen := copy(buf[n:], config.Secret)
-	n += secretLen
+	switch c.handshakeMode {
+	case predef.HandshakeHMAC:
+		proof := util.HandshakeProof(config.Secret, c.nonce[:], config.ID, options[:optionsLen])
+		buf[n] = byte(len(proof))
+		n++
+		n += copy(buf[n:], proof)
+	case predef.HandshakeSecret:
+		n += putShortString(buf[n:], config.Secret)
+	case predef.HandshakeDigest:
+		n += putShortString(buf[n:], util.HandshakeDigest(config.Secret, config.ID))
+	default:
+		buf[n] = 0
+		n++
+	}
+	binary.BigEndian.PutUint16(buf[n:], uint16(optionsLen))
+	n += 2
+	n += copy(buf[n:], options[:optionsLen])
+	return
+}
+
+// genOptions 写入隧道的选项
+func genOptions(config Config, services services, buf []byte) (n int) {
+	// 服务端限速的任务只在服务端允许的窗口内发送数据
+	n += copy(buf[n:], predef.OptionAndNextOption)
+	n += copy(buf[n:], predef.FlowControl)
+
+	// 请求服务端发送访问者连接的地址
+	for _, service := range services {
+		if service.LocalProxyProtocol || service.ForwardedHeaders {
+			n += copy(buf[n:], predef.OptionAndNextOption)
+			n += copy(buf[n:], predef.SendRemoteAddr)
+			break
+		}
+	}
 
 	// services
 	for i, service := range services {
@@ -88,7 +186,47 @@ func gen(config Config, services services, buf []byte) (n int) {
 			optionLen := copy(buf[n:], predef.OptionAndNextOption)
 			n += optionLen
 		}
-		switch service.LocalURL.Scheme {
+		// 自定义域名绑定到紧随其后的服务
+		if len(service.CustomDomain) > 0 {
+			n += copy(buf[n:], predef.OptionAndNextOption)
+			if service.LocalURL.Scheme == "https" && !service.LocalTLS {
+				n += copy(buf[n:], predef.BindTLSDomain)
+			} else {
+				n += copy(buf[n:], predef.BindDomain)
+			}
+			buf[n] = byte(len(service.CustomDomain))
+			n++
+			n += copy(buf[n:], service.CustomDomain)
+		}
+		// 组只作用于紧随其后的服务
+		if len(service.GroupSecret) > 0 {
+			n += copy(buf[n:], predef.OptionAndNextOption)
+			n += copy(buf[n:], predef.JoinGroup)
+			buf[n] = service.GroupWeight
+			n++
+			buf[n] = byte(len(service.GroupSecret))
+			n++
+			n += copy(buf[n:], service.GroupSecret)
+		}
+		// 访问控制列表只作用于紧随其后的服务
+		if len(service.allow) > 0 || len(service.deny) > 0 {
+			n += copy(buf[n:], predef.OptionAndNextOption)
+			n += copy(buf[n:], predef.SetACL)
+			n += putIPPrefixes(buf[n:], service.allow)
+			n += putIPPrefixes(buf[n:], service.deny)
+		}
+		// 认证只作用于紧随其后的服务
+		if len(service.authMethods()) > 0 {
+			n += copy(buf[n:], predef.OptionAndNextOption)
+			n += copy(buf[n:], predef.SetAuth)
+			n += putAuth(buf[n:], &service)
+		}
+		scheme := service.LocalURL.Scheme
+		if service.LocalTLS {
+			// 访问者的 tls 由服务端终止或者访问者使用 http，客户端再与本地服务建立新的 tls 连接
+			scheme = "http"
+		}
+		switch scheme {
 		case "tcp":
 			optionLen := copy(buf[n:], predef.OpenTCPPort)
 			n += optionLen
@@ -103,6 +241,19 @@ func gen(config Config, services services, buf []byte) (n int) {
 			buf[n] = byte(service.RemoteTCPPort >> 8)
 			buf[n+1] = byte(service.RemoteTCPPort)
 			n += 2
+		case "udp":
+			n += copy(buf[n:], predef.OpenUDPPort)
+
+			if *service.RemoteUDPRandom {
+				buf[n] = 1
+			} else {
+				buf[n] = 0
+			}
+			n++
+
+			buf[n] = byte(service.RemoteUDPPort >> 8)
+			buf[n+1] = byte(service.RemoteUDPPort)
+			n += 2
 		case "http":
 			if service.HostPrefix == config.ID {
 				optionLen := copy(buf[n:], predef.IDAsHostPrefix)
@@ -134,6 +285,59 @@ func gen(config Config, services services, buf []byte) (n int) {
 	return
 }
 
+// putIPPrefixes 写入 [数量][ip 长度][ip][前缀长度]...
+// putAuth 写入 predef.SetAuth 之后的认证配置
+func putAuth(buf []byte, s *service) (n int) {
+	buf[n] = byte(len(s.authBasic))
+	n++
+	for _, entry := range s.authBasic {
+		n += putShortString(buf[n:], entry)
+	}
+	buf[n] = byte(len(s.authBearer))
+	n++
+	for _, token := range s.authBearer {
+		n += copy(buf[n:], token[:])
+	}
+	if len(s.AuthOIDCIssuer) == 0 {
+		buf[n] = 0
+		n++
+		return
+	}
+	buf[n] = 1
+	n++
+	n += putShortString(buf[n:], s.AuthOIDCIssuer)
+	n += putShortString(buf[n:], s.AuthOIDCClientID)
+	n += putShortString(buf[n:], s.AuthOIDCClientSecret)
+	buf[n] = byte(len(s.AuthOIDCEmails))
+	n++
+	for _, email := range s.AuthOIDCEmails {
+		n += putShortString(buf[n:], email)
+	}
+	return
+}
+
+// putShortString 写入 [len][string]
+func putShortString(buf []byte, s string) (n int) {
+	buf[n] = byte(len(s))
+	n++
+	n += copy(buf[n:], s)
+	return
+}
+
+func putIPPrefixes(buf []byte, prefixes []netip.Prefix) (n int) {
+	buf[n] = byte(len(prefixes))
+	n++
+	for _, prefix := range prefixes {
+		ip := prefix.Addr().AsSlice()
+		buf[n] = byte(len(ip))
+		n++
+		n += copy(buf[n:], ip)
+		buf[n] = byte(prefix.Bits())
+		n++
+	}
+	return
+}
+
 func (c *conn) IsTimeout(e error) (result bool) {
 	if ne, ok := e.(*net.OpError); ok && ne.Timeout() {
 		err := c.Connection.SendPingSignal()
@@ -179,6 +383,11 @@ func (c *conn) readLoop(connID uint) {
 		pool.PutReader(c.Reader)
 	}()
 
+	err = c.answerChallenge()
+	if err != nil {
+		return
+	}
+
 	r := &bufio.LimitedReader{}
 	r.Reader = c.Reader
 	var timeout time.Duration
@@ -223,7 +432,7 @@ func (c *conn) readLoop(connID uint) {
 			}
 			if lastPing >= 6 {
 				lastPing = 0
-				if c.client.idleManager.ChangeToWait(connID) {
+				if c.pool.idleManager.ChangeToWait(connID) {
 					c.SendCloseSignal()
 					c.Logger.Info().Msg("sent close signal")
 				}
@@ -240,8 +449,13 @@ func (c *conn) readLoop(connID uint) {
 			isClosing = true
 			continue
 		case connection.ReadySignal:
+			c.started = true
 			c.client.addTunnel(c)
 			c.Logger.Info().Msg("tunnel started")
+			if c.pool.succeed(c.remote) {
+				c.Logger.Info().Str("remote", c.remote.url).Msg("remote is available again")
+				c.client.failback(c.pool)
+			}
 			continue
 		case connection.ServicesSignal:
 			c.services.Store(c.client.services.Load())
@@ -304,7 +518,15 @@ func (c *conn) readLoop(connID uint) {
 				return
 			}
 			r.N = int64(l)
-			rErr, wErr := c.processServiceData(connID, taskID, service, r)
+			addr, ok := c.remoteAddrs[taskID]
+			if ok {
+				delete(c.remoteAddrs, taskID)
+			}
+			window, ok := c.windows[taskID]
+			if ok {
+				delete(c.windows, taskID)
+			}
+			rErr, wErr := c.processServiceData(connID, taskID, service, r, addr, window)
 			if rErr != nil {
 				err = wErr
 				if !errors.Is(rErr, net.ErrClosed) {
@@ -355,6 +577,31 @@ func (c *conn) readLoop(connID uint) {
 				}
 				continue
 			}
+		case predef.RemoteAddr:
+			err = c.readRemoteAddr(taskID)
+			if err != nil {
+				return
+			}
+		case predef.Window, predef.WindowUpdate:
+			peekBytes, err = c.Reader.Peek(4)
+			if err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(peekBytes)
+			_, err = c.Reader.Discard(4)
+			if err != nil {
+				return
+			}
+			if taskOption == predef.Window {
+				c.windows[taskID] = n
+				continue
+			}
+			c.tasksRWMtx.RLock()
+			t, ok := c.tasks[taskID]
+			c.tasksRWMtx.RUnlock()
+			if ok && t.window != nil {
+				t.window.add(n)
+			}
 		case predef.Close:
 			c.tasksRWMtx.RLock()
 			t, ok := c.tasks[taskID]
@@ -366,27 +613,136 @@ func (c *conn) readLoop(connID uint) {
 	}
 }
 
-func (c *conn) dial(s *service) (task *httpTask, err error) {
-	conn, err := net.Dial("tcp", s.LocalURL.Host)
+// readRemoteAddr 读取访问者连接的地址与协议，在任务的第一个 ServicesData 中使用
+func (c *conn) readRemoteAddr(taskID uint32) (err error) {
+	peekBytes, err := c.Reader.Peek(4)
+	if err != nil {
+		return
+	}
+	l := uint32(peekBytes[3]) | uint32(peekBytes[2])<<8 | uint32(peekBytes[1])<<16 | uint32(peekBytes[0])<<24
+	_, err = c.Reader.Discard(4)
+	if err != nil {
+		return
+	}
+	if l < 2 || l > 3+3*math.MaxUint8 {
+		err = errInvalidRemoteAddr
+		return
+	}
+	data, err := c.Reader.Peek(int(l))
+	if err != nil {
+		return
+	}
+	addr, err := parseRemoteAddr(data)
+	if err != nil {
+		return
+	}
+	_, err = c.Reader.Discard(int(l))
+	if err != nil {
+		return
+	}
+	c.remoteAddrs[taskID] = addr
+	return
+}
+
+// parseRemoteAddr 解析 [len][src][len][dst] 与可选的 [len][proto]
+func parseRemoteAddr(data []byte) (addr remoteAddr, err error) {
+	var fields [3]string
+	i := 0
+	for ; i < len(fields) && len(data) > 0; i++ {
+		fl := int(data[0])
+		if 1+fl > len(data) {
+			err = errInvalidRemoteAddr
+			return
+		}
+		fields[i] = string(data[1 : 1+fl])
+		data = data[1+fl:]
+	}
+	if i < 2 || len(data) > 0 {
+		err = errInvalidRemoteAddr
+		return
+	}
+	// 地址为空表示未知
+	if srcAddr, e := net.ResolveTCPAddr("tcp", fields[0]); e == nil && fields[0] != "" {
+		addr.src = srcAddr
+	}
+	if dstAddr, e := net.ResolveTCPAddr("tcp", fields[1]); e == nil && fields[1] != "" {
+		addr.dst = dstAddr
+	}
+	addr.proto = fields[2]
+	return
+}
+
+var errInvalidRemoteAddr = errors.New("invalid remote addr")
+
+func (c *conn) dial(s *service, addr remoteAddr) (task *httpTask, err error) {
+	if len(s.Routes) > 0 {
+		// 按路径转发时由 routeConn 为每个请求连接本地服务并改写 Host
+		task = newHTTPTask(newRouteConn(s, addr))
+		task.service = s
+		if s.ForwardedHeaders {
+			task.setForwarded(addr)
+		}
+		return
+	}
+	if s.LocalURL.Scheme == "udp" {
+		// 隧道中的每个数据报前面有 2 字节的长度
+		var conn net.Conn
+		conn, err = net.Dial("udp", s.LocalURL.Host)
+		if err != nil {
+			return
+		}
+		task = newHTTPTask(connection.NewDatagramConn(conn))
+		task.service = s
+		return
+	}
+	conn, err := net.DialTimeout("tcp", s.LocalURL.Host, s.LocalTimeout.Duration)
 	if err != nil {
 		return
 	}
+	if s.LocalTimeout.Duration > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.LocalTimeout.Duration))
+	}
+	if s.LocalProxyProtocol {
+		// PROXY protocol 头部在 tls 握手之前发送，地址未知时发送 LOCAL 命令
+		err = connection.WriteProxyHeaderV2(conn, addr.src, addr.dst)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	if s.LocalTLS {
+		tlsConn := tls.Client(conn, s.localTLSConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	_ = conn.SetDeadline(time.Time{})
 	task = newHTTPTask(conn)
 	task.service = s
 	if s.UseLocalAsHTTPHost {
 		err = task.setHost(s.LocalURL.Host)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	if s.ForwardedHeaders && (s.LocalURL.Scheme == "http" || s.LocalTLS) {
+		task.setForwarded(addr)
 	}
 	return
 }
 
-func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *bufio.LimitedReader) (readErr, writeErr error) {
+func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *bufio.LimitedReader, addr remoteAddr, window uint32) (readErr, writeErr error) {
 	var peekBytes []byte
 	peekBytes, readErr = r.Peek(2)
 	if readErr != nil {
 		return
 	}
-	// first 2 bytes of p2p sdp request is "XP"(0x5850)
-	isP2P := (uint16(peekBytes[1]) | uint16(peekBytes[0])<<8) == 0x5850
+	// first 2 bytes of p2p sdp request is "XP"(0x5850)，udp 服务的前 2 个字节是数据报的长度
+	isP2P := s.LocalURL.Scheme != "udp" && (uint16(peekBytes[1])|uint16(peekBytes[0])<<8) == 0x5850
 	if isP2P {
 		if len(c.stuns) < 1 {
 			respAndClose(taskID, c, [][]byte{
@@ -400,7 +756,7 @@ func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *buf
 
 	var task *httpTask
 	for i := 0; i < 3; i++ {
-		task, writeErr = c.dial(s)
+		task, writeErr = c.dial(s, addr)
 		if writeErr == nil {
 			break
 		}
@@ -411,6 +767,9 @@ func (c *conn) processServiceData(connID uint, taskID uint32, s *service, r *buf
 	task.Logger = c.Logger.With().
 		Uint32("task", taskID).
 		Logger()
+	if window > 0 {
+		task.window = newUploadWindow(window)
+	}
 	task.Logger.Info().Msg("task started")
 	c.tasksRWMtx.Lock()
 	ot, ok := c.tasks[taskID]
@@ -23,6 +23,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -117,10 +118,36 @@ func (pt *peerTask) OnICECandidateError(address string, port int, url string, er
 	pt.Logger.Error().Str("address", address).Int("port", port).Str("url", url).Int("errorCode", errorCode).Str("errorText", errorText).Msg("failed to handle ice candidate")
 }
 
+// turnCredential 服务端下发的 TURN 凭证，服务端的 STUN 服务同时是 TURN 服务
+type turnCredential struct {
+	username string
+	password string
+}
+
+// iceServers 返回 STUN 服务地址，收到 TURN 凭证时添加对应的 TURN 服务地址
+func (c *conn) iceServers() (servers []string, username, password string) {
+	servers = c.stuns
+	cred := c.client.turnCredential.Load()
+	if cred == nil {
+		return
+	}
+	servers = make([]string, 0, len(c.stuns)*2)
+	servers = append(servers, c.stuns...)
+	for _, stun := range c.stuns {
+		if strings.HasPrefix(stun, "stun:") {
+			servers = append(servers, "turn:"+strings.TrimPrefix(stun, "stun:"))
+		}
+	}
+	return servers, cred.username, cred.password
+}
+
 func (pt *peerTask) init(c *conn) (err error) {
 	config := c.client.Config()
+	iceServers, username, password := c.iceServers()
 	peerConnectionConfig := webrtc.PeerConnectionConfig{
-		ICEServers:                        c.stuns,
+		ICEServers:                        iceServers,
+		ICEServerUsername:                 username,
+		ICEServerPassword:                 password,
 		MinPort:                           &config.WebRTCMinPort,
 		MaxPort:                           &config.WebRTCMaxPort,
 		OnSignalingChange:                 pt.OnSignalingChange,
@@ -535,7 +562,7 @@ func (dco *dataChannelObserver) OnOpen() {
 
 	tunnel := dco.peerTask.tunnel
 	service := (*tunnel.services.Load())[0]
-	task, err := dco.peerTask.tunnel.dial(&service)
+	task, err := dco.peerTask.tunnel.dial(&service, remoteAddr{})
 	if err != nil {
 		return
 	}
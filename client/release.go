@@ -37,7 +37,7 @@ type Client struct {
 	peers               map[uint32]*peerTask
 	peersRWMtx          sync.RWMutex
 	tunnelsCond         *sync.Cond
-	idleManager         *idleManager
+	remotePools         []*remotePool
 	apiServer           *api.Server
 	services            atomic.Pointer[services]
 	tcpForwardListener  net.Listener
@@ -45,6 +45,7 @@ type Client struct {
 	configChecksum      atomic.Pointer[[32]byte]
 	reloadWaitGroup     sync.WaitGroup
 	reloading           atomic.Bool
+	turnCredential      atomic.Pointer[turnCredential]
 
 	// indicate which remote is chosen to establish tunnel
 	chosenRemoteLabel int
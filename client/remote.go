@@ -0,0 +1,226 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	remoteStrategySwitch   = "switch"
+	remoteStrategyFailover = "failover"
+	remoteStrategyWeight   = "weight"
+	remoteStrategyAll      = "all"
+)
+
+// remote 一个服务端
+type remote struct {
+	url      string
+	priority int // -remote 中的位置，越小越优先
+	weight   int64
+	current  int64 // 平滑加权轮询的当前权重，由 remotePool.mtx 保护
+	failures atomic.Uint32
+	down     atomic.Bool
+	// dialer 在 -remoteAPI 模式下会被更新
+	dialer atomic.Pointer[dialer]
+}
+
+// remotePool 连接到一个或多个服务端的隧道池
+type remotePool struct {
+	strategy    string
+	remotes     []*remote
+	mtx         sync.Mutex
+	maxFailures uint32
+	idleManager *idleManager
+}
+
+func newRemotePool(strategy string, remotes []*remote, maxFailures uint) *remotePool {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &remotePool{
+		strategy:    strategy,
+		remotes:     remotes,
+		maxFailures: uint32(maxFailures),
+	}
+}
+
+// pick 选择下一个隧道连接的服务端，所有服务端都不可用时从所有服务端中选择
+func (p *remotePool) pick() (r *remote) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	candidates := make([]*remote, 0, len(p.remotes))
+	for _, r := range p.remotes {
+		if !r.down.Load() {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.remotes
+	}
+	if p.strategy != remoteStrategyWeight {
+		r = candidates[0]
+		return
+	}
+
+	// 平滑加权轮询
+	var total int64
+	for _, c := range candidates {
+		c.current += c.weight
+		total += c.weight
+		if r == nil || c.current > r.current {
+			r = c
+		}
+	}
+	r.current -= total
+	return
+}
+
+// preferred 返回可用的优先级最高的服务端
+func (p *remotePool) preferred() *remote {
+	for _, r := range p.remotes {
+		if !r.down.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// succeed 记录连接成功，返回 true 表示服务端从不可用恢复为可用
+func (p *remotePool) succeed(r *remote) (recovered bool) {
+	r.failures.Store(0)
+	return r.down.CompareAndSwap(true, false)
+}
+
+// fail 记录连接失败，返回 true 表示服务端变为不可用
+func (p *remotePool) fail(r *remote) (down bool) {
+	if r.failures.Add(1) < p.maxFailures {
+		return false
+	}
+	return r.down.CompareAndSwap(false, true)
+}
+
+// healthCheckLoop 定期检查不可用的服务端，恢复后重新使用
+func (c *Client) healthCheckLoop(p *remotePool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadUint32(&c.closing) == 1 {
+			return
+		}
+		for _, r := range p.remotes {
+			if !r.down.Load() {
+				continue
+			}
+			conn, err := r.dialer.Load().dialFn()
+			if err != nil {
+				c.Logger.Debug().Err(err).Str("remote", r.url).Msg("remote is still unavailable")
+				continue
+			}
+			_ = conn.Close()
+			if p.succeed(r) {
+				c.Logger.Info().Str("remote", r.url).Msg("remote is available again")
+				c.failback(p)
+			}
+		}
+	}
+}
+
+// failback 在 failover 策略下，关闭连接到低优先级服务端的隧道，使其重新连接到优先级最高的可用服务端
+func (c *Client) failback(p *remotePool) {
+	if p.strategy != remoteStrategyFailover {
+		return
+	}
+	preferred := p.preferred()
+	if preferred == nil {
+		return
+	}
+	c.tunnelsRWMtx.RLock()
+	defer c.tunnelsRWMtx.RUnlock()
+	for t := range c.tunnels {
+		if t.pool == p && t.remote.priority > preferred.priority {
+			t.Logger.Info().Str("remote", t.remote.url).Str("preferred", preferred.url).Msg("fail back to the preferred remote")
+			t.SendCloseSignal()
+		}
+	}
+}
+
+// initRemotePools 根据 -remoteStrategy 创建连接到 -remote 的隧道池
+func (c *Client) initRemotePools() (pools []*remotePool, err error) {
+	strategy := c.Config().RemoteStrategy
+	if strategy == "" {
+		strategy = remoteStrategySwitch
+	}
+	weights := c.Config().RemoteWeight
+	switch strategy {
+	case remoteStrategySwitch:
+		if len(weights) > 0 {
+			err = errors.New("-remoteWeight can only be used with -remoteStrategy weight")
+			return
+		}
+		err = c.chooseRemote()
+		if err != nil {
+			return
+		}
+	case remoteStrategyFailover, remoteStrategyAll:
+		if len(weights) > 0 {
+			err = errors.New("-remoteWeight can only be used with -remoteStrategy weight")
+			return
+		}
+	case remoteStrategyWeight:
+		if len(weights) > len(c.Config().Remote) {
+			err = fmt.Errorf("%d -remoteWeight are specified, but only %d -remote", len(weights), len(c.Config().Remote))
+			return
+		}
+	default:
+		err = fmt.Errorf("remote strategy (-remoteStrategy option) '%s' is invalid", strategy)
+		return
+	}
+
+	var remotes []*remote
+	for i, u := range c.Config().Remote {
+		if strategy == remoteStrategySwitch && i != c.chosenRemoteLabel {
+			continue
+		}
+		r := &remote{url: u, priority: i, weight: 1}
+		if i < len(weights) {
+			if weights[i] < 1 {
+				err = fmt.Errorf("weight (-remoteWeight option) of remote '%s' must be greater than 0", u)
+				return
+			}
+			r.weight = int64(weights[i])
+		}
+		d := &dialer{}
+		err = d.init(c, u, c.Config().RemoteSTUN)
+		if err != nil {
+			return
+		}
+		r.dialer.Store(d)
+		remotes = append(remotes, r)
+	}
+	if strategy == remoteStrategyAll {
+		// 同时保持到每个服务端的隧道池
+		for _, r := range remotes {
+			pools = append(pools, newRemotePool(strategy, []*remote{r}, c.Config().RemoteFailures))
+		}
+		return
+	}
+	pools = []*remotePool{newRemotePool(strategy, remotes, c.Config().RemoteFailures)}
+	return
+}
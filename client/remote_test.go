@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import "testing"
+
+func TestRemotePoolPick(t *testing.T) {
+	newRemotes := func() []*remote {
+		return []*remote{
+			{url: "tcp://a", priority: 0, weight: 3},
+			{url: "tcp://b", priority: 1, weight: 1},
+			{url: "tcp://c", priority: 2, weight: 1},
+		}
+	}
+
+	p := newRemotePool(remoteStrategyFailover, newRemotes(), 2)
+	if r := p.pick(); r.url != "tcp://a" {
+		t.Fatalf("unexpected remote %q", r.url)
+	}
+	if p.fail(p.remotes[0]) {
+		t.Fatal("remote is down before the max failures")
+	}
+	if !p.fail(p.remotes[0]) {
+		t.Fatal("remote is expected to be down")
+	}
+	if r := p.pick(); r.url != "tcp://b" {
+		t.Fatalf("unexpected remote %q", r.url)
+	}
+	p.fail(p.remotes[1])
+	p.fail(p.remotes[1])
+	p.fail(p.remotes[2])
+	p.fail(p.remotes[2])
+	// 所有服务端都不可用时仍然按顺序尝试
+	if r := p.pick(); r.url != "tcp://a" {
+		t.Fatalf("unexpected remote %q", r.url)
+	}
+	if !p.succeed(p.remotes[1]) {
+		t.Fatal("remote is expected to be recovered")
+	}
+	if r := p.preferred(); r.url != "tcp://b" {
+		t.Fatalf("unexpected preferred remote %q", r.url)
+	}
+
+	p = newRemotePool(remoteStrategyWeight, newRemotes(), 1)
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[p.pick().url]++
+	}
+	if counts["tcp://a"] != 6 || counts["tcp://b"] != 2 || counts["tcp://c"] != 2 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	p.fail(p.remotes[0])
+	counts = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[p.pick().url]++
+	}
+	if counts["tcp://a"] != 0 || counts["tcp://b"] != 5 || counts["tcp://c"] != 5 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+}
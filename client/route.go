@@ -0,0 +1,438 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/util"
+)
+
+// ErrInvalidHTTPMessage is an error returned when a request or response of a routed service is invalid
+var ErrInvalidHTTPMessage = util.ErrInvalidHTTPMessage
+
+// matchRoute 返回与 path 最长前缀匹配的 route，routes 已经按路径长度降序排列
+func matchRoute(routes []route, path string) *route {
+	for i := range routes {
+		prefix := routes[i].Path
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		// 只在路径段的边界匹配，/api 不匹配 /apis
+		if len(path) == len(prefix) || prefix[len(prefix)-1] == '/' || path[len(prefix)] == '/' {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+type routeBackend struct {
+	conn     net.Conn
+	leftover []byte // 读到的属于下一个响应的数据
+	err      error  // 读完 leftover 之后返回的错误
+}
+
+type pendingResponse struct {
+	backend *routeBackend
+	head    bool // HEAD 请求的响应没有 body
+}
+
+// routeConn 按请求路径将同一个访问者连接上的请求转发到不同的本地服务，响应按请求的顺序返回
+type routeConn struct {
+	service *service
+	addr    remoteAddr
+
+	// 以下字段只在 Write 中使用
+	req     util.HTTPParser
+	current *routeBackend
+	raw     bool // 协议升级之后不再解析请求
+
+	// 以下字段只在 Read 中使用
+	resp    util.HTTPParser
+	reading *pendingResponse
+	rawResp bool
+
+	mtx      sync.Mutex
+	backends map[*url.URL]*routeBackend
+	pending  []*pendingResponse
+	notify   chan struct{}
+	closed   chan struct{}
+	deadline time.Time
+}
+
+func newRouteConn(s *service, addr remoteAddr) *routeConn {
+	return &routeConn{
+		service:  s,
+		addr:     addr,
+		backends: make(map[*url.URL]*routeBackend),
+		notify:   make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (r *routeConn) backend(u *url.URL) (b *routeBackend, err error) {
+	r.mtx.Lock()
+	b, ok := r.backends[u]
+	r.mtx.Unlock()
+	if ok {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, r.service.LocalTimeout.Duration)
+	if err != nil {
+		return
+	}
+	if r.service.LocalProxyProtocol {
+		err = connection.WriteProxyHeaderV2(conn, r.addr.src, r.addr.dst)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	b = &routeBackend{conn: conn}
+	r.mtx.Lock()
+	select {
+	case <-r.closed:
+		err = net.ErrClosed
+	default:
+		r.backends[u] = b
+		if !r.deadline.IsZero() {
+			_ = conn.SetReadDeadline(r.deadline)
+		}
+	}
+	r.mtx.Unlock()
+	if err != nil {
+		_ = conn.Close()
+	}
+	return
+}
+
+// Write 解析请求，根据请求路径选择本地服务并改写请求行与 Host 头部
+func (r *routeConn) Write(p []byte) (n int, err error) {
+	n = len(p)
+	defer func() {
+		if err != nil {
+			n -= len(p)
+			r.Close()
+		}
+	}()
+	for len(p) > 0 {
+		if r.raw {
+			_, err = r.current.conn.Write(p)
+			if err == nil {
+				p = nil
+			}
+			return
+		}
+		if r.req.ReadingHead() {
+			var l int
+			var done bool
+			l, done, err = r.req.ReadHead(p)
+			if err != nil {
+				return
+			}
+			p = p[l:]
+			if !done {
+				continue
+			}
+			err = r.writeHead()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		var l int
+		var done bool
+		l, done, err = r.req.ReadBody(p)
+		if err != nil {
+			return
+		}
+		if l > 0 {
+			_, err = r.current.conn.Write(p[:l])
+			if err != nil {
+				return
+			}
+			p = p[l:]
+		}
+		if done {
+			r.req.Reset()
+		}
+	}
+	return
+}
+
+func (r *routeConn) writeHead() (err error) {
+	head := r.req.Head
+	i := bytes.IndexByte(head, '\n')
+	requestLine := bytes.Fields(head[:i])
+	if len(requestLine) != 3 {
+		return ErrInvalidHTTPMessage
+	}
+	method, target := requestLine[0], string(requestLine[1])
+
+	local := r.service.LocalURL.URL
+	if strings.HasPrefix(target, "/") {
+		path := target
+		if j := strings.IndexByte(path, '?'); j >= 0 {
+			path = path[:j]
+		}
+		if rt := matchRoute(r.service.Routes, path); rt != nil {
+			local = rt.LocalURL.URL
+			if rt.StripPrefix {
+				target = strings.TrimPrefix(target, strings.TrimSuffix(rt.Path, "/"))
+				if !strings.HasPrefix(target, "/") {
+					target = "/" + target
+				}
+			}
+		}
+	}
+	r.current, err = r.backend(local)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 0, len(head)+len(target)+len(local.Host))
+	buf = append(buf, method...)
+	buf = append(buf, ' ')
+	buf = append(buf, target...)
+	buf = append(buf, ' ')
+	buf = append(buf, requestLine[2]...)
+	buf = append(buf, crlf...)
+	for rest := head[i+1:]; len(rest) > 0; {
+		j := bytes.IndexByte(rest, '\n')
+		line := rest[:j+1]
+		rest = rest[j+1:]
+		if r.service.UseLocalAsHTTPHost && len(line) >= len(host) && bytes.EqualFold(line[:len(host)], host) {
+			buf = append(buf, "Host: "...)
+			buf = append(buf, local.Host...)
+			buf = append(buf, crlf...)
+			continue
+		}
+		buf = append(buf, line...)
+	}
+
+	r.mtx.Lock()
+	r.pending = append(r.pending, &pendingResponse{backend: r.current, head: string(method) == "HEAD"})
+	r.mtx.Unlock()
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+
+	_, err = r.current.conn.Write(buf)
+	if err != nil {
+		return
+	}
+
+	// 升级协议之后连接只属于当前的本地服务
+	var done bool
+	r.raw, done, err = r.req.SetRequestBody()
+	if err == nil && done {
+		r.req.Reset()
+	}
+	return
+}
+
+// Read 按请求的顺序读取本地服务的响应
+func (r *routeConn) Read(p []byte) (n int, err error) {
+	for {
+		if r.reading == nil {
+			r.reading, err = r.nextPending()
+			if err != nil {
+				return
+			}
+			r.resp.Reset()
+		}
+		b := r.reading.backend
+		var readErr error
+		switch {
+		case len(b.leftover) > 0:
+			n = copy(p, b.leftover)
+			b.leftover = b.leftover[:copy(b.leftover, b.leftover[n:])]
+		case b.err != nil:
+			err = b.err
+			return
+		default:
+			n, readErr = b.conn.Read(p)
+		}
+		if r.rawResp || n == 0 {
+			err = readErr
+			return
+		}
+		var l int
+		l, err = r.parseResponse(p[:n])
+		if err != nil {
+			return
+		}
+		if l < n {
+			// 剩余的数据属于下一个响应，读取错误在这些数据之后返回
+			b.leftover = append(b.leftover, p[l:n]...)
+			b.err = readErr
+			readErr = nil
+			n = l
+		}
+		if n > 0 || readErr != nil {
+			err = readErr
+			return
+		}
+	}
+}
+
+// parseResponse 返回 p 中属于当前响应的字节数，当前响应结束后读取下一个请求的响应
+func (r *routeConn) parseResponse(p []byte) (n int, err error) {
+	for n < len(p) && r.reading != nil && !r.rawResp {
+		var l int
+		var done bool
+		if r.resp.ReadingHead() {
+			l, done, err = r.resp.ReadHead(p[n:])
+			n += l
+			if err != nil || !done {
+				return
+			}
+			done, err = r.setResponseBody()
+			if err != nil {
+				return
+			}
+		} else {
+			l, done, err = r.resp.ReadBody(p[n:])
+			n += l
+			if err != nil {
+				return
+			}
+		}
+		if done {
+			r.resp.Reset()
+			r.reading = nil
+			return
+		}
+		if r.resp.ReadingHead() {
+			return
+		}
+	}
+	return
+}
+
+// setResponseBody 根据状态码与头部设置响应 body 的长度，返回响应是否已经结束
+func (r *routeConn) setResponseBody() (done bool, err error) {
+	status, done, err := r.resp.SetResponseBody(r.reading.head)
+	switch {
+	case err != nil:
+	case status == 101:
+		r.rawResp = true
+	case status < 200:
+		// 1xx 之后还有同一个请求的最终响应
+		r.resp.Reset()
+	}
+	return
+}
+
+func (r *routeConn) nextPending() (p *pendingResponse, err error) {
+	var timer <-chan time.Time
+	for {
+		r.mtx.Lock()
+		if len(r.pending) > 0 {
+			p = r.pending[0]
+			r.pending = r.pending[1:]
+			r.mtx.Unlock()
+			return
+		}
+		deadline := r.deadline
+		r.mtx.Unlock()
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				err = os.ErrDeadlineExceeded
+				return
+			}
+			t := time.NewTimer(d)
+			timer = t.C
+			defer t.Stop()
+		}
+		select {
+		case <-r.notify:
+		case <-r.closed:
+			err = net.ErrClosed
+			return
+		case <-timer:
+			err = os.ErrDeadlineExceeded
+			return
+		}
+	}
+}
+
+func (r *routeConn) Close() (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	close(r.closed)
+	for _, b := range r.backends {
+		if e := b.conn.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (r *routeConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (r *routeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (r *routeConn) SetDeadline(t time.Time) (err error) {
+	err = r.SetReadDeadline(t)
+	if err != nil {
+		return
+	}
+	return r.SetWriteDeadline(t)
+}
+
+func (r *routeConn) SetReadDeadline(t time.Time) (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.deadline = t
+	for _, b := range r.backends {
+		if e := b.conn.SetReadDeadline(t); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (r *routeConn) SetWriteDeadline(t time.Time) (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, b := range r.backends {
+		if e := b.conn.SetWriteDeadline(t); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+var _ io.ReadWriteCloser = (*routeConn)(nil)
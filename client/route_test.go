@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchRoute(t *testing.T) {
+	routes := []route{
+		{Path: "/api/v2"},
+		{Path: "/static/"},
+		{Path: "/api"},
+		{Path: "/"},
+	}
+	tests := map[string]string{
+		"/api":          "/api",
+		"/api/":         "/api",
+		"/api/v2/users": "/api/v2",
+		"/api/v22":      "/api",
+		"/apis":         "/",
+		"/static/a.js":  "/static/",
+		"/static":       "/",
+	}
+	for path, want := range tests {
+		r := matchRoute(routes, path)
+		if r == nil || r.Path != want {
+			t.Fatalf("path %q matched %v, %q is expected", path, r, want)
+		}
+	}
+	if r := matchRoute(routes[:3], "/index.html"); r != nil {
+		t.Fatalf("unexpected route %v", r)
+	}
+}
+
+func newEchoServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/chunked" {
+			// 触发 chunked 编码的响应
+			_, _ = io.WriteString(w, name+" ")
+			w.(http.Flusher).Flush()
+		}
+		_, _ = fmt.Fprintf(w, "%s %s %s %s", name, r.URL.RequestURI(), r.Host, body)
+	}))
+}
+
+func TestRouteConn(t *testing.T) {
+	def := newEchoServer("default")
+	defer def.Close()
+	api := newEchoServer("api")
+	defer api.Close()
+	static := newEchoServer("static")
+	defer static.Close()
+
+	parse := func(s string) clientURL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return clientURL{u}
+	}
+	s := &service{
+		LocalURL:           parse(def.URL),
+		UseLocalAsHTTPHost: true,
+		Routes: []route{
+			{Path: "/static/", LocalURL: parse(static.URL), StripPrefix: true},
+			{Path: "/api", LocalURL: parse(api.URL)},
+		},
+	}
+	c := newRouteConn(s, remoteAddr{})
+	defer c.Close()
+
+	// 一次写入多个请求，响应需要按请求的顺序返回
+	requests := "GET /api/a?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"GET /static/b HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"HEAD /api/head HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /index HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET /static/chunked HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /api/c HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nbody"
+	n, err := c.Write([]byte(requests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(requests) {
+		t.Fatalf("%d bytes written, %d is expected", n, len(requests))
+	}
+
+	host := func(u string) string {
+		return strings.TrimPrefix(u, "http://")
+	}
+	wants := []string{
+		"api /api/a?x=1 " + host(api.URL) + " ",
+		"static /b " + host(static.URL) + " ",
+		"",
+		"default /index " + host(def.URL) + " abc",
+		"static static /chunked " + host(static.URL) + " ",
+		"api /api/c " + host(api.URL) + " body",
+	}
+	err = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(c)
+	for i, want := range wants {
+		method := http.MethodGet
+		if i == 2 {
+			method = http.MethodHead
+		}
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Fatalf("response %d is %q, %q is expected", i, body, want)
+		}
+	}
+
+	// 没有未完成的请求时读取会等待到超时
+	err = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.ReadByte()
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("timeout error is expected, but got %v", err)
+	}
+}
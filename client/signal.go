@@ -2,6 +2,7 @@ package client
 
 import (
 	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/util"
 )
 
 func handleError(tunnel *conn) (err error) {
@@ -51,6 +52,55 @@ func handleError(tunnel *conn) (err error) {
 		tunnel.Logger.Error().Str("err", "the number of options exceeded the upper limit").Msg("read error signal")
 	case connection.ErrTCPNumberLimited:
 		tunnel.Logger.Error().Str("err", "the number of tcp ports exceeded the upper limit").Msg("read error signal")
+	case connection.ErrFailedToOpenUDPPort:
+		var peekBytes []byte
+		peekBytes, err = tunnel.Reader.Peek(2)
+		if err != nil {
+			return
+		}
+		serviceIndex := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		_, err = tunnel.Reader.Discard(2)
+		if err != nil {
+			return
+		}
+		var local string
+		if s := tunnel.client.services.Load(); s != nil && serviceIndex < uint16(len(*s)) {
+			local = (*s)[serviceIndex].LocalURL.String()
+		}
+		tunnel.Logger.Error().
+			Str("local", local).
+			Str("err", "failed to open udp port").
+			Msg("read error signal")
+	case connection.ErrUDPNumberLimited:
+		tunnel.Logger.Error().Str("err", "the number of udp ports exceeded the upper limit").Msg("read error signal")
+	case connection.ErrAuthNotAllowed:
+		tunnel.Logger.Error().Str("err", "the auth of services is not allowed by the server").Msg("read error signal")
+	case connection.ErrDomainNumberLimited:
+		tunnel.Logger.Error().Str("err", "the number of custom domains exceeded the upper limit").Msg("read error signal")
+	case connection.ErrDomainNotVerified:
+		var domainLen byte
+		domainLen, err = tunnel.Reader.ReadByte()
+		if err != nil {
+			return
+		}
+		var domain []byte
+		domain, err = tunnel.Reader.Peek(int(domainLen))
+		if err != nil {
+			return
+		}
+		domainStr := string(domain)
+		_, err = tunnel.Reader.Discard(int(domainLen))
+		if err != nil {
+			return
+		}
+		token := util.DomainToken(tunnel.client.Config().ID, domainStr)
+		tunnel.Logger.Error().
+			Str("domain", domainStr).
+			Str("txtRecord", util.DomainChallengePrefix+domainStr).
+			Str("httpURL", "http://"+domainStr+util.DomainChallengePath+token).
+			Str("token", token).
+			Str("err", "the ownership of the custom domain is not verified, set the TXT record or serve the http url with the token").
+			Msg("read error signal")
 	default:
 		tunnel.Logger.Error().Str("err", "unknown error").Msg("read error signal")
 	}
@@ -96,8 +146,54 @@ func handleInfo(tunnel *conn) (err error) {
 			Str("local", local).
 			Uint16("tcp port", tcpPort).
 			Msg("tcp port opened")
+	case connection.InfoUDPPortOpened:
+		peekBytes, err = tunnel.Reader.Peek(4)
+		if err != nil {
+			return
+		}
+		serviceIndex := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+		udpPort := uint16(peekBytes[3]) | uint16(peekBytes[2])<<8
+		_, err = tunnel.Reader.Discard(4)
+		if err != nil {
+			return
+		}
+		var local string
+		if s := tunnel.client.services.Load(); s != nil && serviceIndex < uint16(len(*s)) {
+			local = (*s)[serviceIndex].LocalURL.String()
+		}
+		tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).
+			Str("local", local).
+			Uint16("udp port", udpPort).
+			Msg("udp port opened")
+	case connection.InfoTURNCredential:
+		var cred turnCredential
+		cred.username, err = readShortString(tunnel)
+		if err != nil {
+			return
+		}
+		cred.password, err = readShortString(tunnel)
+		if err != nil {
+			return
+		}
+		tunnel.client.turnCredential.Store(&cred)
+		tunnel.Logger.Debug().Str("username", cred.username).Msg("TURN credential updated")
 	default:
 		tunnel.Logger.Info().Msg("read unknown info signal")
 	}
 	return
 }
+
+// readShortString 读取 [len][string] 形式的字符串
+func readShortString(tunnel *conn) (s string, err error) {
+	l, err := tunnel.Reader.ReadByte()
+	if err != nil {
+		return
+	}
+	b, err := tunnel.Reader.Peek(int(l))
+	if err != nil {
+		return
+	}
+	s = string(b)
+	_, err = tunnel.Reader.Discard(int(l))
+	return
+}
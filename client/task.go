@@ -18,12 +18,15 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/pool"
 	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
 	"github.com/rs/zerolog"
 )
 
@@ -32,17 +35,76 @@ var (
 	ErrHostIsTooLong = errors.New("host is too long")
 
 	host = []byte("Host:")
+	crlf = []byte("\r\n")
+
+	// 访问者可以伪造这些头部，注入转发头部时删除
+	forwardedHeaderNames = [][]byte{
+		[]byte("X-Forwarded-For:"),
+		[]byte("X-Forwarded-Proto:"),
+		[]byte("X-Forwarded-Host:"),
+		[]byte("X-Real-IP:"),
+		[]byte("Forwarded:"),
+	}
 )
 
 type httpTask struct {
-	conn     net.Conn
-	buf      []byte
-	tempBuf  *bytes.Buffer
-	Logger   zerolog.Logger
-	skipping bool
-	passing  bool
-	closing  uint32
-	service  *service
+	conn      net.Conn
+	buf       []byte       // 替换的 Host 头部
+	rewrite   bool         // 是否改写每个请求的头部
+	tempBuf   bytes.Buffer // 缓存不完整的行
+	forwarded *remoteAddr  // 不为 nil 时注入转发头部
+	reqHost   []byte       // 访问者请求中的 Host
+	req       util.HTTPParser
+	raw       bool // 协议升级或者无法解析请求之后不再改写
+	Logger    zerolog.Logger
+	skipping  bool
+	passing   bool
+	closing   uint32
+	service   *service
+	window    *uploadWindow // 不为 nil 时服务端对任务限速，只在窗口内发送数据
+}
+
+// uploadWindow 服务端允许任务继续发送的字节数，用尽时停止读取本地服务，等待服务端写入访问者连接后归还，
+// 避免服务端的限速阻塞同一隧道上的其他任务
+type uploadWindow struct {
+	mtx    sync.Mutex
+	cond   sync.Cond
+	n      uint32
+	closed bool
+}
+
+func newUploadWindow(n uint32) *uploadWindow {
+	w := &uploadWindow{n: n}
+	w.cond.L = &w.mtx
+	return w
+}
+
+func (w *uploadWindow) add(n uint32) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.n += n
+	w.cond.Broadcast()
+}
+
+// acquire 等待窗口足够发送 n 字节，任务关闭时返回 false。n 总是小于服务端的窗口
+func (w *uploadWindow) acquire(n uint32) (ok bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for !w.closed && w.n < n {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return
+	}
+	w.n -= n
+	return true
+}
+
+func (w *uploadWindow) close() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
 }
 
 func newHTTPTask(c net.Conn) (t *httpTask) {
@@ -56,145 +118,185 @@ func (t *httpTask) setHost(host string) (err error) {
 	if len(host) > 200 {
 		return ErrHostIsTooLong
 	}
-	t.buf = pool.BytesPool.Get().([]byte)
-	n := copy(t.buf, "Host: ")
-	n += copy(t.buf[n:], host)
-	n += copy(t.buf[n:], "\r\n")
-	t.tempBuf = bytes.NewBuffer(t.buf[n:][:0])
-	t.buf = t.buf[:n]
+	t.buf = append(append(append(t.buf[:0], "Host: "...), host...), crlf...)
+	t.rewrite = true
 	return
 }
 
+// setForwarded 在每个请求的头部中注入 X-Forwarded-For 等头部
+func (t *httpTask) setForwarded(addr remoteAddr) {
+	t.forwarded = &addr
+	t.rewrite = true
+}
+
+func (t *httpTask) write(p []byte) (n int, err error) {
+	if predef.Debug {
+		t.Logger.Debug().Bytes("data", p).Msg("write")
+	}
+	return t.conn.Write(p)
+}
+
+// Write 改写每个请求的头部，body 与协议升级之后的数据原样写入
 func (t *httpTask) Write(p []byte) (n int, err error) {
-	if t.tempBuf == nil {
+	if !t.rewrite {
 		return t.conn.Write(p)
-	} else if t.skipping {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			return len(p), nil
-		}
-		t.skipping = false
-		t.tempBuf = nil
-		if len(p) <= i+1 {
-			return len(p), nil
-		}
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[i+1:]).Msg("write")
+	}
+	n = len(p)
+	defer func() {
+		if err != nil {
+			n -= len(p)
 		}
-		n, err = t.conn.Write(p[i+1:])
-		n += i + 1
-		return
-	} else if t.passing {
-		i := bytes.IndexByte(p, '\n')
-		if i < 0 {
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p).Msg("write")
+	}()
+	for len(p) > 0 && !t.raw {
+		if t.req.ReadingHead() {
+			l, done, e := t.req.ReadHead(p)
+			if e != nil {
+				// 头部过长，之后的数据原样写入
+				err = t.setRaw()
+				if err != nil {
+					return
+				}
+				break
+			}
+			err = t.writeHead(p[:l])
+			if err != nil {
+				return
+			}
+			p = p[l:]
+			if !done {
+				continue
 			}
-			return t.conn.Write(p)
+			t.tempBuf.Reset()
+			t.skipping = false
+			t.passing = false
+			t.reqHost = t.reqHost[:0]
+			upgrade, done, e := t.req.SetRequestBody()
+			if e != nil || upgrade {
+				t.raw = true
+				break
+			}
+			if done {
+				t.req.Reset()
+			}
+			continue
 		}
-		t.passing = false
-		if predef.Debug {
-			t.Logger.Debug().Bytes("data", p[:i+1]).Msg("write")
+		l, done, e := t.req.ReadBody(p)
+		if e != nil {
+			t.raw = true
+			break
 		}
-		n, err = t.conn.Write(p[:i+1])
+		_, err = t.write(p[:l])
 		if err != nil {
 			return
 		}
-		p = p[i+1:]
-		if len(p) <= 0 {
-			return
+		p = p[l:]
+		if done {
+			t.req.Reset()
 		}
 	}
-
-	var nw int
-	var updated bool
-	if t.tempBuf != nil {
-		if len(p)+t.tempBuf.Len() < 5 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			return
+	if len(p) > 0 {
+		_, err = t.write(p)
+		if err == nil {
+			p = nil
 		}
+	}
+	return
+}
 
-		if t.tempBuf.Len() > 0 {
-			nw, err = t.tempBuf.Write(p)
-			n += nw
-			if err != nil {
-				return
-			}
-			p = t.tempBuf.Bytes()
-			t.tempBuf.Reset()
-			updated = true
-		}
+// setRaw 不再改写请求，先写入缓存的不完整的行
+func (t *httpTask) setRaw() (err error) {
+	t.raw = true
+	if t.tempBuf.Len() > 0 && !t.skipping {
+		_, err = t.write(t.tempBuf.Bytes())
+		t.tempBuf.Reset()
 	}
+	return
+}
 
-	s := 0
-	for len(p[s:]) >= 1 {
-		switch t.isGoodToWrite(p[s:]) {
-		case good:
-			i := bytes.IndexByte(p[s:], '\n')
+// writeHead 逐行改写请求的头部，p 不包含头部之后的数据
+func (t *httpTask) writeHead(p []byte) (err error) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if t.skipping {
 			if i < 0 {
-				t.passing = true
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
 				return
 			}
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", p[s:s+i+1]).Msg("write")
-			}
-			nw, err = t.conn.Write(p[s : s+i+1])
-			if !updated {
-				n += nw
+			t.skipping = false
+			p = p[i+1:]
+			continue
+		}
+		if t.passing {
+			if i < 0 {
+				_, err = t.write(p)
+				return
 			}
+			t.passing = false
+			_, err = t.write(p[:i+1])
 			if err != nil {
 				return
 			}
-			s += i + 1
-		case unsure:
-			nw, err = t.tempBuf.Write(p[s:])
-			if !updated {
-				n += nw
-			}
+			p = p[i+1:]
+			continue
+		}
+
+		// 在行首，缓存数据直到可以判断如何处理这一行
+		var line []byte
+		if i < 0 {
+			line, p = p, nil
+		} else {
+			line, p = p[:i+1], p[i+1:]
+		}
+		if t.tempBuf.Len() > 0 {
+			t.tempBuf.Write(line)
+			line = t.tempBuf.Bytes()
+		}
+		err = t.writeLine(line)
+		if err != nil {
 			return
-		case replace:
-			if predef.Debug {
-				t.Logger.Debug().Bytes("data", t.buf).Msg("write")
-			}
-			_, err = t.conn.Write(t.buf)
+		}
+	}
+	return
+}
+
+func (t *httpTask) writeLine(line []byte) (err error) {
+	complete := line[len(line)-1] == '\n'
+	action := t.isGoodToWrite(line)
+	if action == replace && t.forwarded != nil && !complete {
+		// 需要完整的 Host 头部来设置 X-Forwarded-Host
+		action = unsure
+	}
+	switch action {
+	case unsure:
+		if t.tempBuf.Len() == 0 {
+			t.tempBuf.Write(line)
+		}
+		return
+	case good:
+		_, err = t.write(line)
+		t.passing = !complete
+	case skip:
+		t.skipping = !complete
+	case replace:
+		if complete {
+			t.reqHost = append(t.reqHost[:0], bytes.TrimSpace(line[len(host):])...)
+		}
+		if len(t.buf) > 0 {
+			_, err = t.write(t.buf)
+			t.skipping = !complete
+		} else {
+			_, err = t.write(line)
+			t.passing = !complete
+		}
+	case end:
+		if t.forwarded != nil {
+			_, err = t.write(t.forwardedHeaders())
 			if err != nil {
 				return
 			}
-			i := bytes.IndexByte(p[s:], '\n')
-			if i < 0 {
-				t.skipping = true
-				nw = len(p[s:])
-				if !updated {
-					n += nw
-				}
-				return
-			}
-			s += i + 1
-			if !updated {
-				n += i + 1
-			}
-			t.tempBuf = nil
-			pool.BytesPool.Put(t.buf[:cap(t.buf)])
-			if len(p[s:]) > 0 {
-				if predef.Debug {
-					t.Logger.Debug().Bytes("data", p[s:]).Msg("write")
-				}
-				nw, err = t.conn.Write(p[s:])
-				if !updated {
-					n += nw
-				}
-			}
-			return
 		}
+		_, err = t.write(line)
 	}
+	t.tempBuf.Reset()
 	return
 }
 
@@ -202,22 +304,108 @@ const (
 	good = iota
 	unsure
 	replace
+	skip
+	end
 )
 
-func (t *httpTask) isGoodToWrite(p []byte) int {
-	l := len(p)
-	if l > 5 {
-		l = 5
+func (t *httpTask) isGoodToWrite(line []byte) int {
+	if len(line) == 1 && line[0] == '\n' {
+		return end
+	}
+	result := matchPrefix(line, crlf, end)
+	if result != good {
+		return result
+	}
+	result = matchPrefix(line, host, replace)
+	if result != good {
+		return result
 	}
-	if bytes.Equal(p[:l], host[:l]) {
-		if l < 5 {
+	if t.forwarded != nil {
+		for _, name := range forwardedHeaderNames {
+			result = matchPrefix(line, name, skip)
+			if result != good {
+				return result
+			}
+		}
+	}
+	return good
+}
+
+// matchPrefix 不区分大小写地比较 line 与 prefix，line 比 prefix 短时无法确定
+func matchPrefix(line, prefix []byte, matched int) int {
+	if len(line) < len(prefix) {
+		if bytes.EqualFold(line, prefix[:len(line)]) {
 			return unsure
 		}
-		return replace
+		return good
+	}
+	if bytes.EqualFold(line[:len(prefix)], prefix) {
+		return matched
 	}
 	return good
 }
 
+// forwardedHeaders 生成 X-Forwarded-* 与 RFC 7239 Forwarded 头部
+func (t *httpTask) forwardedHeaders() []byte {
+	var ip net.IP
+	if addr, ok := t.forwarded.src.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	var b []byte
+	var params []string
+	if ip != nil {
+		b = appendHeader(b, "X-Forwarded-For", ip.String())
+		b = appendHeader(b, "X-Real-IP", ip.String())
+		if ip.To4() == nil {
+			params = append(params, `for="[`+ip.String()+`]"`)
+		} else {
+			params = append(params, "for="+ip.String())
+		}
+	}
+	if len(t.reqHost) > 0 {
+		b = appendHeader(b, "X-Forwarded-Host", string(t.reqHost))
+		params = append(params, "host="+quoteForwardedValue(string(t.reqHost)))
+	}
+	if t.forwarded.proto != "" {
+		b = appendHeader(b, "X-Forwarded-Proto", t.forwarded.proto)
+		params = append(params, "proto="+t.forwarded.proto)
+	}
+	if len(params) > 0 {
+		b = appendHeader(b, "Forwarded", strings.Join(params, ";"))
+	}
+	return b
+}
+
+func appendHeader(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	b = append(b, ": "...)
+	b = append(b, value...)
+	return append(b, crlf...)
+}
+
+// quoteForwardedValue 值不是 token 时使用 quoted-string，见 RFC 7239 第 4 节
+func quoteForwardedValue(v string) string {
+	isToken := len(v) > 0
+	for i := 0; i < len(v) && isToken; i++ {
+		c := v[i]
+		isToken = c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+	if isToken {
+		return v
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(v); i++ {
+		if v[i] == '"' || v[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(v[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
 func (t *httpTask) Close() {
 	t.CloseWithValue(connection.Close)
 }
@@ -234,6 +422,9 @@ func (t *httpTask) CloseWithValue(value uint32) {
 	if t.conn != nil {
 		err = t.conn.Close()
 	}
+	if t.window != nil {
+		t.window.close()
+	}
 	t.Logger.Info().Uint32("by", atomic.LoadUint32(&t.closing)).Err(err).Msg("task closed")
 }
 
@@ -244,7 +435,7 @@ func (t *httpTask) IsClosingByRemote() (closingByRemote bool) {
 
 func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 	count := c.TasksCount.Add(1)
-	c.client.idleManager.SetRunningWithTaskCount(connID, count)
+	c.pool.idleManager.SetRunningWithTaskCount(connID, count)
 	var rErr error
 	var wErr error
 	buf := pool.BytesPool.Get().([]byte)
@@ -262,7 +453,7 @@ func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 		c.finishedTasks.Add(1)
 		t.Close()
 		if c.TasksCount.Add(^uint32(0)) == 0 {
-			c.client.idleManager.SetIdle(connID)
+			c.pool.idleManager.SetIdle(connID)
 			if c.IsClosing() {
 				c.SendForceCloseSignal()
 				c.Close()
@@ -290,6 +481,9 @@ func (t *httpTask) process(connID uint, taskID uint32, c *conn) {
 		var l int
 		l, rErr = t.conn.Read(buf[10:])
 		if l > 0 {
+			if t.window != nil && !t.window.acquire(uint32(l)) {
+				return
+			}
 			buf[6] = byte(l >> 24)
 			buf[7] = byte(l >> 16)
 			buf[8] = byte(l >> 8)
@@ -16,6 +16,7 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"testing"
@@ -130,3 +131,177 @@ func Test_task_Write(t1 *testing.T) {
 		})
 	}
 }
+
+func Test_task_WriteForwarded(t1 *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\n" +
+		"host: id1.example.com:8080\r\n" +
+		"X-Forwarded-For: 6.6.6.6\r\n" +
+		"x-real-ip: 6.6.6.6\r\n" +
+		"User-Agent: curl/7.64.1\r\n" +
+		"\r\n" +
+		"POST / HTTP/1.1\r\nX-Real-IP: 6.6.6.6\r\nContent-Length: 20\r\n\r\n" +
+		"X-Real-IP: 6.6.6.6\r\n" +
+		"GET / HTTP/1.1\r\nHost: id2.example.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6\r\nHost: \r\n0\r\n\r\n")
+	tests := []struct {
+		name   string
+		host   string
+		addr   remoteAddr
+		result string
+		rest   string // 之后的请求的改写结果
+	}{
+		{
+			name: "ipv4",
+			addr: remoteAddr{src: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111}, proto: "http"},
+			result: "GET / HTTP/1.1\r\n" +
+				"host: id1.example.com:8080\r\n" +
+				"User-Agent: curl/7.64.1\r\n" +
+				"X-Forwarded-For: 1.2.3.4\r\n" +
+				"X-Real-IP: 1.2.3.4\r\n" +
+				"X-Forwarded-Host: id1.example.com:8080\r\n" +
+				"X-Forwarded-Proto: http\r\n" +
+				"Forwarded: for=1.2.3.4;host=\"id1.example.com:8080\";proto=http\r\n" +
+				"\r\n",
+			rest: "POST / HTTP/1.1\r\nContent-Length: 20\r\n" +
+				"X-Forwarded-For: 1.2.3.4\r\n" +
+				"X-Real-IP: 1.2.3.4\r\n" +
+				"X-Forwarded-Proto: http\r\n" +
+				"Forwarded: for=1.2.3.4;proto=http\r\n" +
+				"\r\n" +
+				"X-Real-IP: 6.6.6.6\r\n" +
+				"GET / HTTP/1.1\r\nHost: id2.example.com\r\nTransfer-Encoding: chunked\r\n" +
+				"X-Forwarded-For: 1.2.3.4\r\n" +
+				"X-Real-IP: 1.2.3.4\r\n" +
+				"X-Forwarded-Host: id2.example.com\r\n" +
+				"X-Forwarded-Proto: http\r\n" +
+				"Forwarded: for=1.2.3.4;host=id2.example.com;proto=http\r\n" +
+				"\r\n" +
+				"6\r\nHost: \r\n0\r\n\r\n",
+		},
+		{
+			name: "ipv6 with local host",
+			host: "localhost",
+			addr: remoteAddr{src: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1111}, proto: "https"},
+			result: "GET / HTTP/1.1\r\n" +
+				"Host: localhost\r\n" +
+				"User-Agent: curl/7.64.1\r\n" +
+				"X-Forwarded-For: ::1\r\n" +
+				"X-Real-IP: ::1\r\n" +
+				"X-Forwarded-Host: id1.example.com:8080\r\n" +
+				"X-Forwarded-Proto: https\r\n" +
+				"Forwarded: for=\"[::1]\";host=\"id1.example.com:8080\";proto=https\r\n" +
+				"\r\n",
+			rest: "POST / HTTP/1.1\r\nContent-Length: 20\r\n" +
+				"X-Forwarded-For: ::1\r\n" +
+				"X-Real-IP: ::1\r\n" +
+				"X-Forwarded-Proto: https\r\n" +
+				"Forwarded: for=\"[::1]\";proto=https\r\n" +
+				"\r\n" +
+				"X-Real-IP: 6.6.6.6\r\n" +
+				"GET / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n" +
+				"X-Forwarded-For: ::1\r\n" +
+				"X-Real-IP: ::1\r\n" +
+				"X-Forwarded-Host: id2.example.com\r\n" +
+				"X-Forwarded-Proto: https\r\n" +
+				"Forwarded: for=\"[::1]\";host=id2.example.com;proto=https\r\n" +
+				"\r\n" +
+				"6\r\nHost: \r\n0\r\n\r\n",
+		},
+		{
+			name: "unknown address",
+			result: "GET / HTTP/1.1\r\n" +
+				"host: id1.example.com:8080\r\n" +
+				"User-Agent: curl/7.64.1\r\n" +
+				"X-Forwarded-Host: id1.example.com:8080\r\n" +
+				"Forwarded: host=\"id1.example.com:8080\"\r\n" +
+				"\r\n",
+			rest: "POST / HTTP/1.1\r\nContent-Length: 20\r\n" +
+				"\r\n" +
+				"X-Real-IP: 6.6.6.6\r\n" +
+				"GET / HTTP/1.1\r\nHost: id2.example.com\r\nTransfer-Encoding: chunked\r\n" +
+				"X-Forwarded-Host: id2.example.com\r\n" +
+				"Forwarded: host=id2.example.com\r\n" +
+				"\r\n" +
+				"6\r\nHost: \r\n0\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t1.Run(tt.name, func(t1 *testing.T) {
+			// 改写每个请求的头部，body 中的数据不会被改写
+			result := tt.result + tt.rest
+			for i := 1; i <= len(data); i++ {
+				buffer := bytes.NewBuffer(nil)
+				t := newHTTPTask(&fakeConn{buffer})
+				if tt.host != "" {
+					err := t.setHost(tt.host)
+					if err != nil {
+						t1.Fatal(err)
+					}
+				}
+				t.setForwarded(tt.addr)
+				for p := data; len(p) > 0; {
+					l := i
+					if l > len(p) {
+						l = len(p)
+					}
+					n, err := t.Write(p[:l])
+					if err != nil {
+						t1.Fatal(err)
+					}
+					if n != l {
+						t1.Fatalf("%d is expected, but got %d", l, n)
+					}
+					p = p[l:]
+				}
+				if buffer.String() != result {
+					t1.Fatalf("chunk size %d: %q is not expected %q", i, buffer.String(), result)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRemoteAddr(t *testing.T) {
+	addr, err := parseRemoteAddr([]byte("\x0c1.2.3.4:1111\x0a5.6.7.8:80\x05https"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.src.String() != "1.2.3.4:1111" || addr.dst.String() != "5.6.7.8:80" || addr.proto != "https" {
+		t.Fatalf("invalid addr %v %v %q", addr.src, addr.dst, addr.proto)
+	}
+	// 协议是可选的
+	addr, err = parseRemoteAddr([]byte("\x00\x00"))
+	if err != nil || addr.src != nil || addr.dst != nil || addr.proto != "" {
+		t.Fatalf("invalid addr %v %v %q %v", addr.src, addr.dst, addr.proto, err)
+	}
+	for _, data := range []string{"\x00", "\x05abc\x00", "\x00\x00\x00\x00", "\x00\x00\x00x"} {
+		_, err = parseRemoteAddr([]byte(data))
+		if !errors.Is(err, errInvalidRemoteAddr) {
+			t.Fatalf("%q: unexpected error %v", data, err)
+		}
+	}
+}
+
+func TestUploadWindow(t *testing.T) {
+	w := newUploadWindow(10)
+	if !w.acquire(6) {
+		t.Fatal("acquire should succeed")
+	}
+	acquired := make(chan bool)
+	go func() {
+		acquired <- w.acquire(6)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire should wait for the window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.add(2)
+	if !<-acquired {
+		t.Fatal("acquire should succeed after the window is updated")
+	}
+	go w.close()
+	if w.acquire(1) {
+		t.Fatal("acquire should fail after close")
+	}
+}
@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !pion
+// +build !pion
+
 #include <api/data_channel_interface.h>
 
 #include "datachannel.h"
@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pion
+// +build pion
+
+package webrtc
+
+import (
+	"sync"
+	"sync/atomic"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxSendQueueSize 与 libwebrtc 的发送缓冲区上限保持一致
+	maxSendQueueSize = 16 * 1024 * 1024
+	// bufferedAmountLowThreshold 缓冲区降到该值以下时唤醒等待发送的协程
+	bufferedAmountLowThreshold = maxSendQueueSize / 2
+)
+
+type DataChannel struct {
+	Label string
+	ID    int
+
+	dataChannel *pion.DataChannel
+	config      *DataChannelConfig
+
+	bufferedAmountMtx        sync.Mutex
+	bufferedAmountChangeCond *sync.Cond
+
+	err             atomic.Value // string
+	messageSent     atomic.Uint32
+	messageReceived atomic.Uint32
+	bytesSent       atomic.Uint64
+	bytesReceived   atomic.Uint64
+	closed          atomic.Bool
+}
+
+func newDataChannel(label string, config *DataChannelConfig) (d *DataChannel) {
+	d = &DataChannel{
+		Label:  label,
+		config: config,
+	}
+	d.bufferedAmountChangeCond = sync.NewCond(&d.bufferedAmountMtx)
+	return
+}
+
+func (d *DataChannel) bind(dataChannel *pion.DataChannel) {
+	d.dataChannel = dataChannel
+	dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	dataChannel.OnBufferedAmountLow(d.onBufferedAmountChange)
+	dataChannel.OnOpen(func() {
+		d.onStateChange(DataStateOpen)
+	})
+	dataChannel.OnClose(func() {
+		d.onBufferedAmountChange()
+		d.onStateChange(DataStateClose)
+	})
+	dataChannel.OnError(func(err error) {
+		d.err.Store(err.Error())
+	})
+	dataChannel.OnMessage(func(message pion.DataChannelMessage) {
+		d.messageReceived.Add(1)
+		d.bytesReceived.Add(uint64(len(message.Data)))
+		if d.config != nil && d.config.OnMessage != nil {
+			d.config.OnMessage(message.Data)
+		}
+	})
+}
+
+func (d *DataChannel) onStateChange(state DataState) {
+	if d.config != nil && d.config.OnStateChange != nil {
+		if id := d.dataChannel.ID(); id != nil {
+			d.ID = int(*id)
+		}
+		d.config.OnStateChange(state)
+	}
+}
+
+func (d *DataChannel) onBufferedAmountChange() {
+	d.bufferedAmountMtx.Lock()
+	d.bufferedAmountChangeCond.Broadcast()
+	d.bufferedAmountMtx.Unlock()
+}
+
+// waitBufferedAmount 缓冲区已满时返回 true，缓冲区低于阈值时总是允许发送，防止错过唤醒
+func (d *DataChannel) waitBufferedAmount(size int) bool {
+	bufferedAmount := d.BufferedAmount()
+	return bufferedAmount > bufferedAmountLowThreshold && bufferedAmount+uint64(size) > maxSendQueueSize
+}
+
+func (d *DataChannel) SendOnce(message []byte) (sent bool, closed bool) {
+	// 等待缓冲区可用空间
+	if d.waitBufferedAmount(len(message)) {
+		d.bufferedAmountMtx.Lock()
+		for d.waitBufferedAmount(len(message)) {
+			if d.closed.Load() || d.State() != DataStateOpen {
+				d.bufferedAmountMtx.Unlock()
+				closed = true
+				return
+			}
+			d.bufferedAmountChangeCond.Wait()
+		}
+		d.bufferedAmountMtx.Unlock()
+	}
+
+	err := d.dataChannel.Send(message)
+	if err != nil {
+		d.err.Store(err.Error())
+		return
+	}
+	d.messageSent.Add(1)
+	d.bytesSent.Add(uint64(len(message)))
+	sent = true
+	return
+}
+
+func (d *DataChannel) Close() {
+	if d.closed.CompareAndSwap(false, true) {
+		d.onBufferedAmountChange()
+		_ = d.dataChannel.Close()
+	}
+}
+
+func (d *DataChannel) Reliable() bool {
+	return d.dataChannel.MaxPacketLifeTime() == nil && d.dataChannel.MaxRetransmits() == nil
+}
+
+func (d *DataChannel) Ordered() bool {
+	return d.dataChannel.Ordered()
+}
+
+func (d *DataChannel) Protocol() string {
+	return d.dataChannel.Protocol()
+}
+
+func (d *DataChannel) Negotiated() bool {
+	return d.dataChannel.Negotiated()
+}
+
+func (d *DataChannel) State() DataState {
+	switch d.dataChannel.ReadyState() {
+	case pion.DataChannelStateOpen:
+		return DataStateOpen
+	case pion.DataChannelStateClosing:
+		return DataStateClosing
+	case pion.DataChannelStateClosed:
+		return DataStateClose
+	}
+	return DataStateConnecting
+}
+
+func (d *DataChannel) Error() string {
+	err, _ := d.err.Load().(string)
+	return err
+}
+
+func (d *DataChannel) MessageSent() uint32 {
+	return d.messageSent.Load()
+}
+
+func (d *DataChannel) MessageReceived() uint32 {
+	return d.messageReceived.Load()
+}
+
+func (d *DataChannel) BytesSent() uint64 {
+	return d.bytesSent.Load()
+}
+
+func (d *DataChannel) BytesReceived() uint64 {
+	return d.bytesReceived.Load()
+}
+
+func (d *DataChannel) BufferedAmount() uint64 {
+	return d.dataChannel.BufferedAmount()
+}
+
+func (d *DataChannel) MaxSendQueueSize() uint64 {
+	return maxSendQueueSize
+}
+
+type DataChannelWithoutCallback struct {
+	label       string
+	id          int
+	dataChannel *pion.DataChannel
+}
+
+// SetCallback 使用 dataChannelPointer 是为了防止回调时值还没有被设置，因为是不同的线程
+func (d *DataChannelWithoutCallback) SetCallback(config *DataChannelConfig, dataChannelPointer **DataChannel) {
+	channel := newDataChannel(d.label, config)
+	channel.ID = d.id
+	*dataChannelPointer = channel
+	channel.bind(d.dataChannel)
+}
@@ -14,13 +14,6 @@
 
 package webrtc
 
-/*
-#include <stdlib.h>
-#include "logging.h"
-*/
-import "C"
-import "sync"
-
 type LoggingSeverity int
 
 const (
@@ -46,29 +39,3 @@ func (l *LoggingSeverity) String() string {
 	}
 	panic("unreachable")
 }
-
-var (
-	onLogMessageGlobalRWMutex sync.RWMutex
-	onLogMessageGlobal        func(severity LoggingSeverity, message string, tag string)
-)
-
-//export onLogMessage
-func onLogMessage(severity C.int, messageC *C.char, tagC *C.char) {
-	onLogMessageGlobalRWMutex.RLock()
-	defer onLogMessageGlobalRWMutex.RUnlock()
-	if onLogMessageGlobal == nil {
-		return
-	}
-
-	message := C.GoString(messageC)
-	tag := C.GoString(tagC)
-	onLogMessageGlobal(LoggingSeverity(severity), message, tag)
-}
-
-// SetLog set logging severity and onLogMessage callback
-func SetLog(severity LoggingSeverity, f func(severity LoggingSeverity, message string, tag string)) {
-	onLogMessageGlobalRWMutex.Lock()
-	onLogMessageGlobal = f
-	onLogMessageGlobalRWMutex.Unlock()
-	C.SetLog(C.int(severity))
-}
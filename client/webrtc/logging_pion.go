@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pion
+// +build pion
+
+package webrtc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/logging"
+)
+
+var (
+	onLogMessageGlobalRWMutex sync.RWMutex
+	onLogMessageGlobal        func(severity LoggingSeverity, message string, tag string)
+	loggingSeverityGlobal     = LoggingSeverityNone
+)
+
+// SetLog set logging severity and onLogMessage callback
+func SetLog(severity LoggingSeverity, f func(severity LoggingSeverity, message string, tag string)) {
+	onLogMessageGlobalRWMutex.Lock()
+	onLogMessageGlobal = f
+	loggingSeverityGlobal = severity
+	onLogMessageGlobalRWMutex.Unlock()
+}
+
+// loggerFactory 将 pion 的日志转发到 SetLog 设置的回调，scope 作为 tag
+type loggerFactory struct{}
+
+func (loggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return logger(scope)
+}
+
+type logger string
+
+func (l logger) log(severity LoggingSeverity, message string) {
+	l.logf(severity, "%s", message)
+}
+
+func (l logger) logf(severity LoggingSeverity, format string, args ...interface{}) {
+	onLogMessageGlobalRWMutex.RLock()
+	defer onLogMessageGlobalRWMutex.RUnlock()
+	if onLogMessageGlobal == nil || severity < loggingSeverityGlobal {
+		return
+	}
+
+	onLogMessageGlobal(severity, fmt.Sprintf(format, args...), string(l))
+}
+
+func (l logger) Trace(msg string) { l.log(LoggingSeverityVerbose, msg) }
+
+func (l logger) Tracef(format string, args ...interface{}) {
+	l.logf(LoggingSeverityVerbose, format, args...)
+}
+
+func (l logger) Debug(msg string) { l.log(LoggingSeverityVerbose, msg) }
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.logf(LoggingSeverityVerbose, format, args...)
+}
+
+func (l logger) Info(msg string) { l.log(LoggingSeverityInfo, msg) }
+
+func (l logger) Infof(format string, args ...interface{}) {
+	l.logf(LoggingSeverityInfo, format, args...)
+}
+
+func (l logger) Warn(msg string) { l.log(LoggingSeverityWarning, msg) }
+
+func (l logger) Warnf(format string, args ...interface{}) {
+	l.logf(LoggingSeverityWarning, format, args...)
+}
+
+func (l logger) Error(msg string) { l.log(LoggingSeverityError, msg) }
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.logf(LoggingSeverityError, format, args...)
+}
@@ -12,6 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !pion
+// +build !pion
+
 #include <iostream>
 #include <sstream>
 
@@ -124,7 +127,8 @@ class PeerConnectionObserver : public webrtc::PeerConnectionObserver {
                                    // 的同时也会释放 this
     }
 
-    char *Start(char **iceServers, int iceServersLen, uint16_t *minPort, uint16_t *maxPort) {
+    char *Start(char **iceServers, int iceServersLen, char *username, char *password,
+                uint16_t *minPort, uint16_t *maxPort) {
         signalingThread = Thread::Create();
         auto ok = signalingThread->Start();
         if (!ok) {
@@ -141,6 +145,10 @@ class PeerConnectionObserver : public webrtc::PeerConnectionObserver {
             for (int i = 0; i < iceServersLen; i++) {
                 iceServer.urls.push_back(iceServers[i]);
             }
+            if (username != nullptr && password != nullptr) {
+                iceServer.username = username;
+                iceServer.password = password;
+            }
             configuration.servers.push_back(iceServer);
         }
         if (minPort != nullptr && *minPort != 0) {
@@ -328,11 +336,12 @@ class PeerConnectionObserver : public webrtc::PeerConnectionObserver {
 };
 
 char *NewPeerConnection(void **peerConnectionOutside, char **iceServers, int iceServersLen,
-                        uint16_t *minPort, uint16_t *maxPort, void *userData) {
+                        char *username, char *password, uint16_t *minPort, uint16_t *maxPort,
+                        void *userData) {
     auto peerConnectionObserver = make_ref_counted<::PeerConnectionObserver>(userData);
     *peerConnectionOutside = (void *)peerConnectionObserver.release();
     auto err = (*(::PeerConnectionObserver **)peerConnectionOutside)
-                   ->Start(iceServers, iceServersLen, minPort, maxPort);
+                   ->Start(iceServers, iceServersLen, username, password, minPort, maxPort);
     return err;
 }
 
@@ -0,0 +1,297 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pion
+// +build pion
+
+package webrtc
+
+import (
+	"math"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+var sdpType2PionMap = map[string]pion.SDPType{
+	"offer":    pion.SDPTypeOffer,
+	"prAnswer": pion.SDPTypePranswer,
+	"answer":   pion.SDPTypeAnswer,
+	"rollBack": pion.SDPTypeRollback,
+}
+
+var pionSDPType2StringMap = map[pion.SDPType]string{
+	pion.SDPTypeOffer:    "offer",
+	pion.SDPTypePranswer: "prAnswer",
+	pion.SDPTypeAnswer:   "answer",
+	pion.SDPTypeRollback: "rollBack",
+}
+
+// NewPeerConnection 使用 peerConnectionPointer 是为了与 libwebrtc 实现保持相同的接口
+func NewPeerConnection(config *PeerConnectionConfig, peerConnectionPointer **PeerConnection) (err error) {
+	settingEngine := pion.SettingEngine{LoggerFactory: loggerFactory{}}
+	var minPort, maxPort uint16
+	if config.MinPort != nil {
+		minPort = *config.MinPort
+	}
+	if config.MaxPort != nil {
+		maxPort = *config.MaxPort
+	}
+	if minPort != 0 || maxPort != 0 {
+		if maxPort == 0 {
+			maxPort = math.MaxUint16
+		}
+		err = settingEngine.SetEphemeralUDPPortRange(minPort, maxPort)
+		if err != nil {
+			return
+		}
+	}
+
+	var configuration pion.Configuration
+	if len(config.ICEServers) > 0 {
+		configuration.ICEServers = []pion.ICEServer{{
+			URLs:       config.ICEServers,
+			Username:   config.ICEServerUsername,
+			Credential: config.ICEServerPassword,
+		}}
+	}
+	api := pion.NewAPI(pion.WithSettingEngine(settingEngine))
+	peerConnection, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return
+	}
+	p := &PeerConnection{
+		peerConnection: peerConnection,
+		config:         config,
+	}
+	*peerConnectionPointer = p
+	p.setCallbacks()
+	return
+}
+
+// PeerConnection 基于 pion 实现，pion 没有 OnRenegotiationNeeded 与 OnICECandidateError 事件，
+// 这两个回调不会被调用
+type PeerConnection struct {
+	peerConnection *pion.PeerConnection
+
+	config *PeerConnectionConfig
+}
+
+func (p *PeerConnection) setCallbacks() {
+	config := p.config
+	p.peerConnection.OnSignalingStateChange(func(state pion.SignalingState) {
+		if config.OnSignalingChange != nil {
+			config.OnSignalingChange(signalingStateFromPion(state))
+		}
+	})
+	p.peerConnection.OnDataChannel(func(dataChannel *pion.DataChannel) {
+		if config.OnDataChannel != nil {
+			d := DataChannelWithoutCallback{
+				label:       dataChannel.Label(),
+				dataChannel: dataChannel,
+			}
+			if id := dataChannel.ID(); id != nil {
+				d.id = int(*id)
+			}
+			config.OnDataChannel(&d)
+		}
+	})
+	p.peerConnection.OnNegotiationNeeded(func() {
+		if config.OnNegotiationNeeded != nil {
+			config.OnNegotiationNeeded()
+		}
+	})
+	p.peerConnection.OnICEConnectionStateChange(func(state pion.ICEConnectionState) {
+		s := iceConnectionStateFromPion(state)
+		if config.OnICEConnectionChange != nil {
+			config.OnICEConnectionChange(s)
+		}
+		if config.OnStandardizedICEConnectionChange != nil {
+			config.OnStandardizedICEConnectionChange(s)
+		}
+	})
+	p.peerConnection.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		if config.OnConnectionChange != nil {
+			config.OnConnectionChange(peerConnectionStateFromPion(state))
+		}
+	})
+	p.peerConnection.OnICEGatheringStateChange(func(state pion.ICEGatheringState) {
+		if config.OnICEGatheringChange != nil {
+			config.OnICEGatheringChange(iceGatheringStateFromPion(state))
+		}
+	})
+	p.peerConnection.OnICECandidate(func(candidate *pion.ICECandidate) {
+		// 收集完成时 candidate 为 nil，完成事件由 OnICEGatheringChange 通知
+		if candidate == nil || config.OnICECandidate == nil {
+			return
+		}
+		init := candidate.ToJSON()
+		i := ICECandidate{
+			SDP: init.Candidate,
+		}
+		if init.SDPMid != nil {
+			i.SDPMid = *init.SDPMid
+		}
+		if init.SDPMLineIndex != nil {
+			i.SDPMLineIndex = int(*init.SDPMLineIndex)
+		}
+		config.OnICECandidate(&i)
+	})
+}
+
+func signalingStateFromPion(state pion.SignalingState) SignalingState {
+	switch state {
+	case pion.SignalingStateHaveLocalOffer:
+		return SignalingStateHaveLocalOffer
+	case pion.SignalingStateHaveLocalPranswer:
+		return SignalingStateHaveLocalPrAnswer
+	case pion.SignalingStateHaveRemoteOffer:
+		return SignalingStateHaveRemoteOffer
+	case pion.SignalingStateHaveRemotePranswer:
+		return SignalingStateHaveRemotePrAnswer
+	case pion.SignalingStateClosed:
+		return SignalingStateClosed
+	}
+	return SignalingStateStable
+}
+
+func iceGatheringStateFromPion(state pion.ICEGatheringState) ICEGatheringState {
+	switch state {
+	case pion.ICEGatheringStateGathering:
+		return ICEGatheringStateGathering
+	case pion.ICEGatheringStateComplete:
+		return ICEGatheringStateComplete
+	}
+	return ICEGatheringStateNew
+}
+
+func iceConnectionStateFromPion(state pion.ICEConnectionState) ICEConnectionState {
+	switch state {
+	case pion.ICEConnectionStateChecking:
+		return ICEConnectionStateChecking
+	case pion.ICEConnectionStateConnected:
+		return ICEConnectionStateConnected
+	case pion.ICEConnectionStateCompleted:
+		return ICEConnectionStateCompleted
+	case pion.ICEConnectionStateFailed:
+		return ICEConnectionStateFailed
+	case pion.ICEConnectionStateDisconnected:
+		return ICEConnectionStateDisconnected
+	case pion.ICEConnectionStateClosed:
+		return ICEConnectionStateClosed
+	}
+	return ICEConnectionStateNew
+}
+
+func peerConnectionStateFromPion(state pion.PeerConnectionState) PeerConnectionState {
+	switch state {
+	case pion.PeerConnectionStateConnecting:
+		return PeerConnectionStateConnecting
+	case pion.PeerConnectionStateConnected:
+		return PeerConnectionStateConnected
+	case pion.PeerConnectionStateDisconnected:
+		return PeerConnectionStateDisconnected
+	case pion.PeerConnectionStateFailed:
+		return PeerConnectionStateFailed
+	case pion.PeerConnectionStateClosed:
+		return PeerConnectionStateClosed
+	}
+	return PeerConnectionStateNew
+}
+
+func (p *PeerConnection) CreateOffer() (offer *SessionDescription, err error) {
+	description, err := p.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return
+	}
+	offer = &SessionDescription{
+		Type: SDPType.Offer,
+		SDP:  description.SDP,
+	}
+	return
+}
+
+func (p *PeerConnection) CreateAnswer() (answer *SessionDescription, err error) {
+	description, err := p.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return
+	}
+	answer = &SessionDescription{
+		Type: SDPType.Answer,
+		SDP:  description.SDP,
+	}
+	return
+}
+
+func (p *PeerConnection) SetRemoteDescription(description *SessionDescription) (err error) {
+	return p.peerConnection.SetRemoteDescription(pion.SessionDescription{
+		Type: sdpType2PionMap[description.Type],
+		SDP:  description.SDP,
+	})
+}
+
+func (p *PeerConnection) SetLocalDescription(description *SessionDescription) (err error) {
+	return p.peerConnection.SetLocalDescription(pion.SessionDescription{
+		Type: sdpType2PionMap[description.Type],
+		SDP:  description.SDP,
+	})
+}
+
+func (p *PeerConnection) GetRemoteDescription() (description *SessionDescription) {
+	return sessionDescriptionFromPion(p.peerConnection.RemoteDescription())
+}
+
+// GetLocalDescription 返回的 SDP 包含已经收集到的 candidate
+func (p *PeerConnection) GetLocalDescription() (description *SessionDescription) {
+	return sessionDescriptionFromPion(p.peerConnection.LocalDescription())
+}
+
+func sessionDescriptionFromPion(d *pion.SessionDescription) (description *SessionDescription) {
+	description = &SessionDescription{}
+	if d != nil {
+		description.Type = pionSDPType2StringMap[d.Type]
+		description.SDP = d.SDP
+	}
+	return
+}
+
+func (p *PeerConnection) AddICECandidate(candidate *ICECandidate) (err error) {
+	sdpMLineIndex := uint16(candidate.SDPMLineIndex)
+	return p.peerConnection.AddICECandidate(pion.ICECandidateInit{
+		Candidate:     candidate.SDP,
+		SDPMid:        &candidate.SDPMid,
+		SDPMLineIndex: &sdpMLineIndex,
+	})
+}
+
+// CreateDataChannel 使用 dataChannelPointer 是为了与 libwebrtc 实现保持相同的接口
+func (p *PeerConnection) CreateDataChannel(label string, negotiated bool, config *DataChannelConfig, dataChannelPointer **DataChannel) (err error) {
+	dataChannel, err := p.peerConnection.CreateDataChannel(label, &pion.DataChannelInit{
+		Negotiated: &negotiated,
+	})
+	if err != nil {
+		return
+	}
+	channel := newDataChannel(label, config)
+	*dataChannelPointer = channel
+	channel.bind(dataChannel)
+	return
+}
+
+func (p *PeerConnection) Close() {
+	_ = p.peerConnection.Close()
+	// pion 关闭时不会通知 signaling 状态变化，与 libwebrtc 保持一致
+	if p.config.OnSignalingChange != nil {
+		p.config.OnSignalingChange(SignalingStateClosed)
+	}
+}
@@ -62,6 +62,12 @@ func main() {
 		switch sig {
 		case syscall.SIGTERM:
 			return
+		case syscall.SIGHUP:
+			// reload users, tcp ranges and host rules without dropping tunnels
+			err = s.Reload()
+			if err != nil {
+				s.Logger.Error().Err(err).Msg("failed to reload")
+			}
 		case syscall.SIGQUIT:
 			// restart, start a new process and then shutdown gracefully
 			err = shutdownWebServer(webServer)
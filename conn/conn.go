@@ -137,7 +137,14 @@ var (
 	errDifferentConfigClientConnectedBytes = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x07}
 	errReachedMaxOptionsBytes              = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x08}
 	errTCPNumberLimited                    = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x09}
+	errDomainNumberLimitedBytes            = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0A}
+	errDomainNotVerifiedBytes              = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0B}
+	errFailedToOpenUDPPortBytes            = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0C}
+	errUDPNumberLimited                    = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0D}
+	errAuthNotAllowedBytes                 = []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x0E}
 	infoTCPPortOpened                      = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x01}
+	infoUDPPortOpened                      = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x02}
+	infoTURNCredential                     = []byte{0xFF, 0xFF, 0xFF, 0xFB, 0x00, 0x03}
 	ServicesBytes                          = []byte{0xFF, 0xFF, 0xFF, 0xFA}
 )
 
@@ -164,6 +171,16 @@ func (e Error) Error() string {
 		return "reached the max options"
 	case ErrTCPNumberLimited:
 		return "tcp number limited"
+	case ErrDomainNumberLimited:
+		return "domain number limited"
+	case ErrDomainNotVerified:
+		return "domain not verified"
+	case ErrFailedToOpenUDPPort:
+		return "failed to open udp port"
+	case ErrUDPNumberLimited:
+		return "udp number limited"
+	case ErrAuthNotAllowed:
+		return "auth not allowed"
 	}
 	return "unknown error"
 }
@@ -188,6 +205,16 @@ const (
 	ErrReachedMaxOptions
 	// ErrTCPNumberLimited represents tcp number limited
 	ErrTCPNumberLimited
+	// ErrDomainNumberLimited represents domain number limited
+	ErrDomainNumberLimited
+	// ErrDomainNotVerified represents the ownership of a domain is not verified
+	ErrDomainNotVerified
+	// ErrFailedToOpenUDPPort represents failed to open udp port
+	ErrFailedToOpenUDPPort
+	// ErrUDPNumberLimited represents udp number limited
+	ErrUDPNumberLimited
+	// ErrAuthNotAllowed represents the auth of services does not conform to the policy of the server
+	ErrAuthNotAllowed
 )
 
 // Info represents a specific information signal
@@ -197,6 +224,10 @@ const (
 	_ Info = iota
 	// InfoTCPPortOpened represents TCP port opened successfully
 	InfoTCPPortOpened
+	// InfoUDPPortOpened represents UDP port opened successfully
+	InfoUDPPortOpened
+	// InfoTURNCredential carries the TURN credential of the client, followed by [len][username][len][password]
+	InfoTURNCredential
 )
 
 // SendPingSignal sends ping signal to the other side
@@ -267,6 +298,45 @@ func (c *Connection) SendInfoTCPPortOpened(si uint16, tcpPort uint16) (err error
 	return
 }
 
+// SendErrorSignalFailedToOpenUDPPort sends FailedToOpenUDPPort signal to the other side
+func (c *Connection) SendErrorSignalFailedToOpenUDPPort(si uint16) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, errFailedToOpenUDPPortBytes)
+	buf[n] = byte(si >> 8)
+	buf[n+1] = byte(si)
+	_, err = c.Write(buf[:n+2])
+	return
+}
+
+// SendInfoUDPPortOpened sends InfoUDPPortOpened signal to the other side
+func (c *Connection) SendInfoUDPPortOpened(si uint16, udpPort uint16) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, infoUDPPortOpened)
+	buf[n] = byte(si >> 8)
+	buf[n+1] = byte(si)
+	buf[n+2] = byte(udpPort >> 8)
+	buf[n+3] = byte(udpPort)
+	_, err = c.Write(buf[:n+4])
+	return
+}
+
+// SendInfoTURNCredential sends InfoTURNCredential signal to the other side
+func (c *Connection) SendInfoTURNCredential(username string, password string) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, infoTURNCredential)
+	buf[n] = byte(len(username))
+	n++
+	n += copy(buf[n:], username)
+	buf[n] = byte(len(password))
+	n++
+	n += copy(buf[n:], password)
+	_, err = c.Write(buf[:n])
+	return
+}
+
 // SendErrorSignalReachedMaxConnections sends ReachedMaxConnections signal to the other side
 func (c *Connection) SendErrorSignalReachedMaxConnections() (err error) {
 	_, err = c.Write(errReachedTheMaxConnectionsBytes)
@@ -285,6 +355,36 @@ func (c *Connection) SendErrorSignalTCPNumberLimited() (err error) {
 	return
 }
 
+// SendErrorSignalUDPNumberLimited sends UDPNumberLimited signal to the other side
+func (c *Connection) SendErrorSignalUDPNumberLimited() (err error) {
+	_, err = c.Write(errUDPNumberLimited)
+	return
+}
+
+// SendErrorSignalDomainNumberLimited sends DomainNumberLimited signal to the other side
+func (c *Connection) SendErrorSignalDomainNumberLimited() (err error) {
+	_, err = c.Write(errDomainNumberLimitedBytes)
+	return
+}
+
+// SendErrorSignalDomainNotVerified sends DomainNotVerified signal with the domain to the other side
+func (c *Connection) SendErrorSignalDomainNotVerified(domain string) (err error) {
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	n := copy(buf, errDomainNotVerifiedBytes)
+	buf[n] = byte(len(domain))
+	n++
+	n += copy(buf[n:], domain)
+	_, err = c.Write(buf[:n])
+	return
+}
+
+// SendErrorSignalAuthNotAllowed sends AuthNotAllowed signal to the other side
+func (c *Connection) SendErrorSignalAuthNotAllowed() (err error) {
+	_, err = c.Write(errAuthNotAllowedBytes)
+	return
+}
+
 // SendErrorSignalHostConflict sends HostConflict signal to the other side
 func (c *Connection) SendErrorSignalHostConflict() (err error) {
 	_, err = c.Write(errHostConflictBytes)
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"net"
+)
+
+// MaxDatagramSize is the max size of a datagram transferred through tunnels
+const MaxDatagramSize = 65535
+
+// DatagramConn converts a connection that reads and writes a datagram in each call into a byte stream. Each
+// datagram in the stream is prefixed with its length in 2 bytes, so datagrams keep their boundaries in tunnels.
+type DatagramConn struct {
+	net.Conn
+	readBuf  []byte
+	readPos  int
+	writeBuf []byte // 未完整的数据报
+}
+
+// NewDatagramConn returns a DatagramConn of c
+func NewDatagramConn(c net.Conn) *DatagramConn {
+	return &DatagramConn{Conn: c}
+}
+
+// Read reads the framed datagrams
+func (d *DatagramConn) Read(p []byte) (n int, err error) {
+	if d.readPos >= len(d.readBuf) {
+		if d.readBuf == nil {
+			d.readBuf = make([]byte, 2+MaxDatagramSize)
+		}
+		d.readBuf = d.readBuf[:cap(d.readBuf)]
+		var l int
+		l, err = d.Conn.Read(d.readBuf[2:])
+		if err != nil {
+			d.readBuf = d.readBuf[:0]
+			d.readPos = 0
+			return
+		}
+		d.readBuf[0] = byte(l >> 8)
+		d.readBuf[1] = byte(l)
+		d.readBuf = d.readBuf[:2+l]
+		d.readPos = 0
+	}
+	n = copy(p, d.readBuf[d.readPos:])
+	d.readPos += n
+	return
+}
+
+// Write parses the framed datagrams and writes each of them to the underlying connection
+func (d *DatagramConn) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if len(d.writeBuf) > 0 {
+		d.writeBuf = append(d.writeBuf, p...)
+		p = d.writeBuf
+	}
+	for len(p) >= 2 {
+		l := int(p[0])<<8 | int(p[1])
+		if len(p) < 2+l {
+			break
+		}
+		_, err = d.Conn.Write(p[2 : 2+l])
+		if err != nil {
+			return
+		}
+		p = p[2+l:]
+	}
+	// 缓存不完整的数据报，等待后续的数据
+	d.writeBuf = append(d.writeBuf[:0], p...)
+	return
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// packetConn 每次 Read 返回一个数据报，每次 Write 记录一个数据报
+type packetConn struct {
+	net.Conn
+	in  [][]byte
+	out [][]byte
+}
+
+func (p *packetConn) Read(b []byte) (n int, err error) {
+	if len(p.in) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(b, p.in[0])
+	p.in = p.in[1:]
+	return
+}
+
+func (p *packetConn) Write(b []byte) (n int, err error) {
+	p.out = append(p.out, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestDatagramConn(t *testing.T) {
+	datagrams := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 1500)}
+
+	// 读取时每个数据报前面加上长度
+	pc := &packetConn{in: datagrams}
+	stream, err := io.ReadAll(&onlyReader{NewDatagramConn(pc), 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	for _, d := range datagrams {
+		expected = append(expected, byte(len(d)>>8), byte(len(d)))
+		expected = append(expected, d...)
+	}
+	if !bytes.Equal(stream, expected) {
+		t.Fatalf("invalid stream %q", stream)
+	}
+
+	// 以任意的大小写入字节流，数据报保持边界
+	for size := 1; size <= len(stream); size += 97 {
+		pc = &packetConn{}
+		dc := NewDatagramConn(pc)
+		for p := stream; len(p) > 0; {
+			l := size
+			if l > len(p) {
+				l = len(p)
+			}
+			n, err := dc.Write(p[:l])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != l {
+				t.Fatalf("%d bytes written, %d is expected", n, l)
+			}
+			p = p[l:]
+		}
+		if len(pc.out) != len(datagrams) {
+			t.Fatalf("size %d: %d datagrams written, %d is expected", size, len(pc.out), len(datagrams))
+		}
+		for i := range datagrams {
+			if !bytes.Equal(pc.out[i], datagrams[i]) {
+				t.Fatalf("size %d: invalid datagram %d", size, i)
+			}
+		}
+	}
+}
+
+// onlyReader 每次最多读取 size 字节
+type onlyReader struct {
+	r    io.Reader
+	size int
+}
+
+func (o *onlyReader) Read(p []byte) (int, error) {
+	if len(p) > o.size {
+		p = p[:o.size]
+	}
+	return o.r.Read(p)
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+// ErrInvalidProxyHeader is an error returned when the PROXY protocol header is invalid
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// 见 https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLen       = 107
+	proxyV2HeaderLen    = 16
+	proxyV2CmdLocal     = 0x20
+	proxyV2CmdProxy     = 0x21
+	proxyV2FamilyTCPv4  = 0x11
+	proxyV2FamilyTCPv6  = 0x21
+	proxyV2AddrLenTCPv4 = 12
+	proxyV2AddrLenTCPv6 = 36
+)
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header. src and dst are nil when the header
+// does not carry addresses, e.g. 'PROXY UNKNOWN' or the LOCAL command of v2.
+func ReadProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	}
+	err = ErrInvalidProxyHeader
+	return
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = ErrInvalidProxyHeader
+		}
+		return
+	}
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		err = ErrInvalidProxyHeader
+		return
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		err = ErrInvalidProxyHeader
+		return
+	}
+	srcAddr, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+	dstAddr, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return
+	}
+	src, dst = srcAddr, dstAddr
+	return
+}
+
+func parseTCPAddr(host, port string) (addr *net.TCPAddr, err error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		err = ErrInvalidProxyHeader
+		return
+	}
+	addr = &net.TCPAddr{IP: ip, Port: int(p)}
+	return
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header, err := r.Peek(proxyV2HeaderLen)
+	if err != nil {
+		return
+	}
+	cmd := header[12]
+	family := header[13]
+	l := int(binary.BigEndian.Uint16(header[14:16]))
+	_, err = r.Discard(proxyV2HeaderLen)
+	if err != nil {
+		return
+	}
+	if cmd != proxyV2CmdLocal && cmd != proxyV2CmdProxy {
+		err = ErrInvalidProxyHeader
+		return
+	}
+	var ipLen int
+	switch family {
+	case proxyV2FamilyTCPv4:
+		ipLen = net.IPv4len
+	case proxyV2FamilyTCPv6:
+		ipLen = net.IPv6len
+	}
+	if cmd == proxyV2CmdProxy && ipLen > 0 {
+		if l < ipLen*2+4 {
+			err = ErrInvalidProxyHeader
+			return
+		}
+		var addrs []byte
+		addrs, err = r.Peek(ipLen*2 + 4)
+		if err != nil {
+			return
+		}
+		src = &net.TCPAddr{
+			IP:   append(net.IP(nil), addrs[:ipLen]...),
+			Port: int(binary.BigEndian.Uint16(addrs[ipLen*2:])),
+		}
+		dst = &net.TCPAddr{
+			IP:   append(net.IP(nil), addrs[ipLen:ipLen*2]...),
+			Port: int(binary.BigEndian.Uint16(addrs[ipLen*2+2:])),
+		}
+	}
+	// 不支持的协议族与 TLV 被忽略
+	_, err = r.Discard(l)
+	return
+}
+
+// WriteProxyHeaderV2 writes a PROXY protocol v2 header. The LOCAL command is used when src and dst are
+// not TCP addresses of the same family.
+func WriteProxyHeaderV2(w io.Writer, src, dst net.Addr) (err error) {
+	buf := make([]byte, proxyV2HeaderLen, proxyV2HeaderLen+proxyV2AddrLenTCPv6)
+	copy(buf, proxyV2Signature)
+	buf[12] = proxyV2CmdLocal
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if sok && dok {
+		if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+			buf[12] = proxyV2CmdProxy
+			buf[13] = proxyV2FamilyTCPv4
+			buf = append(append(buf, s4...), d4...)
+		} else if s16, d16 := s.IP.To16(), d.IP.To16(); s4 == nil && d4 == nil && s16 != nil && d16 != nil {
+			buf[12] = proxyV2CmdProxy
+			buf[13] = proxyV2FamilyTCPv6
+			buf = append(append(buf, s16...), d16...)
+		}
+	}
+	if buf[12] == proxyV2CmdProxy {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(s.Port))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(d.Port))
+	}
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(buf)-proxyV2HeaderLen))
+	_, err = w.Write(buf)
+	return
+}
+
+// ProxyListener accepts connections that start with a PROXY protocol header.
+type ProxyListener struct {
+	net.Listener
+	timeout time.Duration
+	trusted []netip.Prefix
+}
+
+// NewProxyListener returns a listener whose connections read the PROXY protocol header before the first Read,
+// RemoteAddr or LocalAddr call. timeout limits the time to read the header. Only the connections from peers in
+// trusted read the header, the others are returned as is. All peers are trusted when trusted is empty.
+func NewProxyListener(l net.Listener, timeout time.Duration, trusted []netip.Prefix) *ProxyListener {
+	return &ProxyListener{
+		Listener: l,
+		timeout:  timeout,
+		trusted:  trusted,
+	}
+}
+
+// Accept waits for and returns the next connection, the header is not read here to avoid blocking the caller.
+func (l *ProxyListener) Accept() (c net.Conn, err error) {
+	c, err = l.Listener.Accept()
+	if err != nil {
+		return
+	}
+	if l.isTrusted(c.RemoteAddr()) {
+		c = NewProxyConn(c, l.timeout)
+	}
+	return
+}
+
+// isTrusted 返回是否读取来自 addr 的连接的 PROXY protocol 头部
+func (l *ProxyListener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxyConn returns a connection that reads the PROXY protocol header of c before the first Read, RemoteAddr
+// or LocalAddr call. timeout limits the time to read the header.
+func NewProxyConn(c net.Conn, timeout time.Duration) *ProxyConn {
+	return &ProxyConn{
+		Conn:    c,
+		reader:  bufio.NewReaderSize(c, 256),
+		timeout: timeout,
+	}
+}
+
+// ProxyConn is a connection whose RemoteAddr and LocalAddr come from the PROXY protocol header.
+type ProxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	src     net.Addr
+	dst     net.Addr
+	err     error
+}
+
+func (c *ProxyConn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.src, c.dst, c.err = ReadProxyHeader(c.reader)
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+	return c.err
+}
+
+func (c *ProxyConn) Read(b []byte) (n int, err error) {
+	err = c.readHeader()
+	if err != nil {
+		return
+	}
+	// 头部之后已经被缓存的数据需要先读出
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the source address in the header, or the address of the proxy if there is none.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address in the header, or the local address if there is none.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
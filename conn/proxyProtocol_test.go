@@ -0,0 +1,196 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	cases := []struct {
+		header string
+		src    string
+		dst    string
+		err    error
+	}{
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n", "1.2.3.4:1111", "5.6.7.8:80", nil},
+		{"PROXY TCP6 ::1 2001:db8::1 1111 443\r\n", "[::1]:1111", "[2001:db8::1]:443", nil},
+		{"PROXY UNKNOWN\r\n", "", "", nil},
+		{"PROXY UNKNOWN ::1 ::1 1 2\r\n", "", "", nil},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n", "", "", ErrInvalidProxyHeader},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 70000\r\n", "", "", ErrInvalidProxyHeader},
+		{"PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\n", "", "", ErrInvalidProxyHeader},
+		{"PROXY TCP4 " + strings.Repeat("1", 300) + "\r\n", "", "", ErrInvalidProxyHeader},
+		{"GET / HTTP/1.1\r\n\r\n", "", "", ErrInvalidProxyHeader},
+	}
+	for _, c := range cases {
+		r := bufio.NewReaderSize(strings.NewReader(c.header+"data"), 256)
+		src, dst, err := ReadProxyHeader(r)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%q: unexpected error %v", c.header, err)
+		}
+		if err != nil {
+			continue
+		}
+		if (src == nil) != (c.src == "") || (src != nil && src.String() != c.src) {
+			t.Fatalf("%q: invalid src %v", c.header, src)
+		}
+		if (dst == nil) != (c.dst == "") || (dst != nil && dst.String() != c.dst) {
+			t.Fatalf("%q: invalid dst %v", c.header, dst)
+		}
+		left, _ := io.ReadAll(r)
+		if string(left) != "data" {
+			t.Fatalf("%q: invalid data after header %q", c.header, left)
+		}
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	cases := []struct {
+		src net.Addr
+		dst net.Addr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 80}},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		// 地址族不同或者地址未知时使用 LOCAL 命令
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111}, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443}},
+		{nil, nil},
+	}
+	for i, c := range cases {
+		buf := &bytes.Buffer{}
+		err := WriteProxyHeaderV2(buf, c.src, c.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("data")
+		r := bufio.NewReaderSize(buf, 256)
+		src, dst, err := ReadProxyHeader(r)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if i < 2 {
+			if src.String() != c.src.String() || dst.String() != c.dst.String() {
+				t.Fatalf("%d: invalid addresses %v %v", i, src, dst)
+			}
+		} else if src != nil || dst != nil {
+			t.Fatalf("%d: addresses should be nil: %v %v", i, src, dst)
+		}
+		left, _ := io.ReadAll(r)
+		if string(left) != "data" {
+			t.Fatalf("%d: invalid data after header %q", i, left)
+		}
+	}
+
+	// TLV 被忽略
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, proxyV2CmdProxy, proxyV2FamilyTCPv4, 0, 12+3, 1, 2, 3, 4, 5, 6, 7, 8, 0, 1, 0, 2, 0xEE, 0, 0)
+	r := bufio.NewReaderSize(bytes.NewReader(append(header, "data"...)), 256)
+	src, _, err := ReadProxyHeader(r)
+	if err != nil || src.String() != "1.2.3.4:1" {
+		t.Fatal(src, err)
+	}
+	left, _ := io.ReadAll(r)
+	if string(left) != "data" {
+		t.Fatalf("invalid data after header %q", left)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewProxyListener(l, time.Second, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	defer pl.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nhello"))
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() != "1.2.3.4:1111" || c.LocalAddr().String() != "5.6.7.8:80" {
+		t.Fatalf("invalid addresses %v %v", c.RemoteAddr(), c.LocalAddr())
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("invalid data %q", buf)
+	}
+
+	// 没有头部的连接在超时后读取失败
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	pl.timeout = 100 * time.Millisecond
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Read(buf)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// 不可信的对端的头部不会被读取
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n"))
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	pl.trusted = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.RemoteAddr().String() == "1.2.3.4:1111" {
+		t.Fatal("header from an untrusted peer is used")
+	}
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != "PROXY" {
+		t.Fatalf("unexpected data %q %v", buf, err)
+	}
+}
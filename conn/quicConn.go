@@ -8,65 +8,227 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"github.com/isrc-cas/gt/predef"
 	"github.com/quic-go/quic-go"
 	"math/big"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const probePacketLostTimeOutMs = 5
+const (
+	probePacketLostTimeOutMs = 5
+	quicHandshakeIdleTimeout = 5 * time.Second
+)
 
+// QuicConnection 是 QUIC connection 上的一个 stream，多个 QuicConnection 可以共享同一个 connection
 type QuicConnection struct {
 	quic.Connection
 	quic.Stream
+	shared bool
 }
 
+// QuicListener 接受 QUIC connection 上的每一个 stream 作为一个隧道连接
 type QuicListener struct {
-	quic.Listener
+	*quic.Listener
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan *QuicConnection
+	done    chan struct{}
+	err     error
 }
 
 var _ net.Conn = &QuicConnection{}
 var _ net.Listener = &QuicListener{}
 
+func newQuicConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:      true,
+		HandshakeIdleTimeout: quicHandshakeIdleTimeout,
+	}
+}
+
+// QuicDial 建立一个独占的 QUIC connection，关闭 stream 时 connection 也会被关闭
 func QuicDial(addr string, config *tls.Config) (net.Conn, error) {
+	return QuicDialContext(context.Background(), addr, config)
+}
+
+// QuicDialContext is like QuicDial but aborts the handshake when ctx is done.
+func QuicDialContext(ctx context.Context, addr string, config *tls.Config) (nc net.Conn, err error) {
 	config.NextProtos = []string{"gt-quic"}
-	conn, err := quic.DialAddr(context.Background(), addr, config, &quic.Config{EnableDatagrams: true})
+	conn, err := quic.DialAddr(ctx, addr, config, newQuicConfig())
 	if err != nil {
-		panic(err)
+		return
 	}
-	stream, err := conn.OpenStreamSync(context.Background())
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
-		panic(err)
+		_ = conn.CloseWithError(0, "")
+		return
 	}
-	nc := &QuicConnection{
+	nc = &QuicConnection{
 		Connection: conn,
 		Stream:     stream,
 	}
-	return nc, err
+	return
 }
 
-func QuicListen(addr string, config *tls.Config) (net.Listener, error) {
+// QuicDialer 在同一个 QUIC connection 上为每个隧道打开独立的 stream，
+// 所有隧道共享一次握手和一个拥塞控制器，connection 失效后重新建立
+type QuicDialer struct {
+	addr   string
+	config *tls.Config
+	mtx    sync.Mutex
+	conn   quic.Connection
+}
+
+// NewQuicDialer returns a dialer that multiplexes the tunnels to addr over one QUIC connection.
+func NewQuicDialer(addr string, config *tls.Config) *QuicDialer {
 	config.NextProtos = []string{"gt-quic"}
-	listener, err := quic.ListenAddr(addr, config, &quic.Config{EnableDatagrams: true})
+	return &QuicDialer{
+		addr:   addr,
+		config: config,
+	}
+}
+
+// Dial opens a new stream on the shared QUIC connection.
+func (d *QuicDialer) Dial() (net.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext is like Dial but aborts the handshake and the stream opening when ctx is done.
+func (d *QuicDialer) DialContext(ctx context.Context) (nc net.Conn, err error) {
+	conn, err := d.connection(ctx)
 	if err != nil {
-		panic(err)
+		return
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			// connection 已经不可用，下次 Dial 时重新建立
+			d.reset(conn)
+		}
+		return
+	}
+	nc = &QuicConnection{
+		Connection: conn,
+		Stream:     stream,
+		shared:     true,
+	}
+	return
+}
+
+func (d *QuicDialer) connection(ctx context.Context) (conn quic.Connection, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.conn != nil {
+		select {
+		case <-d.conn.Context().Done():
+			d.conn = nil
+		default:
+			conn = d.conn
+			return
+		}
+	}
+	conn, err = quic.DialAddr(ctx, d.addr, d.config, newQuicConfig())
+	if err != nil {
+		return
 	}
-	ln := &QuicListener{
-		Listener: *listener,
+	d.conn = conn
+	return
+}
+
+func (d *QuicDialer) reset(conn quic.Connection) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.conn == conn {
+		d.conn = nil
+	}
+	_ = conn.CloseWithError(0, "")
+}
+
+// Close 关闭 stream 的读写两个方向，共享的 connection 由其余的 stream 继续使用
+func (c *QuicConnection) Close() (err error) {
+	c.Stream.CancelRead(0)
+	err = c.Stream.Close()
+	if !c.shared {
+		_ = c.Connection.CloseWithError(0, "")
+	}
+	return
+}
+
+func QuicListen(addr string, config *tls.Config) (ln net.Listener, err error) {
+	config.NextProtos = []string{"gt-quic"}
+	listener, err := quic.ListenAddr(addr, config, newQuicConfig())
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &QuicListener{
+		Listener: listener,
+		ctx:      ctx,
+		cancel:   cancel,
+		streams:  make(chan *QuicConnection),
+		done:     make(chan struct{}),
 	}
-	return ln, err
+	go l.acceptLoop()
+	ln = l
+	return
 }
 
+func (ln *QuicListener) acceptLoop() {
+	defer close(ln.done)
+	for {
+		conn, err := ln.Listener.Accept(ln.ctx)
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || ln.ctx.Err() != nil {
+				err = net.ErrClosed
+			}
+			ln.err = err
+			return
+		}
+		go ln.acceptStreams(conn)
+	}
+}
+
+// acceptStreams 接受同一个 connection 上的所有 stream，没有打开 stream 的 connection 由空闲超时关闭
+func (ln *QuicListener) acceptStreams(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(ln.ctx)
+		if err != nil {
+			return
+		}
+		nc := &QuicConnection{
+			Connection: conn,
+			Stream:     stream,
+			shared:     true,
+		}
+		select {
+		case ln.streams <- nc:
+		case <-ln.done:
+			_ = nc.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for the next stream. It returns net.ErrClosed after the listener is closed.
 func (ln *QuicListener) Accept() (net.Conn, error) {
-	conn, _ := ln.Listener.Accept(context.Background())
-	stream, err := conn.AcceptStream(context.Background())
-	nc := &QuicConnection{
-		Connection: conn,
-		Stream:     stream,
+	select {
+	case nc := <-ln.streams:
+		return nc, nil
+	case <-ln.done:
+		return nil, ln.err
 	}
-	return nc, err
+}
+
+// Close stops accepting new connections and streams, the accepted streams are not affected.
+func (ln *QuicListener) Close() (err error) {
+	ln.cancel()
+	err = ln.Listener.Close()
+	<-ln.done
+	return
 }
 
 func GenerateTLSConfig() *tls.Config {
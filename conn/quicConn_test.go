@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuicDialerSharesConnection(t *testing.T) {
+	ln, err := QuicListen("127.0.0.1:0", GenerateTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	d := NewQuicDialer(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	for i, c := range conns {
+		if c.(*QuicConnection).Connection != conns[0].(*QuicConnection).Connection {
+			t.Fatal("streams should share the same connection")
+		}
+		msg := []byte{'a' + byte(i)}
+		_, err = c.Write(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(c, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != msg[0] {
+			t.Fatalf("stream %d got %q", i, buf)
+		}
+	}
+
+	// 关闭一个 stream 不影响其他 stream
+	err = conns[0].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conns[1].Write([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conns[1], buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuicDialUnreachable(t *testing.T) {
+	// 未监听的端口与只接收数据不回复的半开对端都应该在超时后返回错误
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := pc.LocalAddr().String()
+	err = pc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfOpen, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer halfOpen.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := halfOpen.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, addr := range []string{closedAddr, halfOpen.LocalAddr().String()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err = QuicDialContext(ctx, addr, &tls.Config{InsecureSkipVerify: true})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("dial %s: unexpected error %v", addr, err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		d := NewQuicDialer(addr, &tls.Config{InsecureSkipVerify: true})
+		_, err = d.DialContext(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("dial %s: unexpected error %v", addr, err)
+		}
+	}
+}
+
+func TestQuicListenerClose(t *testing.T) {
+	ln, err := QuicListen("127.0.0.1:0", GenerateTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = QuicListen(ln.Addr().String(), GenerateTLSConfig())
+	if err == nil {
+		t.Fatal("listen on an address in use should fail")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		result <- err
+	}()
+	err = ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-result:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept is not interrupted by Close")
+	}
+	_, err = ln.Accept()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestQuicDialerRedial(t *testing.T) {
+	ln, err := QuicListen("127.0.0.1:0", GenerateTLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	d := NewQuicDialer(ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c1, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	// quic-go 在 stream 上有数据时才通知对端
+	_, err = c1.Write([]byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := <-accepted
+	err = s1.(*QuicConnection).CloseWithError(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c1.(*QuicConnection).Connection.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed by peer")
+	}
+
+	c2, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if c2.(*QuicConnection).Connection == c1.(*QuicConnection).Connection {
+		t.Fatal("closed connection should not be reused")
+	}
+	_, err = c2.Write([]byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("stream is not accepted")
+	}
+}
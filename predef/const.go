@@ -46,8 +46,14 @@ const (
 	MinHostPrefixSize = MinIDSize
 	// MaxHostPrefixSize 表示 host 前缀长度的最大值
 	MaxHostPrefixSize = MaxIDSize
+	// MaxACLEntries 表示每个服务的 allow 或 deny 列表中 IP 与 CIDR 数量的最大值
+	MaxACLEntries = 16
+	// MaxAuthEntries 表示每个服务的 basic 认证用户、bearer token 与 OIDC email 数量的最大值
+	MaxAuthEntries = 8
 	// MaxHTTPHeaderSize max ending of host in http headers
 	MaxHTTPHeaderSize = 2 * 1024
+	// TunnelALPN 是出示客户端证书的 tls 隧道使用的 ALPN 协议，服务端只对其请求客户端证书
+	TunnelALPN = "gt-tunnel"
 )
 
 // OP is the type of operations
@@ -60,6 +66,13 @@ const (
 	Close
 	// ServicesData is a multiple service data
 	ServicesData
+	// RemoteAddr carries the addresses and the protocol of the visitor connection before the first ServicesData of a task
+	RemoteAddr
+	// Window carries [n uint32] before the first ServicesData of a task, the client sends at most n bytes of Data of the
+	// task until the server updates the window
+	Window
+	// WindowUpdate carries [n uint32], the server has written n bytes of Data of the task and the client can send n more
+	WindowUpdate
 )
 
 // 通信协议的 option
@@ -74,11 +87,51 @@ var (
 	OpenHost            = []byte{3}
 	IDAsTLSHostPrefix   = []byte{4}
 	OpenTLSHost         = []byte{5}
+	SendRemoteAddr      = []byte{6}
+	// BindDomain 后跟 [len][domain]，将完整的域名绑定到下一个服务
+	BindDomain    = []byte{7}
+	BindTLSDomain = []byte{8}
+	// OpenUDPPort 后跟 [random][port]，与 OpenTCPPort 相同
+	OpenUDPPort = []byte{9}
+	// JoinGroup 后跟 [weight]，下一个服务的 host 前缀或 tcp 端口与其他客户端的相同服务组成一个组
+	JoinGroup = []byte{10}
+	// SetACL 后跟 [allow 数量][allow...][deny 数量][deny...]，每一项为 [ip 长度][ip][前缀长度]，
+	// 访问者 IP 的访问控制列表只作用于下一个服务
+	SetACL = []byte{11}
+	// SetAuth 后跟 [basic 数量][len][user:bcrypt]...[bearer 数量][sha256]...[oidc]，oidc 为 1 时后跟
+	// [len][issuer][len][client id][len][client secret][email 数量][len][email]...，认证只作用于下一个服务
+	SetAuth = []byte{12}
+	// FlowControl 客户端支持 Window 与 WindowUpdate，服务端限速的任务只在窗口内发送数据
+	FlowControl = []byte{13}
 )
 
 // MagicNumber 常量数字，见 https://en.wikipedia.org/wiki/Magic_number_(programming)
 const MagicNumber byte = 0xF0
 
+// 隧道握手的版本，紧随 MagicNumber 之后
+const (
+	// LegacyHandshake 后跟 [len][id][len][secret][选项]，secret 以明文传输
+	LegacyHandshake byte = 0x01
+	// SecureHandshake 后跟 [len][id]，服务端回复 [mode][nonce]，客户端再发送
+	// [len][凭证][选项长度 uint16][选项]，凭证由 mode 决定
+	SecureHandshake byte = 0x03
+)
+
+// SecureHandshake 中服务端要求的凭证
+const (
+	// HandshakeHMAC 凭证是以 secret 为密钥对 nonce、id 与选项摘要计算的 HMAC-SHA256
+	HandshakeHMAC byte = iota
+	// HandshakeSecret 凭证是明文 secret，服务端只保存了哈希后的 secret 或者使用 API 认证时使用
+	HandshakeSecret
+	// HandshakeCert 凭证为空，隧道由客户端证书认证
+	HandshakeCert
+	// HandshakeDigest 凭证是以 secret 为密钥对 id 计算的 HMAC-SHA256，服务端接受任意客户端时代替 secret 保存
+	HandshakeDigest
+)
+
+// HandshakeNonceSize 是 SecureHandshake 中 nonce 的长度
+const HandshakeNonceSize = 32
+
 var (
 	defaultClientConfigPath string
 	defaultClientLogPath    string
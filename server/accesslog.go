@@ -0,0 +1,287 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/logger/file-rotatelogs"
+	"github.com/isrc-cas/gt/util"
+	"github.com/rs/zerolog"
+)
+
+// accessRecord 记录一个 HTTP 请求与响应的访问日志
+type accessRecord struct {
+	start  time.Time
+	method []byte
+	path   []byte
+	head   bool          // HEAD 请求的响应没有 body
+	up     atomic.Uint64 // 从 client 发往访问者的数据
+	down   atomic.Uint64 // 从访问者发往 client 的数据
+	status atomic.Uint32
+}
+
+// newAccessRecord 从请求的头部中解析请求行
+func newAccessRecord(head []byte, privacy bool) (r *accessRecord) {
+	r = &accessRecord{start: time.Now()}
+	method, target, _, err := util.HTTPRequestLine(head)
+	if err != nil {
+		return
+	}
+	r.method = append([]byte(nil), method...)
+	r.head = string(method) == "HEAD"
+	if !privacy {
+		// query 中可能包含敏感信息，不记录
+		path, _, _ := bytes.Cut(target, []byte{'?'})
+		r.path = append([]byte(nil), path...)
+	}
+	return
+}
+
+func (r *accessRecord) addUp(n int) {
+	if r != nil && n > 0 {
+		r.up.Add(uint64(n))
+	}
+}
+
+func (r *accessRecord) addDown(n int) {
+	if r != nil && n > 0 {
+		r.down.Add(uint64(n))
+	}
+}
+
+// accessExchanges 解析一个 HTTP 访问者连接上的请求与响应，每个响应结束时记录一条访问日志
+type accessExchanges struct {
+	privacy bool
+	send    func(r *accessRecord, err error)
+
+	// 以下字段只在转发请求的 goroutine 中使用
+	req     util.HTTPParser
+	reqRaw  bool // 协议升级或者无法解析之后不再解析请求
+	sending *accessRecord
+
+	// 以下字段只在 uploadLoop 中使用
+	resp      util.HTTPParser
+	respRaw   bool
+	answering *accessRecord
+
+	mtx     sync.Mutex
+	pending []*accessRecord // 还没有响应完的请求，按请求的顺序排列
+	sent    bool
+}
+
+func newAccessExchanges(privacy bool, send func(r *accessRecord, err error)) *accessExchanges {
+	return &accessExchanges{privacy: privacy, send: send}
+}
+
+// request 解析访问者发往 client 的数据，新的请求头部完整时创建访问记录
+func (e *accessExchanges) request(p []byte) {
+	if e == nil {
+		return
+	}
+	for len(p) > 0 && !e.reqRaw {
+		var n int
+		var done bool
+		var err error
+		if e.req.ReadingHead() {
+			n, done, err = e.req.ReadHead(p)
+			if err != nil {
+				// 已缓存的头部也属于无法解析的数据
+				e.rawRequest()
+				e.sending.addDown(len(e.req.Head) - len(p))
+				break
+			}
+			if done {
+				e.sending = newAccessRecord(e.req.Head, e.privacy)
+				e.sending.addDown(len(e.req.Head))
+				e.mtx.Lock()
+				e.pending = append(e.pending, e.sending)
+				e.mtx.Unlock()
+				e.reqRaw, done, err = e.req.SetRequestBody()
+			}
+		} else {
+			n, done, err = e.req.ReadBody(p)
+			e.sending.addDown(n)
+		}
+		p = p[n:]
+		if err != nil {
+			e.rawRequest()
+			break
+		}
+		if done {
+			e.req.Reset()
+		}
+	}
+	if e.reqRaw {
+		e.sending.addDown(len(p))
+	}
+}
+
+// rawRequest 无法解析请求时，之后的数据都属于当前请求
+func (e *accessExchanges) rawRequest() {
+	e.reqRaw = true
+	if e.sending == nil {
+		e.sending = newAccessRecord(nil, e.privacy)
+		e.mtx.Lock()
+		e.pending = append(e.pending, e.sending)
+		e.mtx.Unlock()
+	}
+}
+
+// response 解析 client 发往访问者的数据，响应结束时记录对应请求的访问日志
+func (e *accessExchanges) response(p []byte) {
+	if e == nil {
+		return
+	}
+	for len(p) > 0 && !e.respRaw {
+		if e.answering == nil {
+			e.mtx.Lock()
+			if len(e.pending) > 0 {
+				e.answering = e.pending[0]
+			}
+			e.mtx.Unlock()
+			if e.answering == nil {
+				// 没有对应的请求，无法解析
+				e.respRaw = true
+				break
+			}
+			e.resp.Reset()
+		}
+		var n int
+		var done bool
+		var err error
+		if e.resp.ReadingHead() {
+			n, done, err = e.resp.ReadHead(p)
+			if err != nil {
+				e.respRaw = true
+				break
+			}
+			e.answering.addUp(n)
+			if done {
+				var status int
+				status, done, err = e.resp.SetResponseBody(e.answering.head)
+				if err == nil {
+					e.answering.status.Store(uint32(status))
+					switch {
+					case status == 101 || string(e.answering.method) == "CONNECT" && status < 300 && status >= 200:
+						e.respRaw = true
+					case status < 200:
+						// 1xx 之后还有同一个请求的最终响应
+						e.resp.Reset()
+					}
+				}
+			}
+		} else {
+			n, done, err = e.resp.ReadBody(p)
+			e.answering.addUp(n)
+		}
+		p = p[n:]
+		if err != nil {
+			e.respRaw = true
+			break
+		}
+		if done {
+			// 连接结束时 finish 可能已经记录了这个请求
+			e.mtx.Lock()
+			ok := len(e.pending) > 0 && e.pending[0] == e.answering
+			if ok {
+				e.pending = e.pending[1:]
+				e.sent = true
+			}
+			e.mtx.Unlock()
+			if ok {
+				e.send(e.answering, nil)
+			}
+			e.answering = nil
+		}
+	}
+	if e.respRaw {
+		e.answering.addUp(len(p))
+	}
+}
+
+// finish 在访问者连接结束时记录还没有响应完的请求的访问日志
+func (e *accessExchanges) finish(err error) {
+	if e == nil {
+		return
+	}
+	e.mtx.Lock()
+	pending := e.pending
+	e.pending = nil
+	sent := e.sent
+	e.sent = true
+	e.mtx.Unlock()
+	if len(pending) == 0 && !sent && err != nil {
+		pending = append(pending, newAccessRecord(nil, e.privacy))
+	}
+	for _, r := range pending {
+		e.send(r, err)
+	}
+}
+
+type accessLogger struct {
+	zerolog.Logger
+	out *rotatelogs.RotateLogs
+}
+
+func (s *Server) startAccessLog() (err error) {
+	out, err := rotatelogs.New(
+		s.config.AccessLogFile+".%Y%m%d",
+		rotatelogs.WithRotationCount(s.config.AccessLogFileMaxCount),
+		rotatelogs.WithRotationSize(s.config.AccessLogFileMaxSize),
+		rotatelogs.WithLinkName(s.config.AccessLogFile),
+	)
+	if err != nil {
+		return
+	}
+	s.accessLog = &accessLogger{
+		Logger: zerolog.New(out).With().Timestamp().Logger(),
+		out:    out,
+	}
+	return
+}
+
+func (s *Server) stopAccessLog() (err error) {
+	if s.accessLog == nil {
+		return
+	}
+	err = s.accessLog.out.Sync()
+	if err != nil {
+		return
+	}
+	return s.accessLog.out.Close()
+}
+
+func (s *Server) logAccess(task *conn, clientID string, r *accessRecord, err error) {
+	remoteIP, _, _ := net.SplitHostPort(task.RemoteAddr().String())
+	event := s.accessLog.Log().
+		Bytes("method", r.method)
+	if !s.config.AccessLogPrivacy {
+		event.Bytes("path", r.path)
+	}
+	event.Str("hostPrefix", task.hostPrefix).
+		Str("client", clientID).
+		Str("remoteIP", remoteIP).
+		Uint32("status", r.status.Load()).
+		Uint64("up", r.up.Load()).
+		Uint64("down", r.down.Load()).
+		Dur("duration", time.Since(r.start)).
+		Err(err).
+		Send()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAccessRecord(t *testing.T) {
+	head := []byte("GET /a/b?token=secret HTTP/1.1\r\nHost: id1.example.com\r\n\r\n")
+	r := newAccessRecord(head, false)
+	if string(r.method) != "GET" || string(r.path) != "/a/b" {
+		t.Fatalf("invalid record %q %q", r.method, r.path)
+	}
+	r = newAccessRecord(head, true)
+	if string(r.method) != "GET" || r.path != nil {
+		t.Fatalf("path should be omitted in privacy mode: %q", r.path)
+	}
+	r = newAccessRecord([]byte("not a http request"), false)
+	if r.method != nil || r.path != nil {
+		t.Fatalf("invalid record %q %q", r.method, r.path)
+	}
+
+	var nilRecord *accessRecord
+	nilRecord.addUp(1)
+	nilRecord.addDown(1)
+	var nilExchanges *accessExchanges
+	nilExchanges.request([]byte("GET / HTTP/1.1\r\n\r\n"))
+	nilExchanges.response([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+	nilExchanges.finish(nil)
+}
+
+type sentRecord struct {
+	method string
+	path   string
+	status uint32
+	up     uint64
+	down   uint64
+	err    error
+}
+
+func testExchanges(t *testing.T, reqs, resps []string, err error, expected []sentRecord) {
+	t.Helper()
+	var sent []sentRecord
+	e := newAccessExchanges(false, func(r *accessRecord, err error) {
+		sent = append(sent, sentRecord{string(r.method), string(r.path), r.status.Load(), r.up.Load(), r.down.Load(), err})
+	})
+	for _, req := range reqs {
+		e.request([]byte(req))
+	}
+	for _, resp := range resps {
+		e.response([]byte(resp))
+	}
+	e.finish(err)
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("unexpected records %+v, %+v is expected", sent, expected)
+	}
+}
+
+func TestAccessExchanges(t *testing.T) {
+	get := "GET /a?x=1 HTTP/1.1\r\nHost: a\r\n\r\n"
+	post := "POST /b HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"
+	head := "HEAD /c HTTP/1.1\r\nHost: a\r\n\r\n"
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	created := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"
+	headResp := "HTTP/1.1 404 Not Found\r\nContent-Length: 9\r\n\r\n"
+	testErr := errors.New("test")
+
+	// 同一个连接上的每个请求都记录一条日志，数据跨越请求的边界
+	all := get + post + head
+	testExchanges(t, []string{all[:10], all[10:60], all[60:]}, []string{ok + created[:30], created[30:] + headResp}, nil, []sentRecord{
+		{"GET", "/a", 200, uint64(len(ok)), uint64(len(get)), nil},
+		{"POST", "/b", 201, uint64(len(created)), uint64(len(post)), nil},
+		{"HEAD", "/c", 404, uint64(len(headResp)), uint64(len(head)), nil},
+	})
+
+	// 没有响应完的请求在连接结束时带着错误记录
+	testExchanges(t, []string{get + get}, []string{ok, "HTTP/1.1 200 OK\r\n"}, testErr, []sentRecord{
+		{"GET", "/a", 200, uint64(len(ok)), uint64(len(get)), nil},
+		{"GET", "/a", 0, 17, uint64(len(get)), testErr},
+	})
+
+	// 协议升级之后的数据都属于升级的请求
+	upgrade := "GET /ws HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	switching := "HTTP/1.1 101 Switching Protocols\r\n\r\n"
+	testExchanges(t, []string{upgrade, "frames"}, []string{switching, "frames"}, testErr, []sentRecord{
+		{"GET", "/ws", 101, uint64(len(switching) + 6), uint64(len(upgrade) + 6), testErr},
+	})
+
+	// 无法解析的请求
+	testExchanges(t, []string{"\x16\x03\x01\r\n\r\n"}, nil, testErr, []sentRecord{
+		{"", "", 0, 0, 7, testErr},
+	})
+
+	// 没有任何数据
+	testExchanges(t, nil, nil, testErr, []sentRecord{
+		{"", "", 0, 0, 0, testErr},
+	})
+	testExchanges(t, nil, nil, nil, nil)
+}
+
+func TestAccessLog(t *testing.T) {
+	for _, privacy := range []bool{false, true} {
+		accessLogFile := filepath.Join(t.TempDir(), "access.log")
+		args := []string{"server", "-accessLogFile", accessLogFile}
+		if privacy {
+			args = append(args, "-accessLogPrivacy")
+		}
+		s, err := New(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.startAccessLog()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		local, remote := net.Pipe()
+		task := newConn(local, s)
+		task.hostPrefix = "id1"
+		task.access = newAccessExchanges(s.config.AccessLogPrivacy, func(r *accessRecord, err error) {
+			s.logAccess(task, "client1", r, err)
+		})
+		task.access.request([]byte("POST /upload HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n"))
+		task.access.response([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"))
+		task.access.finish(errors.New("test"))
+		_ = remote.Close()
+		err = s.stopAccessLog()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := os.ReadFile(accessLogFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("invalid access log: %q", content)
+		}
+		expected := []map[string]interface{}{
+			{
+				"method":     "POST",
+				"hostPrefix": "id1",
+				"client":     "client1",
+				"remoteIP":   "",
+				"status":     201.0,
+				"up":         43.0,
+				"down":       25.0,
+			},
+			{
+				"method": "GET",
+				"status": 0.0,
+				"up":     0.0,
+				"down":   18.0,
+				"error":  "test",
+			},
+		}
+		for i, line := range lines {
+			var record map[string]interface{}
+			err = json.Unmarshal([]byte(line), &record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range expected[i] {
+				if record[k] != v {
+					t.Fatalf("invalid %s: %v", k, record[k])
+				}
+			}
+			if _, ok := record["error"]; ok != (i == 1) {
+				t.Fatalf("invalid error: %v", record["error"])
+			}
+			if _, ok := record["path"]; ok == privacy {
+				t.Fatalf("invalid path: %v, privacy: %v", record["path"], privacy)
+			}
+			if _, ok := record["duration"]; !ok {
+				t.Fatal("duration is missing")
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+// ErrInvalidACL is an error returned when the acl in the handshake is invalid
+var ErrInvalidACL = errors.New("invalid acl")
+
+// forbiddenResponse 拒绝 HTTP 访问者时返回的响应
+var forbiddenResponse = []byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+// aclConfig 配置文件中的访问控制列表，元素为 IP 或 CIDR
+type aclConfig struct {
+	Allow []string `yaml:"allow,omitempty" json:",omitempty"`
+	Deny  []string `yaml:"deny,omitempty" json:",omitempty"`
+}
+
+// acl 访问者 IP 的访问控制列表，deny 优先于 allow，allow 为空时允许不在 deny 中的所有 IP。
+// nil 表示没有限制
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newACL 解析访问控制列表，allow 与 deny 都为空时返回 nil
+func newACL(allow, deny []string) (a *acl, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return
+	}
+	a = &acl{}
+	a.allow, err = parseIPPrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	a.deny, err = parseIPPrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func parseIPPrefixes(ss []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range ss {
+		var prefix netip.Prefix
+		prefix, err = util.ParseIPPrefix(s)
+		if err != nil {
+			err = fmt.Errorf("invalid ip or cidr '%s': %w", s, err)
+			return
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return
+}
+
+// newUserACLs 解析用户的访问控制列表，key 与 SpeedLimits 相同
+func newUserACLs(configs map[string]aclConfig) (acls map[string]*acl, err error) {
+	for key, config := range configs {
+		var a *acl
+		a, err = newACL(config.Allow, config.Deny)
+		if err != nil {
+			err = fmt.Errorf("acl of '%s': %w", key, err)
+			return
+		}
+		if a == nil {
+			continue
+		}
+		if acls == nil {
+			acls = make(map[string]*acl)
+		}
+		acls[key] = a
+	}
+	return
+}
+
+// allowed 判断 ip 是否被允许访问，无效的 ip 只能通过没有 allow 的列表
+func (a *acl) allowed(ip netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	for _, prefix := range a.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *acl) String() string {
+	var sb strings.Builder
+	sb.WriteString("allow:")
+	for i, prefix := range a.allow {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(prefix.String())
+	}
+	sb.WriteString(" deny:")
+	for i, prefix := range a.deny {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(prefix.String())
+	}
+	return sb.String()
+}
+
+// readACL 读取握手中 predef.SetACL 之后的访问控制列表
+func readACL(reader *bufio.Reader) (a *acl, err error) {
+	a = &acl{}
+	a.allow, err = readIPPrefixes(reader)
+	if err != nil {
+		return nil, err
+	}
+	a.deny, err = readIPPrefixes(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return nil, ErrInvalidACL
+	}
+	return
+}
+
+func readIPPrefixes(reader *bufio.Reader) (prefixes []netip.Prefix, err error) {
+	n, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if n > predef.MaxACLEntries {
+		err = ErrInvalidACL
+		return
+	}
+	for i := byte(0); i < n; i++ {
+		var ipLen byte
+		ipLen, err = reader.ReadByte()
+		if err != nil {
+			return
+		}
+		if ipLen != 4 && ipLen != 16 {
+			err = ErrInvalidACL
+			return
+		}
+		var b []byte
+		b, err = reader.Peek(int(ipLen) + 1)
+		if err != nil {
+			return
+		}
+		ip, _ := netip.AddrFromSlice(b[:ipLen])
+		prefix, e := ip.Prefix(int(b[ipLen]))
+		if e != nil {
+			err = ErrInvalidACL
+			return
+		}
+		_, err = reader.Discard(int(ipLen) + 1)
+		if err != nil {
+			return
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return
+}
+
+// visitorIP 返回访问者的 IP，无法解析时返回无效的 netip.Addr
+func visitorIP(addr net.Addr) (ip netip.Addr) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = a.AddrPort().Addr()
+	default:
+		if addr == nil {
+			return
+		}
+		addrPort, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return
+		}
+		ip = addrPort.Addr()
+	}
+	return ip.Unmap()
+}
+
+// allowVisitor 依次检查全局、用户、host 前缀、tcp 或 udp 端口与服务的访问控制列表，
+// 访问者被拒绝时记录日志与指标
+func (c *conn) allowVisitor(target clientWithServiceIndex) bool {
+	ip := visitorIP(c.RemoteAddr())
+	if c.server.acl.Load().allowed(ip) && target.allowed(ip, c.hostPrefix) {
+		return true
+	}
+	c.Logger.Warn().
+		Str("visitor", ip.String()).
+		Str("client", target.client.id).
+		Str("prefix", c.hostPrefix).
+		Msg("visitor denied by acl")
+	c.server.metrics.deny(target.client.id, c.hostPrefix)
+	return false
+}
+
+// allowed 检查用户、host 前缀或 tcp 端口与服务的访问控制列表
+func (c *client) allowed(ip netip.Addr, hostPrefix string, serviceIndex uint16) bool {
+	c.aclsMtx.RLock()
+	defer c.aclsMtx.RUnlock()
+	return c.acl.allowed(ip) && c.prefixACLs[hostPrefix].allowed(ip) && c.serviceACLs[serviceIndex].allowed(ip)
+}
+
+// updateACLs 更新用户的访问控制列表，正在进行的任务不受影响
+func (c *client) updateACLs(u user) {
+	c.aclsMtx.Lock()
+	c.acl = u.acl
+	c.prefixACLs = u.acls
+	c.aclsMtx.Unlock()
+}
+
+// setServiceACLs 设置客户端在握手中为各个服务指定的访问控制列表
+func (c *client) setServiceACLs(acls map[uint16]*acl) {
+	c.aclsMtx.Lock()
+	c.serviceACLs = acls
+	c.aclsMtx.Unlock()
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/isrc-cas/gt/bufio"
+)
+
+func TestACL(t *testing.T) {
+	var nilACL *acl
+	if !nilACL.allowed(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("nil acl should allow all ips")
+	}
+	if a, err := newACL(nil, nil); a != nil || err != nil {
+		t.Fatal("empty acl should be nil")
+	}
+	if _, err := newACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Fatal("invalid cidr should fail")
+	}
+
+	a, err := newACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false, // deny 优先于 allow
+		"192.168.1.1": false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	}
+	for ip, expected := range cases {
+		if a.allowed(netip.MustParseAddr(ip)) != expected {
+			t.Fatalf("%s: expected %t", ip, expected)
+		}
+	}
+	if a.allowed(netip.Addr{}) {
+		t.Fatal("invalid ip should not pass an allow list")
+	}
+	deny, _ := newACL(nil, []string{"10.0.0.0/8"})
+	if !deny.allowed(netip.Addr{}) || !deny.allowed(netip.MustParseAddr("192.168.1.1")) || deny.allowed(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("unexpected result of deny list")
+	}
+
+	ip := visitorIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80})
+	if ip != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("unexpected visitor ip %s", ip)
+	}
+}
+
+func TestReadACL(t *testing.T) {
+	data := []byte{
+		2,
+		4, 10, 0, 0, 0, 8,
+		16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 32,
+		1,
+		4, 10, 0, 0, 1, 32,
+	}
+	a, err := readACL(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := a.String(); s != "allow:10.0.0.0/8,2001:db8::/32 deny:10.0.0.1/32" {
+		t.Fatalf("unexpected acl %s", s)
+	}
+
+	for _, data := range [][]byte{
+		{0, 0},                     // 空的访问控制列表
+		{1, 4, 10, 0, 0},           // 数据不完整
+		{1, 5, 10, 0, 0, 0, 0, 8},  // 无效的 ip 长度
+		{1, 4, 10, 0, 0, 0, 33, 0}, // 无效的前缀长度
+		{17},                       // 超过最大数量
+	} {
+		if _, err := readACL(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			t.Fatalf("%v should be invalid", data)
+		}
+	}
+}
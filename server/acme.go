@@ -0,0 +1,607 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/server/sync"
+	"github.com/isrc-cas/gt/util"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeChallengeHTTP01    = "http-01"
+	acmeChallengeTLSALPN01 = "tls-alpn-01"
+	acmeChallengeDNS01     = "dns-01"
+
+	acmeALPNProto      = "acme-tls/1"
+	acmeHTTP01Prefix   = "GET /.well-known/acme-challenge/"
+	acmeAccountKeyFile = "account.key"
+
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeRenewInterval = 12 * time.Hour
+	acmeObtainTimeout = 3 * time.Minute
+
+	// 申请失败后等待一段时间才能再次申请，每次失败等待的时间加倍，避免触发 CA 的频率限制
+	acmeRetryMinDelay = time.Minute
+	acmeRetryMaxDelay = 24 * time.Hour
+)
+
+// ErrACMEHostNotAllowed is an error returned when a certificate is requested for a host
+// that is neither the base domain nor a host prefix in use
+var ErrACMEHostNotAllowed = errors.New("acme: host is not allowed")
+
+// DNSProvider sets the TXT records of ACME dns-01 challenges.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn, e.g. '_acme-challenge.example.com.', with value.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+var (
+	dnsProvidersMtx gosync.RWMutex
+	dnsProviders    = map[string]func(config string) (DNSProvider, error){
+		"exec": newExecDNSProvider,
+	}
+)
+
+// RegisterDNSProvider makes a DNS provider available to the acmeDNSProvider option. newProvider is called with
+// the value of the acmeDNSProviderConfig option.
+func RegisterDNSProvider(name string, newProvider func(config string) (DNSProvider, error)) {
+	dnsProvidersMtx.Lock()
+	defer dnsProvidersMtx.Unlock()
+	dnsProviders[name] = newProvider
+}
+
+func newDNSProvider(name, config string) (provider DNSProvider, err error) {
+	dnsProvidersMtx.RLock()
+	newProvider, ok := dnsProviders[name]
+	dnsProvidersMtx.RUnlock()
+	if !ok {
+		err = fmt.Errorf("unknown acme dns provider '%s'", name)
+		return
+	}
+	return newProvider(config)
+}
+
+// execDNSProvider 执行外部程序设置 TXT 记录，参数为 'present|cleanup fqdn value'
+type execDNSProvider struct {
+	path string
+}
+
+func newExecDNSProvider(config string) (provider DNSProvider, err error) {
+	if len(config) == 0 {
+		err = errors.New("the exec acme dns provider requires the program path in option 'acmeDNSProviderConfig'")
+		return
+	}
+	provider = &execDNSProvider{path: config}
+	return
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) (err error) {
+	output, err := exec.CommandContext(ctx, p.path, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%s %s failed: %w, output: %s", p.path, action, err, bytes.TrimSpace(output))
+	}
+	return
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// acmeManager 从 ACME CA 申请 tlsAddr 使用的证书，证书缓存在磁盘中并在过期前续期
+type acmeManager struct {
+	server     *Server
+	client     *acme.Client
+	domain     string
+	challenge  string
+	dns        DNSProvider
+	accountMtx gosync.Mutex
+	registered bool
+	certs      sync.Map // key: 证书名(string) value: *acmeCert
+	tokens     sync.Map // key: http-01 token(string) value: key authorization(string)
+	alpnCerts  sync.Map // key: 域名(string) value: tls-alpn-01 证书(*tls.Certificate)
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+type acmeCert struct {
+	mtx  gosync.Mutex // 同一个证书同时只申请一次
+	cert atomic.Pointer[tls.Certificate]
+
+	// 以下字段由 mtx 保护
+	failures int       // 连续申请失败的次数
+	retryAt  time.Time // 在此之前不再申请
+	err      error     // 最后一次申请失败的错误
+}
+
+// failed 记录申请失败，返回下次可以申请的时间
+func (c *acmeCert) failed(err error, now time.Time) time.Time {
+	delay := acmeRetryMinDelay << c.failures
+	if delay > acmeRetryMaxDelay {
+		delay = acmeRetryMaxDelay
+	} else {
+		c.failures++
+	}
+	c.retryAt = now.Add(delay)
+	c.err = err
+	return c.retryAt
+}
+
+func newACMEManager(s *Server) (m *acmeManager, err error) {
+	m = &acmeManager{
+		server:    s,
+		domain:    strings.ToLower(strings.TrimSuffix(s.config.ACMEDomain, ".")),
+		challenge: s.config.ACMEChallenge,
+	}
+	if !util.IsValidHostname(m.domain) {
+		err = fmt.Errorf("invalid acme domain '%s'", s.config.ACMEDomain)
+		return
+	}
+	if len(m.challenge) == 0 {
+		if len(s.config.ACMEDNSProvider) > 0 {
+			m.challenge = acmeChallengeDNS01
+		} else {
+			m.challenge = acmeChallengeTLSALPN01
+		}
+	}
+	switch m.challenge {
+	case acmeChallengeHTTP01, acmeChallengeTLSALPN01:
+	case acmeChallengeDNS01:
+		m.dns, err = newDNSProvider(s.config.ACMEDNSProvider, s.config.ACMEDNSProviderConfig)
+		if err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("invalid acme challenge '%s', supports values: http-01, tls-alpn-01, dns-01", m.challenge)
+		return
+	}
+	err = os.MkdirAll(s.config.ACMECacheDir, 0700)
+	if err != nil {
+		return
+	}
+	key, err := m.loadAccountKey()
+	if err != nil {
+		return
+	}
+	m.client = &acme.Client{
+		Key:          key,
+		DirectoryURL: s.config.ACMEDirectory,
+		UserAgent:    "gt/" + predef.Version,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.renewLoop()
+	return
+}
+
+func (m *acmeManager) close() {
+	m.cancel()
+}
+
+func (m *acmeManager) loadAccountKey() (key crypto.Signer, err error) {
+	path := filepath.Join(m.server.config.ACMECacheDir, acmeAccountKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			err = fmt.Errorf("invalid acme account key '%s'", path)
+			return
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	key = ecKey
+	return
+}
+
+func (m *acmeManager) tlsConfig(tlsMinVersion string) (tlsConfig *tls.Config) {
+	tlsConfig = &tls.Config{
+		GetCertificate:     m.getCertificate,
+		GetConfigForClient: m.getConfigForClient,
+	}
+	setTLSMinVersion(tlsConfig, tlsMinVersion)
+	return
+}
+
+// getConfigForClient 只在 tls-alpn-01 验证时使用单独的配置，避免影响访问者的 ALPN 协商
+func (m *acmeManager) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto != acmeALPNProto {
+			continue
+		}
+		name := strings.ToLower(hello.ServerName)
+		value, ok := m.alpnCerts.Load(name)
+		if !ok {
+			return nil, fmt.Errorf("acme: no tls-alpn-01 challenge for '%s'", name)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{*value.(*tls.Certificate)},
+			NextProtos:   []string{acmeALPNProto},
+		}, nil
+	}
+	return nil, nil
+}
+
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	name, err := m.certName(hello.ServerName)
+	if err != nil {
+		return
+	}
+	return m.load(hello.Context(), name, time.Now())
+}
+
+// certName 返回 serverName 使用的证书名，dns-01 申请的证书包含通配符，所有的 host prefix 共用一个证书
+func (m *acmeManager) certName(serverName string) (name string, err error) {
+	name = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if len(name) == 0 || name == m.domain {
+		name = m.domain
+		return
+	}
+	// 已验证的自定义域名单独申请证书，dns-01 无法为其他域名设置 TXT 记录
+	if _, ok := m.server.getDomain(name, false); ok && m.challenge != acmeChallengeDNS01 {
+		return
+	}
+	prefix := strings.TrimSuffix(name, "."+m.domain)
+	if prefix == name || strings.IndexByte(prefix, '.') >= 0 || !util.IsValidHostname(name) {
+		err = ErrACMEHostNotAllowed
+		return
+	}
+	if m.challenge == acmeChallengeDNS01 {
+		name = m.domain
+		return
+	}
+	if _, ok := m.server.getHostPrefix(prefix); !ok {
+		err = ErrACMEHostNotAllowed
+	}
+	return
+}
+
+// load 返回 before 之后才过期的证书，内存中没有时从磁盘缓存中加载，仍然没有时申请新的证书
+func (m *acmeManager) load(ctx context.Context, name string, before time.Time) (cert *tls.Certificate, err error) {
+	value, _ := m.certs.LoadOrCreate(name, func() interface{} {
+		return &acmeCert{}
+	})
+	c := value.(*acmeCert)
+	cert = c.cert.Load()
+	if cert != nil && cert.Leaf.NotAfter.After(before) {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cert = c.cert.Load()
+	if cert != nil && cert.Leaf.NotAfter.After(before) {
+		return
+	}
+	if cert == nil {
+		var cached *tls.Certificate
+		cached, err = m.readCache(name)
+		if err == nil && cached.Leaf.NotAfter.After(before) {
+			cert = cached
+			c.cert.Store(cert)
+			return
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			m.server.Logger.Warn().Err(err).Str("name", name).Msg("failed to read acme certificate cache")
+		}
+	}
+	now := time.Now()
+	if now.Before(c.retryAt) {
+		err = fmt.Errorf("acme: obtaining the certificate is retried after %s: %w", c.retryAt.Format(time.RFC3339), c.err)
+		return
+	}
+	cert, err = m.obtain(ctx, name)
+	if err != nil {
+		if ctx.Err() != nil {
+			// 访问者断开连接或者服务端关闭，不是 CA 的错误
+			return
+		}
+		retryAt := c.failed(err, now)
+		m.server.Logger.Error().Err(err).Str("name", name).Time("retryAt", retryAt).Msg("failed to obtain acme certificate")
+		return
+	}
+	c.failures = 0
+	c.retryAt = time.Time{}
+	c.err = nil
+	c.cert.Store(cert)
+	return
+}
+
+func (m *acmeManager) renewLoop() {
+	ticker := time.NewTicker(acmeRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.renew()
+		}
+	}
+}
+
+// renew 续期即将过期的证书，不再使用的 host prefix 的证书不续期
+func (m *acmeManager) renew() {
+	var names []string
+	m.certs.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	for _, name := range names {
+		if _, err := m.certName(name); err != nil {
+			m.certs.Delete(name)
+			continue
+		}
+		_, _ = m.load(m.ctx, name, time.Now().Add(acmeRenewBefore))
+	}
+}
+
+func (m *acmeManager) register(ctx context.Context) (err error) {
+	m.accountMtx.Lock()
+	defer m.accountMtx.Unlock()
+	if m.registered {
+		return
+	}
+	account := &acme.Account{}
+	if len(m.server.config.ACMEEmail) > 0 {
+		account.Contact = []string{"mailto:" + m.server.config.ACMEEmail}
+	}
+	_, err = m.client.Register(ctx, account, acme.AcceptTOS)
+	if errors.Is(err, acme.ErrAccountAlreadyExists) {
+		err = nil
+	}
+	m.registered = err == nil
+	return
+}
+
+func (m *acmeManager) obtain(ctx context.Context, name string) (cert *tls.Certificate, err error) {
+	ctx, cancel := context.WithTimeout(ctx, acmeObtainTimeout)
+	defer cancel()
+	err = m.register(ctx)
+	if err != nil {
+		return
+	}
+	names := []string{name}
+	if m.challenge == acmeChallengeDNS01 {
+		names = append(names, "*."+name)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return
+	}
+	for _, u := range order.AuthzURLs {
+		err = m.authorize(ctx, u)
+		if err != nil {
+			return
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return
+	}
+	data, err := encodeACMECert(der, key)
+	if err != nil {
+		return
+	}
+	cert, err = parseACMECert(data)
+	if err != nil {
+		return
+	}
+	err = cert.Leaf.VerifyHostname(name)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(m.cachePath(name), data, 0600)
+	if err != nil {
+		return
+	}
+	m.server.Logger.Info().Str("name", name).Time("notAfter", cert.Leaf.NotAfter).Msg("obtained acme certificate")
+	return
+}
+
+func (m *acmeManager) authorize(ctx context.Context, url string) (err error) {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return
+	}
+	if authz.Status == acme.StatusValid {
+		return
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		err = fmt.Errorf("acme: challenge %s is not offered for '%s'", m.challenge, authz.Identifier.Value)
+		return
+	}
+	cleanup, err := m.prepare(ctx, authz.Identifier.Value, challenge)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return
+	}
+	_, err = m.client.WaitAuthorization(ctx, url)
+	return
+}
+
+// prepare 准备 ACME 服务器验证所需的数据，验证完成后调用 cleanup 清理
+func (m *acmeManager) prepare(ctx context.Context, domain string, challenge *acme.Challenge) (cleanup func(), err error) {
+	switch m.challenge {
+	case acmeChallengeHTTP01:
+		var value string
+		value, err = m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return
+		}
+		m.tokens.Store(challenge.Token, value)
+		cleanup = func() {
+			m.tokens.Delete(challenge.Token)
+		}
+	case acmeChallengeTLSALPN01:
+		var cert tls.Certificate
+		cert, err = m.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return
+		}
+		m.alpnCerts.Store(domain, &cert)
+		cleanup = func() {
+			m.alpnCerts.Delete(domain)
+		}
+	case acmeChallengeDNS01:
+		var value string
+		value, err = m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return
+		}
+		fqdn := "_acme-challenge." + domain + "."
+		err = m.dns.Present(ctx, fqdn, value)
+		if err != nil {
+			return
+		}
+		cleanup = func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := m.dns.CleanUp(ctx, fqdn, value); err != nil {
+				m.server.Logger.Warn().Err(err).Str("fqdn", fqdn).Msg("failed to clean up acme dns record")
+			}
+		}
+	}
+	return
+}
+
+// handleHTTP01 响应 ACME 服务器的 http-01 验证请求
+func (m *acmeManager) handleHTTP01(c *conn) (handled bool) {
+	if !hasRequestPrefix(c.Reader, acmeHTTP01Prefix) {
+		return
+	}
+	handled = true
+	buf, err := c.Reader.Peek(c.Reader.Buffered())
+	if err != nil {
+		return
+	}
+	token := buf[len(acmeHTTP01Prefix):]
+	if i := bytes.IndexAny(token, " ?\r\n"); i >= 0 {
+		token = token[:i]
+	}
+	resp := "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	if value, ok := m.tokens.Load(string(token)); ok {
+		body := value.(string)
+		resp = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: " + strconv.Itoa(len(body)) +
+			"\r\nConnection: close\r\n\r\n" + body
+	}
+	_, err = c.Write([]byte(resp))
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("failed to write acme http-01 response")
+	}
+	return
+}
+
+func (m *acmeManager) cachePath(name string) string {
+	return filepath.Join(m.server.config.ACMECacheDir, name+".pem")
+}
+
+func (m *acmeManager) readCache(name string) (cert *tls.Certificate, err error) {
+	data, err := os.ReadFile(m.cachePath(name))
+	if err != nil {
+		return
+	}
+	cert, err = parseACMECert(data)
+	if err != nil {
+		return
+	}
+	err = cert.Leaf.VerifyHostname(name)
+	return
+}
+
+// encodeACMECert 将私钥与证书链编码到一个 PEM 文件中
+func encodeACMECert(der [][]byte, key *ecdsa.PrivateKey) (data []byte, err error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	return
+}
+
+func parseACMECert(data []byte) (cert *tls.Certificate, err error) {
+	c, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return
+	}
+	cert = &c
+	return
+}
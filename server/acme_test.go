@@ -0,0 +1,688 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// testACMEServer 是一个简化的 ACME CA，不校验 JWS 签名，在收到 challenge 请求时同步完成验证
+type testACMEServer struct {
+	*httptest.Server
+	t          *testing.T
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+	validity   time.Duration
+	httpAddr   string
+	tlsAddr    string
+	mtx        gosync.Mutex
+	thumbprint string
+	authzs     []*testACMEAuthz
+	orders     []*testACMEOrder
+	issued     int
+	reject     bool // 拒绝新的订单
+	newOrders  int
+}
+
+type testACMEAuthz struct {
+	domain   string
+	wildcard bool
+	token    string
+	status   string
+}
+
+type testACMEOrder struct {
+	names  []string
+	authzs []int
+	cert   []byte
+}
+
+func newTestACMEServer(t *testing.T) (s *testACMEServer) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = &testACMEServer{
+		t:        t,
+		caKey:    caKey,
+		caCert:   caCert,
+		validity: 90 * 24 * time.Hour,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return
+}
+
+func (s *testACMEServer) rootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	return pool
+}
+
+func (s *testACMEServer) issuedCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.issued
+}
+
+func (s *testACMEServer) keyAuth(token string) string {
+	return token + "." + s.thumbprint
+}
+
+func (s *testACMEServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", strconv.FormatInt(time.Now().UnixNano(), 36))
+	if r.URL.Path == "/dir" {
+		s.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&jws)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := -1
+	if len(parts) > 1 {
+		id, _ = strconv.Atoi(parts[1])
+	}
+	switch {
+	case parts[0] == "account":
+		s.handleAccount(w, jws.Protected)
+	case parts[0] == "order" && id < 0:
+		s.handleNewOrder(w, payload)
+	case parts[0] == "order" && id < len(s.orders):
+		s.writeOrder(w, id)
+	case parts[0] == "authz" && id < len(s.authzs):
+		s.writeAuthz(w, id)
+	case parts[0] == "challenge" && id < len(s.authzs) && len(parts) == 3:
+		s.handleChallenge(w, id, parts[2])
+	case parts[0] == "finalize" && id < len(s.orders):
+		s.handleFinalize(w, id, payload)
+	case parts[0] == "cert" && id < len(s.orders):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.orders[id].cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *testACMEServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *testACMEServer) handleAccount(w http.ResponseWriter, protected string) {
+	data, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var header struct {
+		JWK struct {
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// RFC 7638
+	jwk := fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)
+	sum := sha256.Sum256([]byte(jwk))
+	s.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+	w.Header().Set("Location", s.URL+"/account/0")
+	s.writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (s *testACMEServer) handleNewOrder(w http.ResponseWriter, payload []byte) {
+	s.newOrders++
+	if s.reject {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:rejectedIdentifier","detail":"rejected"}`))
+		return
+	}
+	var req struct {
+		Identifiers []struct {
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order := &testACMEOrder{}
+	for _, identifier := range req.Identifiers {
+		order.names = append(order.names, identifier.Value)
+		order.authzs = append(order.authzs, len(s.authzs))
+		s.authzs = append(s.authzs, &testACMEAuthz{
+			domain:   strings.TrimPrefix(identifier.Value, "*."),
+			wildcard: strings.HasPrefix(identifier.Value, "*."),
+			token:    "token" + strconv.Itoa(len(s.authzs)),
+			status:   "pending",
+		})
+	}
+	s.orders = append(s.orders, order)
+	w.Header().Set("Location", s.URL+"/order/"+strconv.Itoa(len(s.orders)-1))
+	s.writeJSON(w, http.StatusCreated, s.order(len(s.orders)-1))
+}
+
+func (s *testACMEServer) order(id int) map[string]interface{} {
+	order := s.orders[id]
+	status := "ready"
+	var authzs []string
+	for _, i := range order.authzs {
+		authzs = append(authzs, s.URL+"/authz/"+strconv.Itoa(i))
+		switch s.authzs[i].status {
+		case "invalid":
+			status = "invalid"
+		case "pending":
+			if status == "ready" {
+				status = "pending"
+			}
+		}
+	}
+	v := map[string]interface{}{
+		"status":         status,
+		"authorizations": authzs,
+		"finalize":       s.URL + "/finalize/" + strconv.Itoa(id),
+	}
+	if order.cert != nil {
+		v["status"] = "valid"
+		v["certificate"] = s.URL + "/cert/" + strconv.Itoa(id)
+	}
+	return v
+}
+
+func (s *testACMEServer) writeOrder(w http.ResponseWriter, id int) {
+	w.Header().Set("Location", s.URL+"/order/"+strconv.Itoa(id))
+	s.writeJSON(w, http.StatusOK, s.order(id))
+}
+
+func (s *testACMEServer) challenge(id int, typ string) map[string]string {
+	authz := s.authzs[id]
+	return map[string]string{
+		"type":   typ,
+		"url":    s.URL + "/challenge/" + strconv.Itoa(id) + "/" + typ,
+		"token":  authz.token,
+		"status": authz.status,
+	}
+}
+
+func (s *testACMEServer) writeAuthz(w http.ResponseWriter, id int) {
+	authz := s.authzs[id]
+	var challenges []map[string]string
+	for _, typ := range []string{acmeChallengeHTTP01, acmeChallengeTLSALPN01, acmeChallengeDNS01} {
+		if authz.wildcard && typ != acmeChallengeDNS01 {
+			continue
+		}
+		challenges = append(challenges, s.challenge(id, typ))
+	}
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     authz.status,
+		"identifier": map[string]string{"type": "dns", "value": authz.domain},
+		"wildcard":   authz.wildcard,
+		"challenges": challenges,
+	})
+}
+
+func (s *testACMEServer) handleChallenge(w http.ResponseWriter, id int, typ string) {
+	authz := s.authzs[id]
+	var err error
+	switch typ {
+	case acmeChallengeHTTP01:
+		err = s.validateHTTP01(authz)
+	case acmeChallengeTLSALPN01:
+		err = s.validateTLSALPN01(authz)
+	case acmeChallengeDNS01:
+		err = s.validateDNS01(authz)
+	}
+	if err != nil {
+		s.t.Logf("%s validation of %s failed: %v", typ, authz.domain, err)
+		authz.status = "invalid"
+	} else {
+		authz.status = "valid"
+	}
+	s.writeJSON(w, http.StatusOK, s.challenge(id, typ))
+}
+
+func (s *testACMEServer) validateHTTP01(authz *testACMEAuthz) (err error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.httpAddr+"/.well-known/acme-challenge/"+authz.token, nil)
+	if err != nil {
+		return
+	}
+	req.Host = authz.domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if string(body) != s.keyAuth(authz.token) {
+		err = fmt.Errorf("invalid key authorization %q", body)
+	}
+	return
+}
+
+func (s *testACMEServer) validateTLSALPN01(authz *testACMEAuthz) (err error) {
+	conn, err := tls.Dial("tcp", s.tlsAddr, &tls.Config{
+		ServerName:         authz.domain,
+		NextProtos:         []string{acmeALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("invalid protocol %q", state.NegotiatedProtocol)
+	}
+	sum := sha256.Sum256([]byte(s.keyAuth(authz.token)))
+	expected, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return
+	}
+	idPeACMEIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) && string(ext.Value) == string(expected) {
+			return
+		}
+	}
+	return errors.New("acmeIdentifier extension is not found")
+}
+
+func (s *testACMEServer) validateDNS01(authz *testACMEAuthz) (err error) {
+	sum := sha256.Sum256([]byte(s.keyAuth(authz.token)))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	testDNS.mtx.Lock()
+	defer testDNS.mtx.Unlock()
+	for _, value := range testDNS.records["_acme-challenge."+authz.domain+"."] {
+		if value == expected {
+			return
+		}
+	}
+	return errors.New("TXT record is not found")
+}
+
+func (s *testACMEServer) handleFinalize(w http.ResponseWriter, id int, payload []byte) {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order := s.orders[id]
+	if s.order(id)["status"] != "ready" || strings.Join(csr.DNSNames, ",") != strings.Join(order.names, ",") {
+		http.Error(w, "order is not ready", http.StatusForbidden)
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(s.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	s.issued++
+	s.writeOrder(w, id)
+}
+
+// testDNSProvider 将 TXT 记录保存在内存中
+type testDNSProvider struct {
+	mtx     gosync.Mutex
+	records map[string][]string
+}
+
+var testDNS = &testDNSProvider{records: make(map[string][]string)}
+
+func init() {
+	RegisterDNSProvider("test", func(config string) (DNSProvider, error) {
+		return testDNS, nil
+	})
+}
+
+func (p *testDNSProvider) Present(_ context.Context, fqdn, value string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(_ context.Context, fqdn, value string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	values := p.records[fqdn]
+	for i, v := range values {
+		if v == value {
+			p.records[fqdn] = append(values[:i], values[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func startACMEServer(t *testing.T, ca *testACMEServer, cacheDir string, args ...string) (s *Server) {
+	args = append([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-acmeDomain", "example.com",
+		"-acmeDirectory", ca.URL + "/dir",
+		"-acmeCacheDir", cacheDir,
+	}, args...)
+	s, err := New(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	ca.mtx.Lock()
+	ca.httpAddr = s.GetListenerAddrPort().String()
+	ca.tlsAddr = s.GetTLSListenerAddrPort().String()
+	ca.mtx.Unlock()
+	return
+}
+
+func dialACMEServer(s *Server, ca *testACMEServer, serverName string) (cert *x509.Certificate, err error) {
+	conn, err := tls.Dial("tcp", s.GetTLSListenerAddrPort().String(), &tls.Config{
+		ServerName: serverName,
+		RootCAs:    ca.rootCAs(),
+	})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	cert = conn.ConnectionState().PeerCertificates[0]
+	return
+}
+
+func TestACME(t *testing.T) {
+	for _, challenge := range []string{acmeChallengeTLSALPN01, acmeChallengeHTTP01} {
+		t.Run(challenge, func(t *testing.T) {
+			ca := newTestACMEServer(t)
+			cacheDir := t.TempDir()
+			s := startACMEServer(t, ca, cacheDir, "-acmeChallenge", challenge)
+
+			cert, err := dialACMEServer(s, ca, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(cert.DNSNames, ",") != "example.com" {
+				t.Fatalf("invalid names %v", cert.DNSNames)
+			}
+			// 未使用的 host prefix 不申请证书
+			_, err = dialACMEServer(s, ca, "id1.example.com")
+			if err == nil {
+				t.Fatal("certificate should not be obtained for unused host prefix")
+			}
+			s.hostPrefix2Client.Store("id1", clientWithServiceIndex{})
+			cert, err = dialACMEServer(s, ca, "id1.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(cert.DNSNames, ",") != "id1.example.com" {
+				t.Fatalf("invalid names %v", cert.DNSNames)
+			}
+			if ca.issuedCount() != 2 {
+				t.Fatalf("invalid issued count %d", ca.issuedCount())
+			}
+			_, err = dialACMEServer(s, ca, "id1.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ca.issuedCount() != 2 {
+				t.Fatalf("certificate should be reused, issued count %d", ca.issuedCount())
+			}
+
+			// 重启后从磁盘缓存中加载证书
+			s.Close()
+			_, err = os.Stat(filepath.Join(cacheDir, "example.com.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s = startACMEServer(t, ca, cacheDir, "-acmeChallenge", challenge)
+			_, err = dialACMEServer(s, ca, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ca.issuedCount() != 2 {
+				t.Fatalf("cached certificate should be used, issued count %d", ca.issuedCount())
+			}
+		})
+	}
+}
+
+func TestACMEDNS01(t *testing.T) {
+	ca := newTestACMEServer(t)
+	s := startACMEServer(t, ca, t.TempDir(), "-acmeDNSProvider", "test")
+	if s.acme.challenge != acmeChallengeDNS01 {
+		t.Fatalf("invalid challenge %s", s.acme.challenge)
+	}
+	// 通配符证书覆盖所有的 host prefix
+	for _, name := range []string{"id1.example.com", "example.com", "id2.example.com"} {
+		cert, err := dialACMEServer(s, ca, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(cert.DNSNames, ",") != "example.com,*.example.com" {
+			t.Fatalf("invalid names %v", cert.DNSNames)
+		}
+	}
+	if ca.issuedCount() != 1 {
+		t.Fatalf("invalid issued count %d", ca.issuedCount())
+	}
+	testDNS.mtx.Lock()
+	left := len(testDNS.records["_acme-challenge.example.com."])
+	testDNS.mtx.Unlock()
+	if left != 0 {
+		t.Fatalf("%d TXT records are not cleaned up", left)
+	}
+	_, err := dialACMEServer(s, ca, "a.id1.example.com")
+	if err == nil {
+		t.Fatal("certificate should not be obtained for nested host")
+	}
+}
+
+func TestACMERenew(t *testing.T) {
+	ca := newTestACMEServer(t)
+	ca.validity = 10 * 24 * time.Hour
+	s := startACMEServer(t, ca, t.TempDir())
+	cert, err := dialACMEServer(s, ca, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 证书在续期时间之内，续期后新的连接使用新证书
+	s.acme.renew()
+	if ca.issuedCount() != 2 {
+		t.Fatalf("invalid issued count %d", ca.issuedCount())
+	}
+	renewed, err := dialACMEServer(s, ca, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Fatal("certificate is not renewed")
+	}
+
+	ca.validity = 90 * 24 * time.Hour
+	s.acme.renew()
+	s.acme.renew()
+	if ca.issuedCount() != 3 {
+		t.Fatalf("invalid issued count %d", ca.issuedCount())
+	}
+}
+
+func TestACMERetry(t *testing.T) {
+	ca := newTestACMEServer(t)
+	ca.reject = true
+	s := startACMEServer(t, ca, t.TempDir())
+	newOrders := func() int {
+		ca.mtx.Lock()
+		defer ca.mtx.Unlock()
+		return ca.newOrders
+	}
+	// 失败之后在等待时间内不再申请
+	for i := 0; i < 3; i++ {
+		_, err := dialACMEServer(s, ca, "example.com")
+		if err == nil {
+			t.Fatal("certificate should not be obtained")
+		}
+	}
+	if newOrders() != 1 {
+		t.Fatalf("invalid order count %d", newOrders())
+	}
+	value, _ := s.acme.certs.Load("example.com")
+	c := value.(*acmeCert)
+	c.mtx.Lock()
+	if delay := time.Until(c.retryAt); delay <= 0 || delay > acmeRetryMinDelay {
+		t.Fatalf("invalid retry delay %v", delay)
+	}
+	c.retryAt = time.Now()
+	c.mtx.Unlock()
+
+	// 再次失败后等待的时间加倍
+	_, err := dialACMEServer(s, ca, "example.com")
+	if err == nil {
+		t.Fatal("certificate should not be obtained")
+	}
+	c.mtx.Lock()
+	if delay := time.Until(c.retryAt); delay <= acmeRetryMinDelay || delay > 2*acmeRetryMinDelay {
+		t.Fatalf("invalid retry delay %v", delay)
+	}
+	c.retryAt = time.Now()
+	c.mtx.Unlock()
+
+	// 成功之后清除失败记录
+	ca.mtx.Lock()
+	ca.reject = false
+	ca.mtx.Unlock()
+	_, err = dialACMEServer(s, ca, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.failures != 0 || !c.retryAt.IsZero() || c.err != nil {
+		t.Fatalf("failures are not reset: %d %v %v", c.failures, c.retryAt, c.err)
+	}
+	if newOrders() != 3 {
+		t.Fatalf("invalid order count %d", newOrders())
+	}
+
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		now := time.Now()
+		if delay := c.failed(errors.New("test"), now).Sub(now); delay != expected {
+			t.Fatalf("%d: invalid delay %v", i, delay)
+		}
+	}
+	c.failures = 20
+	now := time.Now()
+	if delay := c.failed(errors.New("test"), now).Sub(now); delay != acmeRetryMaxDelay {
+		t.Fatalf("invalid max delay %v", delay)
+	}
+}
@@ -47,6 +47,9 @@ type Server struct {
 	secret     atomic.Value
 	idConflict func(id string) bool
 	muxHeader  string
+	metrics    func(w io.Writer) error
+	// metricsToken 读取 metrics 所需的 bearer token
+	metricsToken string
 }
 
 // ID 返回 api server 生成的 id
@@ -68,7 +71,8 @@ func (s *Server) Secret() string {
 }
 
 // NewServer returns an api server instance.
-func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bool, header string) *Server {
+// The metrics are served only if metricsToken is not empty.
+func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bool, header string, metrics func(w io.Writer) error, metricsToken string) *Server {
 	mux := http.NewServeMux()
 	s := &Server{
 		Server: http.Server{
@@ -78,9 +82,15 @@ func NewServer(addr string, logger zerolog.Logger, idConflict func(id string) bo
 		logger:     logger,
 		idConflict: idConflict,
 		muxHeader:  header,
+		metrics:    metrics,
+
+		metricsToken: metricsToken,
 	}
 	mux.HandleFunc("/status", s.status)
 	mux.HandleFunc("/statusResp", s.statusResp)
+	if metrics != nil && len(metricsToken) > 0 {
+		mux.HandleFunc("/metrics", s.writeMetrics)
+	}
 	return s
 }
 
@@ -105,6 +115,19 @@ func (s *Server) statusResp(writer http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+func (s *Server) writeMetrics(writer http.ResponseWriter, req *http.Request) {
+	if !util.ValidBearerToken(req, s.metricsToken) {
+		writer.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := s.metrics(writer)
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("failed to responses to metrics request")
+	}
+}
+
 func (s *Server) randomIDSecret() error {
 	retries := 10
 	for i := 0; i < retries; i++ {
@@ -0,0 +1,922 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdbufio "bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/isrc-cas/gt/bufio"
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidAuth is an error returned when the auth in the handshake is invalid
+var ErrInvalidAuth = errors.New("invalid auth")
+
+var errAuthRejected = errors.New("the request of the gated connection is rejected")
+
+const (
+	authMethodBasic  = "basic"
+	authMethodBearer = "bearer"
+	authMethodOIDC   = "oidc"
+
+	authCallbackPath  = "/.gt/oidc/callback"
+	authSessionCookie = "gt_session"
+	authStateCookie   = "gt_state"
+	authStateDuration = 10 * time.Minute
+
+	authVerifiedTTL   = 5 * time.Minute // 缓存通过 bcrypt 验证的凭据的时间
+	authMaxFailures   = 10              // 访问者在 authFailureWindow 内允许认证失败的次数
+	authFailureWindow = time.Minute
+	authFailuresSweep = 4096 // 失败记录达到该数量时清理过期的记录
+)
+
+// initAuth 检查认证相关的配置，并准备签名 session 的 key
+func (s *Server) initAuth() (err error) {
+	err = checkAuthMethods(s.config.AuthMethods)
+	if err != nil {
+		return
+	}
+	if s.config.AuthSessionDuration.Duration <= 0 {
+		return fmt.Errorf("auth session duration (-authSessionDuration option) '%s' is invalid", s.config.AuthSessionDuration.Duration)
+	}
+	err = checkOIDCIssuers(s.config.AuthOIDCIssuers)
+	if err != nil {
+		return
+	}
+	s.oidcHTTPClient, err = newOIDCHTTPClient(s.config.AuthOIDCCA)
+	if err != nil {
+		return
+	}
+	if len(s.config.AuthSessionKey) > 0 {
+		s.authKey = []byte(s.config.AuthSessionKey)
+		return
+	}
+	s.authKey = make([]byte, 32)
+	_, err = rand.Read(s.authKey)
+	return
+}
+
+func checkAuthMethods(methods []string) error {
+	for _, m := range methods {
+		switch strings.ToLower(m) {
+		case authMethodBasic, authMethodBearer, authMethodOIDC:
+		default:
+			return fmt.Errorf("auth method (-authMethods option) '%s' is invalid", m)
+		}
+	}
+	return nil
+}
+
+// authGate 服务端在 HTTP 服务之前进行的认证，由客户端在握手中为服务指定。
+// 访问者连接只转发通过认证的第一个请求，未通过认证的请求不会被发送到隧道中
+type authGate struct {
+	basic    map[string][]byte // key: 用户名 value: bcrypt 哈希
+	bearer   [][sha256.Size]byte
+	oidc     *oidcGate
+	verified sync.Map // key: [sha256.Size]byte(用户名:密码) value: 过期时间(time.Time)，缓存通过 bcrypt 验证的凭据
+}
+
+// oidcGate 通过 OIDC 登录后使用服务端签名的 session cookie 访问
+type oidcGate struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	emails       []string // 允许的 email，以 @ 开头时表示允许该域名下的所有 email，为空时允许所有用户
+}
+
+// key 区分使用不同 OIDC 配置的服务签发的 session
+func (o *oidcGate) key() string {
+	sum := sha256.Sum256([]byte(o.issuer + "\n" + o.clientID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (o *oidcGate) allowEmail(email string, verified *bool) bool {
+	if len(o.emails) == 0 {
+		return true
+	}
+	if email == "" || verified != nil && !*verified {
+		return false
+	}
+	email = strings.ToLower(email)
+	for _, e := range o.emails {
+		e = strings.ToLower(e)
+		if e == email || e[0] == '@' && strings.HasSuffix(email, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// methods 返回认证使用的所有方式
+func (g *authGate) methods() (methods []string) {
+	if len(g.basic) > 0 {
+		methods = append(methods, authMethodBasic)
+	}
+	if len(g.bearer) > 0 {
+		methods = append(methods, authMethodBearer)
+	}
+	if g.oidc != nil {
+		methods = append(methods, authMethodOIDC)
+	}
+	return
+}
+
+// sum 返回认证配置的摘要，用于计算客户端配置的 checksum
+func (g *authGate) sum() (result [sha256.Size]byte) {
+	return g.digest(true)
+}
+
+// groupSum 返回不包含 bcrypt 哈希的摘要，bcrypt 哈希带有随机的盐，相同的密码在不同的客户端上哈希不同。
+// 没有认证时返回零值
+func (g *authGate) groupSum() (result [sha256.Size]byte) {
+	if g == nil {
+		return
+	}
+	return g.digest(false)
+}
+
+func (g *authGate) digest(hashes bool) (result [sha256.Size]byte) {
+	h := sha256.New()
+	users := make([]string, 0, len(g.basic))
+	for user := range g.basic {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		h.Write([]byte(user))
+		if hashes {
+			h.Write(g.basic[user])
+		}
+	}
+	for _, token := range g.bearer {
+		h.Write(token[:])
+	}
+	if g.oidc != nil {
+		h.Write([]byte(g.oidc.issuer + "\n" + g.oidc.clientID + "\n" + g.oidc.clientSecret))
+		for _, email := range g.oidc.emails {
+			h.Write([]byte("\n" + email))
+		}
+	}
+	h.Sum(result[:0])
+	return
+}
+
+// check 检查请求的 Authorization 头部。limited 为 true 时只接受缓存中通过验证的凭据，不再计算 bcrypt
+func (g *authGate) check(req *http.Request, limited bool) (ok, present bool) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return
+	}
+	present = true
+	scheme, value, _ := strings.Cut(auth, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && len(g.basic) > 0:
+		user, password, found := req.BasicAuth()
+		if !found {
+			return
+		}
+		key := sha256.Sum256([]byte(user + ":" + password))
+		now := time.Now()
+		if expires, cached := g.verified.Load(key); cached && now.Before(expires.(time.Time)) {
+			return true, true
+		}
+		hash, exists := g.basic[user]
+		if limited || !exists {
+			return
+		}
+		ok = bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+		if ok {
+			g.verified.Store(key, now.Add(authVerifiedTTL))
+		}
+	case strings.EqualFold(scheme, "Bearer") && len(g.bearer) > 0 && !limited:
+		sum := sha256.Sum256([]byte(strings.TrimSpace(value)))
+		for _, token := range g.bearer {
+			if subtle.ConstantTimeCompare(sum[:], token[:]) == 1 {
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+type authFailure struct {
+	count int
+	reset time.Time
+}
+
+// authFailureKey IPv6 的访问者按 /64 计算失败次数
+func authFailureKey(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	if ip.Is6() {
+		p, _ := ip.Prefix(64)
+		return p
+	}
+	return netip.PrefixFrom(ip, ip.BitLen())
+}
+
+// authLimited 判断访问者在 authFailureWindow 内认证失败的次数是否达到了 authMaxFailures
+func (s *Server) authLimited(ip netip.Addr) bool {
+	s.authFailuresMtx.Lock()
+	defer s.authFailuresMtx.Unlock()
+	f, ok := s.authFailures[authFailureKey(ip)]
+	return ok && f.count >= authMaxFailures && time.Now().Before(f.reset)
+}
+
+// authFailed 记录访问者认证失败，记录过多时清理已经过期的记录
+func (s *Server) authFailed(ip netip.Addr) {
+	key := authFailureKey(ip)
+	now := time.Now()
+	s.authFailuresMtx.Lock()
+	defer s.authFailuresMtx.Unlock()
+	f, ok := s.authFailures[key]
+	if ok && now.Before(f.reset) {
+		f.count++
+		return
+	}
+	if s.authFailures == nil {
+		s.authFailures = make(map[netip.Prefix]*authFailure)
+	} else if len(s.authFailures) >= authFailuresSweep {
+		for k, v := range s.authFailures {
+			if !now.Before(v.reset) {
+				delete(s.authFailures, k)
+			}
+		}
+	}
+	s.authFailures[key] = &authFailure{count: 1, reset: now.Add(authFailureWindow)}
+}
+
+// readAuth 读取握手中 predef.SetAuth 之后的认证配置
+func readAuth(reader *bufio.Reader) (g *authGate, err error) {
+	g = &authGate{}
+	n, err := readAuthCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := byte(0); i < n; i++ {
+		var entry string
+		entry, err = readShortString(reader)
+		if err != nil {
+			return nil, err
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || !strings.HasPrefix(hash, "$2") {
+			return nil, ErrInvalidAuth
+		}
+		if g.basic == nil {
+			g.basic = make(map[string][]byte)
+		}
+		g.basic[user] = []byte(hash)
+	}
+
+	n, err = readAuthCount(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := byte(0); i < n; i++ {
+		var b []byte
+		b, err = reader.Peek(sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		var token [sha256.Size]byte
+		copy(token[:], b)
+		_, err = reader.Discard(sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		g.bearer = append(g.bearer, token)
+	}
+
+	oidc, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if oidc == 1 {
+		o := &oidcGate{}
+		o.issuer, err = readShortString(reader)
+		if err != nil {
+			return nil, err
+		}
+		o.clientID, err = readShortString(reader)
+		if err != nil {
+			return nil, err
+		}
+		o.clientSecret, err = readShortString(reader)
+		if err != nil {
+			return nil, err
+		}
+		n, err = readAuthCount(reader)
+		if err != nil {
+			return nil, err
+		}
+		for i := byte(0); i < n; i++ {
+			var email string
+			email, err = readShortString(reader)
+			if err != nil {
+				return nil, err
+			}
+			if email == "" {
+				return nil, ErrInvalidAuth
+			}
+			o.emails = append(o.emails, email)
+		}
+		if !isHTTPSURL(o.issuer) || o.clientID == "" {
+			return nil, ErrInvalidAuth
+		}
+		g.oidc = o
+	} else if oidc != 0 {
+		return nil, ErrInvalidAuth
+	}
+
+	if len(g.basic) == 0 && len(g.bearer) == 0 && g.oidc == nil {
+		return nil, ErrInvalidAuth
+	}
+	return
+}
+
+func readAuthCount(reader *bufio.Reader) (n byte, err error) {
+	n, err = reader.ReadByte()
+	if err == nil && n > predef.MaxAuthEntries {
+		err = ErrInvalidAuth
+	}
+	return
+}
+
+// readShortString 读取 [len][string]
+func readShortString(reader *bufio.Reader) (s string, err error) {
+	n, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	b, err := reader.Peek(int(n))
+	if err != nil {
+		return
+	}
+	s = string(b)
+	_, err = reader.Discard(int(n))
+	return
+}
+
+// allowAuth 判断服务端的 -authMethods 是否允许认证使用的所有方式，以及 -authOIDCIssuers 是否允许 OIDC 的 issuer
+func (s *Server) allowAuth(g *authGate) bool {
+	if g.oidc != nil && !s.allowOIDCIssuer(g.oidc.issuer) {
+		return false
+	}
+	s.configRWMtx.RLock()
+	authMethods := s.config.AuthMethods
+	s.configRWMtx.RUnlock()
+	if len(authMethods) == 0 {
+		return true
+	}
+	for _, m := range g.methods() {
+		found := false
+		for _, allowed := range authMethods {
+			if strings.EqualFold(m, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkServiceAuth 检查 host 前缀服务的认证是否符合服务端的策略
+func (c *conn) checkServiceAuth(g *authGate, tls bool) (err error) {
+	if g != nil && tls {
+		c.Logger.Error().Msg("tls host prefix can not set auth")
+		return errors.New("invalid option")
+	}
+	c.server.configRWMtx.RLock()
+	authRequired := c.server.config.AuthRequired
+	c.server.configRWMtx.RUnlock()
+	if g == nil && !tls && authRequired {
+		err = connection.ErrAuthNotAllowed
+		e := c.SendErrorSignalAuthNotAllowed()
+		c.Logger.Error().Err(err).AnErr("SendError", e).Msg("auth is required for http host prefixes")
+	}
+	return
+}
+
+// peekRequest 解析第一个请求的请求行与头部，不消耗 reader 中的数据
+func peekRequest(reader *bufio.Reader) (req *http.Request, err error) {
+	n := 1
+	for {
+		var buf []byte
+		_, err = reader.Peek(n)
+		if err != nil {
+			return
+		}
+		buf, _ = reader.Peek(reader.Buffered())
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			return http.ReadRequest(stdbufio.NewReader(bytes.NewReader(buf[:i+4])))
+		}
+		n = len(buf) + 1
+	}
+}
+
+// authenticate 检查访问者连接上的下一个请求是否通过服务的认证，不消耗请求的数据。未通过时在之前的请求的响应结束之后返回 401
+// 或者重定向到 OIDC 的登录页面，OIDC 的回调请求由服务端处理，这些请求都不会被发送到隧道中
+func (c *conn) authenticate(g *authGate) (ok bool) {
+	req, err := peekRequest(c.Reader)
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("failed to parse the request to authenticate")
+		if c.gated.waitIdle() {
+			c.writeAuthResponse(http.StatusBadRequest, nil)
+		}
+		return
+	}
+	if g.oidc != nil && req.URL.Path == authCallbackPath {
+		if c.gated.waitIdle() {
+			c.handleOIDCCallback(g.oidc, req)
+		}
+		return
+	}
+	ip := visitorIP(c.RemoteAddr())
+	limited := c.server.authLimited(ip)
+	ok, present := g.check(req, limited)
+	if ok {
+		return
+	}
+	if present && !limited {
+		c.server.authFailed(ip)
+		c.Logger.Warn().Str("prefix", c.hostPrefix).Msg("visitor failed to authenticate")
+	}
+	if g.oidc != nil && c.server.verifySession(req, g.oidc) {
+		return true
+	}
+	if !c.gated.waitIdle() {
+		return
+	}
+	if g.oidc != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		c.redirectToOIDC(g.oidc, req)
+		return
+	}
+	if limited {
+		c.Logger.Warn().Str("visitor", ip.String()).Str("prefix", c.hostPrefix).Msg("visitor failed to authenticate too many times")
+		c.writeAuthResponse(http.StatusTooManyRequests, http.Header{"Retry-After": []string{strconv.Itoa(int(authFailureWindow.Seconds()))}})
+		return
+	}
+	header := http.Header{}
+	if len(g.basic) > 0 {
+		header.Add("WWW-Authenticate", `Basic realm="GT", charset="UTF-8"`)
+	}
+	if len(g.bearer) > 0 {
+		header.Add("WWW-Authenticate", `Bearer realm="GT"`)
+	}
+	c.writeAuthResponse(http.StatusUnauthorized, header)
+	return
+}
+
+// authExchange 跟踪受认证保护的访问者连接上的请求与响应。每个请求的头部完整并且通过认证之后才被转发，连接保持复用；
+// 未通过认证时服务端在之前的请求的响应结束之后响应，然后关闭连接。响应 101 或者 CONNECT 成功之后不再检查
+type authExchange struct {
+	gate *authGate
+
+	// 以下字段只在 process 中使用
+	req       util.HTTPParser
+	checked   bool // 当前请求的头部已经通过认证
+	upgrading bool // 当前请求要求升级协议，响应之前不再读取
+	raw       bool
+
+	// 以下字段只在上行中使用
+	resp      util.HTTPParser
+	answering *authRequest
+	respRaw   bool
+
+	mtx      sync.Mutex
+	cond     sync.Cond
+	pending  []*authRequest // 已经转发但还没有响应完的请求，按请求的顺序排列
+	upgraded bool
+	closed   bool // 任务已经结束或者响应无法解析
+}
+
+type authRequest struct {
+	head    bool // HEAD 请求的响应没有 body
+	connect bool
+}
+
+// newAuthExchange 创建访问者连接的 authExchange，第一个请求已经由 authenticate 检查
+func newAuthExchange(g *authGate) *authExchange {
+	a := &authExchange{gate: g, checked: true}
+	a.cond.L = &a.mtx
+	return a
+}
+
+// waitIdle 等待已经转发的请求都响应完，任务已经结束或者响应无法解析时返回 false
+func (a *authExchange) waitIdle() (ok bool) {
+	_, ok = a.wait()
+	return
+}
+
+// wait 等待已经转发的请求都响应完或者协议升级
+func (a *authExchange) wait() (upgraded, ok bool) {
+	if a == nil {
+		return false, true
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for len(a.pending) > 0 && !a.upgraded && !a.closed {
+		a.cond.Wait()
+	}
+	return a.upgraded, !a.closed
+}
+
+// close 在任务结束时唤醒等待响应的 process
+func (a *authExchange) close() {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	a.closed = true
+	a.cond.Broadcast()
+	a.mtx.Unlock()
+}
+
+// request 返回 p 中属于当前请求的字节数，当前请求结束之后的数据属于下一个请求，需要重新认证
+func (a *authExchange) request(p []byte) (n int, err error) {
+	if a.raw {
+		return len(p), nil
+	}
+	if a.req.ReadingHead() {
+		var done bool
+		n, done, err = a.req.ReadHead(p)
+		if err != nil || !done {
+			return
+		}
+		a.checked = false
+		method, _, _, _ := util.HTTPRequestLine(a.req.Head)
+		a.mtx.Lock()
+		a.pending = append(a.pending, &authRequest{
+			head:    string(method) == http.MethodHead,
+			connect: string(method) == http.MethodConnect,
+		})
+		a.mtx.Unlock()
+		var upgrade bool
+		upgrade, done, err = a.req.SetRequestBody()
+		if err != nil {
+			return
+		}
+		if upgrade {
+			a.upgrading = true
+			return
+		}
+		if done {
+			a.req.Reset()
+			return
+		}
+	}
+	m, done, err := a.req.ReadBody(p[n:])
+	n += m
+	if done {
+		a.req.Reset()
+	}
+	return
+}
+
+// response 解析 client 发往访问者的数据，在数据写入访问者连接之后调用，每个响应结束时唤醒等待的 process
+func (a *authExchange) response(p []byte) {
+	if a == nil {
+		return
+	}
+	for len(p) > 0 && !a.respRaw {
+		if a.answering == nil {
+			a.mtx.Lock()
+			if len(a.pending) > 0 {
+				a.answering = a.pending[0]
+			}
+			a.mtx.Unlock()
+			if a.answering == nil {
+				// 没有对应的请求，无法解析
+				a.fail()
+				return
+			}
+			a.resp.Reset()
+		}
+		var n int
+		var done bool
+		var err error
+		if a.resp.ReadingHead() {
+			n, done, err = a.resp.ReadHead(p)
+			if err == nil && done {
+				var status int
+				status, done, err = a.resp.SetResponseBody(a.answering.head)
+				switch {
+				case err != nil:
+				case status == http.StatusSwitchingProtocols || a.answering.connect && status/100 == 2:
+					a.respRaw = true
+					a.mtx.Lock()
+					a.upgraded = true
+					a.cond.Broadcast()
+					a.mtx.Unlock()
+					return
+				case status < 200:
+					// 1xx 之后还有同一个请求的最终响应
+					a.resp.Reset()
+				}
+			}
+		} else {
+			n, done, err = a.resp.ReadBody(p)
+		}
+		if err != nil {
+			a.fail()
+			return
+		}
+		p = p[n:]
+		if done {
+			a.mtx.Lock()
+			a.pending = a.pending[1:]
+			a.cond.Broadcast()
+			a.mtx.Unlock()
+			a.answering = nil
+		}
+	}
+}
+
+// fail 无法解析响应时不再转发之后的请求
+func (a *authExchange) fail() {
+	a.respRaw = true
+	a.close()
+}
+
+func (c *conn) writeAuthResponse(status int, header http.Header) {
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 ")
+	sb.WriteString(strconv.Itoa(status))
+	sb.WriteByte(' ')
+	sb.WriteString(http.StatusText(status))
+	sb.WriteString("\r\n")
+	_ = header.Write(&sb)
+	sb.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	_, err := c.Write([]byte(sb.String()))
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("failed to write auth response")
+	}
+}
+
+// authCallbackURL 返回 OIDC 登录后的回调地址，需要在 OIDC provider 中登记
+func (c *conn) authCallbackURL(req *http.Request) string {
+	scheme := "http"
+	if c.isTLS() {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + authCallbackPath
+}
+
+// authSession 是 OIDC 登录后签发的 session cookie 的内容
+type authSession struct {
+	Host  string `json:"h"`
+	Gate  string `json:"g"`
+	Email string `json:"e,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// authState 是 OIDC 登录请求的 state，nonce 同时保存在访问者的 cookie 中
+type authState struct {
+	Nonce  string `json:"n"`
+	Return string `json:"r"`
+	jwt.RegisteredClaims
+}
+
+// signAuth 使用服务端的 authKey 签发 HS256 的 JWT
+func (s *Server) signAuth(claims jwt.Claims) string {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.authKey)
+	return token
+}
+
+// verifyAuth 验证 signAuth 签发的 JWT 并解析到 claims 中，没有过期时间或者已经过期的 JWT 无效
+func (s *Server) verifyAuth(token string, claims jwt.Claims) bool {
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return s.authKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return false
+	}
+	exp, err := claims.GetExpirationTime()
+	return err == nil && exp != nil
+}
+
+func authHost(req *http.Request) string {
+	return strings.ToLower(string(stripPort([]byte(req.Host))))
+}
+
+func (s *Server) verifySession(req *http.Request, o *oidcGate) bool {
+	cookie, err := req.Cookie(authSessionCookie)
+	if err != nil {
+		return false
+	}
+	var session authSession
+	return s.verifyAuth(cookie.Value, &session) &&
+		session.Host == authHost(req) &&
+		session.Gate == o.key()
+}
+
+func (c *conn) redirectToOIDC(o *oidcGate, req *http.Request) {
+	p, err := c.server.oidcProvider(o.issuer, false)
+	if err != nil {
+		c.Logger.Error().Err(err).Str("issuer", o.issuer).Msg("failed to get oidc provider")
+		c.writeAuthResponse(http.StatusBadGateway, nil)
+		return
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		c.writeAuthResponse(http.StatusInternalServerError, nil)
+		return
+	}
+	nonce := hex.EncodeToString(b)
+	state := c.server.signAuth(authState{
+		Nonce:            nonce,
+		Return:           req.URL.RequestURI(),
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(authStateDuration))},
+	})
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.clientID},
+		"redirect_uri":  {c.authCallbackURL(req)},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	location := p.AuthorizationEndpoint
+	if strings.IndexByte(location, '?') >= 0 {
+		location += "&" + query.Encode()
+	} else {
+		location += "?" + query.Encode()
+	}
+	header := http.Header{}
+	header.Set("Location", location)
+	header.Set("Set-Cookie", (&http.Cookie{
+		Name:     authStateCookie,
+		Value:    nonce,
+		Path:     authCallbackPath,
+		MaxAge:   int(authStateDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   c.isTLS(),
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+	c.writeAuthResponse(http.StatusFound, header)
+}
+
+// oidcClaims 是 ID token 中使用到的字段
+type oidcClaims struct {
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+func (c *conn) handleOIDCCallback(o *oidcGate, req *http.Request) {
+	query := req.URL.Query()
+	var state authState
+	if !c.server.verifyAuth(query.Get("state"), &state) {
+		c.Logger.Warn().Msg("invalid oidc state")
+		c.writeAuthResponse(http.StatusBadRequest, nil)
+		return
+	}
+	cookie, err := req.Cookie(authStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state.Nonce)) != 1 {
+		c.Logger.Warn().Msg("oidc state does not match the cookie")
+		c.writeAuthResponse(http.StatusBadRequest, nil)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		c.Logger.Info().Str("error", e).Msg("oidc login failed")
+		c.writeAuthResponse(http.StatusUnauthorized, nil)
+		return
+	}
+	idToken, err := c.server.exchangeOIDCCode(o, query.Get("code"), c.authCallbackURL(req))
+	if err != nil {
+		c.Logger.Error().Err(err).Str("issuer", o.issuer).Msg("failed to exchange oidc code")
+		c.writeAuthResponse(http.StatusBadGateway, nil)
+		return
+	}
+	claims, err := c.server.verifyIDToken(o.issuer, o.clientID, idToken)
+	if err == nil && subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(state.Nonce)) != 1 {
+		err = errInvalidIDToken
+	}
+	if err != nil {
+		c.Logger.Warn().Err(err).Str("issuer", o.issuer).Msg("invalid oidc id token")
+		c.writeAuthResponse(http.StatusUnauthorized, nil)
+		return
+	}
+	if !o.allowEmail(claims.Email, claims.EmailVerified) {
+		c.Logger.Warn().Str("email", claims.Email).Msg("oidc user is not allowed")
+		c.writeAuthResponse(http.StatusForbidden, nil)
+		return
+	}
+
+	duration := c.server.config.AuthSessionDuration.Duration
+	session := c.server.signAuth(authSession{
+		Host:             authHost(req),
+		Gate:             o.key(),
+		Email:            claims.Email,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration))},
+	})
+	location := state.Return
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+		location = "/"
+	}
+	header := http.Header{}
+	header.Set("Location", location)
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     authSessionCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(duration.Seconds()),
+		HttpOnly: true,
+		Secure:   c.isTLS(),
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:   authStateCookie,
+		Path:   authCallbackPath,
+		MaxAge: -1,
+	}).String())
+	c.Logger.Info().Str("email", claims.Email).Str("prefix", c.hostPrefix).Msg("oidc user logged in")
+	c.writeAuthResponse(http.StatusFound, header)
+}
+
+// exchangeOIDCCode 使用授权码获取 ID token
+func (s *Server) exchangeOIDCCode(o *oidcGate, code, redirectURI string) (idToken string, err error) {
+	p, err := s.oidcProvider(o.issuer, false)
+	if err != nil {
+		return
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+		"client_id":    {o.clientID},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := s.oidcHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status of oidc token endpoint: %s", resp.Status)
+		return
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token)
+	idToken = token.IDToken
+	return
+}
+
+// authGate 返回服务的认证配置，没有配置时返回 nil
+func (c *client) authGate(serviceIndex uint16) *authGate {
+	c.authsMtx.RLock()
+	defer c.authsMtx.RUnlock()
+	return c.serviceAuths[serviceIndex]
+}
+
+// setServiceAuths 设置客户端在握手中为各个服务指定的认证
+func (c *client) setServiceAuths(auths map[uint16]*authGate) {
+	c.authsMtx.Lock()
+	c.serviceAuths = auths
+	c.authsMtx.Unlock()
+}
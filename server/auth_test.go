@@ -0,0 +1,239 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/isrc-cas/gt/bufio"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func appendShortString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+func TestReadAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := sha256.Sum256([]byte("token1"))
+	data := []byte{1}
+	data = appendShortString(data, "user1:"+string(hash))
+	data = append(data, 1)
+	data = append(data, token[:]...)
+	data = append(data, 1)
+	data = appendShortString(data, "https://accounts.example.com")
+	data = appendShortString(data, "client1")
+	data = appendShortString(data, "secret1")
+	data = append(data, 1)
+	data = appendShortString(data, "@example.com")
+	g, err := readAuth(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := strings.Join(g.methods(), ","); m != "basic,bearer,oidc" {
+		t.Fatalf("unexpected methods %s", m)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://a.example.com/", nil)
+	if ok, present := g.check(req, false); ok || present {
+		t.Fatal("request without authorization should not pass")
+	}
+	req.SetBasicAuth("user1", "password1")
+	if ok, _ := g.check(req, false); !ok {
+		t.Fatal("valid basic auth should pass")
+	}
+	if ok, _ := g.check(req, true); !ok {
+		t.Fatal("verified basic auth should pass when limited")
+	}
+	req.SetBasicAuth("user1", "password2")
+	if ok, present := g.check(req, false); ok || !present {
+		t.Fatal("invalid basic auth should not pass")
+	}
+	req.Header.Set("Authorization", "Bearer token1")
+	if ok, _ := g.check(req, false); !ok {
+		t.Fatal("valid bearer token should pass")
+	}
+	if ok, present := g.check(req, true); ok || !present {
+		t.Fatal("bearer token should not be checked when limited")
+	}
+	req.Header.Set("Authorization", "Bearer token2")
+	if ok, _ := g.check(req, false); ok {
+		t.Fatal("invalid bearer token should not pass")
+	}
+
+	verified, unverified := true, false
+	if !g.oidc.allowEmail("Alice@Example.com", &verified) || !g.oidc.allowEmail("bob@example.com", nil) ||
+		g.oidc.allowEmail("bob@example.com", &unverified) || g.oidc.allowEmail("bob@example.org", &verified) ||
+		g.oidc.allowEmail("bob@evilexample.com", &verified) || g.oidc.allowEmail("", nil) {
+		t.Fatal("unexpected result of allowEmail")
+	}
+
+	cases := [][]byte{
+		{0, 0, 0},                       // 没有任何认证方式
+		{1, 5, 'u', 's', 'e', 'r', '1'}, // 没有哈希
+		appendShortString([]byte{1}, "user1:password1"),
+		{0, 0, 2},
+		append(appendShortString([]byte{0, 0, 1}, "ftp://example.com"), 7, 'c', 'l', 'i', 'e', 'n', 't', '1', 0, 0),
+		append(appendShortString([]byte{0, 0, 1}, "http://example.com"), 7, 'c', 'l', 'i', 'e', 'n', 't', '1', 0, 0),
+		{9},
+	}
+	for _, c := range cases {
+		if _, err := readAuth(bufio.NewReader(bytes.NewReader(c))); err == nil {
+			t.Fatalf("auth should be invalid: %v", c)
+		}
+	}
+}
+
+func TestCheckLimited(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &authGate{basic: map[string][]byte{"user1": hash}}
+	req, _ := http.NewRequest(http.MethodGet, "http://a.example.com/", nil)
+	req.SetBasicAuth("user1", "password1")
+	if ok, present := g.check(req, true); ok || !present {
+		t.Fatal("unverified basic auth should not pass when limited")
+	}
+
+	s := &Server{}
+	ip := netip.MustParseAddr("2001:db8::1")
+	for i := 0; i < authMaxFailures; i++ {
+		if s.authLimited(ip) {
+			t.Fatalf("visitor should not be limited after %d failures", i)
+		}
+		s.authFailed(ip)
+	}
+	if !s.authLimited(ip) || !s.authLimited(netip.MustParseAddr("2001:db8::2")) {
+		t.Fatal("visitor should be limited")
+	}
+	if s.authLimited(netip.MustParseAddr("2001:db8:0:1::1")) || s.authLimited(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatal("other visitors should not be limited")
+	}
+	s.authFailures[authFailureKey(ip)].reset = time.Now()
+	if s.authLimited(ip) {
+		t.Fatal("visitor should not be limited after the window")
+	}
+}
+
+func TestAuthExchange(t *testing.T) {
+	a := newAuthExchange(nil)
+	first := "GET /a HTTP/1.1\r\nHost: a.example.com\r\n\r\n"
+	second := "POST /b HTTP/1.1\r\nContent-Length: 4\r\n\r\n"
+	if n, err := a.request([]byte(first + second)); err != nil || n != len(first) {
+		t.Fatalf("only the first request should be read, got %d bytes, %v", n, err)
+	}
+	if n, _ := a.request([]byte(second + "ab")); n != len(second)+2 {
+		t.Fatalf("unexpected length %d", n)
+	}
+	if n, _ := a.request([]byte("cdGET / HTTP/1.1\r\n\r\n")); n != 2 {
+		t.Fatalf("only the rest of the body should be read, got %d bytes", n)
+	}
+
+	// 之前的响应结束之后才能响应被拒绝的请求
+	idle := make(chan bool)
+	go func() {
+		idle <- a.waitIdle()
+	}()
+	a.response([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	select {
+	case <-idle:
+		t.Fatal("should wait for the response of the second request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.response([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+	if !<-idle {
+		t.Fatal("all responses are done")
+	}
+
+	a = newAuthExchange(nil)
+	upgrade := "GET / HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	if n, _ := a.request([]byte(upgrade + "frame")); n != len(upgrade) || !a.upgrading {
+		t.Fatalf("unexpected length %d", n)
+	}
+	a.response([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\nframe"))
+	if upgraded, ok := a.wait(); !upgraded || !ok {
+		t.Fatal("connection should be upgraded")
+	}
+
+	// 响应无法解析或者任务结束时不再等待
+	a = newAuthExchange(nil)
+	_, _ = a.request([]byte(first))
+	a.response([]byte("invalid\r\n\r\n"))
+	if a.waitIdle() {
+		t.Fatal("invalid response should stop the exchange")
+	}
+	a = newAuthExchange(nil)
+	_, _ = a.request([]byte(first))
+	go a.close()
+	if a.waitIdle() {
+		t.Fatal("closed exchange should not be idle")
+	}
+}
+
+func TestSignAuth(t *testing.T) {
+	s := &Server{authKey: []byte("key1")}
+	expiry := func(d time.Duration) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(d))}
+	}
+	token := s.signAuth(authSession{Host: "a.example.com", Gate: "g", RegisteredClaims: expiry(time.Hour)})
+	var session authSession
+	if !s.verifyAuth(token, &session) || session.Host != "a.example.com" {
+		t.Fatalf("failed to verify session %s", token)
+	}
+	if s.verifyAuth(token[:len(token)-2], &session) || s.verifyAuth(strings.Replace(token, ".", "a.", 1), &session) {
+		t.Fatal("tampered session should be invalid")
+	}
+	if (&Server{authKey: []byte("key2")}).verifyAuth(token, &session) {
+		t.Fatal("session signed with another key should be invalid")
+	}
+	if s.verifyAuth(s.signAuth(authSession{Host: "a.example.com", RegisteredClaims: expiry(-time.Minute)}), &session) ||
+		s.verifyAuth(s.signAuth(authSession{Host: "a.example.com"}), &session) {
+		t.Fatal("session without a valid expiry should be invalid")
+	}
+}
+
+func TestPeekRequest(t *testing.T) {
+	data := "GET /path?q=1 HTTP/1.1\r\nHost: a.example.com\r\nCookie: gt_session=abc\r\n\r\nbody"
+	reader := bufio.NewReader(strings.NewReader(data))
+	req, err := peekRequest(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Host != "a.example.com" || req.URL.RequestURI() != "/path?q=1" {
+		t.Fatalf("unexpected request %v", req)
+	}
+	if c, err := req.Cookie(authSessionCookie); err != nil || c.Value != "abc" {
+		t.Fatalf("unexpected cookie %v", c)
+	}
+	if reader.Buffered() != len(data) {
+		t.Fatal("peekRequest should not consume the reader")
+	}
+
+	_, err = peekRequest(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a.example.com\r\n")))
+	if err == nil {
+		t.Fatal("incomplete request should fail")
+	}
+}
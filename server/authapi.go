@@ -0,0 +1,431 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+	"github.com/isrc-cas/gt/util"
+)
+
+// ErrAuthAPIUnavailable is returned if the auth API fails or its circuit breaker is open, and the user is not cached
+var ErrAuthAPIUnavailable = errors.New("auth API is unavailable")
+
+type authParam struct {
+	NetworkClientId  string   `json:"networkClientId"`
+	NetworkSecretKey string   `json:"networkSecretKey"`
+	AppletTokens     []string `json:"appletTokens"`
+}
+
+// authAPIResponse 认证 API 的响应，除 result 与 appletTokens 外的字段都是可选的，设置后覆盖全局的默认值
+type authAPIResponse struct {
+	Result       bool       `json:"result"`
+	AppletTokens []string   `json:"appletTokens"`
+	Speed        *uint32    `json:"speed"`
+	SpeedUp      *uint32    `json:"speedUp"`
+	SpeedDown    *uint32    `json:"speedDown"`
+	SpeedBurst   *uint32    `json:"speedBurst"`
+	Connections  *uint32    `json:"connections"`
+	TCPNumber    *uint16    `json:"tcpNumber"`
+	TCPRanges    []string   `json:"tcpRanges"`
+	HostNumber   *uint32    `json:"hostNumber"`
+	HostRegex    []string   `json:"hostRegex"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+}
+
+// authAPIEvictInterval 删除过期的认证缓存的最小间隔
+const authAPIEvictInterval = time.Minute
+
+// authAPIEntry 缓存的认证结果，只缓存认证成功的结果
+type authAPIEntry struct {
+	key      [32]byte // secret 与 host 前缀的摘要
+	user     user
+	cachedAt time.Time
+}
+
+// authAPIPorts 用户的 tcp 端口范围，范围不变时沿用同一个 portsManager，已分配的端口不会被重复分配
+type authAPIPorts struct {
+	ranges string
+	pm     *portsManager
+}
+
+// authAPIClient 请求认证 API，缓存认证结果，失败时重试，连续失败时熔断
+type authAPIClient struct {
+	server *Server
+	client http.Client
+
+	mtx       gosync.Mutex
+	entries   map[string]*authAPIEntry // key: id
+	ports     map[string]authAPIPorts  // key: id
+	evictedAt time.Time                // 上次删除过期缓存的时间
+	failures  uint                     // 连续失败的请求数
+	openUntil time.Time                // 熔断结束的时间
+}
+
+func newAuthAPIClient(s *Server) *authAPIClient {
+	return &authAPIClient{
+		server:  s,
+		client:  http.Client{Timeout: s.config.Timeout.Duration},
+		entries: make(map[string]*authAPIEntry),
+		ports:   make(map[string]authAPIPorts),
+	}
+}
+
+// auth 认证 id 与 secret。缓存未过期时不请求 API，API 不可用时使用缓存的结果
+func (a *authAPIClient) auth(id string, secret string, prefixes []string) (u user, ok bool, err error) {
+	key := authAPIKey(secret, prefixes)
+	now := time.Now()
+	entry := a.cached(id, key, now)
+	if entry != nil && now.Sub(entry.cachedAt) < a.server.config.AuthAPICacheTTL.Duration {
+		return entry.user, true, nil
+	}
+
+	if a.open(now) {
+		err = ErrAuthAPIUnavailable
+	} else {
+		var resp authAPIResponse
+		resp, err = a.request(id, secret, prefixes)
+		a.done(err)
+		if err == nil {
+			if !resp.Result || resp.ExpiresAt != nil && !resp.ExpiresAt.After(now) {
+				a.remove(id)
+				return
+			}
+			u, err = a.newUser(id, &resp)
+			if err != nil {
+				return
+			}
+			a.store(id, &authAPIEntry{key: key, user: u, cachedAt: now})
+			return u, true, nil
+		}
+	}
+	if entry != nil && now.Sub(entry.cachedAt) < a.server.config.AuthAPICacheMaxStale.Duration {
+		a.server.Logger.Warn().Err(err).Str("id", id).Time("cachedAt", entry.cachedAt).Msg("use the cached result of auth API")
+		return entry.user, true, nil
+	}
+	return
+}
+
+// authAPIKey 计算 secret 与请求的 host 前缀的摘要，secret 或 host 前缀改变时不使用缓存
+func authAPIKey(secret string, prefixes []string) (key [32]byte) {
+	sorted := append([]string(nil), prefixes...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	h.Write([]byte(secret))
+	for _, p := range sorted {
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	h.Sum(key[:0])
+	return
+}
+
+func (a *authAPIClient) cached(id string, key [32]byte, now time.Time) *authAPIEntry {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	entry, ok := a.entries[id]
+	if !ok || entry.key != key {
+		return nil
+	}
+	if a.expired(entry, now) {
+		delete(a.entries, id)
+		return nil
+	}
+	return entry
+}
+
+// expired 判断缓存是否不再使用：用户已过期，或者超过了 AuthAPICacheTTL 与 AuthAPICacheMaxStale
+func (a *authAPIClient) expired(entry *authAPIEntry, now time.Time) bool {
+	if !entry.user.expiresAt.IsZero() && !entry.user.expiresAt.After(now) {
+		return true
+	}
+	age := now.Sub(entry.cachedAt)
+	return age >= a.server.config.AuthAPICacheTTL.Duration && age >= a.server.config.AuthAPICacheMaxStale.Duration
+}
+
+// store 缓存 id 的认证结果，每隔 authAPIEvictInterval 删除过期的缓存
+func (a *authAPIClient) store(id string, entry *authAPIEntry) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.entries[id] = entry
+	if entry.cachedAt.Sub(a.evictedAt) < authAPIEvictInterval {
+		return
+	}
+	a.evictedAt = entry.cachedAt
+	for k, e := range a.entries {
+		if a.expired(e, entry.cachedAt) {
+			delete(a.entries, k)
+		}
+	}
+}
+
+func (a *authAPIClient) remove(id string) {
+	a.mtx.Lock()
+	delete(a.entries, id)
+	a.mtx.Unlock()
+}
+
+// open 判断熔断是否打开，打开期间不请求 API
+func (a *authAPIClient) open(now time.Time) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return now.Before(a.openUntil)
+}
+
+// done 记录请求的结果，连续失败 AuthAPIBreakerFailures 次后熔断 AuthAPIBreakerDuration
+func (a *authAPIClient) done(err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err == nil {
+		a.failures = 0
+		return
+	}
+	a.failures++
+	threshold := a.server.config.AuthAPIBreakerFailures
+	if threshold == 0 || a.failures < threshold {
+		return
+	}
+	a.failures = 0
+	a.openUntil = time.Now().Add(a.server.config.AuthAPIBreakerDuration.Duration)
+	a.server.Logger.Warn().Err(err).Time("until", a.openUntil).Msg("auth API circuit breaker is open")
+}
+
+// request 请求认证 API，失败时按指数退避重试 AuthAPIRetries 次
+func (a *authAPIClient) request(id string, secret string, prefixes []string) (resp authAPIResponse, err error) {
+	body, err := json.Marshal(&authParam{
+		NetworkClientId:  id,
+		NetworkSecretKey: secret,
+		AppletTokens:     prefixes,
+	})
+	if err != nil {
+		return
+	}
+	delay := a.server.config.AuthAPIRetryDelay.Duration
+	for i := uint(0); ; i++ {
+		var retry bool
+		resp, retry, err = a.do(body)
+		if err == nil || !retry || i >= a.server.config.AuthAPIRetries || a.server.IsClosing() {
+			return
+		}
+		a.server.Logger.Debug().Err(err).Str("id", id).Dur("delay", delay).Msg("retry auth API")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (a *authAPIClient) do(body []byte) (resp authAPIResponse, retry bool, err error) {
+	req, err := http.NewRequest("POST", a.server.config.AuthAPI, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Request-Id", timestamp)
+	if len(a.server.config.AuthAPISecret) > 0 {
+		req.Header.Set("X-GT-Timestamp", timestamp)
+		req.Header.Set("X-GT-Signature", signAuthAPIRequest(a.server.config.AuthAPISecret, timestamp, body))
+	}
+	r, err := a.client.Do(req)
+	if err != nil {
+		retry = true
+		return
+	}
+	defer r.Body.Close()
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		retry = true
+		return
+	}
+	if r.StatusCode != http.StatusOK {
+		retry = r.StatusCode >= http.StatusInternalServerError || r.StatusCode == http.StatusTooManyRequests
+		err = fmt.Errorf("invalid http status code %d, body: %s", r.StatusCode, string(b))
+		return
+	}
+	err = json.Unmarshal(b, &resp)
+	return
+}
+
+// signAuthAPIRequest 计算 X-GT-Signature：以 AuthAPISecret 为密钥对 "timestamp\nbody" 计算 HMAC-SHA256 的 hex
+func signAuthAPIRequest(secret string, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newUser 使用 API 返回的限制覆盖全局的默认值
+func (a *authAPIClient) newUser(id string, resp *authAPIResponse) (u user, err error) {
+	u = a.server.defaultUser()
+	// 与 users 配置相同，用户的 speed 优先级高于全局的 speedUp 与 speedDown
+	if resp.Speed != nil {
+		u.Speed = *resp.Speed
+		u.SpeedUp = *resp.Speed
+		u.SpeedDown = *resp.Speed
+	}
+	if resp.SpeedUp != nil {
+		u.SpeedUp = *resp.SpeedUp
+	}
+	if resp.SpeedDown != nil {
+		u.SpeedDown = *resp.SpeedDown
+	}
+	if resp.SpeedBurst != nil {
+		u.SpeedBurst = *resp.SpeedBurst
+	}
+	if resp.Connections != nil {
+		u.Connections = *resp.Connections
+	}
+	if resp.TCPNumber != nil {
+		u.TCPNumber = resp.TCPNumber
+	}
+	if len(resp.TCPRanges) > 0 {
+		u.portsManager, err = a.portsManager(id, resp.TCPRanges)
+		if err != nil {
+			return
+		}
+	}
+	if resp.HostNumber != nil {
+		u.Host.Number = resp.HostNumber
+	}
+	if resp.HostRegex != nil {
+		regexStr := config.Slice[string](resp.HostRegex)
+		regexes := make([]*regexp.Regexp, 0, len(resp.HostRegex))
+		for _, str := range resp.HostRegex {
+			var regex *regexp.Regexp
+			regex, err = regexp.Compile(str)
+			if err != nil {
+				return
+			}
+			regexes = append(regexes, regex)
+		}
+		u.Host.RegexStr = &regexStr
+		u.Host.Regex = &regexes
+	}
+	if resp.ExpiresAt != nil {
+		u.expiresAt = *resp.ExpiresAt
+	}
+	u.Host.Prefixes = make(map[string]struct{}, len(resp.AppletTokens)+1)
+	u.Host.Prefixes[id] = struct{}{}
+	for _, prefix := range resp.AppletTokens {
+		u.Host.Prefixes[prefix] = struct{}{}
+	}
+	return
+}
+
+// portsManager 返回用户的 tcp 端口范围的 portsManager。与 users 配置相同，端口记录在 Server 的 tcpOwners 中，
+// 与全局配置或者其他用户的端口重叠时返回错误
+func (a *authAPIClient) portsManager(id string, ranges []string) (pm *portsManager, err error) {
+	joined := strings.Join(ranges, ",")
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if p, ok := a.ports[id]; ok && p.ranges == joined {
+		return p.pm, nil
+	}
+	s := a.server
+	s.tcpOwnersMtx.Lock()
+	defer s.tcpOwnersMtx.Unlock()
+	ports := make(map[uint16]struct{})
+	for _, r := range ranges {
+		var pr util.PortRange
+		pr, err = util.NewPortRangeFromString(r)
+		if err != nil {
+			return
+		}
+		for i := pr.Min; i <= pr.Max; i++ {
+			if owner, ok := s.tcpOwners[i]; ok && owner != id {
+				if len(owner) == 0 {
+					err = fmt.Errorf("tcp port %d is used by global", i)
+				} else {
+					err = fmt.Errorf("tcp port %d is used by user %q", i, owner)
+				}
+				return
+			}
+			ports[i] = struct{}{}
+			if i == math.MaxUint16 {
+				break
+			}
+		}
+	}
+	a.releasePorts(id)
+	if s.tcpOwners == nil {
+		s.tcpOwners = make(map[uint16]string, len(ports))
+	}
+	all := make(map[uint16]struct{}, len(ports))
+	for port := range ports {
+		all[port] = struct{}{}
+		s.tcpOwners[port] = id
+	}
+	pm = &portsManager{ports: ports, all: all}
+	a.ports[id] = authAPIPorts{ranges: joined, pm: pm}
+	return
+}
+
+// releasePorts 删除 id 之前分配的端口，调用时需要持有 a.mtx 与 tcpOwnersMtx
+func (a *authAPIClient) releasePorts(id string) {
+	p, ok := a.ports[id]
+	if !ok {
+		return
+	}
+	for port := range p.pm.all {
+		if a.server.tcpOwners[port] == id {
+			delete(a.server.tcpOwners, port)
+		}
+	}
+	delete(a.ports, id)
+}
+
+// reclaimPorts 在重新加载配置后使用新配置的端口所有者，并保留 API 分配的端口。
+// 与新配置重叠的用户的端口与缓存被删除，下次认证时重新请求 API
+func (a *authAPIClient) reclaimPorts(owners map[uint16]string) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.server.tcpOwnersMtx.Lock()
+	defer a.server.tcpOwnersMtx.Unlock()
+	for id, p := range a.ports {
+		overlapped := false
+		for port := range p.pm.all {
+			if owner, ok := owners[port]; ok && owner != id {
+				overlapped = true
+				break
+			}
+		}
+		if overlapped {
+			a.server.Logger.Warn().Str("id", id).Msg("tcp ports of auth API overlap with the reloaded config")
+			delete(a.ports, id)
+			delete(a.entries, id)
+			continue
+		}
+		for port := range p.pm.all {
+			owners[port] = id
+		}
+	}
+	a.server.tcpOwners = owners
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+func newTestAuthAPI(t *testing.T, handler http.HandlerFunc) (a *authAPIClient, requests *atomic.Int32) {
+	requests = &atomic.Int32{}
+	api := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+		handler(writer, request)
+	}))
+	t.Cleanup(api.Close)
+	conf := defaultConfig()
+	conf.AuthAPI = api.URL
+	conf.AuthAPIRetryDelay = config.Duration{Duration: time.Millisecond}
+	s := &Server{config: conf}
+	s.portsManager.ports = map[uint16]struct{}{10000: {}}
+	s.tcpOwners = map[uint16]string{10000: "", 10010: "user1"}
+	a = newAuthAPIClient(s)
+	return
+}
+
+func TestAuthAPIUser(t *testing.T) {
+	a, _ := newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, `{"result":true,"appletTokens":["p1"],"speed":100,"speedDown":200,"connections":3,`+
+			`"tcpNumber":2,"tcpRanges":["10001-10002"],"hostNumber":4,"hostRegex":["^p"],"expiresAt":"2100-01-02T03:04:05Z"}`)
+	})
+	u, ok, err := a.auth("id1", "secret1", []string{"p1"})
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if u.Speed != 100 || u.SpeedUp != 100 || u.SpeedDown != 200 || u.Connections != 3 || *u.TCPNumber != 2 ||
+		*u.Host.Number != 4 || len(*u.Host.Regex) != 1 || !(*u.Host.Regex)[0].MatchString("p1") {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	if _, ok := u.Host.Prefixes["id1"]; !ok {
+		t.Fatal("id should be a host prefix")
+	}
+	if _, ok := u.Host.Prefixes["p1"]; !ok {
+		t.Fatal("p1 should be a host prefix")
+	}
+	if u.portsManager.contains(10000) || !u.portsManager.contains(10001) || !u.portsManager.contains(10002) {
+		t.Fatalf("unexpected ports %v", u.portsManager.all)
+	}
+	if !u.expiresAt.Equal(time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected expiry %v", u.expiresAt)
+	}
+	u2, _, _ := a.auth("id1", "secret1", []string{"p1"})
+	if u2.portsManager != u.portsManager {
+		t.Fatal("the ports manager should be reused")
+	}
+
+	a, _ = newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, `{"result":true}`)
+	})
+	u, ok, err = a.auth("id1", "secret1", nil)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if u.Connections != a.server.config.Connections || u.portsManager != &a.server.portsManager || !u.expiresAt.IsZero() {
+		t.Fatalf("the global defaults should be used %+v", u)
+	}
+
+	a, _ = newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, `{"result":true,"expiresAt":"2000-01-01T00:00:00Z"}`)
+	})
+	_, ok, err = a.auth("id1", "secret1", nil)
+	if err != nil || ok {
+		t.Fatal("expired user should be rejected", err)
+	}
+}
+
+func TestAuthAPIPorts(t *testing.T) {
+	var ranges atomic.Value
+	a, _ := newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, `{"result":true,"tcpRanges":[`+ranges.Load().(string)+`]}`)
+	})
+	auth := func(id string, r string) error {
+		ranges.Store(r)
+		_, _, err := a.auth(id, "secret", nil)
+		return err
+	}
+	if err := auth("id1", `"10001-10002"`); err != nil {
+		t.Fatal(err)
+	}
+	// 与全局配置、users 配置以及其他用户的端口重叠时拒绝
+	for _, r := range []string{`"10000"`, `"10010"`, `"10002-10003"`} {
+		if err := auth("id2", r); err == nil {
+			t.Fatalf("%s should be rejected", r)
+		}
+	}
+	if owner := a.server.tcpOwners[10003]; owner != "" {
+		t.Fatal("rejected ports should not be recorded", owner)
+	}
+	// 端口范围改变后之前的端口可以分配给其他用户
+	if err := auth("id1", `"10005"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth("id2", `"10002-10003"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.server.tcpOwners[10001]; ok || a.server.tcpOwners[10002] != "id2" || a.server.tcpOwners[10005] != "id1" {
+		t.Fatalf("unexpected owners %v", a.server.tcpOwners)
+	}
+
+	// 重新加载的配置使用了 id1 的端口
+	a.reclaimPorts(map[uint16]string{10005: "user2"})
+	if _, ok := a.ports["id1"]; ok {
+		t.Fatal("the overlapped ports should be removed")
+	}
+	if _, ok := a.entries["id1"]; ok {
+		t.Fatal("the overlapped user should ask the API again")
+	}
+	if a.server.tcpOwners[10002] != "id2" || a.server.tcpOwners[10005] != "user2" {
+		t.Fatalf("unexpected owners %v", a.server.tcpOwners)
+	}
+	if err := auth("id1", `"10005"`); err == nil {
+		t.Fatal("the port of the reloaded config should be rejected")
+	}
+}
+
+func TestAuthAPICache(t *testing.T) {
+	var fail, reject atomic.Bool
+	a, requests := newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		if fail.Load() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(writer, `{"result":`+strconv.FormatBool(!reject.Load())+`}`)
+	})
+	a.server.config.AuthAPICacheTTL = config.Duration{Duration: time.Hour}
+	a.server.config.AuthAPIBreakerFailures = 2
+	for i := 0; i < 2; i++ {
+		if _, ok, err := a.auth("id1", "secret1", nil); err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("the result should be cached, %d requests", n)
+	}
+	// secret 改变时不使用缓存
+	if _, ok, err := a.auth("id1", "secret2", nil); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("unexpected %d requests", n)
+	}
+
+	// API 失败时重试，仍然失败时使用缓存的结果
+	fail.Store(true)
+	a.server.config.AuthAPICacheTTL = config.Duration{}
+	if _, ok, err := a.auth("id1", "secret2", nil); err != nil || !ok {
+		t.Fatal("cached user should be accepted", ok, err)
+	}
+	if n := requests.Load(); n != 5 {
+		t.Fatalf("unexpected %d requests", n)
+	}
+	if _, ok, err := a.auth("id2", "secret2", nil); ok || err == nil {
+		t.Fatal("uncached user should be rejected", ok, err)
+	}
+	// 连续失败 2 次后熔断，不再请求 API
+	if n := requests.Load(); n != 8 {
+		t.Fatalf("unexpected %d requests", n)
+	}
+	if _, ok, err := a.auth("id1", "secret2", nil); err != nil || !ok {
+		t.Fatal("cached user should be accepted", ok, err)
+	}
+	if _, ok, err := a.auth("id2", "secret2", nil); ok || !errors.Is(err, ErrAuthAPIUnavailable) {
+		t.Fatal("uncached user should be rejected", ok, err)
+	}
+	if n := requests.Load(); n != 8 {
+		t.Fatalf("the circuit breaker should be open, %d requests", n)
+	}
+
+	// API 恢复后关闭熔断，拒绝时删除缓存
+	fail.Store(false)
+	reject.Store(true)
+	a.mtx.Lock()
+	a.openUntil = time.Time{}
+	a.mtx.Unlock()
+	if _, ok, err := a.auth("id1", "secret2", nil); ok || err != nil {
+		t.Fatal("rejected user should not be accepted", ok, err)
+	}
+	fail.Store(true)
+	if _, ok, _ := a.auth("id1", "secret2", nil); ok {
+		t.Fatal("the cached result should be removed")
+	}
+}
+
+func TestAuthAPICacheMaxStale(t *testing.T) {
+	var fail atomic.Bool
+	a, _ := newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		if fail.Load() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(writer, `{"result":true}`)
+	})
+	a.server.config.AuthAPIRetries = 0
+	for _, id := range []string{"id1", "id2"} {
+		if _, ok, err := a.auth(id, "secret", nil); err != nil || !ok {
+			t.Fatal(ok, err)
+		}
+	}
+	age := func(id string, d time.Duration) {
+		a.mtx.Lock()
+		a.entries[id].cachedAt = a.entries[id].cachedAt.Add(-d)
+		a.mtx.Unlock()
+	}
+
+	// API 失败时只使用 AuthAPICacheMaxStale 内缓存的结果
+	fail.Store(true)
+	age("id1", 30*time.Minute)
+	if _, ok, err := a.auth("id1", "secret", nil); err != nil || !ok {
+		t.Fatal("cached user should be accepted", ok, err)
+	}
+	age("id1", time.Hour)
+	if _, ok, err := a.auth("id1", "secret", nil); ok || err == nil {
+		t.Fatal("stale user should be rejected", ok, err)
+	}
+	if _, ok := a.entries["id1"]; ok {
+		t.Fatal("stale entry should be removed")
+	}
+
+	// 缓存新的结果时删除过期的缓存
+	fail.Store(false)
+	age("id2", 2*time.Hour)
+	a.evictedAt = time.Time{}
+	if _, ok, err := a.auth("id3", "secret", nil); err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if _, ok := a.entries["id2"]; ok {
+		t.Fatal("stale entry should be evicted")
+	}
+	if _, ok := a.entries["id3"]; !ok {
+		t.Fatal("the result should be cached")
+	}
+}
+
+func TestAuthAPISignature(t *testing.T) {
+	var a *authAPIClient
+	a, _ = newTestAuthAPI(t, func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		timestamp := request.Header.Get("X-GT-Timestamp")
+		if request.Header.Get("X-GT-Signature") != signAuthAPIRequest("api secret", timestamp, body) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(writer, `{"result":true}`)
+	})
+	if _, ok, err := a.auth("id1", "secret1", nil); ok || err == nil {
+		t.Fatal("unsigned request should be rejected", ok, err)
+	}
+	a.server.config.AuthAPISecret = "api secret"
+	if _, ok, err := a.auth("id1", "secret1", nil); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+}
@@ -40,15 +40,32 @@ type client struct {
 	portsManager *portsManager
 	tcpListeners ssync.Map // key: serverIndex value: net.Listener
 
-	speedMutex    sync.Mutex
-	speedNum      uint32
-	uploadCount   uint32
-	downloadCount uint32
+	udpPortsManager *portsManager
+	udpListeners    ssync.Map // key: serverIndex value: *udpListener
+
+	upLimiter      *limiter
+	downLimiter    *limiter
+	speedLimits    map[string]speed // key: hostPrefix(string)，tcp 端口的形式为 tcp:port，udp 端口的形式为 udp:port
+	speedLimitsMtx sync.RWMutex
+	prefixLimiters ssync.Map // key: hostPrefix(string) value: *prefixLimiter
+
+	acl         *acl
+	prefixACLs  map[string]*acl // key 与 speedLimits 相同
+	serviceACLs map[uint16]*acl // key: serviceIndex，由客户端在握手中指定
+	aclsMtx     sync.RWMutex
+
+	serviceAuths map[uint16]*authGate // key: serviceIndex，由客户端在握手中指定
+	authsMtx     sync.RWMutex
 
 	connections uint32
 
 	host host
 
+	expiry    *time.Timer // 认证 API 返回的过期时间到达时关闭 client
+	expiryMtx sync.Mutex
+
+	usage *clientUsage
+
 	checksumBlacklist     *lru.Cache[[32]byte, any]
 	lastProcessedChecksum [32]byte
 }
@@ -61,9 +78,15 @@ func newClient() interface{} {
 func (c *client) init(id string, u user, s *Server) {
 	c.host = u.Host
 	c.portsManager = u.portsManager
-	c.speedNum = u.Speed
+	c.udpPortsManager = u.udpPortsManager
+	c.upLimiter = newLimiter(u.SpeedUp, u.SpeedBurst)
+	c.downLimiter = newLimiter(u.SpeedDown, u.SpeedBurst)
+	c.speedLimits = u.SpeedLimits
+	c.acl = u.acl
+	c.prefixACLs = u.acls
 	c.connections = u.Connections
 	c.checksumBlacklist, _ = lru.New[[32]byte, any](3)
+	c.usage = s.getOrCreateUsage(id)
 	c.logger = s.Logger.With().
 		Str("client", id).
 		Logger()
@@ -91,7 +114,19 @@ func (c *client) process(task *conn) (err error) {
 	if tunnel == nil {
 		return ErrNoTunnelExists
 	}
+	task.usage = c.usage.get(task.hostPrefix)
+	task.usage.tasks.Add(1)
+	task.upLimiters = []*limiter{c.upLimiter, tunnel.server.upLimiter}
+	if pl := c.getPrefixLimiter(task.hostPrefix); pl != nil {
+		task.downLimiter = pl.down
+		task.upLimiters = append(task.upLimiters, pl.up)
+	}
+	if task.startUploadLoop(tunnel, taskID) {
+		defer task.stopUploadLoop()
+	}
+	start := time.Now()
 	tunnel.process(taskID, task, c)
+	task.usage.observe(time.Since(start))
 	return nil
 }
 
@@ -176,6 +211,21 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 		}
 	}
 
+	if c.udpPortsManager != nil {
+		err = t.processUDPOptions(o, c)
+		if err != nil {
+			return
+		}
+	} else if len(o.udpPorts) > 0 {
+		err = connection.ErrUDPNumberLimited
+		if e := t.SendErrorSignalUDPNumberLimited(); e != nil {
+			t.Logger.Error().Err(e).Msg("failed to SendErrorSignalUDPNumberLimited")
+		}
+		return
+	}
+
+	c.setServiceACLs(o.acls)
+	c.setServiceAuths(o.auths)
 	c.lastProcessedChecksum = o.configChecksum
 
 	if reload {
@@ -234,8 +284,8 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 				Hex("newChecksum", o.configChecksum[:]).
 				Msg("added old checksum to blacklist")
 			for id, changes := range ids {
-				if changes.remove || changes.oldServiceIndex.tls != changes.serviceIndex.tls {
-					t.server.removeHostPrefix(id, changes.oldServiceIndex.tls)
+				if changes.remove || !changes.oldServiceIndex.sameKind(changes.serviceIndex) {
+					t.server.removeHostPrefix(id, changes.oldServiceIndex, c)
 					t.Logger.Info().
 						Str("id", c.id).
 						Hex("oldChecksum", checksum[:]).
@@ -244,7 +294,7 @@ func (c *client) addTunnel(t *conn, reload bool, o options) (ok bool, err error)
 						Str("oldServiceIndex", changes.oldServiceIndex.String()).
 						Msg("removed associated host prefix")
 				} else {
-					t.server.storeHostPrefix(id, changes.serviceIndex.tls,
+					t.server.storeHostPrefix(id, changes.serviceIndex,
 						clientWithServiceIndex{
 							client:       c,
 							serviceIndex: changes.serviceIndex.serviceIndex,
@@ -272,16 +322,17 @@ func (c *client) removeTunnel(tunnel *conn) {
 		delete(c.tunnels, tunnel)
 		if len(c.tunnels) < 1 {
 			c.tunnels = nil
-			tunnel.server.removeClient(c.id)
+			tunnel.server.removeClientFunc()(c.id)
 			for hostPrefix, o := range tunnel.ids {
 				tunnel.Logger.Info().
 					Hex("checksum", tunnel.configChecksum[:]).
 					Str("prefix", hostPrefix).
 					Str("serviceIndex", o.String()).
 					Msg("remove associated host prefix")
-				tunnel.server.removeHostPrefix(hostPrefix, o.tls)
+				tunnel.server.removeHostPrefix(hostPrefix, o, c)
 			}
 			c.closeTCPListeners()
+			c.closeUDPListeners()
 		}
 	}
 }
@@ -323,16 +374,35 @@ func (c *client) close() {
 			t.Close()
 		}
 		c.closeTCPListeners()
+		c.closeUDPListeners()
 		c.tunnelsRWMtx.Unlock()
 	})
 }
 
+// expireAt 在 t 关闭 client 的所有隧道，t 为零值时不过期。每次认证都会更新过期时间
+func (c *client) expireAt(t time.Time) {
+	c.expiryMtx.Lock()
+	defer c.expiryMtx.Unlock()
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(t), func() {
+		c.logger.Info().Time("expiresAt", t).Msg("client expired")
+		c.close()
+	})
+}
+
 func (c *client) shutdown() {
 	c.tunnelsRWMtx.Lock()
 	for t := range c.tunnels {
 		t.Shutdown()
 	}
 	c.closeTCPListeners()
+	c.closeUDPListeners()
 	c.tunnelsRWMtx.Unlock()
 }
 
@@ -346,9 +416,7 @@ func (c *client) closeTCPListeners() {
 					Interface("serviceIndex", key).
 					Uint16("port", port).
 					Msg("close associated tcp listener")
-				c.portsManager.portsMtx.Lock()
-				c.portsManager.ports[port] = struct{}{}
-				c.portsManager.portsMtx.Unlock()
+				l.releasePort(port)
 				_ = l.l.Close()
 			}
 		}
@@ -356,6 +424,17 @@ func (c *client) closeTCPListeners() {
 	})
 }
 
+func (c *client) tcpListenersLen() (n int) {
+	c.tcpListeners.Range(func(key, value interface{}) bool {
+		l, ok := value.(*tcpListener)
+		if ok && l.l != nil {
+			n++
+		}
+		return true
+	})
+	return
+}
+
 func (c *client) deleteTCPListener(si uint16) {
 	value, loaded := c.tcpListeners.LoadAndDelete(si)
 	if loaded {
@@ -367,9 +446,7 @@ func (c *client) deleteTCPListener(si uint16) {
 					Uint16("serviceIndex", si).
 					Uint16("port", port).
 					Msg("close associated tcp listener")
-				c.portsManager.portsMtx.Lock()
-				c.portsManager.ports[port] = struct{}{}
-				c.portsManager.portsMtx.Unlock()
+				l.releasePort(port)
 				_ = l.l.Close()
 			}
 		}
@@ -377,13 +454,50 @@ func (c *client) deleteTCPListener(si uint16) {
 }
 
 type portsManager struct {
-	ports    map[uint16]struct{}
+	ports    map[uint16]struct{} // 可分配的端口
+	all      map[uint16]struct{} // 配置的全部端口，nil 表示不限制归还的端口
 	portsMtx sync.Mutex
 }
 
+// release 归还端口，重新加载配置后不在配置中的端口不再归还
+func (pm *portsManager) release(port uint16) {
+	pm.portsMtx.Lock()
+	defer pm.portsMtx.Unlock()
+	if pm.all != nil {
+		if _, ok := pm.all[port]; !ok {
+			return
+		}
+	}
+	pm.ports[port] = struct{}{}
+}
+
+// contains 判断 port 是否在配置的端口中
+func (pm *portsManager) contains(port uint16) bool {
+	pm.portsMtx.Lock()
+	defer pm.portsMtx.Unlock()
+	if pm.all != nil {
+		_, ok := pm.all[port]
+		return ok
+	}
+	_, ok := pm.ports[port]
+	return ok
+}
+
 type tcpListener struct {
-	l    net.Listener
-	port openTCPOption
+	l     net.Listener
+	port  openTCPOption
+	pm    atomic.Pointer[portsManager] // 分配端口的 portsManager
+	group *backendGroup                // 端口属于组时 l 为 *groupListener
+}
+
+func (l *tcpListener) releasePort(port uint16) {
+	if gl, ok := l.l.(*groupListener); ok && !gl.leave() {
+		return // 组中还有其他成员使用该端口
+	}
+	pm := l.pm.Load()
+	if pm != nil {
+		pm.release(port)
+	}
 }
 
 func (c *client) openTCPPort(serviceIndex uint16, l *tcpListener, tunnel *conn) (openedTCPPort uint16, err error) {
@@ -434,8 +548,10 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 	if err != nil {
 		return err
 	}
+	listener = tunnel.server.proxyListener(listener)
 	tunnel.Logger.Info().Uint16("port", tcpPort).Msg("tcp port opened")
 	l.l = listener
+	l.pm.Store(c.portsManager)
 
 	// 启动 goroutine 处理 tcp 连接
 	go tunnel.server.acceptLoop(listener, func(conn *conn) {
@@ -443,9 +559,19 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 			tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).Uint16("tcpPort", tcpPort).Msg("tcp forward stop")
 		}()
 		tunnel.Logger.Info().Uint16("serviceIndex", serviceIndex).Uint16("tcpPort", tcpPort).Msg("tcp forward start")
-		conn.serviceIndex = serviceIndex
+		conn.hostPrefix = "tcp:" + strconv.Itoa(int(tcpPort))
 		conn.handle(func() bool {
-			err = c.process(conn)
+			// 端口属于组时由组选择处理连接的 client
+			target, ok := clientWithServiceIndex{client: c, serviceIndex: serviceIndex, group: l.group}.pick()
+			if !ok {
+				conn.Logger.Error().Err(ErrNoTunnelExists).Msg("tcp handle")
+				return false
+			}
+			conn.serviceIndex = target.serviceIndex
+			if !conn.allowVisitor(target) {
+				return true
+			}
+			err = target.process(conn)
 			if err != nil {
 				conn.Logger.Error().Err(err).Msg("tcp handle")
 				return false
@@ -457,28 +583,38 @@ func (c *client) openSpecifiedTCPPort(serviceIndex uint16, l *tcpListener, tcpPo
 	return nil
 }
 
-func (c *client) needSpeedLimit() (ok bool) {
-	return c.speedNum > 0
-}
-
-func (c *client) speedLimit(bufLen uint32, isUpload bool) {
-	c.speedMutex.Lock()
-	defer c.speedMutex.Unlock()
-
-	// 上下行分开限速，限制的速度都是 Speed
-	count := &c.downloadCount
-	if isUpload {
-		count = &c.uploadCount
+// getPrefixLimiter 获取 host 前缀或 tcp 端口的限速器，没有配置限速时返回 nil
+func (c *client) getPrefixLimiter(hostPrefix string) *prefixLimiter {
+	value, ok := c.prefixLimiters.Load(hostPrefix)
+	if ok {
+		return value.(*prefixLimiter)
 	}
-
-	// 乐观思想，假设数据包可以立即到达客户端，仅控制服务端的发包速度
-	*count += bufLen
-	if *count < c.speedNum {
-		return
+	c.speedLimitsMtx.RLock()
+	s, ok := c.speedLimits[hostPrefix]
+	c.speedLimitsMtx.RUnlock()
+	if !ok {
+		return nil
 	}
-	sleepSeconds := *count / c.speedNum
-	*count -= sleepSeconds * c.speedNum
-	time.Sleep(time.Duration(sleepSeconds) * time.Second)
+	value, _ = c.prefixLimiters.LoadOrCreate(hostPrefix, func() interface{} {
+		return &prefixLimiter{
+			up:   newLimiter(s.Up, s.Burst),
+			down: newLimiter(s.Down, s.Burst),
+		}
+	})
+	return value.(*prefixLimiter)
+}
+
+// updateSpeed 在原地更新限速，正在进行的任务也会使用新的限速
+func (c *client) updateSpeed(u user) {
+	c.upLimiter.set(u.SpeedUp, u.SpeedBurst)
+	c.downLimiter.set(u.SpeedDown, u.SpeedBurst)
+	c.speedLimitsMtx.Lock()
+	c.speedLimits = u.SpeedLimits
+	c.speedLimitsMtx.Unlock()
+	c.prefixLimiters.Range(func(key, value interface{}) bool {
+		value.(*prefixLimiter).set(u.SpeedLimits[key.(string)])
+		return true
+	})
 }
 
 type ConnectionInfo struct {
@@ -0,0 +1,872 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/rs/zerolog"
+)
+
+// 节点之间的请求类型
+const (
+	clusterGossip byte = iota + 1
+	clusterClaim
+	clusterForward
+)
+
+// 转发的访问者连接的类型
+const (
+	clusterForwardHTTP  byte = iota + 1
+	clusterForwardHTTPS      // TLS 已经在转发的节点上终止
+	clusterForwardSNI
+)
+
+const (
+	clusterMaxMessageSize = 16 << 20
+	clusterTimeout        = 5 * time.Second
+	clusterALPN           = "gt-cluster"
+	clusterMACSize        = sha256.Size
+)
+
+var errClusterUnauthorized = errors.New("invalid cluster secret")
+
+// clusterHost 节点持有的 host 前缀或者自定义域名
+type clusterHost struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	ID    string `json:"id,omitempty"`
+	Group string `json:"group,omitempty"` // 组密钥的 sha256
+}
+
+func (h clusterHost) key() string {
+	return h.Kind + ":" + h.Name
+}
+
+// conflicts 判断 h 与 o 是否属于不同的 client，相同 id 或者相同组的 client 可以在多个节点上同时持有
+func (h clusterHost) conflicts(o clusterHost) bool {
+	if h.Group != "" || o.Group != "" {
+		return h.Group != o.Group
+	}
+	return h.ID != o.ID
+}
+
+func clusterKind(o hostPrefixOption) string {
+	switch {
+	case o.domain && o.tls:
+		return "tlsDomain"
+	case o.domain:
+		return "domain"
+	case o.tls:
+		return "tlsHost"
+	}
+	return "host"
+}
+
+func parseClusterKind(kind string) (o hostPrefixOption, ok bool) {
+	ok = true
+	switch kind {
+	case "tlsDomain":
+		o.domain, o.tls = true, true
+	case "domain":
+		o.domain = true
+	case "tlsHost":
+		o.tls = true
+	case "host":
+	default:
+		ok = false
+	}
+	return
+}
+
+func newClusterHost(name string, o hostPrefixOption, v clientWithServiceIndex) (h clusterHost) {
+	h.Name = name
+	h.Kind = clusterKind(o)
+	if v.group != nil {
+		h.Group = hex.EncodeToString(v.group.secret[:])
+	} else if v.client != nil {
+		h.ID = v.client.id
+	}
+	return
+}
+
+// clusterState 节点之间同步的状态
+type clusterState struct {
+	Node  string           `json:"node"`
+	Peers []string         `json:"peers,omitempty"`
+	Hosts []clusterHost    `json:"hosts,omitempty"`
+	Bans  map[string]int64 `json:"bans,omitempty"` // key: ip value: 解除限制的 unix 时间，0 表示不解除
+}
+
+// clusterPeer 已知的节点
+type clusterPeer struct {
+	seed bool      // 通过 -clusterPeers 配置的节点，不会被移除
+	seen time.Time // 发现的时间
+}
+
+type clusterNode struct {
+	hosts   map[string]clusterHost // key: clusterHost.key()
+	bans    map[string]int64
+	updated time.Time
+}
+
+type clusterClaimRecord struct {
+	host    clusterHost
+	expires time.Time
+}
+
+// cluster 多个服务端节点共享 host 前缀的注册表，访问者连接到没有对应隧道的节点时被转发到持有隧道的节点
+type cluster struct {
+	server   *Server
+	Logger   zerolog.Logger
+	listener net.Listener
+	node     string // 其他节点访问本节点的地址，同时作为节点的标识
+	secret   []byte
+	tls      *tls.Config
+	interval time.Duration
+	closed   atomic.Bool
+
+	mtx    sync.RWMutex
+	peers  map[string]clusterPeer            // 已知的其他节点
+	nodes  map[string]*clusterNode           // 其他节点最近同步的状态
+	claims map[string]clusterClaimRecord     // 尚未同步到注册表的声明，key: clusterHost.key()
+	bans   map[string]time.Time              // 本节点的重连限制，key: ip，零值表示不解除
+	hosts  map[string]map[string]clusterHost // 其他节点持有的 host，key: clusterHost.key() 与节点
+}
+
+func newCluster(s *Server) (cl *cluster, err error) {
+	if len(s.config.ClusterSecret) == 0 {
+		err = errors.New("cluster secret (-clusterSecret option) must be specified when clusterAddr is set")
+		return
+	}
+	interval := s.config.ClusterGossipInterval.Duration
+	if interval <= 0 {
+		err = fmt.Errorf("cluster gossip interval (-clusterGossipInterval option) '%s' is invalid", interval)
+		return
+	}
+	l, err := net.Listen("tcp", s.config.ClusterAddr)
+	if err != nil {
+		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'clusterAddr'", s.config.ClusterAddr, err.Error())
+		return
+	}
+	node := s.config.ClusterAdvertiseAddr
+	if len(node) == 0 {
+		node = l.Addr().String()
+	}
+	// 证书是临时生成的，不用于认证节点，节点之间通过集群密钥对 TLS 会话的 HMAC 互相认证
+	tlsConfig := connection.GenerateTLSConfig()
+	tlsConfig.NextProtos = []string{clusterALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	cl = &cluster{
+		server:   s,
+		Logger:   s.Logger.With().Str("scope", "cluster").Logger(),
+		listener: l,
+		node:     node,
+		secret:   []byte(s.config.ClusterSecret),
+		tls:      tlsConfig,
+		interval: interval,
+		peers:    make(map[string]clusterPeer),
+		nodes:    make(map[string]*clusterNode),
+		claims:   make(map[string]clusterClaimRecord),
+		bans:     make(map[string]time.Time),
+		hosts:    make(map[string]map[string]clusterHost),
+	}
+	for _, p := range s.config.ClusterPeers {
+		if p != node {
+			cl.peers[p] = clusterPeer{seed: true, seen: time.Now()}
+		}
+	}
+	cl.Logger.Info().Str("addr", l.Addr().String()).Str("node", node).Msg("Listening cluster")
+	go cl.acceptLoop()
+	go cl.gossipLoop()
+	return
+}
+
+func (cl *cluster) close() error {
+	cl.closed.Store(true)
+	return cl.listener.Close()
+}
+
+// expiry 节点超过这个时间没有同步状态时被认为已经离开集群
+func (cl *cluster) expiry() time.Duration {
+	return 3 * cl.interval
+}
+
+func (cl *cluster) alive(n *clusterNode, now time.Time) bool {
+	return now.Sub(n.updated) <= cl.expiry()
+}
+
+// removal 节点超过这个时间不可达时从已知节点中移除
+func (cl *cluster) removal() time.Duration {
+	return 10 * cl.expiry()
+}
+
+// prune 移除长时间不可达的节点与它的状态，配置的节点只会被标记为离开
+func (cl *cluster) prune(now time.Time) {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	for p, peer := range cl.peers {
+		last := peer.seen
+		n, ok := cl.nodes[p]
+		if ok && n.updated.After(last) {
+			last = n.updated
+		}
+		if peer.seed || now.Sub(last) <= cl.removal() {
+			continue
+		}
+		cl.Logger.Info().Str("node", p).Msg("node removed")
+		delete(cl.peers, p)
+		if ok {
+			cl.removeHosts(p, n)
+			delete(cl.nodes, p)
+		}
+	}
+}
+
+// removeHosts 从注册表中删除 node 持有的 host，调用时需要持有写锁
+func (cl *cluster) removeHosts(node string, n *clusterNode) {
+	for key := range n.hosts {
+		delete(cl.hosts[key], node)
+		if len(cl.hosts[key]) == 0 {
+			delete(cl.hosts, key)
+		}
+	}
+}
+
+func (cl *cluster) gossipLoop() {
+	ticker := time.NewTicker(cl.interval)
+	defer ticker.Stop()
+	cl.gossip()
+	for range ticker.C {
+		if cl.closed.Load() {
+			return
+		}
+		cl.gossip()
+		cl.prune(time.Now())
+	}
+}
+
+// gossip 与所有已知的节点交换状态
+func (cl *cluster) gossip() {
+	state, err := json.Marshal(cl.localState())
+	if err != nil {
+		cl.Logger.Error().Err(err).Msg("failed to marshal cluster state")
+		return
+	}
+	cl.mtx.RLock()
+	peers := make([]string, 0, len(cl.peers))
+	for p := range cl.peers {
+		peers = append(peers, p)
+	}
+	cl.mtx.RUnlock()
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p string) {
+			defer wg.Done()
+			resp, err := cl.request(p, clusterGossip, state)
+			if err != nil {
+				cl.Logger.Debug().Err(err).Str("peer", p).Msg("failed to gossip")
+				return
+			}
+			var st clusterState
+			err = json.Unmarshal(resp, &st)
+			if err != nil {
+				cl.Logger.Warn().Err(err).Str("peer", p).Msg("invalid cluster state")
+				return
+			}
+			cl.merge(st)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// localState 返回本节点持有的 host 前缀与重连限制
+func (cl *cluster) localState() (st clusterState) {
+	s := cl.server
+	st.Node = cl.node
+	for _, o := range []hostPrefixOption{{}, {tls: true}, {domain: true}, {domain: true, tls: true}} {
+		o := o
+		s.hostPrefixMap(o).Range(func(key, value interface{}) bool {
+			st.Hosts = append(st.Hosts, newClusterHost(key.(string), o, value.(clientWithServiceIndex)))
+			return true
+		})
+	}
+	now := time.Now()
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	// 只通告存活的节点，已经离开的节点不会在节点之间反复传播
+	for p := range cl.peers {
+		if n, ok := cl.nodes[p]; ok && cl.alive(n, now) {
+			st.Peers = append(st.Peers, p)
+		}
+	}
+	sort.Strings(st.Peers)
+	for ip, expires := range cl.bans {
+		if !expires.IsZero() && now.After(expires) {
+			delete(cl.bans, ip)
+			continue
+		}
+		if st.Bans == nil {
+			st.Bans = make(map[string]int64)
+		}
+		if expires.IsZero() {
+			st.Bans[ip] = 0
+		} else {
+			st.Bans[ip] = expires.Unix()
+		}
+	}
+	for key, c := range cl.claims {
+		if now.After(c.expires) {
+			delete(cl.claims, key)
+		}
+	}
+	return
+}
+
+// merge 更新其他节点的状态，并从中发现新的节点
+func (cl *cluster) merge(st clusterState) {
+	if len(st.Node) == 0 || st.Node == cl.node {
+		return
+	}
+	n := &clusterNode{
+		hosts:   make(map[string]clusterHost, len(st.Hosts)),
+		bans:    st.Bans,
+		updated: time.Now(),
+	}
+	for _, h := range st.Hosts {
+		n.hosts[h.key()] = h
+	}
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	if _, ok := cl.peers[st.Node]; !ok {
+		cl.Logger.Info().Str("node", st.Node).Msg("node joined")
+		cl.peers[st.Node] = clusterPeer{seen: n.updated}
+	}
+	for _, p := range st.Peers {
+		if _, ok := cl.peers[p]; !ok && p != cl.node {
+			cl.peers[p] = clusterPeer{seen: n.updated}
+		}
+	}
+	if old, ok := cl.nodes[st.Node]; ok {
+		cl.removeHosts(st.Node, old)
+	}
+	cl.nodes[st.Node] = n
+	for key, h := range n.hosts {
+		m, ok := cl.hosts[key]
+		if !ok {
+			m = make(map[string]clusterHost)
+			cl.hosts[key] = m
+		}
+		m[st.Node] = h
+	}
+}
+
+// lookup 返回持有 host 的一个存活的节点
+func (cl *cluster) lookup(key string) (node string, ok bool) {
+	now := time.Now()
+	cl.mtx.RLock()
+	defer cl.mtx.RUnlock()
+	for nodeName := range cl.hosts[key] {
+		if n, exists := cl.nodes[nodeName]; exists && cl.alive(n, now) {
+			return nodeName, true
+		}
+	}
+	return
+}
+
+// claim 在添加 host 前缀之前检查其他节点上是否被其他 client 持有，节点不可达时忽略该节点
+func (cl *cluster) claim(h clusterHost) (ok bool) {
+	key := h.key()
+	now := time.Now()
+	cl.mtx.Lock()
+	if c, exists := cl.claims[key]; exists && now.Before(c.expires) && c.host.conflicts(h) {
+		cl.mtx.Unlock()
+		return false
+	}
+	var peers []string
+	for node, n := range cl.nodes {
+		if !cl.alive(n, now) {
+			continue
+		}
+		if o, exists := cl.hosts[key][node]; exists && o.conflicts(h) {
+			cl.mtx.Unlock()
+			return false
+		}
+		peers = append(peers, node)
+	}
+	cl.claims[key] = clusterClaimRecord{host: h, expires: now.Add(cl.expiry())}
+	cl.mtx.Unlock()
+
+	req, err := json.Marshal(h)
+	if err != nil {
+		return false
+	}
+	ok = true
+	for _, p := range peers {
+		resp, err := cl.request(p, clusterClaim, req)
+		if err != nil {
+			cl.Logger.Warn().Err(err).Str("peer", p).Str("host", key).Msg("failed to claim host")
+			continue
+		}
+		var granted bool
+		err = json.Unmarshal(resp, &granted)
+		if err == nil && !granted {
+			ok = false
+			break
+		}
+	}
+	if !ok {
+		cl.mtx.Lock()
+		if c, exists := cl.claims[key]; exists && c.host == h {
+			delete(cl.claims, key)
+		}
+		cl.mtx.Unlock()
+	}
+	return
+}
+
+// grant 处理其他节点的声明，host 被本节点的其他 client 持有或者声明时拒绝
+func (cl *cluster) grant(h clusterHost) bool {
+	o, ok := parseClusterKind(h.Kind)
+	if !ok {
+		return false
+	}
+	if value, ok := cl.server.hostPrefixMap(o).Load(h.Name); ok {
+		if newClusterHost(h.Name, o, value.(clientWithServiceIndex)).conflicts(h) {
+			return false
+		}
+	}
+	key := h.key()
+	now := time.Now()
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	if c, exists := cl.claims[key]; exists && now.Before(c.expires) && c.host.conflicts(h) {
+		return false
+	}
+	cl.claims[key] = clusterClaimRecord{host: h, expires: now.Add(cl.expiry())}
+	return true
+}
+
+// ban 记录本节点的重连限制，d 为 0 表示不解除
+func (cl *cluster) ban(ip string, d time.Duration) {
+	var expires time.Time
+	if d > 0 {
+		expires = time.Now().Add(d)
+	}
+	cl.mtx.Lock()
+	cl.bans[ip] = expires
+	cl.mtx.Unlock()
+}
+
+// banned 判断 ip 是否被其他节点限制重连
+func (cl *cluster) banned(ip string) bool {
+	now := time.Now()
+	cl.mtx.RLock()
+	defer cl.mtx.RUnlock()
+	for _, n := range cl.nodes {
+		if !cl.alive(n, now) {
+			continue
+		}
+		if expires, ok := n.bans[ip]; ok && (expires == 0 || now.Unix() < expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// mac 返回集群密钥对 TLS 会话导出密钥的 HMAC，两端使用不同的 label，被中间人转发的会话无法通过验证
+func (cl *cluster) mac(c *tls.Conn, label string) (sum []byte, err error) {
+	state := c.ConnectionState()
+	key, err := state.ExportKeyingMaterial("gt cluster "+label, nil, clusterMACSize)
+	if err != nil {
+		return
+	}
+	h := hmac.New(sha256.New, cl.secret)
+	h.Write(key)
+	sum = h.Sum(nil)
+	return
+}
+
+// writeHeader 写入请求类型与 HMAC，集群密钥本身不会被发送
+func (cl *cluster) writeHeader(c *tls.Conn, typ byte) (err error) {
+	sum, err := cl.mac(c, "client")
+	if err != nil {
+		return
+	}
+	_, err = c.Write(append([]byte{typ}, sum...))
+	return
+}
+
+// readHeader 读取请求类型并验证 HMAC，验证通过后返回本节点的 HMAC，不能读取多于头部的数据
+func (cl *cluster) readHeader(c *tls.Conn) (typ byte, err error) {
+	buf := make([]byte, 1+clusterMACSize)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return
+	}
+	typ = buf[0]
+	sum, err := cl.mac(c, "client")
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(buf[1:], sum) {
+		err = errClusterUnauthorized
+		return
+	}
+	sum, err = cl.mac(c, "server")
+	if err != nil {
+		return
+	}
+	_, err = c.Write(sum)
+	return
+}
+
+// dial 连接节点并互相验证集群密钥，节点之间的数据都经过 TLS 加密
+func (cl *cluster) dial(node string, typ byte) (c *tls.Conn, err error) {
+	nc, err := net.DialTimeout("tcp", node, clusterTimeout)
+	if err != nil {
+		return
+	}
+	c = tls.Client(nc, &tls.Config{
+		InsecureSkipVerify: true, // 通过 HMAC 认证节点
+		NextProtos:         []string{clusterALPN},
+		MinVersion:         tls.VersionTLS13,
+	})
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+			c = nil
+		}
+	}()
+	err = c.SetDeadline(time.Now().Add(clusterTimeout))
+	if err != nil {
+		return
+	}
+	err = c.Handshake()
+	if err != nil {
+		return
+	}
+	err = cl.writeHeader(c, typ)
+	if err != nil {
+		return
+	}
+	sum, err := cl.mac(c, "server")
+	if err != nil {
+		return
+	}
+	buf := make([]byte, clusterMACSize)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(buf, sum) {
+		err = errClusterUnauthorized
+	}
+	return
+}
+
+func writeClusterMessage(w io.Writer, data []byte) (err error) {
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return
+}
+
+func readClusterMessage(r io.Reader) (data []byte, err error) {
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	l := binary.BigEndian.Uint32(buf)
+	if l > clusterMaxMessageSize {
+		err = fmt.Errorf("cluster message is too large: %d", l)
+		return
+	}
+	data = make([]byte, l)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// request 向节点发送一个请求并返回响应
+func (cl *cluster) request(node string, typ byte, data []byte) (resp []byte, err error) {
+	c, err := cl.dial(node, typ)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	err = writeClusterMessage(c, data)
+	if err != nil {
+		return
+	}
+	return readClusterMessage(c)
+}
+
+func (cl *cluster) acceptLoop() {
+	for {
+		c, err := cl.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cl.Logger.Error().Err(err).Msg("cluster accept loop ended")
+			}
+			return
+		}
+		go cl.serve(c)
+	}
+}
+
+func (cl *cluster) serve(nc net.Conn) {
+	c := tls.Server(nc, cl.tls)
+	handed := false
+	defer func() {
+		if !handed {
+			_ = c.Close()
+		}
+	}()
+	err := c.SetDeadline(time.Now().Add(clusterTimeout))
+	if err != nil {
+		return
+	}
+	err = c.Handshake()
+	if err != nil {
+		cl.Logger.Debug().Err(err).Str("ip", c.RemoteAddr().String()).Msg("cluster tls handshake failed")
+		return
+	}
+	typ, err := cl.readHeader(c)
+	if err != nil {
+		cl.Logger.Warn().Err(err).Str("ip", c.RemoteAddr().String()).Msg("invalid cluster request")
+		return
+	}
+	switch typ {
+	case clusterGossip:
+		var data []byte
+		data, err = readClusterMessage(c)
+		if err != nil {
+			break
+		}
+		var st clusterState
+		err = json.Unmarshal(data, &st)
+		if err != nil {
+			break
+		}
+		cl.merge(st)
+		data, err = json.Marshal(cl.localState())
+		if err != nil {
+			break
+		}
+		err = writeClusterMessage(c, data)
+	case clusterClaim:
+		var data []byte
+		data, err = readClusterMessage(c)
+		if err != nil {
+			break
+		}
+		var h clusterHost
+		err = json.Unmarshal(data, &h)
+		if err != nil {
+			break
+		}
+		granted := cl.grant(h)
+		if !granted {
+			cl.Logger.Info().Str("host", h.key()).Str("id", h.ID).Msg("rejected cluster claim")
+		}
+		data, _ = json.Marshal(granted)
+		err = writeClusterMessage(c, data)
+	case clusterForward:
+		kind := make([]byte, 1)
+		_, err = io.ReadFull(c, kind)
+		if err != nil {
+			break
+		}
+		err = c.SetDeadline(time.Time{})
+		if err != nil {
+			break
+		}
+		handed = true
+		cl.handleForwarded(c, kind[0])
+	default:
+		err = fmt.Errorf("invalid cluster request type %d", typ)
+	}
+	if err != nil {
+		cl.Logger.Warn().Err(err).Str("ip", c.RemoteAddr().String()).Msg("failed to serve cluster request")
+	}
+}
+
+// handleForwarded 处理其他节点转发的访问者连接，访问者的地址在 PROXY protocol 头部中
+func (cl *cluster) handleForwarded(c net.Conn, kind byte) {
+	s := cl.server
+	atomic.AddUint64(&s.accepted, 1)
+	sc := newConn(connection.NewProxyConn(c, proxyProtocolTimeout), s)
+	sc.forwarded = kind
+	if kind == clusterForwardSNI {
+		sc.handle(sc.handleSNI)
+	} else {
+		sc.handle(sc.handleHTTP)
+	}
+}
+
+// forward 将访问者连接转发给 node，包括已经读取到缓存中的数据
+func (cl *cluster) forward(c *conn, node string, kind byte) (err error) {
+	nc, err := cl.dial(node, clusterForward)
+	if err != nil {
+		return
+	}
+	defer nc.Close()
+	err = nc.SetDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	_, err = nc.Write([]byte{kind})
+	if err != nil {
+		return
+	}
+	err = connection.WriteProxyHeaderV2(nc, c.RemoteAddr(), c.LocalAddr())
+	if err != nil {
+		return
+	}
+	err = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(c.Conn, nc)
+		_ = c.Conn.Close()
+	}()
+	_, err = io.Copy(nc, c.Reader)
+	_ = nc.CloseWrite()
+	<-done
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return
+}
+
+// forwardHost 本节点没有 host 对应的隧道时，将访问者连接转发给持有它的节点
+func (s *Server) forwardHost(c *conn, host []byte, tls bool) (forwarded bool, err error) {
+	if s.cluster == nil || c.forwarded != 0 {
+		return
+	}
+	o := hostPrefixOption{tls: tls}
+	name := strings.ToLower(string(stripPort(host)))
+	o.domain = true
+	node, ok := s.cluster.lookup(clusterHost{Name: name, Kind: clusterKind(o)}.key())
+	if !ok {
+		o.domain = false
+		var id []byte
+		if len(s.config.BaseDomains) > 0 {
+			id, err = parseIDFromBaseDomains(host, s.config.BaseDomains)
+		} else {
+			id, err = parseIDFromHost(host)
+		}
+		if err != nil {
+			err = nil
+			return
+		}
+		name = string(id)
+		node, ok = s.cluster.lookup(clusterHost{Name: name, Kind: clusterKind(o)}.key())
+		if !ok {
+			return
+		}
+	}
+	return true, s.forwardToNode(c, name, node, tls)
+}
+
+// forwardHostPrefix 与 forwardHost 相同，用于 httpMUXHeader 不是 Host 的情况
+func (s *Server) forwardHostPrefix(c *conn, hostPrefix []byte) (forwarded bool, err error) {
+	if s.cluster == nil || c.forwarded != 0 {
+		return
+	}
+	node, ok := s.cluster.lookup(clusterHost{Name: string(hostPrefix), Kind: clusterKind(hostPrefixOption{})}.key())
+	if !ok {
+		return
+	}
+	return true, s.forwardToNode(c, string(hostPrefix), node, false)
+}
+
+func (s *Server) forwardToNode(c *conn, name string, node string, tls bool) (err error) {
+	kind := clusterForwardHTTP
+	switch {
+	case tls:
+		kind = clusterForwardSNI
+	case c.isTLS():
+		kind = clusterForwardHTTPS
+	}
+	c.Logger.Info().Str("host", name).Str("node", node).Msg("forward to node")
+	return s.cluster.forward(c, node, kind)
+}
+
+// claimHostPrefix 在集群中声明 host 前缀，未开启集群时总是成功
+func (s *Server) claimHostPrefix(hostPrefix string, o hostPrefixOption, cli *client) bool {
+	if s.cluster == nil {
+		return true
+	}
+	h := clusterHost{Name: hostPrefix, Kind: clusterKind(o), ID: cli.id}
+	if o.group.enabled() {
+		h.ID = ""
+		h.Group = hex.EncodeToString(o.group.secret[:])
+	}
+	return s.cluster.claim(h)
+}
+
+// ClusterNode is a node of the cluster and the host prefixes held by it.
+type ClusterNode struct {
+	Node  string
+	Alive bool
+	Hosts []string
+}
+
+// GetClusterNodes returns the other nodes of the cluster known by this node.
+func (s *Server) GetClusterNodes() (nodes []ClusterNode) {
+	if s.cluster == nil {
+		return
+	}
+	cl := s.cluster
+	now := time.Now()
+	cl.mtx.RLock()
+	defer cl.mtx.RUnlock()
+	for p := range cl.peers {
+		node := ClusterNode{Node: p}
+		if n, ok := cl.nodes[p]; ok {
+			node.Alive = cl.alive(n, now)
+			for key := range n.hosts {
+				node.Hosts = append(node.Hosts, key)
+			}
+			sort.Strings(node.Hosts)
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+	return
+}
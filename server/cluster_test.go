@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/config"
+)
+
+func newTestCluster(t *testing.T, secret string, peers ...string) (s *Server) {
+	s = &Server{config: Config{Options: Options{
+		ClusterAddr:           "127.0.0.1:0",
+		ClusterSecret:         secret,
+		ClusterPeers:          peers,
+		ClusterGossipInterval: config.Duration{Duration: 50 * time.Millisecond},
+	}}}
+	var err error
+	s.cluster, err = newCluster(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.cluster.close()
+	})
+	return
+}
+
+func TestClusterClaim(t *testing.T) {
+	a := newTestCluster(t, "secret")
+	b := newTestCluster(t, "secret", a.cluster.node)
+	other := newTestCluster(t, "other", a.cluster.node)
+	time.Sleep(200 * time.Millisecond)
+	if nodes := a.GetClusterNodes(); len(nodes) != 1 || nodes[0].Node != b.cluster.node || !nodes[0].Alive {
+		t.Fatalf("unexpected nodes: %v", nodes)
+	}
+	if nodes := other.GetClusterNodes(); len(nodes) != 1 || nodes[0].Alive {
+		t.Fatalf("node with a different secret should not join: %v", nodes)
+	}
+
+	c1, c2 := &client{id: "c1"}, &client{id: "c2"}
+	o := hostPrefixOption{serviceIndex: 1}
+	if !a.claimHostPrefix("app", o, c1) {
+		t.Fatal("failed to claim host prefix")
+	}
+	// 声明尚未同步到注册表时，其他节点也会拒绝冲突的声明
+	if b.claimHostPrefix("app", o, c2) {
+		t.Fatal("claim of another client should be rejected")
+	}
+	if !b.claimHostPrefix("app", o, c1) {
+		t.Fatal("the same client should claim the host prefix on several nodes")
+	}
+	if !b.claimHostPrefix("app", hostPrefixOption{tls: true}, c2) {
+		t.Fatal("tls host prefix is independent of the http one")
+	}
+
+	a.hostPrefix2Client.Store("app", clientWithServiceIndex{client: c1, serviceIndex: 1})
+	time.Sleep(200 * time.Millisecond)
+	if node, ok := b.cluster.lookup(clusterHost{Name: "app", Kind: "host"}.key()); !ok || node != a.cluster.node {
+		t.Fatalf("unexpected node of host prefix: %q", node)
+	}
+
+	a.cluster.ban("1.2.3.4", time.Minute)
+	time.Sleep(200 * time.Millisecond)
+	if !b.cluster.banned("1.2.3.4") || b.cluster.banned("1.2.3.5") {
+		t.Fatal("unexpected bans")
+	}
+
+	// 节点离开后它持有的 host 前缀与限制失效
+	_ = a.cluster.close()
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := b.cluster.lookup(clusterHost{Name: "app", Kind: "host"}.key()); ok {
+		t.Fatal("host prefix of the left node should be ignored")
+	}
+	if b.cluster.banned("1.2.3.4") {
+		t.Fatal("bans of the left node should be ignored")
+	}
+}
+
+func TestClusterPrune(t *testing.T) {
+	// 长度超过 255 的密钥
+	secret := strings.Repeat("s", 300)
+	a := newTestCluster(t, secret)
+	b := newTestCluster(t, secret, a.cluster.node)
+	c := newTestCluster(t, secret, a.cluster.node)
+	time.Sleep(300 * time.Millisecond)
+	if nodes := b.GetClusterNodes(); len(nodes) != 2 || !nodes[0].Alive || !nodes[1].Alive {
+		t.Fatalf("unexpected nodes: %v", nodes)
+	}
+
+	_ = c.cluster.close()
+	_ = a.cluster.close()
+	time.Sleep(2 * time.Second)
+	// 通过 gossip 发现的节点被移除，配置的节点保留
+	nodes := b.GetClusterNodes()
+	if len(nodes) != 1 || nodes[0].Node != a.cluster.node || nodes[0].Alive {
+		t.Fatalf("unexpected nodes: %v", nodes)
+	}
+	b.cluster.mtx.RLock()
+	_, ok := b.cluster.nodes[c.cluster.node]
+	b.cluster.mtx.RUnlock()
+	if ok {
+		t.Fatal("state of the removed node should be deleted")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/isrc-cas/gt/predef"
 	"github.com/isrc-cas/gt/server/sync"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
 )
 
 // Config is a server config.
@@ -31,6 +32,7 @@ type Config struct {
 	Version string          `yaml:"-" json:"-"` // 目前未使用
 	Users   map[string]user `yaml:"users,omitempty"`
 	TCPs    []tcp           `yaml:"tcp,omitempty" json:",omitempty"`
+	UDPs    []udp           `yaml:"udp,omitempty" json:",omitempty"`
 	Host    host            `yaml:"host,omitempty" json:",omitempty"`
 	Options
 }
@@ -44,23 +46,65 @@ type Options struct {
 	CertFile      string `yaml:"certFile,omitempty" json:",omitempty" usage:"The path to cert file"`
 	KeyFile       string `yaml:"keyFile,omitempty" json:",omitempty" usage:"The path to key file"`
 
-	IDs               config.Slice[string] `arg:"id" yaml:"-" json:"-" usage:"The user id"`
-	Secrets           config.Slice[string] `arg:"secret" yaml:"-" json:"-" usage:"The secret for user id"`
-	Users             string               `yaml:"users,omitempty" json:"UserPath,omitempty" usage:"The users yaml file to load"`
-	AuthAPI           string               `yaml:"authAPI,omitempty" json:",omitempty" usage:"The API to authenticate user with id and secret"`
-	AllowAnyClient    bool                 `yaml:"allowAnyClient,omitempty" json:",omitempty" usage:"Allow any client to connect to the server"`
-	TCPRanges         config.Slice[string] `arg:"tcpRange" yaml:"-" json:"-" usage:"The tcp port range, like 1024-65535"`
-	TCPNumber         uint16               `arg:"tcpNumber" yaml:"tcpNumber,omitempty" json:",omitempty" usage:"The number of tcp ports allowed to be opened for each id"`
-	Speed             uint32               `yaml:"speed,omitempty" json:",omitempty" usage:"The max number of bytes the client can transfer per second"`
-	Connections       uint32               `yaml:"connections,omitempty" json:",omitempty" usage:"The max number of tunnel connections for a client"`
-	ReconnectTimes    uint32               `yaml:"reconnectTimes,omitempty" json:",omitempty" usage:"The max number of times the client fails to reconnect"`
-	ReconnectDuration config.Duration      `yaml:"reconnectDuration,omitempty" json:",omitempty" json:",omitempty" usage:"The time that the client cannot connect after the number of failed reconnections reaches the max number"`
-	HostNumber        uint32               `arg:"hostNumber" yaml:"-" json:"-" usage:"The number of host-based services that the user can start"`
-	HostRegex         config.Slice[string] `arg:"hostRegex" yaml:"-" json:"-" usage:"The host prefix started by user must conform to one of these rules"`
-	HostWithID        bool                 `arg:"hostWithID" yaml:"-" json:"-" usage:"The prefix of host will become the form of id-host"`
-
-	HTTPMUXHeader       string `yaml:"httpMUXHeader,omitempty" json:",omitempty" usage:"The http multiplexing header to be used"`
-	MaxHandShakeOptions uint16 `yaml:"maxHandShakeOptions,omitempty" json:",omitempty" usage:"The max number of hand shake options"`
+	TLSClientCA           string `yaml:"tlsClientCA,omitempty" json:",omitempty" usage:"The path to the CA cert that issues client certs. Tunnels over tlsAddr and quicAddr that present a client cert issued by it are authenticated by the cert instead of the secret"`
+	TLSClientCRL          string `yaml:"tlsClientCRL,omitempty" json:",omitempty" usage:"The path to a CRL signed by tlsClientCA, or a file of revoked serial numbers in hex per line. It is read again on reload"`
+	TLSClientIDFrom       string `yaml:"tlsClientIDFrom,omitempty" json:",omitempty" usage:"The field of client certs that must equal the user id. Supports values: cn (subject common name), san (any DNS, email or URI subject alternative name)"`
+	TLSClientCertRequired bool   `yaml:"tlsClientCertRequired,omitempty" json:",omitempty" usage:"Reject tunnels without a client cert issued by tlsClientCA"`
+
+	ACMEDomain            string `yaml:"acmeDomain,omitempty" json:",omitempty" usage:"The base domain to get certificates for tlsAddr from an ACME CA automatically instead of certFile and keyFile. Certificates of host prefixes are obtained on demand"`
+	ACMEEmail             string `yaml:"acmeEmail,omitempty" json:",omitempty" usage:"The email of the ACME account"`
+	ACMEDirectory         string `yaml:"acmeDirectory,omitempty" json:",omitempty" usage:"The directory url of the ACME CA"`
+	ACMECacheDir          string `yaml:"acmeCacheDir,omitempty" json:",omitempty" usage:"The directory to cache the ACME account key and certificates"`
+	ACMEChallenge         string `yaml:"acmeChallenge,omitempty" json:",omitempty" usage:"The ACME challenge type. Supports values: tls-alpn-01, http-01, dns-01 (default dns-01 if acmeDNSProvider is set, otherwise tls-alpn-01)"`
+	ACMEDNSProvider       string `yaml:"acmeDNSProvider,omitempty" json:",omitempty" usage:"The DNS provider to set TXT records for dns-01 challenges. Supports values: exec"`
+	ACMEDNSProviderConfig string `yaml:"acmeDNSProviderConfig,omitempty" json:",omitempty" usage:"The config of the DNS provider. The exec provider runs this program with the arguments 'present|cleanup fqdn value'"`
+
+	IDs                      config.Slice[string] `arg:"id" yaml:"-" json:"-" usage:"The user id"`
+	Secrets                  config.Slice[string] `arg:"secret" yaml:"-" json:"-" usage:"The secret for user id"`
+	Users                    string               `yaml:"users,omitempty" json:"UserPath,omitempty" usage:"The users yaml file to load"`
+	AuthAPI                  string               `yaml:"authAPI,omitempty" json:",omitempty" usage:"The API to authenticate user with id and secret"`
+	AuthAPICacheTTL          config.Duration      `yaml:"authAPICacheTTL,omitempty" json:",omitempty" usage:"How long the successful results of the auth API are used without asking it again. The last results are still used when the API fails. Supports values like '30s', '5m'"`
+	AuthAPICacheMaxStale     config.Duration      `yaml:"authAPICacheMaxStale,omitempty" json:",omitempty" usage:"How long after being cached the results of the auth API are still used when the API fails. 0 disables the fallback. Supports values like '30m', '1h'"`
+	AuthAPIRetries           uint                 `yaml:"authAPIRetries,omitempty" json:",omitempty" usage:"The number of retries when the auth API request fails or the API returns a 5xx or 429 status"`
+	AuthAPIRetryDelay        config.Duration      `yaml:"authAPIRetryDelay,omitempty" json:",omitempty" usage:"The delay before the first retry of the auth API, doubled after each retry. Supports values like '100ms', '1s'"`
+	AuthAPIBreakerFailures   uint                 `yaml:"authAPIBreakerFailures,omitempty" json:",omitempty" usage:"The number of consecutive failed auth API requests that stop calling the API for -authAPIBreakerDuration, during which only cached users are accepted. 0 disables the circuit breaker"`
+	AuthAPIBreakerDuration   config.Duration      `yaml:"authAPIBreakerDuration,omitempty" json:",omitempty" usage:"How long the auth API is not called after the circuit breaker opens. Supports values like '30s', '5m'"`
+	AuthAPISecret            string               `yaml:"authAPISecret,omitempty" json:",omitempty" usage:"The key to sign the auth API requests. The X-GT-Signature header is the hex HMAC-SHA256 of the X-GT-Timestamp header, a newline and the body"`
+	AllowAnyClient           bool                 `yaml:"allowAnyClient,omitempty" json:",omitempty" usage:"Allow any client to connect to the server"`
+	RequireSecureHandshake   bool                 `yaml:"requireSecureHandshake,omitempty" json:",omitempty" usage:"Reject the old clients that send the secret in plaintext"`
+	PlaintextSecretHandshake bool                 `yaml:"plaintextSecretHandshake,omitempty" json:",omitempty" usage:"Ask every client for its secret in plaintext instead of an HMAC in the handshake. Needed by the users whose secrets are hashed. The secret is always asked in plaintext with -authAPI. Use it with tls:// or quic:// only"`
+	TCPRanges                config.Slice[string] `arg:"tcpRange" yaml:"-" json:"-" usage:"The tcp port range, like 1024-65535"`
+	TCPNumber                uint16               `arg:"tcpNumber" yaml:"tcpNumber,omitempty" json:",omitempty" usage:"The number of tcp ports allowed to be opened for each id"`
+	UDPRanges                config.Slice[string] `arg:"udpRange" yaml:"-" json:"-" usage:"The udp port range, like 1024-65535"`
+	UDPNumber                uint16               `arg:"udpNumber" yaml:"udpNumber,omitempty" json:",omitempty" usage:"The number of udp ports allowed to be opened for each id"`
+	UDPTimeout               config.Duration      `yaml:"udpTimeout,omitempty" json:",omitempty" usage:"The idle timeout of udp sessions. A session is a visitor address of a udp port. Supports values like '30s', '5m'"`
+	Speed                    uint32               `yaml:"speed,omitempty" json:",omitempty" usage:"The max number of bytes the client can transfer per second"`
+	SpeedUp                  uint32               `yaml:"speedUp,omitempty" json:",omitempty" usage:"The max number of bytes the client can upload per second, overrides speed"`
+	SpeedDown                uint32               `yaml:"speedDown,omitempty" json:",omitempty" usage:"The max number of bytes the client can download per second, overrides speed"`
+	SpeedBurst               uint32               `yaml:"speedBurst,omitempty" json:",omitempty" usage:"The max number of bytes that can be transferred at once when the speed is limited, 0 means no burst"`
+	GlobalSpeed              uint32               `yaml:"globalSpeed,omitempty" json:",omitempty" usage:"The max number of bytes all clients can transfer per second in each direction"`
+	Connections              uint32               `yaml:"connections,omitempty" json:",omitempty" usage:"The max number of tunnel connections for a client"`
+	ReconnectTimes           uint32               `yaml:"reconnectTimes,omitempty" json:",omitempty" usage:"The max number of times the client fails to reconnect"`
+	ReconnectDuration        config.Duration      `yaml:"reconnectDuration,omitempty" json:",omitempty" json:",omitempty" usage:"The time that the client cannot connect after the number of failed reconnections reaches the max number"`
+	HostNumber               uint32               `arg:"hostNumber" yaml:"-" json:"-" usage:"The number of host-based services that the user can start"`
+	HostRegex                config.Slice[string] `arg:"hostRegex" yaml:"-" json:"-" usage:"The host prefix started by user must conform to one of these rules"`
+	HostWithID               bool                 `arg:"hostWithID" yaml:"-" json:"-" usage:"The prefix of host will become the form of id-host"`
+	DomainNumber             uint32               `arg:"domainNumber" yaml:"-" json:"-" usage:"The number of custom domains that the user can bind to services"`
+	BaseDomains              config.Slice[string] `yaml:"baseDomains,omitempty" json:",omitempty" usage:"The base domains that host prefixes are under. Requests for hosts that are neither under them nor bound custom domains are rejected"`
+	GroupBalance             string               `yaml:"groupBalance,omitempty" json:",omitempty" usage:"How tasks are spread across the clients of a group that serve the same host prefix or tcp port. Supports values: leastTasks, weight"`
+	Allow                    config.Slice[string] `yaml:"allow,omitempty" json:",omitempty" usage:"Only visitors from these IPs or CIDRs like 10.0.0.0/8 can access host prefixes and tcp ports of all clients"`
+	Deny                     config.Slice[string] `yaml:"deny,omitempty" json:",omitempty" usage:"Visitors from these IPs or CIDRs like 10.0.0.0/8 can not access host prefixes and tcp ports of all clients. Deny takes precedence over allow"`
+	AuthMethods              config.Slice[string] `yaml:"authMethods,omitempty" json:",omitempty" usage:"The auth methods that clients can protect http host prefixes with. Supports values: basic, bearer, oidc (default all)"`
+	AuthRequired             bool                 `yaml:"authRequired,omitempty" json:",omitempty" usage:"Require clients to protect every http host prefix with an auth"`
+	AuthOIDCIssuers          config.Slice[string] `yaml:"authOIDCIssuers,omitempty" json:",omitempty" usage:"The https OpenID Connect issuers that clients can log visitors in with, like https://accounts.google.com. The oidc auth is not allowed when it is empty"`
+	AuthOIDCCA               string               `yaml:"authOIDCCA,omitempty" json:",omitempty" usage:"The PEM file of the CA certificates to verify the OpenID Connect issuers. The system CAs are used by default"`
+	AuthSessionKey           string               `yaml:"authSessionKey,omitempty" json:",omitempty" usage:"The key to sign the OIDC session cookies of visitors. A random key is used by default, so the sessions are invalidated after restarts and are not shared by the nodes of a cluster"`
+	AuthSessionDuration      config.Duration      `yaml:"authSessionDuration,omitempty" json:",omitempty" usage:"The duration of the OIDC session cookies of visitors. Supports values like '30m', '12h'"`
+
+	HTTPMUXHeader        string               `yaml:"httpMUXHeader,omitempty" json:",omitempty" usage:"The http multiplexing header to be used"`
+	MaxHandShakeOptions  uint16               `yaml:"maxHandShakeOptions,omitempty" json:",omitempty" usage:"The max number of hand shake options"`
+	ProxyProtocol        bool                 `yaml:"proxyProtocol,omitempty" json:",omitempty" usage:"Require PROXY protocol v1/v2 headers on addr, tlsAddr, sniAddr and the tcp ports of clients to get the real addresses of visitors"`
+	ProxyProtocolTrusted config.Slice[string] `yaml:"proxyProtocolTrusted,omitempty" json:",omitempty" usage:"The IPs or CIDRs like 10.0.0.0/8 of the load balancers that send PROXY protocol headers. Required by proxyProtocol. Connections from other peers are served without reading the headers"`
 
 	Timeout                        config.Duration `yaml:"timeout,omitempty" json:",omitempty" usage:"The timeout of connections. Supports values like '30s', '5m'"`
 	TimeoutOnUnidirectionalTraffic bool            `yaml:"timeoutOnUnidirectionalTraffic,omitempty" json:",omitempty" usage:"Timeout will happens when traffic is unidirectional"`
@@ -74,6 +118,13 @@ type Options struct {
 	STUNAddr     string `yaml:"stunAddr,omitempty" json:",omitempty" usage:"The address to listen on for STUN service. Supports values like: '3478', ':3478' or '0.0.0.0:3478'"`
 	STUNLogLevel string `yaml:"stunLogLevel,omitempty" json:",omitempty" usage:"Log level: trace, debug, info, warn, error, disable"`
 
+	TURNRelayIP       string               `yaml:"turnRelayIP,omitempty" json:",omitempty" usage:"The IP address of the TURN relays returned to peers, usually the public IP of the server. The TURN relay is enabled on stunAddr if it is set"`
+	TURNRelayPorts    string               `yaml:"turnRelayPorts,omitempty" json:",omitempty" usage:"The port range of the TURN relays. Supports values like: '49152-65535'"`
+	TURNSecret        string               `yaml:"turnSecret,omitempty" json:",omitempty" usage:"The shared secret to generate and verify the time-limited TURN credentials. A random secret is used if it is empty"`
+	TURNCredentialTTL config.Duration      `yaml:"turnCredentialTTL,omitempty" json:",omitempty" usage:"How long the TURN credentials sent to clients are valid, they are renewed at half of it. Supports values like '1h', '24h'"`
+	TURNQuota         uint16               `yaml:"turnQuota,omitempty" json:",omitempty" usage:"The number of TURN relays allowed to be allocated at the same time for each id, 0 means unlimited"`
+	TURNPeerAllow     config.Slice[string] `arg:"turnPeerAllow" yaml:"turnPeerAllow,omitempty" json:",omitempty" usage:"The internal IP or CIDR that TURN relays are allowed to send data to, like 10.0.0.0/8. Loopback, private and link-local peers are denied by default"`
+
 	SNIAddr string `yaml:"sniAddr,omitempty" json:",omitempty" usage:"The address to listen on for raw tls proxy. Host comes from Server Name Indication. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 
 	SentryDSN         string               `yaml:"sentryDSN,omitempty" json:",omitempty" usage:"Sentry DSN to use"`
@@ -89,32 +140,80 @@ type Options struct {
 	LogFileMaxCount uint   `yaml:"logFileMaxCount,omitempty" json:",omitempty" usage:"Max count of the log files"`
 	LogLevel        string `yaml:"logLevel,omitempty" json:",omitempty" usage:"Log level: trace, debug, info, warn, error, fatal, panic, disable"`
 	Version         bool   `arg:"version" yaml:"-" json:"-" usage:"Show the version of this program"`
-
-	WebAddr     string `arg:"webAddr"  yaml:"webAddr,omitempty" json:"-" usage:"The address to listen on for web server"`
-	WebCertFile string `arg:"webCertFile" yaml:"webCertFile,omitempty" json:"-" usage:"The path to cert file for GT-Web server"`
-	WebKeyFile  string `arg:"webKeyFile" yaml:"webKeyFile,omitempty" json:"-" usage:"The path to key file for GT-Web server"`
-	EnablePprof bool   `arg:"pprof"  yaml:"pprof,omitempty" json:"-" usage:"Enable pprof in web server"`
-	SigningKey  string `arg:"signingKey" yaml:"signingKey,omitempty" json:"-" usage:"JWT signing key for web server"`
-	Admin       string `arg:"admin" yaml:"admin,omitempty" json:"-" usage:"Admin username use for login in web server"`
-	Password    string `arg:"password" yaml:"password,omitempty" json:"-" usage:"Admin password use for login in web server"`
-
-	Signal string `arg:"s" yaml:"-" json:"-" usage:"Send signal to client processes. Supports values: restart, stop, kill"`
+	HashSecret      string `arg:"hashSecret" yaml:"-" json:"-" usage:"Print the hash of the secret that can be used in the users config, and exit. '-' reads the secret from stdin"`
+	HashAlgorithm   string `arg:"hashAlgorithm" yaml:"-" json:"-" usage:"The algorithm used by -hashSecret. Supports values: bcrypt, argon2id, scrypt"`
+
+	AccessLogFile         string `yaml:"accessLogFile,omitempty" json:",omitempty" usage:"Path to save the HTTP access log file"`
+	AccessLogFileMaxSize  int64  `yaml:"accessLogFileMaxSize,omitempty" json:",omitempty" usage:"Max size of the HTTP access log files"`
+	AccessLogFileMaxCount uint   `yaml:"accessLogFileMaxCount,omitempty" json:",omitempty" usage:"Max count of the HTTP access log files"`
+	AccessLogPrivacy      bool   `yaml:"accessLogPrivacy,omitempty" json:",omitempty" usage:"Omit the request paths in the HTTP access log"`
+
+	UsageFile          string          `yaml:"usageFile,omitempty" json:",omitempty" usage:"Path to the file that the usage of clients is appended to in JSON lines format periodically"`
+	UsageFlushInterval config.Duration `yaml:"usageFlushInterval,omitempty" json:",omitempty" usage:"The interval of appending the usage of clients to the usage file. Supports values like '30s', '5m'"`
+
+	WebAddr       string `arg:"webAddr"  yaml:"webAddr,omitempty" json:"-" usage:"The address to listen on for web server"`
+	WebCertFile   string `arg:"webCertFile" yaml:"webCertFile,omitempty" json:"-" usage:"The path to cert file for GT-Web server"`
+	WebKeyFile    string `arg:"webKeyFile" yaml:"webKeyFile,omitempty" json:"-" usage:"The path to key file for GT-Web server"`
+	EnablePprof   bool   `arg:"pprof"  yaml:"pprof,omitempty" json:"-" usage:"Enable pprof in web server"`
+	EnableMetrics bool   `arg:"metrics" yaml:"metrics,omitempty" json:"-" usage:"Enable Prometheus metrics in web server"`
+	MetricsToken  string `arg:"metricsToken" yaml:"metricsToken,omitempty" json:"-" usage:"The bearer token to read the Prometheus metrics of api server and web server. The metrics of api server are disabled without it"`
+	SigningKey    string `arg:"signingKey" yaml:"signingKey,omitempty" json:"-" usage:"JWT signing key for web server"`
+	Admin         string `arg:"admin" yaml:"admin,omitempty" json:"-" usage:"Admin username use for login in web server"`
+	Password      string `arg:"password" yaml:"password,omitempty" json:"-" usage:"Admin password use for login in web server"`
+
+	Signal string `arg:"s" yaml:"-" json:"-" usage:"Send signal to client processes. Supports values: restart, stop, kill, reload"`
+
+	ClusterAddr           string               `yaml:"clusterAddr,omitempty" json:",omitempty" usage:"The address to listen on for other nodes of the cluster. The nodes share host prefixes and forward visitors to the node that holds the tunnel. Supports values like: '7946', ':7946' or '0.0.0.0:7946'"`
+	ClusterAdvertiseAddr  string               `yaml:"clusterAdvertiseAddr,omitempty" json:",omitempty" usage:"The address that other nodes use to reach this node, default is the address of clusterAddr"`
+	ClusterPeers          config.Slice[string] `yaml:"clusterPeers,omitempty" json:",omitempty" usage:"The cluster addresses of other nodes to join. Nodes found through them are joined too"`
+	ClusterSecret         string               `yaml:"clusterSecret,omitempty" json:",omitempty" usage:"The secret shared by the nodes of the cluster"`
+	ClusterGossipInterval config.Duration      `yaml:"clusterGossipInterval,omitempty" json:",omitempty" usage:"The interval of exchanging states with other nodes. A node is considered left after 3 intervals without response. Supports values like '1s', '5s'"`
 
 	QuicAddr string `yaml:"quicAddr" usage:"The address for quic connection (between GT client and GT server) to listen on. Supports values like: '443', ':443' or '0.0.0.0:443'"`
 	OpenBBR  bool   `yaml:"bbr" usage:"Use bbr as congestion control algorithm (through msquic) when GT use QUIC connection. Default algorithm is Cubic (through quic-go)."`
 }
 
+// speedUp 返回全局的上行限速，speedUp 的优先级高于 speed
+func (o *Options) speedUp() uint32 {
+	if o.SpeedUp > 0 {
+		return o.SpeedUp
+	}
+	return o.Speed
+}
+
+// speedDown 返回全局的下行限速，speedDown 的优先级高于 speed
+func (o *Options) speedDown() uint32 {
+	if o.SpeedDown > 0 {
+		return o.SpeedDown
+	}
+	return o.Speed
+}
+
 func defaultConfig() Config {
 	return Config{
 		Options: Options{
 			Timeout:          config.Duration{Duration: 90 * time.Second},
+			UDPTimeout:       config.Duration{Duration: 60 * time.Second},
 			TLSMinVersion:    "tls1.2",
+			TLSClientIDFrom:  clientIDFromCN,
+			ACMEDirectory:    acme.LetsEncryptURL,
+			ACMECacheDir:     "acme",
 			APITLSMinVersion: "tls1.2",
 			LogFileMaxCount:  7,
 			LogFileMaxSize:   512 * 1024 * 1024,
 			LogLevel:         zerolog.InfoLevel.String(),
+			HashAlgorithm:    hashBcrypt,
 			STUNLogLevel:     "warn",
 
+			TURNRelayPorts:    "49152-65535",
+			TURNCredentialTTL: config.Duration{Duration: 24 * time.Hour},
+			TURNQuota:         5,
+
+			AccessLogFileMaxCount: 7,
+			AccessLogFileMaxSize:  512 * 1024 * 1024,
+
+			UsageFlushInterval: config.Duration{Duration: time.Minute},
+
 			SentrySampleRate: 1.0,
 			SentryRelease:    predef.Version,
 
@@ -128,6 +227,18 @@ func defaultConfig() Config {
 
 			MaxHandShakeOptions: 30,
 
+			GroupBalance: groupBalanceLeastTasks,
+
+			AuthSessionDuration: config.Duration{Duration: 12 * time.Hour},
+
+			AuthAPICacheMaxStale:   config.Duration{Duration: time.Hour},
+			AuthAPIRetries:         2,
+			AuthAPIRetryDelay:      config.Duration{Duration: 200 * time.Millisecond},
+			AuthAPIBreakerFailures: 5,
+			AuthAPIBreakerDuration: config.Duration{Duration: 30 * time.Second},
+
+			ClusterGossipInterval: config.Duration{Duration: time.Second},
+
 			OpenBBR: false,
 		},
 	}
@@ -148,17 +259,40 @@ type tcp struct {
 	Range string `yaml:"range,omitempty" json:",omitempty"`
 }
 
+// udp 管理
+type udp struct {
+	Range string `yaml:"range,omitempty" json:",omitempty"`
+}
+
 // user 用户权限细节
 type user struct {
 	Secret      string
 	TCPs        []tcp   `yaml:"tcp,omitempty" json:",omitempty"`
 	TCPNumber   *uint16 `yaml:"tcpNumber,omitempty"`
+	UDPs        []udp   `yaml:"udp,omitempty" json:",omitempty"`
+	UDPNumber   *uint16 `yaml:"udpNumber,omitempty"`
 	Speed       uint32  `yaml:"speed,omitempty" json:",omitempty"`
+	SpeedUp     uint32  `yaml:"speedUp,omitempty" json:",omitempty"`
+	SpeedDown   uint32  `yaml:"speedDown,omitempty" json:",omitempty"`
+	SpeedBurst  uint32  `yaml:"speedBurst,omitempty" json:",omitempty"`
 	Connections uint32  `yaml:"connections,omitempty" json:",omitempty"`
 	Host        host    `yaml:"host,omitempty" json:",omitempty"`
-
-	temp         bool
-	portsManager *portsManager
+	TURNQuota   *uint16 `yaml:"turnQuota,omitempty" json:",omitempty"`
+
+	// 单个 host 前缀或 tcp 端口的限速，key 为 host 前缀，tcp 端口的形式为 tcp:port
+	SpeedLimits map[string]speed `yaml:"speedLimits,omitempty" json:",omitempty"`
+
+	// 访问者 IP 的访问控制，Allow 与 Deny 作用于用户的所有服务，ACLs 的 key 与 SpeedLimits 相同
+	Allow []string             `yaml:"allow,omitempty" json:",omitempty"`
+	Deny  []string             `yaml:"deny,omitempty" json:",omitempty"`
+	ACLs  map[string]aclConfig `yaml:"acls,omitempty" json:",omitempty"`
+
+	acl             *acl
+	acls            map[string]*acl
+	temp            bool
+	expiresAt       time.Time // 认证 API 返回的过期时间，零值表示不过期
+	portsManager    *portsManager
+	udpPortsManager *portsManager
 }
 
 // users 客户端的权限管理
@@ -192,8 +326,12 @@ func (u *users) verify() (err error) {
 			err = fmt.Errorf("invalid id length: '%s'", id)
 		}
 
-		if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
-			err = fmt.Errorf("invalid secret length: '%s'", user.Secret)
+		if isHashedSecret(user.Secret) {
+			if e := checkHashedSecret(user.Secret); e != nil {
+				err = fmt.Errorf("invalid hashed secret of id '%s': %w", id, e)
+			}
+		} else if len(user.Secret) < predef.MinSecretSize || len(user.Secret) > predef.MaxSecretSize {
+			err = fmt.Errorf("invalid secret length of id '%s': %d", id, len(user.Secret))
 		}
 		return true
 	})
@@ -209,6 +347,18 @@ func (u *users) empty() (empty bool) {
 	return
 }
 
+// configured 判断是否有配置的用户，不包括 -allowAnyClient 创建的临时用户
+func (u *users) configured() (configured bool) {
+	u.Range(func(key, value interface{}) bool {
+		if v, ok := value.(user); ok && !v.temp {
+			configured = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
 func (u *users) auth(id string, secret string) (result user, err error) {
 	value, ok := u.Load(id)
 	if !ok {
@@ -220,7 +370,7 @@ func (u *users) auth(id string, secret string) (result user, err error) {
 		err = ErrInvalidUser
 		return
 	}
-	if result.Secret != secret {
+	if !verifySecret(result.Secret, secret) {
 		err = ErrInvalidUser
 	}
 	return
@@ -238,4 +388,7 @@ type host struct {
 	Regex    *[]*regexp.Regexp     `yaml:"-" json:"-"`
 	WithID   *bool                 `yaml:"withID" json:",omitempty"`
 	Prefixes map[string]struct{}   `yaml:"-" json:"-"`
+
+	// 可以绑定的自定义域名的数量
+	DomainNumber *uint32 `yaml:"domainNumber" json:",omitempty"`
 }
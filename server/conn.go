@@ -17,9 +17,11 @@ package server
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"github.com/quic-go/quic-go"
 	"io"
+	"math"
 	"net"
 	"runtime/debug"
 	"strconv"
@@ -35,6 +37,7 @@ import (
 	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/pool"
 	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
 )
 
 var (
@@ -54,6 +57,20 @@ type conn struct {
 	serviceIndex   uint16 // 0 表示客户端只有一个 Local，使用 predef.Data，兼容老客户端；大于 0 使用 predef.ServicesData
 	ids            hostPrefixOptions
 	configChecksum [32]byte
+	hostPrefix     string           // 访问者连接对应的 host 前缀，tcp 端口的形式为 tcp:port
+	usage          *usage           // 访问者连接所属 host 前缀的用量统计
+	access         *accessExchanges // 访问日志，未开启访问日志时为 nil
+	gated          *authExchange    // 受认证保护的访问者连接上的请求与响应，没有认证时为 nil
+	upLimiters     []*limiter       // host 前缀或 tcp 端口、client 以及全局的上行限速
+	downLimiter    *limiter
+	upQueue        *uploadQueue // 受 upLimiters 限速的上行数据，没有限速时为 nil，数据由 readLoop 直接写入
+	upTunnel       *conn        // 客户端支持流量控制时向其归还上行窗口的隧道连接，否则为 nil
+	upTaskID       uint32
+	sendRemoteAddr atomic.Bool    // 隧道连接是否在任务开始时发送访问者连接的地址
+	flowControl    atomic.Bool    // 隧道连接的客户端是否只在服务端允许的窗口内发送受限速的任务的数据
+	forwarded      byte           // 其他节点转发的访问者连接的类型，0 表示不是转发的连接
+	handshake      handshakeState // 隧道握手的版本与凭证，只在 handleTunnel 中读写
+	turnSentAt     time.Time      // 最后发送 TURN 凭证的时间，只在 handleTunnel 与 readLoop 中读写
 }
 
 func newConn(c net.Conn, s *Server) *conn {
@@ -73,6 +90,12 @@ func newConn(c net.Conn, s *Server) *conn {
 	return nc
 }
 
+// isTLS 判断访问者连接是否使用 TLS，包括其他节点终止 TLS 后转发的连接
+func (c *conn) isTLS() bool {
+	_, ok := c.Conn.(*tls.Conn)
+	return ok || c.forwarded == clusterForwardHTTPS
+}
+
 func (c *conn) addTask(taskID uint32, conn *conn) {
 	c.tasksRWMtx.Lock()
 	c.tasks[taskID] = conn
@@ -129,7 +152,8 @@ func (c *conn) handle(handleFunc func() bool) {
 	}
 	if version[0] == predef.MagicNumber {
 		switch version[1] {
-		case 0x01:
+		case predef.LegacyHandshake, predef.SecureHandshake:
+			c.handshake.version = version[1]
 			_, err = reader.Discard(2)
 			if err != nil {
 				c.Logger.Warn().Err(err).Msg("failed to discard version field")
@@ -155,7 +179,8 @@ func (c *conn) handle(handleFunc func() bool) {
 			c.server.reconnectRWMutex.RLock()
 			reconnectTimes := c.server.reconnect[remoteIP]
 			c.server.reconnectRWMutex.RUnlock()
-			if reconnectTimes > c.server.config.ReconnectTimes {
+			if reconnectTimes > c.server.config.ReconnectTimes ||
+				c.server.cluster != nil && c.server.cluster.banned(remoteIP) {
 				c.Logger.Warn().Msgf("IP: '%v' is limited", remoteIP)
 				return
 			}
@@ -220,17 +245,26 @@ func (c *conn) handleSNI() (handled bool) {
 		err = ErrInvalidHTTPProtocol
 		return
 	}
-	id, err := parseIDFromHost(host)
+	client, id, ok, err := c.server.routeHost(host, true)
+	if err != nil || !ok {
+		forwarded, e := c.server.forwardHost(c, host, true)
+		if forwarded {
+			err = e
+			return
+		}
+	}
 	if err != nil {
 		return
 	}
-	if len(id) < predef.MinIDSize {
-		err = ErrInvalidID
-		return
+	if ok {
+		client, ok = client.pick()
 	}
-	client, ok := c.server.getTLSHostPrefix(string(id))
 	if ok {
 		c.serviceIndex = client.serviceIndex
+		c.hostPrefix = string(id)
+		if !c.allowVisitor(client) {
+			return
+		}
 		err = client.process(c)
 	} else {
 		err = ErrIDNotFound
@@ -255,6 +289,14 @@ func (c *conn) handleHTTP() (handled bool) {
 		atomic.AddUint64(&c.server.served, 1)
 		handled = true
 	}()
+	if c.server.acme != nil && c.server.acme.handleHTTP01(c) {
+		return
+	}
+	if c.server.handleDomainChallenge(c) {
+		return
+	}
+	var client clientWithServiceIndex
+	var ok bool
 	if c.server.config.HTTPMUXHeader == "Host" {
 		host, err = peekHost(c.Reader)
 		if err != nil {
@@ -264,7 +306,14 @@ func (c *conn) handleHTTP() (handled bool) {
 			err = ErrInvalidHTTPProtocol
 			return
 		}
-		id, err = parseIDFromHost(host)
+		client, id, ok, err = c.server.routeHost(host, false)
+		if err != nil || !ok {
+			forwarded, e := c.server.forwardHost(c, host, false)
+			if forwarded {
+				err = e
+				return
+			}
+		}
 		if err != nil {
 			return
 		}
@@ -273,15 +322,42 @@ func (c *conn) handleHTTP() (handled bool) {
 		if err != nil {
 			return
 		}
+		if len(id) < predef.MinIDSize {
+			err = ErrInvalidID
+			return
+		}
+		client, ok = c.server.getHostPrefix(string(id))
+		if !ok {
+			forwarded, e := c.server.forwardHostPrefix(c, id)
+			if forwarded {
+				err = e
+				return
+			}
+		}
 	}
-	if len(id) < predef.MinIDSize {
-		err = ErrInvalidID
-		return
+	if ok {
+		client, ok = client.pick()
 	}
-	client, ok := c.server.getHostPrefix(string(id))
 	if ok {
 		c.serviceIndex = client.serviceIndex
+		c.hostPrefix = string(id)
+		if !c.allowVisitor(client) {
+			_, err = c.Write(forbiddenResponse)
+			return
+		}
+		if g := client.authGate(); g != nil {
+			if !c.authenticate(g) {
+				return
+			}
+			c.gated = newAuthExchange(g)
+		}
+		if c.server.accessLog != nil {
+			c.access = newAccessExchanges(c.server.config.AccessLogPrivacy, func(r *accessRecord, err error) {
+				c.server.logAccess(c, client.id, r, err)
+			})
+		}
 		err = client.process(c)
+		c.access.finish(err)
 	} else {
 		err = ErrIDNotFound
 	}
@@ -334,110 +410,84 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (handled, reload bool, cli
 		return
 	}
 
-	// secret
-	secretLen, err := reader.ReadByte()
+	// secret 或者 SecureHandshake 的凭证，之后的选项从返回的 reader 中读取
+	secretStr, reader, err := c.readCredential(idStr, r)
 	if err != nil {
-		c.Logger.Error().Err(err).Msg("failed to read secret len")
-		return
-	}
-	if secretLen < predef.MinSecretSize && secretLen > predef.MaxSecretSize {
-		c.Logger.Error().Err(err).Msg("invalid secret len")
-		return
-	}
-	secret, err := reader.Peek(int(secretLen))
-	if err != nil {
-		c.Logger.Error().Err(err).Msg("failed to read secret")
+		switch {
+		case errors.Is(err, ErrInvalidUser):
+			c.rejectTunnel(remoteIP, idStr, err)
+		case errors.Is(err, ErrInsecureHandshake):
+			e := c.SendErrorSignalInvalidIDAndSecret()
+			c.server.metrics.reject(connection.ErrInvalidIDAndSecret)
+			c.Logger.Info().Err(err).Str("id", idStr).Uint8("version", c.handshake.version).AnErr("respErr", e).
+				Msg("client did not use the secure handshake")
+		default:
+			c.Logger.Error().Err(err).Msg("failed to read secret")
+		}
 		return
 	}
-	secretStr := string(secret)
-	_, err = reader.Discard(int(secretLen))
-	if err != nil {
-		c.Logger.Error().Err(err).Msg("failed to discard secret")
+
+	// 出示了客户端证书的隧道由证书证明 id
+	cert := c.clientCert()
+	if cert != nil && !c.server.certMatchesID(cert, idStr) || cert == nil && c.server.config.TLSClientCertRequired {
+		e := c.SendErrorSignalInvalidIDAndSecret()
+		c.server.metrics.reject(connection.ErrInvalidIDAndSecret)
+		c.Logger.Info().Str("id", idStr).Bool("cert", cert != nil).AnErr("respErr", e).Msg("client cert does not match the id")
 		return
 	}
 
 	var options options
 	var u user
-	if c.server.authUser != nil {
+	if authUser := c.server.authUserFunc(); authUser != nil {
 		// 验证 id secret
-		u, err = c.server.authUser(idStr, secretStr)
+		if cert != nil {
+			u, err = c.server.authUserWithCert(idStr)
+		} else {
+			u, err = authUser(idStr, secretStr)
+		}
 		if err != nil {
-			// 使用局部锁而不是全局锁可以明显提高并发性能，但少数情况下会降低限制效果
-			c.server.reconnectRWMutex.Lock()
-			reconnectTimes := c.server.reconnect[remoteIP]
-			reconnectTimes++
-			c.server.reconnect[remoteIP] = reconnectTimes
-			c.server.reconnectRWMutex.Unlock()
-
-			// ReconnectDuration 为 0 表示不进行限制解除
-			if c.server.config.ReconnectDuration.Duration > 0 && reconnectTimes > c.server.config.ReconnectTimes {
-				time.AfterFunc(c.server.config.ReconnectDuration.Duration, func() {
-					c.server.reconnectRWMutex.Lock()
-					c.server.reconnect[remoteIP] = 0
-					c.server.reconnectRWMutex.Unlock()
-					c.Logger.Info().Msgf("release blocked IP: '%v'", remoteIP)
-				})
-			}
-
-			e := c.SendErrorSignalInvalidIDAndSecret()
-			c.Logger.Info().Err(err).Str("id", idStr).AnErr("respErr", e).Msg("invalid id and secret")
+			c.rejectTunnel(remoteIP, idStr, err)
 			return
 		}
 
 		options, err = c.parseOptions(reader, idStr, u)
 		if err != nil {
+			c.server.metrics.reject(err)
 			c.Logger.Info().Err(err).Msg("failed to parse options")
 			return
 		}
 	} else {
-		u = user{
-			TCPNumber:   &c.server.config.TCPNumber,
-			Speed:       c.server.config.Speed,
-			Connections: c.server.config.Connections,
-			Host:        c.server.config.Host,
-		}
+		u = c.server.defaultUser()
 		options, err = c.parseOptions(reader, idStr, u)
 		if err != nil {
+			c.server.metrics.reject(err)
 			c.Logger.Info().Err(err).Msg("failed to parse options")
 			return
 		}
 		prefixes := make([]string, 0, len(options.ids))
-		for s := range options.ids {
-			prefixes = append(prefixes, s)
+		for s, o := range options.ids {
+			if !o.domain {
+				prefixes = append(prefixes, s)
+			}
 		}
 		u, err = c.server.authUserWithAPI(idStr, secretStr, prefixes)
 		if err != nil {
-			// 使用局部锁而不是全局锁可以明显提高并发性能，但少数情况下会降低限制效果
-			c.server.reconnectRWMutex.Lock()
-			reconnectTimes := c.server.reconnect[remoteIP]
-			reconnectTimes++
-			c.server.reconnect[remoteIP] = reconnectTimes
-			c.server.reconnectRWMutex.Unlock()
-
-			// ReconnectDuration 为 0 表示不进行限制解除
-			if c.server.config.ReconnectDuration.Duration > 0 && reconnectTimes > c.server.config.ReconnectTimes {
-				time.AfterFunc(c.server.config.ReconnectDuration.Duration, func() {
-					c.server.reconnectRWMutex.Lock()
-					c.server.reconnect[remoteIP] = 0
-					c.server.reconnectRWMutex.Unlock()
-					c.Logger.Debug().Msgf("release blocked IP: '%v'", remoteIP)
-				})
-			}
-
-			e := c.SendErrorSignalInvalidIDAndSecret()
-			c.Logger.Info().Err(err).Str("id", idStr).AnErr("respErr", e).Msg("invalid id and secret")
+			c.rejectTunnel(remoteIP, idStr, err)
 			return
 		}
 		if len(u.Host.Prefixes) > 0 {
-			for id := range options.ids {
+			for id, o := range options.ids {
+				if o.domain {
+					continue
+				}
 				if _, ok := u.Host.Prefixes[id]; !ok {
 					c.Logger.Info().Str("id", idStr).Str("prefix", id).Msg("prefix not exists on platform")
 					delete(options.ids, id)
 				}
 			}
 		} else {
-			for id := range options.ids {
-				if id != idStr {
+			for id, o := range options.ids {
+				if !o.domain && id != idStr {
 					c.Logger.Info().Str("id", idStr).Str("prefix", id).Msg("prefix not exists on platform")
 					delete(options.ids, id)
 				}
@@ -445,7 +495,15 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (handled, reload bool, cli
 		}
 	}
 
+	err = c.verifyDomains(idStr, options)
+	if err != nil {
+		c.server.metrics.reject(err)
+		return
+	}
+
 	c.Logger.Info().Hex("checksum", options.configChecksum[:]).Bool("reload", r).Msg("handling tunnel")
+	c.sendRemoteAddr.Store(options.remoteAddr)
+	c.flowControl.Store(options.flowControl)
 
 	// 获取或创建 client
 	var ok bool
@@ -461,6 +519,7 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (handled, reload bool, cli
 			break
 		}
 		if err != nil {
+			c.server.metrics.reject(err)
 			c.Logger.Error().Err(err).Msg("failed to add tunnels")
 			return
 		}
@@ -469,6 +528,7 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (handled, reload bool, cli
 		c.Logger.Error().Msg("failed to create client")
 		return
 	}
+	cli.expireAt(u.expiresAt)
 
 	if !r {
 		atomic.AddUint64(&c.server.tunneling, 1)
@@ -480,44 +540,76 @@ func (c *conn) handleTunnel(remoteIP string, r bool) (handled, reload bool, cli
 		c.Logger.Error().Err(err).Bool("reload", r).Msg("failed to send ready/services signal")
 		return
 	}
+	c.sendTURNCredential(idStr)
 
 	handled = true
 	reload = c.readLoop(cli)
 	return
 }
 
+// rejectTunnel 拒绝 id 与 secret 无效的隧道，并累计 IP 的重连次数
+func (c *conn) rejectTunnel(remoteIP string, idStr string, err error) {
+	// 使用局部锁而不是全局锁可以明显提高并发性能，但少数情况下会降低限制效果
+	c.server.reconnectRWMutex.Lock()
+	reconnectTimes := c.server.reconnect[remoteIP]
+	reconnectTimes++
+	c.server.reconnect[remoteIP] = reconnectTimes
+	c.server.reconnectRWMutex.Unlock()
+	if c.server.cluster != nil && reconnectTimes > c.server.config.ReconnectTimes {
+		c.server.cluster.ban(remoteIP, c.server.config.ReconnectDuration.Duration)
+	}
+
+	// ReconnectDuration 为 0 表示不进行限制解除
+	if c.server.config.ReconnectDuration.Duration > 0 && reconnectTimes > c.server.config.ReconnectTimes {
+		time.AfterFunc(c.server.config.ReconnectDuration.Duration, func() {
+			c.server.reconnectRWMutex.Lock()
+			c.server.reconnect[remoteIP] = 0
+			c.server.reconnectRWMutex.Unlock()
+			c.Logger.Info().Msgf("release blocked IP: '%v'", remoteIP)
+		})
+	}
+
+	e := c.SendErrorSignalInvalidIDAndSecret()
+	c.server.metrics.reject(connection.ErrInvalidIDAndSecret)
+	c.Logger.Info().Err(err).Str("id", idStr).AnErr("respErr", e).Msg("invalid id and secret")
+}
+
 func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
-	rollbackIds := make(map[string]bool)
+	rollbackIds := make(map[string]hostPrefixOption)
 	// add host prefixes
 	for id, o := range options.ids {
-		v, ok := c.server.getOrCreateHostPrefix(id, o.tls, func() interface{} {
-			return clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex}
-		})
+		// 集群中其他节点的冲突
+		ok := c.server.claimHostPrefix(id, o, cli)
+		var loaded bool
 		if ok {
-			if v.client == cli {
-				continue
-			} else {
-				c.Logger.Error().
+			ok, loaded = c.server.addHostPrefix(id, o, cli)
+		}
+		if loaded {
+			continue
+		}
+		if !ok {
+			c.Logger.Error().
+				Str("id", cli.id).
+				Str("prefix", id).
+				Bool("tls", o.tls).
+				Bool("domain", o.domain).
+				Err(connection.ErrHostConflict).
+				Msg("failed to add host prefix")
+			for id, o := range rollbackIds {
+				c.server.removeHostPrefix(id, o, cli)
+				c.Logger.Info().
+					Hex("checksum", options.configChecksum[:]).
 					Str("id", cli.id).
 					Str("prefix", id).
 					Bool("tls", o.tls).
-					Err(connection.ErrHostConflict).
-					Msg("failed to add host prefix")
-				for id, tls := range rollbackIds {
-					c.server.removeHostPrefix(id, tls)
-					c.Logger.Info().
-						Hex("checksum", options.configChecksum[:]).
-						Str("id", cli.id).
-						Str("prefix", id).
-						Bool("tls", tls).
-						Msg("rollback added associated host prefix because host prefixes conflict")
-				}
-				err = c.SendErrorSignalHostConflict()
-				if err != nil {
-					c.Logger.Error().Err(err).Msg("failed to SendErrorSignalHostConflict")
-				}
-				return connection.ErrHostConflict
+					Bool("domain", o.domain).
+					Msg("rollback added associated host prefix because host prefixes conflict")
+			}
+			err = c.SendErrorSignalHostConflict()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to SendErrorSignalHostConflict")
 			}
+			return connection.ErrHostConflict
 		}
 		c.Logger.Info().
 			Hex("checksum", options.configChecksum[:]).
@@ -525,21 +617,21 @@ func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
 			Str("prefix", id).
 			Str("newServiceIndex", o.String()).
 			Msg("added associated host prefix")
-		rollbackIds[id] = o.tls
+		rollbackIds[id] = o
 	}
 	// remove host prefixes that are no longer used
 	for id, oo := range c.ids {
 		o, ok := options.ids[id]
-		if !ok || oo.tls != o.tls {
-			c.server.removeHostPrefix(id, oo.tls)
+		if !ok || !oo.sameKind(o) {
+			c.server.removeHostPrefix(id, oo, cli)
 			c.Logger.Info().
 				Str("id", cli.id).
 				Hex("last checksum", c.configChecksum[:]).
 				Hex("checksum", options.configChecksum[:]).
 				Str("oldServiceIndex", oo.String()).
 				Str("prefix", id).Msg("removed associated host prefix no longer needed")
-		} else if oo.serviceIndex != o.serviceIndex {
-			c.server.storeHostPrefix(id, oo.tls, clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex})
+		} else if oo != o {
+			c.server.storeHostPrefix(id, o, clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex})
 			c.Logger.Info().
 				Str("id", cli.id).
 				Hex("last checksum", c.configChecksum[:]).
@@ -561,24 +653,44 @@ func (c *conn) processHostPrefixes(options options, cli *client) (err error) {
 type options struct {
 	ids            hostPrefixOptions
 	ports          map[uint16]openTCPOption
+	udpPorts       map[uint16]openUDPOption
+	acls           map[uint16]*acl      // key: serviceIndex
+	auths          map[uint16]*authGate // key: serviceIndex
 	configChecksum [32]byte
+	remoteAddr     bool // 客户端需要访问者连接的地址
+	flowControl    bool // 客户端支持上行的流量控制
 }
 
 type openTCPOption struct {
 	port   uint16
 	random bool
+	group  groupOption
 }
 
 type hostPrefixOption struct {
 	serviceIndex uint16
 	tls          bool
+	domain       bool // key 是完整的自定义域名而不是 host 前缀
+	group        groupOption
 }
 
 func (h *hostPrefixOption) String() string {
+	s := strconv.FormatUint(uint64(h.serviceIndex), 10)
+	if h.domain {
+		s += "domain"
+	}
 	if h.tls {
-		return strconv.FormatUint(uint64(h.serviceIndex), 10) + "tls"
+		s += "tls"
+	}
+	if h.group.enabled() {
+		s += "group" + strconv.FormatUint(uint64(h.group.weight), 10)
 	}
-	return strconv.FormatUint(uint64(h.serviceIndex), 10)
+	return s
+}
+
+// sameKind 判断两个 option 是否保存在同一个表中，并且都属于或者都不属于组
+func (h hostPrefixOption) sameKind(o hostPrefixOption) bool {
+	return h.tls == o.tls && h.domain == o.domain && h.group.enabled() == o.group.enabled()
 }
 
 type hostPrefixOptions map[string]hostPrefixOption
@@ -599,8 +711,22 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 	var serviceIndex uint16
 	ids := make(hostPrefixOptions)
 	ports := make(map[uint16]openTCPOption)
+	udpPorts := make(map[uint16]openUDPOption)
 	num := *u.Host.Number
 	tcpNum := *u.TCPNumber
+	var udpNum uint16
+	if u.UDPNumber != nil {
+		udpNum = *u.UDPNumber
+	}
+	var domainNum, domains uint32
+	if u.Host.DomainNumber != nil {
+		domainNum = *u.Host.DomainNumber
+	}
+	var group groupOption // 只作用于紧随其后的服务
+	var serviceACL *acl   // 只作用于紧随其后的服务
+	acls := make(map[uint16]*acl)
+	var serviceAuth *authGate // 只作用于紧随其后的服务
+	auths := make(map[uint16]*authGate)
 	for leftOptions := 1; leftOptions > 0; leftOptions-- {
 		if optionsCount+1 > c.server.config.MaxHandShakeOptions {
 			c.Logger.Error().
@@ -646,9 +772,26 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 				Uint16("serviceIndex", serviceIndex).
 				Str("id", idStr).
 				Msg("adding associated host prefix")
-			ids[idStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls}
+			if group.enabled() {
+				group.auth = serviceAuth
+			}
+			ids[idStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls, group: group}
+			if serviceACL != nil {
+				acls[serviceIndex] = serviceACL
+			}
+			err = c.checkServiceAuth(serviceAuth, tls)
+			if err != nil {
+				return options, err
+			}
+			if serviceAuth != nil {
+				auths[serviceIndex] = serviceAuth
+			}
 			serviceIndex++
 		case bytes.Equal(option, predef.OpenTCPPort):
+			if serviceAuth != nil {
+				c.Logger.Error().Msg("tcp port can not set auth")
+				return options, errors.New("invalid option")
+			}
 			if tcpNum != 0 && uint16(len(ports))+1 > tcpNum {
 				err = connection.ErrTCPNumberLimited
 				e := c.SendErrorSignalTCPNumberLimited()
@@ -674,11 +817,155 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 				return options, err
 			}
 
-			ports[serviceIndex] = openTCPOption{port: tcpPort, random: random != 0}
+			ports[serviceIndex] = openTCPOption{port: tcpPort, random: random != 0, group: group}
+			if serviceACL != nil {
+				acls[serviceIndex] = serviceACL
+			}
+			serviceIndex++
+		case bytes.Equal(option, predef.OpenUDPPort):
+			if group.enabled() {
+				c.Logger.Error().Msg("udp port can not join a group")
+				return options, errors.New("invalid option")
+			}
+			if serviceAuth != nil {
+				c.Logger.Error().Msg("udp port can not set auth")
+				return options, errors.New("invalid option")
+			}
+			if udpNum != 0 && uint16(len(udpPorts))+1 > udpNum {
+				err = connection.ErrUDPNumberLimited
+				e := c.SendErrorSignalUDPNumberLimited()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of udp ports")
+				return options, err
+			}
+			var random byte
+			random, err = reader.ReadByte()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read random byte")
+				return options, err
+			}
+			var peekBytes []byte
+			peekBytes, err = reader.Peek(2)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to peek udp port")
+				return options, err
+			}
+			udpPort := uint16(peekBytes[1]) | uint16(peekBytes[0])<<8
+			_, err = reader.Discard(2)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to discard udp port")
+				return options, err
+			}
+
+			udpPorts[serviceIndex] = openUDPOption{port: udpPort, random: random != 0}
+			if serviceACL != nil {
+				acls[serviceIndex] = serviceACL
+			}
 			serviceIndex++
 		case bytes.Equal(option, predef.OptionAndNextOption):
 			leftOptions += 2
 			continue // 跳过 serverIndex++
+		case bytes.Equal(option, predef.SendRemoteAddr):
+			options.remoteAddr = true
+			continue
+		case bytes.Equal(option, predef.FlowControl):
+			options.flowControl = true
+			continue
+		case bytes.Equal(option, predef.JoinGroup):
+			var weight byte
+			weight, err = reader.ReadByte()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read group weight")
+				return options, err
+			}
+			var secretLen byte
+			secretLen, err = reader.ReadByte()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read group secret length")
+				return options, err
+			}
+			var secret []byte
+			secret, err = reader.Peek(int(secretLen))
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to peek group secret")
+				return options, err
+			}
+			group.secret = sha256.Sum256(secret)
+			_, err = reader.Discard(int(secretLen))
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to discard group secret")
+				return options, err
+			}
+			if weight == 0 || secretLen == 0 {
+				c.Logger.Error().Msg("invalid group option")
+				return options, errors.New("invalid option")
+			}
+			group.weight = weight
+			continue
+		case bytes.Equal(option, predef.SetACL):
+			serviceACL, err = readACL(reader)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read acl")
+				return options, err
+			}
+			continue
+		case bytes.Equal(option, predef.SetAuth):
+			serviceAuth, err = readAuth(reader)
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read auth")
+				return options, err
+			}
+			if !c.server.allowAuth(serviceAuth) {
+				err = connection.ErrAuthNotAllowed
+				e := c.SendErrorSignalAuthNotAllowed()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Strs("methods", serviceAuth.methods()).Msg("auth methods or oidc issuer are not allowed")
+				return options, err
+			}
+			continue
+		case bytes.Equal(option, predef.BindTLSDomain):
+			tls = true
+			fallthrough
+		case bytes.Equal(option, predef.BindDomain):
+			if domainNum != 0 && domains+1 > domainNum {
+				err = connection.ErrDomainNumberLimited
+				e := c.SendErrorSignalDomainNumberLimited()
+				c.Logger.Error().Err(err).AnErr("SendError", e).Msg("client has reached the max number of domains")
+				return options, err
+			}
+			var domainLen byte
+			domainLen, err = reader.ReadByte()
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to read domain length")
+				return options, err
+			}
+			var domain []byte
+			domain, err = reader.Peek(int(domainLen))
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to peek domain")
+				return options, err
+			}
+			domainStr := util.NormalizeDomain(string(domain))
+			_, err = reader.Discard(int(domainLen))
+			if err != nil {
+				c.Logger.Error().Err(err).Msg("failed to discard domain")
+				return options, err
+			}
+			if domainStr == "" {
+				c.Logger.Error().Bytes("domain", domain).Msg("invalid domain")
+				return options, errors.New("invalid domain")
+			}
+			if group.enabled() {
+				c.Logger.Error().Str("domain", domainStr).Msg("domain can not join a group")
+				return options, errors.New("invalid option")
+			}
+			c.Logger.Info().
+				Str("domain", domainStr).
+				Uint16("serviceIndex", serviceIndex).
+				Str("id", idStr).
+				Msg("adding associated domain")
+			// 自定义域名绑定到下一个服务，不增加 serviceIndex
+			ids[domainStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls, domain: true}
+			domains++
+			continue
 		case bytes.Equal(option, predef.OpenTLSHost):
 			tls = true
 			fallthrough
@@ -730,32 +1017,66 @@ func (c *conn) parseOptions(reader *bufio.Reader, idStr string, u user) (options
 				Uint16("serviceIndex", serviceIndex).
 				Str("id", idStr).
 				Msg("adding associated host prefix")
-			ids[hostPrefixStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls}
+			if group.enabled() {
+				group.auth = serviceAuth
+			}
+			ids[hostPrefixStr] = hostPrefixOption{serviceIndex: serviceIndex, tls: tls, group: group}
+			if serviceACL != nil {
+				acls[serviceIndex] = serviceACL
+			}
+			err = c.checkServiceAuth(serviceAuth, tls)
+			if err != nil {
+				return options, err
+			}
+			if serviceAuth != nil {
+				auths[serviceIndex] = serviceAuth
+			}
 			serviceIndex++
 		default:
 			c.Logger.Error().Msgf("invalid option: %v", optionFirst)
 			return options, errors.New("invalid option")
 		}
+		group = groupOption{}
+		serviceACL = nil
+		serviceAuth = nil
 	}
-	sum := calChecksum(ids, ports)
+	sum := calChecksum(ids, ports, udpPorts, acls, auths)
 	options.ids = ids
 	options.ports = ports
+	options.udpPorts = udpPorts
+	options.acls = acls
+	options.auths = auths
 	options.configChecksum = sum
 	return
 }
 
-func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption) (result [32]byte) {
+func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption, udpPorts map[uint16]openUDPOption, acls map[uint16]*acl, auths map[uint16]*authGate) (result [32]byte) {
 	tree := btree.NewWith(3, utils.UInt16Comparator)
+	// 自定义域名与服务的 host 前缀有相同的 serviceIndex，按域名排序
+	domainTree := btree.NewWith(3, utils.StringComparator)
 	for id, o := range ids {
 		si := o.serviceIndex
+		if o.domain {
+			if o.tls {
+				id = id + "-tls"
+			}
+			domainTree.Put(id, si)
+			continue
+		}
 		if o.tls {
 			id = id + "-tls"
 		}
+		if o.group.enabled() {
+			id = id + "-group" + strconv.FormatUint(uint64(o.group.weight), 10) + string(o.group.secret[:])
+		}
 		tree.Put(si, id)
 	}
 	for si, port := range ports {
 		tree.Put(si, port)
 	}
+	for si, port := range udpPorts {
+		tree.Put(si, port)
+	}
 	h := sha256.New()
 	it := tree.Iterator()
 	k := []byte{0x0, 0x0}
@@ -775,8 +1096,54 @@ func calChecksum(ids hostPrefixOptions, ports map[uint16]openTCPOption) (result
 			} else {
 				h.Write([]byte{0x0})
 			}
+			if v.group.enabled() {
+				h.Write([]byte{v.group.weight})
+				h.Write(v.group.secret[:])
+			}
+		case openUDPOption:
+			// 与相同端口的 tcp 服务区分
+			h.Write([]byte("udp"))
+			k[0], k[1] = byte(v.port>>8), byte(v.port)
+			h.Write(k)
+			if v.random {
+				h.Write([]byte{0x1})
+			} else {
+				h.Write([]byte{0x0})
+			}
 		}
 	}
+	it = domainTree.Iterator()
+	for it.Next() {
+		h.Write([]byte(it.Key().(string)))
+		key := it.Value().(uint16)
+		k[0], k[1] = byte(key>>8), byte(key)
+		h.Write(k)
+	}
+	aclTree := btree.NewWith(3, utils.UInt16Comparator)
+	for si, a := range acls {
+		aclTree.Put(si, a.String())
+	}
+	it = aclTree.Iterator()
+	for it.Next() {
+		h.Write([]byte("acl"))
+		key := it.Key().(uint16)
+		k[0], k[1] = byte(key>>8), byte(key)
+		h.Write(k)
+		h.Write([]byte(it.Value().(string)))
+	}
+	authTree := btree.NewWith(3, utils.UInt16Comparator)
+	for si, g := range auths {
+		authTree.Put(si, g.sum())
+	}
+	it = authTree.Iterator()
+	for it.Next() {
+		h.Write([]byte("auth"))
+		key := it.Key().(uint16)
+		k[0], k[1] = byte(key>>8), byte(key)
+		h.Write(k)
+		sum := it.Value().([sha256.Size]byte)
+		h.Write(sum[:])
+	}
 	h.Sum(result[:0])
 	return
 }
@@ -788,6 +1155,7 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 		c.Logger.Info().Err(err).Msg("readLoop ended")
 		c.tasksRWMtx.RLock()
 		for _, t := range c.tasks {
+			t.gated.close()
 			t.Close()
 		}
 		c.tasksRWMtx.RUnlock()
@@ -829,6 +1197,7 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 				c.Logger.Debug().Err(err).Msg("readLoop resp ping signal failed")
 				return
 			}
+			c.renewTURNCredential(cli.id)
 			continue
 		case connection.CloseSignal:
 			if predef.Debug {
@@ -875,8 +1244,8 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 			if err != nil {
 				return
 			}
-			if cli.needSpeedLimit() {
-				cli.speedLimit(l, true) // 对客户端上行进行限速
+			if ok && task.usage != nil {
+				task.usage.up.Add(uint64(l))
 			}
 			if predef.Debug {
 				c.Logger.Trace().Uint32("len", l).Msg("readLoop read len")
@@ -896,51 +1265,59 @@ func (c *conn) readLoop(cli *client) (reload bool) {
 				}
 				continue
 			}
-			_, err = r.WriteTo(task)
-			if r.N > 0 {
-				if !predef.Debug {
-					_, err = r.Discard(int(r.N))
-					if err != nil {
-						return
-					}
-				} else {
-					event := c.Logger.Trace().Int64("N", r.N)
-					bs, err := io.ReadAll(r)
-					event.Uint16("taskOption", taskOption).Hex("content", bs).Err(err).Uint32("taskID", taskID).Msg("orphan resp")
-				}
+			if task.upQueue != nil {
+				// 受限速的任务的上行数据由任务自己的 goroutine 限速与写入，避免阻塞同一隧道上的其他任务
+				err = task.queueUpload(r)
+			} else {
+				err = task.upload(r)
 			}
 			if err != nil {
-				switch e := err.(type) {
-				case *net.OpError:
-					switch e.Op {
-					case "write":
-						c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("remote req resp writer closed")
-						continue
-					}
-				case *bufio.WriteErr:
-					c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("remote req resp writer closed")
-					continue
-				}
 				return
 			}
-			if c.server.config.Timeout.Duration > 0 && !c.server.config.TimeoutOnUnidirectionalTraffic {
-				dl := time.Now().Add(c.server.config.Timeout.Duration)
-				err = task.SetReadDeadline(dl)
-				if err != nil {
-					c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("update read deadline failed")
-				}
-			}
+			c.updateTaskReadDeadline(task, taskID)
 		case predef.Close:
 			if predef.Debug {
 				c.Logger.Trace().Uint32("taskID", taskID).Msg("read close op")
 			}
 			if ok {
-				task.CloseByRemote()
+				if task.upQueue != nil {
+					task.upQueue.push(nil)
+				} else {
+					task.gated.close()
+					task.CloseByRemote()
+				}
 			}
 		}
 	}
 }
 
+// writeRemoteAddr 在任务的第一个 ServicesData 之前发送访问者连接的地址与协议，
+// 客户端据此向本地服务发送 PROXY protocol 头部或者 X-Forwarded-For 等 HTTP 头部
+func (c *conn) writeRemoteAddr(taskID uint32, task *conn) (err error) {
+	src := task.RemoteAddr().String()
+	dst := task.LocalAddr().String()
+	if len(src) > math.MaxUint8 || len(dst) > math.MaxUint8 {
+		src, dst = "", ""
+	}
+	proto := "http"
+	if task.isTLS() {
+		proto = "https"
+	}
+	l := 3 + len(src) + len(dst) + len(proto)
+	buf := make([]byte, 0, 10+l)
+	buf = append(buf, byte(taskID>>24), byte(taskID>>16), byte(taskID>>8), byte(taskID))
+	buf = append(buf, byte(predef.RemoteAddr>>8), byte(predef.RemoteAddr))
+	buf = append(buf, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	buf = append(buf, byte(len(src)))
+	buf = append(buf, src...)
+	buf = append(buf, byte(len(dst)))
+	buf = append(buf, dst...)
+	buf = append(buf, byte(len(proto)))
+	buf = append(buf, proto...)
+	_, err = c.Write(buf)
+	return
+}
+
 func (c *conn) process(taskID uint32, task *conn, cli *client) {
 	var rErr error
 	var wErr error
@@ -964,6 +1341,18 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 			c.Close()
 		}
 	}()
+	if c.sendRemoteAddr.Load() {
+		wErr = c.writeRemoteAddr(taskID, task)
+		if wErr != nil {
+			return
+		}
+	}
+	if task.upTunnel != nil {
+		wErr = c.writeWindow(taskID, predef.Window, uploadWindow)
+		if wErr != nil {
+			return
+		}
+	}
 	buf[0] = byte(taskID >> 24)
 	buf[1] = byte(taskID >> 16)
 	buf[2] = byte(taskID >> 8)
@@ -977,7 +1366,12 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 
 	buffered := task.Reader.Buffered()
 	var l int
-	if buffered > 0 {
+	if task.gated != nil {
+		l, rErr = task.readGated(buf[bufIndex+4:])
+		if rErr != nil {
+			return
+		}
+	} else if buffered > 0 {
 		var peek []byte
 		peek, rErr = task.Reader.Peek(buffered)
 		if rErr != nil {
@@ -989,9 +1383,9 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 			return
 		}
 	}
-	if cli.needSpeedLimit() {
-		cli.speedLimit(uint32(l), false) // 对客户端下行进行限速
-	}
+	wait(l, cli.downLimiter, task.downLimiter, c.server.downLimiter) // 对客户端下行进行限速
+	task.usage.down.Add(uint64(l))
+	task.access.request(buf[bufIndex+4 : bufIndex+4+l])
 	buf[bufIndex] = byte(l >> 24)
 	buf[bufIndex+1] = byte(l >> 16)
 	buf[bufIndex+2] = byte(l >> 8)
@@ -1014,10 +1408,14 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 				return
 			}
 		}
-		l, rErr = task.Reader.Read(buf[bufIndex+4:])
-		if cli.needSpeedLimit() {
-			cli.speedLimit(uint32(l), false) // 对客户端下行进行限速
+		if task.gated != nil {
+			l, rErr = task.readGated(buf[bufIndex+4:])
+		} else {
+			l, rErr = task.Reader.Read(buf[bufIndex+4:])
 		}
+		wait(l, cli.downLimiter, task.downLimiter, c.server.downLimiter) // 对客户端下行进行限速
+		task.usage.down.Add(uint64(l))
+		task.access.request(buf[bufIndex+4 : bufIndex+4+l])
 		if l > 0 {
 			buf[bufIndex] = byte(l >> 24)
 			buf[bufIndex+1] = byte(l >> 16)
@@ -1049,6 +1447,8 @@ func (c *conn) process(taskID uint32, task *conn, cli *client) {
 type clientWithServiceIndex struct {
 	*client
 	serviceIndex uint16
+	group        *backendGroup // 不为 nil 时 host 前缀属于组，选择成员之前 client 为 nil
+	member       *groupMember  // 从组中选择的成员
 }
 
 func (c *conn) processTCPOptions(o options, cli *client) (err error) {
@@ -1069,7 +1469,11 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 		vl := v.(*tcpListener)
 		if ok && vl.l != nil {
 			port := vl.l.Addr().(*net.TCPAddr).Port
-			if port == int(portOption.port) || portOption.random {
+			if (port == int(portOption.port) || portOption.random) && (vl.group != nil) == portOption.group.enabled() {
+				if vl.group != nil {
+					// 更新在组中的权重
+					vl.group.join(cli, si, portOption.group)
+				}
 				if err := c.SendInfoTCPPortOpened(si, uint16(port)); err != nil {
 					c.Logger.Error().Err(err).Msg("failed to send InfoTCPPortOpened signal")
 				}
@@ -1081,19 +1485,24 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 						Uint16("serviceIndex", si).
 						Uint16("port", port).
 						Msg("close associated tcp listener")
-					cli.portsManager.portsMtx.Lock()
-					cli.portsManager.ports[port] = struct{}{}
-					cli.portsManager.portsMtx.Unlock()
+					vl.releasePort(port)
 					_ = vl.l.Close()
 				}
 			}
 		}
 
 		var openedPort uint16
-		openedPort, err = cli.openTCPPort(si, vl, c)
+		vl.port = portOption
+		vl.group = nil
+		if portOption.group.enabled() {
+			openedPort, err = cli.openGroupTCPPort(si, vl, c)
+		} else {
+			openedPort, err = cli.openTCPPort(si, vl, c)
+		}
 		if err == nil {
 			success = append(success, si)
 		} else {
+			c.server.metrics.reject(connection.ErrFailedToOpenTCPPort)
 			c.Logger.Error().Err(err).
 				Uint16("port", portOption.port).
 				Bool("random", portOption.random).
@@ -1121,3 +1530,200 @@ func (c *conn) processTCPOptions(o options, cli *client) (err error) {
 	}
 	return
 }
+
+func (c *conn) updateTaskReadDeadline(task *conn, taskID uint32) {
+	if c.server.config.Timeout.Duration > 0 && !c.server.config.TimeoutOnUnidirectionalTraffic {
+		dl := time.Now().Add(c.server.config.Timeout.Duration)
+		err := task.SetReadDeadline(dl)
+		if err != nil {
+			c.Logger.Debug().Err(err).Uint32("taskID", taskID).Msg("update read deadline failed")
+		}
+	}
+}
+
+// startUploadLoop 在任务的 upLimiters 中有限速时启动任务自己的上行 goroutine，没有限速时返回 false。
+// 客户端支持流量控制时，任务的数据只在 uploadWindow 内发送，写入访问者连接后再归还窗口，
+// 所以限速只会使客户端停止读取本地服务，不会阻塞同一隧道上的其他任务
+func (c *conn) startUploadLoop(tunnel *conn, taskID uint32) (started bool) {
+	for _, l := range c.upLimiters {
+		if l.limited() {
+			started = true
+			break
+		}
+	}
+	if !started {
+		return
+	}
+	c.upQueue = newUploadQueue()
+	if tunnel.flowControl.Load() {
+		c.upTunnel = tunnel
+		c.upTaskID = taskID
+	}
+	go c.uploadLoop()
+	return
+}
+
+func (c *conn) stopUploadLoop() {
+	c.upQueue.close()
+}
+
+// queueUpload 把 r 中的数据分块放入上行队列
+func (c *conn) queueUpload(r *bufio.LimitedReader) (err error) {
+	for r.N > 0 {
+		buf := pool.BytesPool.Get().([]byte)
+		n := len(buf)
+		if int64(n) > r.N {
+			n = int(r.N)
+		}
+		n, err = io.ReadFull(r, buf[:n])
+		if err != nil {
+			pool.BytesPool.Put(buf)
+			return
+		}
+		if !c.upQueue.push(buf[:n]) {
+			pool.BytesPool.Put(buf)
+		}
+	}
+	return
+}
+
+// upload 直接写入没有限速的任务的上行数据，写入失败时丢弃剩余的数据
+func (c *conn) upload(r *bufio.LimitedReader) (err error) {
+	if c.access == nil && c.gated == nil {
+		_, err = r.WriteTo(c)
+		if err != nil {
+			switch e := err.(type) {
+			case *net.OpError:
+				if e.Op == "write" {
+					c.Logger.Debug().Err(err).Msg("remote req resp writer closed")
+					err = nil
+				}
+			case *bufio.WriteErr:
+				c.Logger.Debug().Err(err).Msg("remote req resp writer closed")
+				err = nil
+			}
+		}
+		if err == nil && r.N > 0 {
+			_, err = r.Discard(int(r.N))
+		}
+		return
+	}
+	buf := pool.BytesPool.Get().([]byte)
+	defer pool.BytesPool.Put(buf)
+	var wErr error
+	for r.N > 0 {
+		n := len(buf)
+		if int64(n) > r.N {
+			n = int(r.N)
+		}
+		n, err = io.ReadFull(r, buf[:n])
+		if err != nil {
+			return
+		}
+		if wErr == nil {
+			wErr = c.writeUpload(buf[:n])
+		}
+	}
+	return
+}
+
+// writeUpload 记录访问日志并把上行数据写入访问者连接
+func (c *conn) writeUpload(buf []byte) (err error) {
+	c.access.response(buf)
+	_, err = c.Write(buf)
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("remote req resp writer closed")
+	}
+	// 数据写入之后才唤醒等待响应结束的 process，服务端的响应不会插入到之前的响应中
+	c.gated.response(buf)
+	return
+}
+
+// readGated 读取受认证保护的访问者连接的数据，一次最多读到当前请求的结尾，之后的请求在头部完整并且通过认证之后才被读取
+func (c *conn) readGated(p []byte) (n int, err error) {
+	a := c.gated
+	if a.upgrading {
+		a.upgrading = false
+		upgraded, ok := a.wait()
+		if !ok {
+			err = net.ErrClosed
+			return
+		}
+		if upgraded {
+			a.raw = true
+		} else {
+			a.req.Reset()
+		}
+	}
+	_, err = c.Reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if !a.raw && a.req.ReadingHead() && !a.checked {
+		if !c.authenticate(a.gate) {
+			err = errAuthRejected
+			return
+		}
+		a.checked = true
+	}
+	l := c.Reader.Buffered()
+	if l > len(p) {
+		l = len(p)
+	}
+	b, err := c.Reader.Peek(l)
+	if err != nil {
+		return
+	}
+	n, err = a.request(b)
+	if err != nil {
+		n = 0
+		return
+	}
+	copy(p, b[:n])
+	_, err = c.Reader.Discard(n)
+	return
+}
+
+func (c *conn) uploadLoop() {
+	var err error
+	var written int // 已经写入但还没有归还的窗口
+	for {
+		buf, empty, ok := c.upQueue.pop()
+		if !ok {
+			return
+		}
+		if buf == nil {
+			c.gated.close()
+			c.CloseByRemote()
+			continue
+		}
+		n := len(buf)
+		if err == nil {
+			wait(n, c.upLimiters...)
+			err = c.writeUpload(buf)
+		}
+		pool.BytesPool.Put(buf[:cap(buf)])
+		if c.upTunnel != nil {
+			// 批量归还窗口，队列为空时全部归还，客户端不会一直等待
+			written += n
+			if empty || written >= uploadWindow/4 {
+				e := c.upTunnel.writeWindow(c.upTaskID, predef.WindowUpdate, written)
+				if e != nil {
+					c.Logger.Debug().Err(e).Msg("failed to update the upload window")
+				}
+				written = 0
+			}
+		}
+	}
+}
+
+// writeWindow 发送任务的上行窗口
+func (c *conn) writeWindow(taskID uint32, op predef.OP, n int) (err error) {
+	buf := [10]byte{
+		byte(taskID >> 24), byte(taskID >> 16), byte(taskID >> 8), byte(taskID),
+		byte(op >> 8), byte(op),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+	}
+	_, err = c.Write(buf[:])
+	return
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+const (
+	domainVerifyTimeout = 10 * time.Second
+	// 验证成功的结果在此期间内被复用，避免客户端重连时重复验证
+	domainVerifiedTTL = time.Hour
+	// 验证失败的结果在此期间内被复用，避免客户端反复重连时每次握手都等待验证
+	domainFailedTTL = time.Minute
+	// 每个用户缓存的验证失败的域名的最大数量，超过时删除最早过期的结果
+	domainFailedMax        = 64
+	domainChallengeRequest = "GET " + util.DomainChallengePath
+)
+
+type verifiedDomain struct {
+	id      string
+	expires time.Time
+}
+
+type failedDomain struct {
+	err     error
+	expires time.Time
+}
+
+// newDomainHTTPClient 返回 HTTP token 验证使用的客户端，不跟随重定向，也不连接内部地址，避免服务端被用于访问内网
+func newDomainHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: domainVerifyTimeout,
+		// 在解析域名之后检查实际连接的地址
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if util.IsInternalIP(addr.Addr()) {
+				return fmt.Errorf("internal address %s is not allowed", address)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: domainVerifyTimeout,
+	}
+}
+
+// parseBaseDomains 将 base domain 转为小写并检查是否合法
+func parseBaseDomains(domains []string) (result []string, err error) {
+	for _, d := range domains {
+		name := util.NormalizeDomain(d)
+		if name == "" {
+			err = fmt.Errorf("invalid base domain: '%s'", d)
+			return
+		}
+		result = append(result, name)
+	}
+	return
+}
+
+// routeHost 先按完整的域名查找自定义域名，再按 host 前缀查找
+func (s *Server) routeHost(host []byte, tls bool) (client clientWithServiceIndex, id []byte, ok bool, err error) {
+	name := strings.ToLower(string(stripPort(host)))
+	client, ok = s.getDomain(name, tls)
+	if ok {
+		id = []byte(name)
+		return
+	}
+	if len(s.config.BaseDomains) > 0 {
+		id, err = parseIDFromBaseDomains(host, s.config.BaseDomains)
+	} else {
+		id, err = parseIDFromHost(host)
+	}
+	if err != nil {
+		return
+	}
+	if len(id) < predef.MinIDSize {
+		err = ErrInvalidID
+		return
+	}
+	if tls {
+		client, ok = s.getTLSHostPrefix(string(id))
+	} else {
+		client, ok = s.getHostPrefix(string(id))
+	}
+	return
+}
+
+// handleDomainChallenge 拒绝未绑定的域名的验证请求，避免其被 host 前缀路由到其他用户的服务而通过验证
+func (s *Server) handleDomainChallenge(c *conn) (handled bool) {
+	if !hasRequestPrefix(c.Reader, domainChallengeRequest) {
+		return
+	}
+	host, err := peekHost(c.Reader)
+	if err == nil {
+		if _, ok := s.getDomain(strings.ToLower(string(stripPort(host))), false); ok {
+			return
+		}
+	}
+	handled = true
+	_, err = c.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("failed to write domain challenge response")
+	}
+	return
+}
+
+// isBaseDomain 判断 domain 是否为 base domain 或者在 base domain 之下，这些域名按 host 前缀路由，不能作为自定义域名
+func (s *Server) isBaseDomain(domain string) bool {
+	bases := s.config.BaseDomains
+	if s.config.ACMEDomain != "" {
+		bases = append(bases[:len(bases):len(bases)], strings.ToLower(s.config.ACMEDomain))
+	}
+	for _, base := range bases {
+		if domain == base || strings.HasSuffix(domain, "."+base) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyDomains 验证客户端绑定的所有自定义域名的所有权
+func (c *conn) verifyDomains(id string, o options) (err error) {
+	for domain, option := range o.ids {
+		if !option.domain {
+			continue
+		}
+		err = c.server.verifyDomain(id, domain)
+		if err != nil {
+			c.Logger.Info().
+				Err(err).
+				Str("id", id).
+				Str("domain", domain).
+				AnErr("sendSignalError", c.SendErrorSignalDomainNotVerified(domain)).
+				Msg("failed to verify domain")
+			return connection.ErrDomainNotVerified
+		}
+	}
+	return
+}
+
+// verifyDomain 通过 TXT 记录或者 HTTP token 验证 id 对应的用户拥有 domain
+func (s *Server) verifyDomain(id, domain string) (err error) {
+	if s.isBaseDomain(domain) {
+		err = fmt.Errorf("'%s' is a base domain", domain)
+		return
+	}
+	if _, e := netip.ParseAddr(domain); e == nil {
+		err = fmt.Errorf("'%s' is an ip address", domain)
+		return
+	}
+	if value, ok := s.verifiedDomains.Load(domain); ok {
+		v := value.(verifiedDomain)
+		if v.id == id && time.Now().Before(v.expires) {
+			return
+		}
+	}
+	err = s.loadFailedDomain(id, domain, time.Now())
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), domainVerifyTimeout)
+	defer cancel()
+	token := util.DomainToken(id, domain)
+	txtErr := s.verifyDomainTXT(ctx, domain, token)
+	if txtErr != nil {
+		httpErr := s.verifyDomainHTTP(ctx, domain, token)
+		if httpErr != nil {
+			err = fmt.Errorf("txt: %v, http: %v", txtErr, httpErr)
+			s.storeFailedDomain(id, domain, err, time.Now())
+			return
+		}
+	}
+	s.verifiedDomains.Store(domain, verifiedDomain{id: id, expires: time.Now().Add(domainVerifiedTTL)})
+	return
+}
+
+// loadFailedDomain 返回缓存的 id 验证 domain 失败的结果，过期的结果被删除
+func (s *Server) loadFailedDomain(id, domain string, now time.Time) (err error) {
+	s.failedDomainsMtx.Lock()
+	defer s.failedDomainsMtx.Unlock()
+	domains := s.failedDomains[id]
+	f, ok := domains[domain]
+	if !ok {
+		return
+	}
+	if now.Before(f.expires) {
+		return f.err
+	}
+	delete(domains, domain)
+	if len(domains) == 0 {
+		delete(s.failedDomains, id)
+	}
+	return
+}
+
+// storeFailedDomain 缓存 id 验证 domain 失败的结果。每隔 domainFailedTTL 删除全部过期的结果，
+// 每个用户最多缓存 domainFailedMax 个域名
+func (s *Server) storeFailedDomain(id, domain string, err error, now time.Time) {
+	s.failedDomainsMtx.Lock()
+	defer s.failedDomainsMtx.Unlock()
+	if now.Sub(s.failedEvicted) >= domainFailedTTL {
+		s.failedEvicted = now
+		for k, domains := range s.failedDomains {
+			for d, f := range domains {
+				if !now.Before(f.expires) {
+					delete(domains, d)
+				}
+			}
+			if len(domains) == 0 {
+				delete(s.failedDomains, k)
+			}
+		}
+	}
+	if s.failedDomains == nil {
+		s.failedDomains = make(map[string]map[string]failedDomain)
+	}
+	domains, ok := s.failedDomains[id]
+	if !ok {
+		domains = make(map[string]failedDomain)
+		s.failedDomains[id] = domains
+	}
+	if _, ok = domains[domain]; !ok && len(domains) >= domainFailedMax {
+		var oldest string
+		for d, f := range domains {
+			if len(oldest) == 0 || f.expires.Before(domains[oldest].expires) {
+				oldest = d
+			}
+		}
+		delete(domains, oldest)
+	}
+	domains[domain] = failedDomain{err: err, expires: now.Add(domainFailedTTL)}
+}
+
+func (s *Server) verifyDomainTXT(ctx context.Context, domain, token string) (err error) {
+	records, err := s.lookupTXT(ctx, util.DomainChallengePrefix+domain)
+	if err != nil {
+		return
+	}
+	for _, r := range records {
+		if strings.TrimSpace(r) == token {
+			return
+		}
+	}
+	err = fmt.Errorf("token not found in %d TXT records", len(records))
+	return
+}
+
+func (s *Server) verifyDomainHTTP(ctx context.Context, domain, token string) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+util.DomainChallengePath+token, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.domainHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(body)) != token {
+		err = fmt.Errorf("unexpected token %q", body)
+	}
+	return
+}
+
+func (s *Server) getDomain(domain string, tls bool) (c clientWithServiceIndex, ok bool) {
+	var value interface{}
+	if tls {
+		value, ok = s.tlsDomain2Client.Load(domain)
+	} else {
+		value, ok = s.domain2Client.Load(domain)
+	}
+	if ok {
+		c = value.(clientWithServiceIndex)
+	}
+	return
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/util"
+)
+
+func newDomainTestServer(t *testing.T, txt map[string][]string) *Server {
+	s, err := New([]string{"server", "-baseDomains", "Example.com."}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		records, ok := txt[name]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return records, nil
+	}
+	return s
+}
+
+func TestVerifyDomain(t *testing.T) {
+	txt := map[string][]string{
+		"_gt-challenge.www.customer.com": {"other", util.DomainToken("id1", "www.customer.com")},
+	}
+	s := newDomainTestServer(t, txt)
+	if len(s.config.BaseDomains) != 1 || s.config.BaseDomains[0] != "example.com" {
+		t.Fatalf("invalid base domains %v", s.config.BaseDomains)
+	}
+
+	err := s.verifyDomain("id1", "www.customer.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.verifyDomain("id2", "www.customer.com")
+	if err == nil {
+		t.Fatal("token of another id should not be accepted")
+	}
+	// 验证结果被缓存
+	delete(txt, "_gt-challenge.www.customer.com")
+	err = s.verifyDomain("id1", "www.customer.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base domain 下的域名按 host 前缀路由，不能被绑定
+	txt["_gt-challenge.abc.example.com"] = []string{util.DomainToken("id1", "abc.example.com")}
+	err = s.verifyDomain("id1", "abc.example.com")
+	if err == nil {
+		t.Fatal("domains under base domains should not be accepted")
+	}
+
+	// 没有 TXT 记录时使用 HTTP token 验证
+	token := util.DomainToken("id1", "web.customer.net")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "redirect.customer.net" {
+			http.Redirect(w, r, "http://web.customer.net"+util.DomainChallengePath+token, http.StatusFound)
+			return
+		}
+		if r.Host != "web.customer.net" || r.URL.Path != util.DomainChallengePath+token {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = io.WriteString(w, token+"\n")
+	}))
+	defer ts.Close()
+
+	// 测试服务器监听在内部地址上，默认的客户端拒绝连接
+	_, err = s.domainHTTPClient.Get(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("internal address should not be allowed: %v", err)
+	}
+	s.domainHTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+		},
+	}
+	err = s.verifyDomain("id1", "web.customer.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.verifyDomain("id2", "web.customer.net")
+	if err == nil {
+		t.Fatal("token of another id should not be accepted")
+	}
+	// 不跟随重定向
+	err = s.verifyDomain("id1", "redirect.customer.net")
+	if err == nil || !strings.Contains(err.Error(), "302") {
+		t.Fatalf("redirect should not be followed: %v", err)
+	}
+	// 不验证 ip 地址
+	for _, domain := range []string{"127.0.0.1", "::1"} {
+		err = s.verifyDomain("id1", domain)
+		if err == nil || !strings.Contains(err.Error(), "ip address") {
+			t.Fatalf("ip address %s should not be accepted: %v", domain, err)
+		}
+	}
+}
+
+func TestVerifyDomainFailureCache(t *testing.T) {
+	txt := map[string][]string{}
+	s := newDomainTestServer(t, txt)
+	s.domainHTTPClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+	err := s.verifyDomain("id1", "www.customer.com")
+	if err == nil {
+		t.Fatal("domain should not be verified")
+	}
+	// 失败的结果被缓存，添加记录之后仍然失败
+	txt["_gt-challenge.www.customer.com"] = []string{util.DomainToken("id1", "www.customer.com")}
+	err = s.verifyDomain("id1", "www.customer.com")
+	if err == nil {
+		t.Fatal("failure should be cached")
+	}
+	// 其他 id 的结果不受影响
+	txt["_gt-challenge.www.customer.com"] = append(txt["_gt-challenge.www.customer.com"], util.DomainToken("id2", "www.customer.com"))
+	err = s.verifyDomain("id2", "www.customer.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 缓存过期之后重新验证
+	f, ok := s.failedDomains["id1"]["www.customer.com"]
+	if !ok {
+		t.Fatal("failure is not cached")
+	}
+	f.expires = time.Now()
+	s.failedDomains["id1"]["www.customer.com"] = f
+	err = s.verifyDomain("id1", "www.customer.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = s.failedDomains["id1"]; ok {
+		t.Fatal("expired failure is not removed")
+	}
+}
+
+func TestFailedDomainEviction(t *testing.T) {
+	s := &Server{}
+	now := time.Now()
+	failure := errors.New("failed")
+	for i := 0; i <= domainFailedMax; i++ {
+		s.storeFailedDomain("id1", strconv.Itoa(i)+".customer.com", failure, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	// 超过数量限制时删除最早过期的结果
+	if n := len(s.failedDomains["id1"]); n != domainFailedMax {
+		t.Fatalf("unexpected %d failures", n)
+	}
+	if err := s.loadFailedDomain("id1", "0.customer.com", now); err != nil {
+		t.Fatal("the oldest failure should be removed")
+	}
+	if err := s.loadFailedDomain("id1", "1.customer.com", now); err != failure {
+		t.Fatal("failure should be cached", err)
+	}
+
+	// 定期删除其他用户过期的结果
+	s.storeFailedDomain("id2", "www.customer.com", failure, now.Add(2*domainFailedTTL))
+	if _, ok := s.failedDomains["id1"]; ok || len(s.failedDomains) != 1 {
+		t.Fatal("expired failures should be evicted", len(s.failedDomains))
+	}
+}
+
+func TestRouteHost(t *testing.T) {
+	s := newDomainTestServer(t, nil)
+	s.storeHostPrefix("abc", hostPrefixOption{}, clientWithServiceIndex{serviceIndex: 1})
+	s.storeHostPrefix("www.customer.com", hostPrefixOption{domain: true}, clientWithServiceIndex{serviceIndex: 2})
+	s.storeHostPrefix("tls.customer.com", hostPrefixOption{domain: true, tls: true}, clientWithServiceIndex{serviceIndex: 3})
+
+	cases := []struct {
+		host         string
+		tls          bool
+		id           string
+		serviceIndex uint16
+		ok           bool
+		err          error
+	}{
+		{"abc.example.com", false, "abc", 1, true, nil},
+		{"abc.example.com:8080", false, "abc", 1, true, nil},
+		{"WWW.Customer.com:80", false, "www.customer.com", 2, true, nil},
+		{"tls.customer.com", true, "tls.customer.com", 3, true, nil},
+		{"tls.customer.com", false, "", 0, false, ErrHostNotAllowed},
+		{"def.example.com", false, "def", 0, false, nil},
+		{"abc.other.com", false, "", 0, false, ErrHostNotAllowed},
+	}
+	for _, c := range cases {
+		client, id, ok, err := s.routeHost([]byte(c.host), c.tls)
+		if !errors.Is(err, c.err) || ok != c.ok || string(id) != c.id || client.serviceIndex != c.serviceIndex {
+			t.Fatalf("%s: unexpected result %q %v %d %v", c.host, id, ok, client.serviceIndex, err)
+		}
+	}
+}
+
+func TestHandleDomainChallenge(t *testing.T) {
+	s := newDomainTestServer(t, nil)
+	s.storeHostPrefix("www.customer.com", hostPrefixOption{domain: true}, clientWithServiceIndex{})
+	cases := []struct {
+		req     string
+		handled bool
+	}{
+		{"GET " + util.DomainChallengePath + "token HTTP/1.1\r\nHost: abc.example.com\r\n\r\n", true},
+		{"GET " + util.DomainChallengePath + "token HTTP/1.1\r\nHost: www.customer.com\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: abc.example.com\r\n\r\n", false},
+	}
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		task := newConn(local, s)
+		task.Reader = bufio.NewReader(strings.NewReader(c.req))
+		resp := make(chan string, 1)
+		go func() {
+			data, _ := io.ReadAll(remote)
+			resp <- string(data)
+		}()
+		handled := s.handleDomainChallenge(task)
+		_ = local.Close()
+		if handled != c.handled {
+			t.Fatalf("%q: unexpected handled %v", c.req, handled)
+		}
+		if r := <-resp; handled != strings.HasPrefix(r, "HTTP/1.1 404 ") {
+			t.Fatalf("%q: unexpected response %q", c.req, r)
+		}
+	}
+}
+
+func TestCalChecksumWithDomains(t *testing.T) {
+	ids := hostPrefixOptions{
+		"abc":              {serviceIndex: 0},
+		"www.customer.com": {serviceIndex: 0, domain: true},
+		"def":              {serviceIndex: 1, tls: true},
+		"tls.customer.com": {serviceIndex: 1, tls: true, domain: true},
+	}
+	sum := calChecksum(ids, nil, nil, nil, nil)
+	for i := 0; i < 10; i++ {
+		if calChecksum(ids, nil, nil, nil, nil) != sum {
+			t.Fatal("checksum should be stable")
+		}
+	}
+	delete(ids, "www.customer.com")
+	if calChecksum(ids, nil, nil, nil, nil) == sum {
+		t.Fatal("checksum should change with domains")
+	}
+}
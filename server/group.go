@@ -0,0 +1,391 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	groupBalanceLeastTasks = "leastTasks"
+	groupBalanceWeight     = "weight"
+)
+
+// groupOption 服务加入组的选项，weight 为 0 表示不加入组
+type groupOption struct {
+	secret [32]byte // 组密钥的 sha256
+	weight uint8
+	auth   *authGate // 服务的认证，组的成员必须使用相同的认证
+}
+
+func (o groupOption) enabled() bool {
+	return o.weight > 0
+}
+
+// backendGroup 由多个 client 的相同 host 前缀或 tcp 端口的服务组成，任务按 balance 分配到各个成员
+type backendGroup struct {
+	name     string // host 前缀，tcp 端口的形式为 tcp:port
+	secret   [32]byte
+	auth     *authGate // 第一个成员的认证，组的所有访问者都使用它检查
+	balance  string
+	members  []*groupMember
+	next     int // 最少任务数相同时从 next 开始选择，使任务轮流分配到各个成员
+	mtx      sync.Mutex
+	listener net.Listener // tcp 端口的组共享的 listener
+}
+
+type groupMember struct {
+	client       *client
+	serviceIndex uint16
+	weight       int64
+	current      int64        // 平滑加权轮询的当前权重
+	tasks        atomic.Int64 // 正在处理的任务数
+}
+
+func newBackendGroup(name string, o groupOption, balance string) *backendGroup {
+	return &backendGroup{
+		name:    name,
+		secret:  o.secret,
+		auth:    o.auth,
+		balance: balance,
+	}
+}
+
+// join 加入组，已经是成员时更新 serviceIndex 与权重。组密钥或者认证不同时返回 false
+func (g *backendGroup) join(c *client, serviceIndex uint16, o groupOption) (ok bool) {
+	if subtle.ConstantTimeCompare(g.secret[:], o.secret[:]) != 1 || g.auth.groupSum() != o.auth.groupSum() {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	ok = true
+	for _, m := range g.members {
+		if m.client == c {
+			m.serviceIndex = serviceIndex
+			m.weight = int64(o.weight)
+			return
+		}
+	}
+	g.members = append(g.members, &groupMember{
+		client:       c,
+		serviceIndex: serviceIndex,
+		weight:       int64(o.weight),
+	})
+	return
+}
+
+// leave 离开组，返回组是否已经没有成员
+func (g *backendGroup) leave(c *client) (empty bool) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for i, m := range g.members {
+		if m.client == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+func (g *backendGroup) has(c *client) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, m := range g.members {
+		if m.client == c {
+			return true
+		}
+	}
+	return false
+}
+
+// only 判断 c 是否为组的唯一成员
+func (g *backendGroup) only(c *client) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return len(g.members) == 1 && g.members[0].client == c
+}
+
+// allowed 检查所有成员的访问控制列表，访问者需要被每个成员允许，与最终选择的成员无关
+func (g *backendGroup) allowed(ip netip.Addr) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, m := range g.members {
+		if !m.client.allowed(ip, g.name, m.serviceIndex) {
+			return false
+		}
+	}
+	return true
+}
+
+// pick 按 balance 选择处理任务的成员，没有成员时返回 nil
+func (g *backendGroup) pick() (m *groupMember) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	n := len(g.members)
+	if n == 0 {
+		return
+	}
+	if g.balance == groupBalanceWeight {
+		// 平滑加权轮询
+		var total int64
+		for _, cur := range g.members {
+			cur.current += cur.weight
+			total += cur.weight
+			if m == nil || cur.current > m.current {
+				m = cur
+			}
+		}
+		m.current -= total
+		return
+	}
+	// 任务数与权重之比最小的成员
+	for i := 0; i < n; i++ {
+		cur := g.members[(g.next+i)%n]
+		if m == nil || cur.tasks.Load()*m.weight < m.tasks.Load()*cur.weight {
+			m = cur
+		}
+	}
+	g.next = (g.next + 1) % n
+	return
+}
+
+// pick 返回处理访问者连接的 client，属于组时按组的分配方式选择一个成员
+func (c clientWithServiceIndex) pick() (result clientWithServiceIndex, ok bool) {
+	if c.group == nil {
+		return c, c.client != nil
+	}
+	m := c.group.pick()
+	if m == nil {
+		return
+	}
+	return clientWithServiceIndex{client: m.client, serviceIndex: m.serviceIndex, group: c.group, member: m}, true
+}
+
+// authGate 返回服务的认证配置，属于组时返回组的认证
+func (c clientWithServiceIndex) authGate() *authGate {
+	if c.group != nil {
+		return c.group.auth
+	}
+	return c.client.authGate(c.serviceIndex)
+}
+
+// allowed 检查访问控制列表，属于组时检查组的所有成员
+func (c clientWithServiceIndex) allowed(ip netip.Addr, hostPrefix string) bool {
+	if c.group != nil {
+		return c.group.allowed(ip)
+	}
+	return c.client.allowed(ip, hostPrefix, c.serviceIndex)
+}
+
+func (c clientWithServiceIndex) process(task *conn) error {
+	if c.member != nil {
+		c.member.tasks.Add(1)
+		defer c.member.tasks.Add(-1)
+	}
+	return c.client.process(task)
+}
+
+// addHostPrefix 添加 host 前缀，加入组的 host 前缀可以被多个 client 添加。
+// host 前缀冲突时 ok 为 false，cli 已经添加过时 loaded 为 true
+func (s *Server) addHostPrefix(hostPrefix string, o hostPrefixOption, cli *client) (ok, loaded bool) {
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	m := s.hostPrefixMap(o)
+	value, exists := m.Load(hostPrefix)
+	if !exists {
+		m.Store(hostPrefix, s.newHostPrefixValue(hostPrefix, o, cli))
+		ok = true
+		return
+	}
+	v := value.(clientWithServiceIndex)
+	switch {
+	case v.group != nil && o.group.enabled():
+		loaded = v.group.has(cli)
+		ok = v.group.join(cli, o.serviceIndex, o.group)
+		// 组的唯一成员修改了组密钥或者认证时重新创建组
+		if !ok && v.group.only(cli) {
+			m.Store(hostPrefix, s.newHostPrefixValue(hostPrefix, o, cli))
+			ok, loaded = true, false
+		}
+	case v.group != nil:
+		// 组的唯一成员不再加入组
+		if v.group.only(cli) {
+			m.Store(hostPrefix, s.newHostPrefixValue(hostPrefix, o, cli))
+			ok = true
+		}
+	case v.client == cli:
+		if o.group.enabled() {
+			m.Store(hostPrefix, s.newHostPrefixValue(hostPrefix, o, cli))
+		} else {
+			loaded = true
+		}
+		ok = true
+	}
+	return
+}
+
+func (s *Server) newHostPrefixValue(hostPrefix string, o hostPrefixOption, cli *client) clientWithServiceIndex {
+	if !o.group.enabled() {
+		return clientWithServiceIndex{client: cli, serviceIndex: o.serviceIndex}
+	}
+	g := newBackendGroup(hostPrefix, o.group, s.config.GroupBalance)
+	g.join(cli, o.serviceIndex, o.group)
+	return clientWithServiceIndex{group: g}
+}
+
+// groupListener 是组的成员持有的 tcp listener，最后一个成员离开时才关闭组共享的 listener
+type groupListener struct {
+	net.Listener
+	server *Server
+	group  *backendGroup
+	client *client
+	port   uint16
+	once   sync.Once
+	last   bool
+}
+
+// leave 离开组，返回是否是最后一个离开的成员
+func (l *groupListener) leave() bool {
+	l.once.Do(func() {
+		l.last = l.server.leaveTCPGroup(l.port, l.group, l.client)
+	})
+	return l.last
+}
+
+func (l *groupListener) Close() error {
+	l.leave()
+	return nil
+}
+
+// openGroupTCPPort 加入 tcp 端口的组，组不存在时打开端口并创建组
+func (c *client) openGroupTCPPort(serviceIndex uint16, l *tcpListener, tunnel *conn) (openedTCPPort uint16, err error) {
+	s := tunnel.server
+	o := l.port
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	g, ok := s.tcpGroups[o.port]
+	if ok {
+		if !c.portsManager.contains(o.port) {
+			err = fmt.Errorf("tcp port %d is not allowed", o.port)
+			return
+		}
+		if !g.join(c, serviceIndex, o.group) {
+			err = fmt.Errorf("tcp port %d is used by a group with a different secret or auth", o.port)
+			return
+		}
+		openedTCPPort = o.port
+		l.pm.Store(c.portsManager)
+		tunnel.Logger.Info().Uint16("port", o.port).Msg("joined tcp port group")
+	} else {
+		if s.tcpGroups == nil {
+			s.tcpGroups = make(map[uint16]*backendGroup)
+		}
+		g = newBackendGroup("tcp:"+strconv.Itoa(int(o.port)), o.group, s.config.GroupBalance)
+		l.group = g
+		openedTCPPort, err = c.openTCPPort(serviceIndex, l, tunnel)
+		if err != nil {
+			l.group = nil
+			return
+		}
+		g.listener = l.l
+		g.join(c, serviceIndex, o.group)
+		s.tcpGroups[openedTCPPort] = g
+	}
+	l.group = g
+	l.l = &groupListener{
+		Listener: g.listener,
+		server:   s,
+		group:    g,
+		client:   c,
+		port:     openedTCPPort,
+	}
+	return
+}
+
+// leaveTCPGroup 离开 tcp 端口的组，最后一个成员离开时关闭组共享的 listener
+func (s *Server) leaveTCPGroup(port uint16, g *backendGroup, cli *client) (last bool) {
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	if !g.leave(cli) {
+		return
+	}
+	if s.tcpGroups[port] == g {
+		delete(s.tcpGroups, port)
+	}
+	_ = g.listener.Close()
+	return true
+}
+
+// GroupMember is a client serving a group.
+type GroupMember struct {
+	ID           string `json:"id"`
+	ServiceIndex uint16 `json:"serviceIndex"`
+	Weight       int64  `json:"weight"`
+	Tasks        int64  `json:"tasks"`
+}
+
+// Group is a host prefix or a tcp port served by several clients.
+type Group struct {
+	Name    string        `json:"name"` // tcp 端口的形式为 tcp:port
+	TLS     bool          `json:"tls"`
+	Balance string        `json:"balance"`
+	Members []GroupMember `json:"members"`
+}
+
+func (g *backendGroup) info(tls bool) (result Group) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	result = Group{Name: g.name, TLS: tls, Balance: g.balance}
+	for _, m := range g.members {
+		result.Members = append(result.Members, GroupMember{
+			ID:           m.client.id,
+			ServiceIndex: m.serviceIndex,
+			Weight:       m.weight,
+			Tasks:        m.tasks.Load(),
+		})
+	}
+	return
+}
+
+// GetGroups returns the groups of host prefixes and tcp ports and their members.
+func (s *Server) GetGroups() (result []Group) {
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	for _, tls := range []bool{false, true} {
+		s.hostPrefixMap(hostPrefixOption{tls: tls}).Range(func(key, value interface{}) bool {
+			if g := value.(clientWithServiceIndex).group; g != nil {
+				result = append(result, g.info(tls))
+			}
+			return true
+		})
+	}
+	for _, g := range s.tcpGroups {
+		result = append(result, g.info(false))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return !result[i].TLS && result[j].TLS
+	})
+	return
+}
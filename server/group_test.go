@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"net/netip"
+	"testing"
+)
+
+func TestBackendGroupPick(t *testing.T) {
+	secret := sha256.Sum256([]byte("secret"))
+	a, b := &client{id: "a"}, &client{id: "b"}
+
+	g := newBackendGroup("app", groupOption{secret: secret}, groupBalanceWeight)
+	g.join(a, 1, groupOption{secret: secret, weight: 3})
+	g.join(b, 2, groupOption{secret: secret, weight: 1})
+	counts := make(map[*client]int)
+	for i := 0; i < 8; i++ {
+		counts[g.pick().client]++
+	}
+	if counts[a] != 6 || counts[b] != 2 {
+		t.Fatalf("unexpected distribution by weight: %d %d", counts[a], counts[b])
+	}
+
+	g = newBackendGroup("app", groupOption{secret: secret}, groupBalanceLeastTasks)
+	g.join(a, 1, groupOption{secret: secret, weight: 1})
+	g.join(b, 2, groupOption{secret: secret, weight: 1})
+	m := g.pick()
+	m.tasks.Add(1)
+	for i := 0; i < 3; i++ {
+		if other := g.pick(); other == m {
+			t.Fatal("the member with the least tasks should be picked")
+		}
+	}
+	m.tasks.Add(-1)
+	counts = make(map[*client]int)
+	for i := 0; i < 4; i++ {
+		counts[g.pick().client]++
+	}
+	if counts[a] != 2 || counts[b] != 2 {
+		t.Fatalf("members with the same tasks should be picked in turn: %d %d", counts[a], counts[b])
+	}
+
+	if g.join(a, 1, groupOption{secret: sha256.Sum256([]byte("other")), weight: 1}) {
+		t.Fatal("member with a different secret should not join")
+	}
+	if g.join(a, 1, groupOption{secret: secret, weight: 1, auth: &authGate{bearer: [][sha256.Size]byte{{1}}}}) {
+		t.Fatal("member with a different auth should not join")
+	}
+	// 相同的密码在不同的客户端上有不同的 bcrypt 哈希
+	g.auth = &authGate{basic: map[string][]byte{"user": []byte("$2a$10$a")}}
+	if !g.join(a, 1, groupOption{secret: secret, weight: 1, auth: &authGate{basic: map[string][]byte{"user": []byte("$2a$10$b")}}}) {
+		t.Fatal("member with the same users should join")
+	}
+	if g.join(a, 1, groupOption{secret: secret, weight: 1, auth: &authGate{basic: map[string][]byte{"other": []byte("$2a$10$b")}}}) {
+		t.Fatal("member with different users should not join")
+	}
+	g.auth = nil
+	if g.leave(a) || !g.leave(b) || g.pick() != nil {
+		t.Fatal("group should be empty after all members left")
+	}
+}
+
+func TestGroupHostPrefix(t *testing.T) {
+	s := &Server{config: Config{Options: Options{GroupBalance: groupBalanceLeastTasks}}}
+	secret := sha256.Sum256([]byte("secret"))
+	a, b, c := &client{id: "a"}, &client{id: "b"}, &client{id: "c"}
+	o := hostPrefixOption{serviceIndex: 1, group: groupOption{secret: secret, weight: 1}}
+
+	if ok, _ := s.addHostPrefix("app", o, a); !ok {
+		t.Fatal("failed to add host prefix")
+	}
+	if ok, loaded := s.addHostPrefix("app", o, b); !ok || loaded {
+		t.Fatal("failed to join group")
+	}
+	if ok, loaded := s.addHostPrefix("app", o, b); !ok || !loaded {
+		t.Fatal("member should be loaded")
+	}
+	if ok, _ := s.addHostPrefix("app", hostPrefixOption{serviceIndex: 1}, c); ok {
+		t.Fatal("host prefix of a group should conflict with a client out of the group")
+	}
+	other := o
+	other.group.secret = sha256.Sum256([]byte("other"))
+	if ok, _ := s.addHostPrefix("app", other, c); ok {
+		t.Fatal("group with a different secret should conflict")
+	}
+	other = o
+	other.group.auth = &authGate{bearer: [][sha256.Size]byte{{1}}}
+	if ok, _ := s.addHostPrefix("app", other, c); ok {
+		t.Fatal("group with a different auth should conflict")
+	}
+	if ok, _ := s.addHostPrefix("plain", hostPrefixOption{serviceIndex: 1}, c); !ok {
+		t.Fatal("failed to add host prefix")
+	}
+	if ok, _ := s.addHostPrefix("plain", o, a); ok {
+		t.Fatal("host prefix out of a group should conflict")
+	}
+
+	groups := s.GetGroups()
+	if len(groups) != 1 || groups[0].Name != "app" || len(groups[0].Members) != 2 {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+
+	s.removeHostPrefix("app", o, a)
+	v, ok := s.getHostPrefix("app")
+	if !ok {
+		t.Fatal("host prefix should exist while the group has members")
+	}
+	if v, ok = v.pick(); !ok || v.client != b || v.serviceIndex != 1 {
+		t.Fatalf("unexpected member: %v", v.client)
+	}
+	s.removeHostPrefix("app", o, b)
+	if _, ok = s.getHostPrefix("app"); ok {
+		t.Fatal("host prefix should be removed after all members left")
+	}
+}
+
+func TestBackendGroupAllowed(t *testing.T) {
+	secret := sha256.Sum256([]byte("secret"))
+	a, b := &client{id: "a"}, &client{id: "b"}
+	var err error
+	a.acl, err = newACL(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceACL, err := newACL(nil, []string{"192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.serviceACLs = map[uint16]*acl{2: serviceACL}
+	g := newBackendGroup("app", groupOption{secret: secret}, groupBalanceWeight)
+	g.join(a, 1, groupOption{secret: secret, weight: 1})
+	g.join(b, 2, groupOption{secret: secret, weight: 1})
+
+	// 访问者需要被所有成员允许，与选择的成员无关
+	v := clientWithServiceIndex{group: g}
+	for ip, expected := range map[string]bool{
+		"127.0.0.1":   true,
+		"10.0.0.1":    false,
+		"192.168.1.1": false,
+	} {
+		for i := 0; i < 2; i++ {
+			picked, ok := v.pick()
+			if !ok {
+				t.Fatal("failed to pick a member")
+			}
+			if picked.allowed(netip.MustParseAddr(ip), "app") != expected {
+				t.Fatalf("%s picked %s: expected %v", ip, picked.client.id, expected)
+			}
+		}
+	}
+}
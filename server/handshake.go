@@ -0,0 +1,147 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/isrc-cas/gt/bufio"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+// ErrInsecureHandshake is returned if an old client sends its secret in plaintext while -requireSecureHandshake is set
+var ErrInsecureHandshake = errors.New("insecure handshake")
+
+// handshakeState 隧道握手的版本与 SecureHandshake 中的凭证类型、nonce，重新加载服务时沿用
+type handshakeState struct {
+	version byte
+	mode    byte
+	nonce   [predef.HandshakeNonceSize]byte
+}
+
+// handshakeSecret 返回 SecureHandshake 中验证 HMAC 与 digest 使用的 secret。它们只能使用明文保存的 secret 验证，
+// ok 为 false 表示服务端只保存了哈希后的 secret、使用 API 认证、id 不存在或者是接受任意客户端时创建的临时用户
+func (s *Server) handshakeSecret(id string) (secret string, ok bool) {
+	if s.authUserFunc() == nil {
+		return
+	}
+	if s.apiServer != nil && len(id) > 0 && id == s.apiServer.ID() {
+		return s.apiServer.Secret(), true
+	}
+	value, loaded := s.users.Load(id)
+	if !loaded {
+		return
+	}
+	u, ok := value.(user)
+	if !ok || u.temp || isHashedSecret(u.Secret) {
+		return "", false
+	}
+	return u.Secret, true
+}
+
+// readCredential 读取握手中的 secret 与选项，返回解析选项使用的 reader。
+// SecureHandshake 首次握手时先发送 [mode][nonce]，mode 只由服务端的配置与客户端证书决定，与 id 是否存在无关，
+// 避免通过 mode 判断 id 是否存在。HMAC 验证通过后返回服务端保存的 secret，
+// 之后的认证流程与明文 secret 相同；凭证无效时返回 ErrInvalidUser
+func (c *conn) readCredential(idStr string, reload bool) (secret string, reader *bufio.Reader, err error) {
+	reader = c.Reader
+	if c.handshake.version != predef.SecureHandshake {
+		if !reload && c.server.config.RequireSecureHandshake {
+			err = ErrInsecureHandshake
+			return
+		}
+		secret, err = readShortString(reader)
+		return
+	}
+
+	if !reload {
+		switch {
+		case c.server.authUserFunc() != nil && c.clientCert() != nil:
+			c.handshake.mode = predef.HandshakeCert
+		case c.server.apiServer != nil && idStr == c.server.apiServer.ID():
+			// 内部的 API 客户端使用随机的 id，不会泄露其它 id 是否存在
+			c.handshake.mode = predef.HandshakeHMAC
+		default:
+			c.handshake.mode = c.server.handshakeModeFunc()
+		}
+		_, err = rand.Read(c.handshake.nonce[:])
+		if err != nil {
+			return
+		}
+		challenge := make([]byte, 0, 1+len(c.handshake.nonce))
+		challenge = append(challenge, c.handshake.mode)
+		challenge = append(challenge, c.handshake.nonce[:]...)
+		_, err = c.Write(challenge)
+		if err != nil {
+			return
+		}
+	}
+
+	credential, err := readShortString(reader)
+	if err != nil {
+		return
+	}
+	optionsLenBytes, err := reader.Peek(2)
+	if err != nil {
+		return
+	}
+	optionsLen := int(binary.BigEndian.Uint16(optionsLenBytes))
+	_, err = reader.Discard(2)
+	if err != nil {
+		return
+	}
+	options := make([]byte, optionsLen)
+	_, err = io.ReadFull(reader, options)
+	if err != nil {
+		return
+	}
+	reader = bufio.NewReaderSize(bytes.NewReader(options), optionsLen)
+
+	switch c.handshake.mode {
+	case predef.HandshakeHMAC:
+		knownSecret, known := c.server.handshakeSecret(idStr)
+		if !known || len(knownSecret) == 0 {
+			c.Logger.Warn().Str("id", idStr).Msg("can not verify the hmac without the plaintext secret of the id, -plaintextSecretHandshake is needed if it is hashed or checked by the auth api")
+			err = ErrInvalidUser
+			return
+		}
+		proof := util.HandshakeProof(knownSecret, c.handshake.nonce[:], idStr, options)
+		if !hmac.Equal(proof, []byte(credential)) {
+			err = ErrInvalidUser
+			return
+		}
+		secret = knownSecret
+	case predef.HandshakeSecret:
+		secret = credential
+	case predef.HandshakeDigest:
+		// 已配置明文 secret 的 id 验证 digest，其它 id 以 digest 代替 secret 创建或验证临时用户
+		secret = credential
+		knownSecret, known := c.server.handshakeSecret(idStr)
+		if known && len(knownSecret) > 0 {
+			if !hmac.Equal([]byte(util.HandshakeDigest(knownSecret, idStr)), []byte(credential)) {
+				err = ErrInvalidUser
+				return
+			}
+			secret = knownSecret
+		}
+	}
+	return
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"strings"
 
 	"github.com/isrc-cas/gt/bufio"
 	"github.com/isrc-cas/gt/predef"
@@ -30,6 +31,8 @@ var (
 	ErrInvalidHTTPProtocol = errors.New("invalid http protocol")
 	// ErrInvalidHost is an error returned when host value is invalid
 	ErrInvalidHost = errors.New("invalid host value")
+	// ErrHostNotAllowed is an error returned when host is not under any base domain
+	ErrHostNotAllowed = errors.New("host is not under the base domains")
 )
 
 const (
@@ -100,3 +103,54 @@ func parseIDFromHost(host []byte) (id []byte, err error) {
 	id = host[:i]
 	return
 }
+
+// parseIDFromBaseDomains 返回 host 在 baseDomains 下的一级前缀，baseDomains 必须是小写的
+func parseIDFromBaseDomains(host []byte, baseDomains []string) (id []byte, err error) {
+	name := stripPort(host)
+	for _, base := range baseDomains {
+		i := len(name) - len(base) - 1
+		if i <= 0 || name[i] != '.' || !bytes.EqualFold(name[i+1:], []byte(base)) {
+			continue
+		}
+		id = name[:i]
+		if bytes.IndexByte(id, '.') >= 0 {
+			id = nil
+			err = ErrInvalidHost
+		}
+		return
+	}
+	err = ErrHostNotAllowed
+	return
+}
+
+// stripPort 去掉 host 中的端口
+func stripPort(host []byte) []byte {
+	if len(host) > 0 && host[0] == '[' {
+		if i := bytes.IndexByte(host, ']'); i > 0 {
+			return host[:i+1]
+		}
+		return host
+	}
+	if i := bytes.LastIndexByte(host, ':'); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// hasRequestPrefix 判断请求是否以 prefix 开头，已经缓存的数据不是 prefix 的前缀时不再等待更多的数据
+func hasRequestPrefix(reader *bufio.Reader, prefix string) bool {
+	_, err := reader.Peek(1)
+	if err != nil {
+		return false
+	}
+	n := reader.Buffered()
+	if n > len(prefix) {
+		n = len(prefix)
+	}
+	buf, err := reader.Peek(n)
+	if err != nil || !strings.HasPrefix(prefix, string(buf)) {
+		return false
+	}
+	buf, err = reader.Peek(len(prefix))
+	return err == nil && string(buf) == prefix
+}
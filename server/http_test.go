@@ -122,6 +122,45 @@ func TestParseTokenFromHost(t *testing.T) {
 	t.Logf("%s", id)
 }
 
+func TestParseIDFromBaseDomains(t *testing.T) {
+	bases := []string{"example.com", "gt.example.org"}
+	cases := []struct {
+		host string
+		id   string
+		err  error
+	}{
+		{"abc.example.com", "abc", nil},
+		{"ABC.Example.COM:8080", "ABC", nil},
+		{"abc.gt.example.org", "abc", nil},
+		{"a.b.example.com", "", ErrInvalidHost},
+		{"example.com", "", ErrHostNotAllowed},
+		{".example.com", "", ErrHostNotAllowed},
+		{"abcexample.com", "", ErrHostNotAllowed},
+		{"abc.other.com", "", ErrHostNotAllowed},
+		{"abc.example.org", "", ErrHostNotAllowed},
+	}
+	for _, c := range cases {
+		id, err := parseIDFromBaseDomains([]byte(c.host), bases)
+		if !errors.Is(err, c.err) || string(id) != c.id {
+			t.Fatalf("%s: unexpected id %q, err %v", c.host, id, err)
+		}
+	}
+}
+
+func TestHasRequestPrefix(t *testing.T) {
+	prefix := "GET /.well-known/"
+	if !hasRequestPrefix(bufio.NewReader(strings.NewReader("GET /.well-known/a HTTP/1.1\r\n\r\n")), prefix) {
+		t.Fatal("prefix should match")
+	}
+	if hasRequestPrefix(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n")), prefix) {
+		t.Fatal("prefix should not match")
+	}
+	// 数据比前缀短时不能阻塞
+	if hasRequestPrefix(bufio.NewReader(strings.NewReader("GET")), prefix) {
+		t.Fatal("prefix should not match")
+	}
+}
+
 func BenchmarkParseTokenFromHost(b *testing.B) {
 	host := []byte("abc.id.com")
 	var id []byte
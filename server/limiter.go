@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/pool"
+)
+
+// speed 限速配置，单位为字节每秒，0 表示不限速
+type speed struct {
+	Up    uint32 `yaml:"up,omitempty" json:",omitempty"`
+	Down  uint32 `yaml:"down,omitempty" json:",omitempty"`
+	Burst uint32 `yaml:"burst,omitempty" json:",omitempty"`
+}
+
+// limiter 令牌桶限速器，令牌的单位为字节，nil 或 rate 为 0 时不限速
+type limiter struct {
+	enabled atomic.Bool
+	mtx     sync.Mutex
+	rate    float64 // 每秒产生的令牌数
+	burst   float64 // 桶的容量
+	tokens  float64
+	last    time.Time
+}
+
+func newLimiter(rate, burst uint32) *limiter {
+	l := &limiter{}
+	l.set(rate, burst)
+	return l
+}
+
+// set 更新速率与桶的容量，burst 为 0 时不积累令牌，数据按照速率被平滑地发送
+func (l *limiter) set(rate, burst uint32) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.rate <= 0 {
+		// 从不限速变为限速时桶是满的
+		l.tokens = float64(burst)
+		l.last = time.Time{}
+	}
+	l.rate = float64(rate)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.enabled.Store(rate > 0)
+}
+
+func (l *limiter) limited() bool {
+	return l != nil && l.enabled.Load()
+}
+
+// reserve 取出 n 个令牌并返回需要等待的时间，令牌不足时允许透支，透支的令牌由之后的调用者等待
+func (l *limiter) reserve(n int, now time.Time) (d time.Duration) {
+	if !l.limited() {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	return
+}
+
+// wait 从每个限速器中取出 n 个令牌，等待其中最长的时间
+func wait(n int, limiters ...*limiter) {
+	if n <= 0 {
+		return
+	}
+	var now time.Time
+	var max time.Duration
+	for _, l := range limiters {
+		if !l.limited() {
+			continue
+		}
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if d := l.reserve(n, now); d > max {
+			max = d
+		}
+	}
+	if max > 0 {
+		time.Sleep(max)
+	}
+}
+
+// prefixLimiter host 前缀或 tcp 端口的上下行限速器
+type prefixLimiter struct {
+	up   *limiter
+	down *limiter
+}
+
+func (p *prefixLimiter) set(s speed) {
+	p.up.set(s.Up, s.Burst)
+	p.down.set(s.Down, s.Burst)
+}
+
+// uploadWindow 客户端支持流量控制时，受限速的任务在服务端写入之前最多可以发送的字节数
+const uploadWindow = 512 * 1024
+
+// uploadQueue 受限速的任务的上行数据，nil 表示访问者连接被客户端关闭。
+// 队列中的数据超过 uploadWindow 时 push 阻塞，只有不支持流量控制的老客户端会使 readLoop 阻塞
+type uploadQueue struct {
+	mtx  sync.Mutex
+	cond sync.Cond
+	bufs [][]byte
+	size int
+	done bool
+}
+
+func newUploadQueue() *uploadQueue {
+	q := &uploadQueue{}
+	q.cond.L = &q.mtx
+	return q
+}
+
+// push 放入数据，队列已经关闭时返回 false
+func (q *uploadQueue) push(buf []byte) (ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for !q.done && q.size >= uploadWindow {
+		q.cond.Wait()
+	}
+	if q.done {
+		return
+	}
+	q.bufs = append(q.bufs, buf)
+	q.size += len(buf)
+	q.cond.Broadcast()
+	return true
+}
+
+// pop 取出数据，empty 表示取出后队列为空，队列已经关闭时 ok 为 false
+func (q *uploadQueue) pop() (buf []byte, empty bool, ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for !q.done && len(q.bufs) == 0 {
+		q.cond.Wait()
+	}
+	if q.done {
+		return
+	}
+	buf = q.bufs[0]
+	q.bufs[0] = nil
+	q.bufs = q.bufs[1:]
+	q.size -= len(buf)
+	q.cond.Broadcast()
+	return buf, len(q.bufs) == 0, true
+}
+
+// close 关闭队列，把还在队列中的数据放回池中
+func (q *uploadQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.done = true
+	for _, buf := range q.bufs {
+		if buf != nil {
+			pool.BytesPool.Put(buf[:cap(buf)])
+		}
+	}
+	q.bufs = nil
+	q.cond.Broadcast()
+}
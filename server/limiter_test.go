@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var nilLimiter *limiter
+	if nilLimiter.limited() || nilLimiter.reserve(100, time.Now()) != 0 {
+		t.Fatal("nil limiter should not limit")
+	}
+	if newLimiter(0, 0).reserve(100, time.Now()) != 0 {
+		t.Fatal("limiter with zero rate should not limit")
+	}
+
+	now := time.Now()
+	l := newLimiter(1000, 2000)
+	// 桶初始是满的
+	if d := l.reserve(2000, now); d != 0 {
+		t.Fatalf("burst should be available, wait %v", d)
+	}
+	// 透支 500 个令牌需要等待 0.5 秒
+	if d := l.reserve(500, now); d != 500*time.Millisecond {
+		t.Fatalf("invalid wait %v", d)
+	}
+	// 1 秒后还清透支并产生 500 个令牌
+	if d := l.reserve(500, now.Add(time.Second)); d != 0 {
+		t.Fatalf("invalid wait %v", d)
+	}
+	// 桶的容量限制了空闲期间积累的令牌
+	if d := l.reserve(3000, now.Add(time.Hour)); d != time.Second {
+		t.Fatalf("invalid wait %v", d)
+	}
+
+	// burst 为 0 时不积累令牌
+	l.set(100, 0)
+	if d := l.reserve(50, now.Add(2*time.Hour)); d != 500*time.Millisecond {
+		t.Fatalf("invalid wait %v", d)
+	}
+	l.set(0, 0)
+	if l.limited() {
+		t.Fatal("limiter should be disabled")
+	}
+	l.set(100, 100)
+	if d := l.reserve(100, now.Add(3*time.Hour)); d != 0 {
+		t.Fatalf("bucket should be full after enabling, wait %v", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	fast := newLimiter(1000, 0)
+	slow := newLimiter(100, 0)
+	start := time.Now()
+	wait(10, fast, nil, slow)
+	if d := time.Since(start); d < 90*time.Millisecond || d > time.Second {
+		t.Fatalf("should wait for the slowest limiter, waited %v", d)
+	}
+}
+
+func TestUploadQueue(t *testing.T) {
+	q := newUploadQueue()
+	if !q.push(make([]byte, uploadWindow)) {
+		t.Fatal("push should succeed")
+	}
+	// 超过窗口时等待取出
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(nil)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push should wait when the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	buf, _, ok := q.pop()
+	if !ok || len(buf) != uploadWindow {
+		t.Fatalf("unexpected pop %d %v", len(buf), ok)
+	}
+	if !<-pushed {
+		t.Fatal("push should succeed after pop")
+	}
+	buf, empty, ok := q.pop()
+	if !ok || !empty || buf != nil {
+		t.Fatalf("unexpected pop %d %v %v", len(buf), empty, ok)
+	}
+
+	// 关闭后 push 与 pop 都返回
+	go q.close()
+	if _, _, ok = q.pop(); ok {
+		t.Fatal("pop should fail after close")
+	}
+	if q.push([]byte{1}) {
+		t.Fatal("push should fail after close")
+	}
+}
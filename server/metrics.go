@@ -0,0 +1,229 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/server/sync"
+)
+
+// metrics 记录 Server 结构体上没有的统计数据
+type metrics struct {
+	rejections sync.Map // key: connection.Error value: *atomic.Uint64
+	denials    sync.Map // key: aclDenial value: *atomic.Uint64
+}
+
+// aclDenial 被访问控制列表拒绝的访问者所访问的 client 与 host 前缀
+type aclDenial struct {
+	id     string
+	prefix string
+}
+
+// deny 记录一次访问者被访问控制列表拒绝
+func (m *metrics) deny(id, prefix string) {
+	value, _ := m.denials.LoadOrCreate(aclDenial{id: id, prefix: prefix}, func() interface{} {
+		return new(atomic.Uint64)
+	})
+	value.(*atomic.Uint64).Add(1)
+}
+
+// reject 记录一次握手被拒绝，err 不是 connection.Error 时忽略
+func (m *metrics) reject(err error) {
+	var e connection.Error
+	if !errors.As(err, &e) {
+		return
+	}
+	value, _ := m.rejections.LoadOrCreate(e, func() interface{} {
+		return new(atomic.Uint64)
+	})
+	value.(*atomic.Uint64).Add(1)
+}
+
+// metricsWriter 输出 Prometheus text exposition format
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.writeString("# HELP ", name, " ", help, "\n# TYPE ", name, " ", typ, "\n")
+}
+
+func (mw *metricsWriter) sample(name string, value uint64, labels ...string) {
+	mw.writeString(name)
+	if len(labels) > 0 {
+		mw.writeString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.writeString(",")
+			}
+			mw.writeString(labels[i], `="`, escapeLabelValue(labels[i+1]), `"`)
+		}
+		mw.writeString("}")
+	}
+	mw.writeString(" ", strconv.FormatUint(value, 10), "\n")
+}
+
+func (mw *metricsWriter) writeString(ss ...string) {
+	for _, s := range ss {
+		if mw.err != nil {
+			return
+		}
+		_, mw.err = mw.w.WriteString(s)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+// WriteMetrics writes the metrics of the server in Prometheus text format
+func (s *Server) WriteMetrics(w io.Writer) (err error) {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.header("gt_server_accepted_total", "counter", "The number of accepted connections.")
+	mw.sample("gt_server_accepted_total", s.GetAccepted())
+	mw.header("gt_server_served_total", "counter", "The number of served visitor connections.")
+	mw.sample("gt_server_served_total", s.GetServed())
+	mw.header("gt_server_failed_total", "counter", "The number of connections failed to be handled.")
+	mw.sample("gt_server_failed_total", s.GetFailed())
+	mw.header("gt_server_tunnels_established_total", "counter", "The number of tunnel connections established.")
+	mw.sample("gt_server_tunnels_established_total", s.GetTunneling())
+
+	var clients []*client
+	s.id2Client.Range(func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok && c != nil {
+			clients = append(clients, c)
+		}
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+
+	var tunnels int
+	for _, c := range clients {
+		c.tunnelsRWMtx.RLock()
+		tunnels += len(c.tunnels)
+		c.tunnelsRWMtx.RUnlock()
+	}
+	mw.header("gt_server_tunnels", "gauge", "The number of tunnel connections currently connected.")
+	mw.sample("gt_server_tunnels", uint64(tunnels))
+
+	mw.header("gt_client_tunnels", "gauge", "The number of tunnel connections of a client.")
+	for _, c := range clients {
+		c.tunnelsRWMtx.RLock()
+		n := len(c.tunnels)
+		c.tunnelsRWMtx.RUnlock()
+		mw.sample("gt_client_tunnels", uint64(n), "id", c.id)
+	}
+
+	mw.header("gt_tunnel_tasks", "gauge", "The number of running tasks of a tunnel connection.")
+	for _, c := range clients {
+		c.tunnelsRWMtx.RLock()
+		for t := range c.tunnels {
+			mw.sample("gt_tunnel_tasks", uint64(t.TasksCount.Load()), "id", c.id, "tunnel", t.RemoteAddr().String())
+		}
+		c.tunnelsRWMtx.RUnlock()
+	}
+
+	mw.header("gt_client_tcp_listeners", "gauge", "The number of opened tcp listeners of a client.")
+	for _, c := range clients {
+		mw.sample("gt_client_tcp_listeners", uint64(c.tcpListenersLen()), "id", c.id)
+	}
+
+	mw.header("gt_client_udp_listeners", "gauge", "The number of opened udp listeners of a client.")
+	for _, c := range clients {
+		mw.sample("gt_client_udp_listeners", uint64(c.udpListenersLen()), "id", c.id)
+	}
+
+	mw.header("gt_client_up_bytes_total", "counter", "The number of bytes sent from a client to visitors.")
+	s.rangeUsages(func(id string, cu *clientUsage) {
+		cu.rangePrefixes(func(prefix string, u *usage) {
+			mw.sample("gt_client_up_bytes_total", u.up.Load(), "id", id, "prefix", prefix)
+		})
+	})
+	mw.header("gt_client_down_bytes_total", "counter", "The number of bytes sent from visitors to a client.")
+	s.rangeUsages(func(id string, cu *clientUsage) {
+		cu.rangePrefixes(func(prefix string, u *usage) {
+			mw.sample("gt_client_down_bytes_total", u.down.Load(), "id", id, "prefix", prefix)
+		})
+	})
+	mw.header("gt_client_tasks_total", "counter", "The number of tasks started by visitors of a client.")
+	s.rangeUsages(func(id string, cu *clientUsage) {
+		cu.rangePrefixes(func(prefix string, u *usage) {
+			mw.sample("gt_client_tasks_total", u.tasks.Load(), "id", id, "prefix", prefix)
+		})
+	})
+
+	mw.header("gt_server_auth_failures", "gauge", "The number of failed authentications of an IP in the current reconnect duration.")
+	s.reconnectRWMutex.RLock()
+	ips := make([]string, 0, len(s.reconnect))
+	for ip := range s.reconnect {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		mw.sample("gt_server_auth_failures", uint64(s.reconnect[ip]), "ip", ip)
+	}
+	s.reconnectRWMutex.RUnlock()
+
+	mw.header("gt_server_handshake_rejections_total", "counter", "The number of rejected tunnel handshakes by error.")
+	var codes []connection.Error
+	s.metrics.rejections.Range(func(key, value interface{}) bool {
+		codes = append(codes, key.(connection.Error))
+		return true
+	})
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	for _, code := range codes {
+		value, _ := s.metrics.rejections.Load(code)
+		mw.sample("gt_server_handshake_rejections_total", value.(*atomic.Uint64).Load(),
+			"code", strconv.FormatUint(uint64(code), 10), "error", code.Error())
+	}
+
+	mw.header("gt_server_acl_denied_total", "counter", "The number of visitor connections denied by access control lists.")
+	var denials []aclDenial
+	s.metrics.denials.Range(func(key, value interface{}) bool {
+		denials = append(denials, key.(aclDenial))
+		return true
+	})
+	sort.Slice(denials, func(i, j int) bool {
+		if denials[i].id != denials[j].id {
+			return denials[i].id < denials[j].id
+		}
+		return denials[i].prefix < denials[j].prefix
+	})
+	for _, d := range denials {
+		value, _ := s.metrics.denials.Load(d)
+		mw.sample("gt_server_acl_denied_total", value.(*atomic.Uint64).Load(), "id", d.id, "prefix", d.prefix)
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
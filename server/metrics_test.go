@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	connection "github.com/isrc-cas/gt/conn"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	s, err := New([]string{"server"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.accepted = 3
+	s.served = 2
+	s.reconnect["127.0.0.1"] = 2
+	s.metrics.reject(connection.ErrHostConflict)
+	s.metrics.reject(connection.ErrHostConflict)
+	s.metrics.reject(errors.New("not an error signal"))
+
+	c, _ := s.getOrCreateClient("id1", newClient)
+	c.init("id1", user{}, s)
+	u := c.usage.get("a\"b")
+	u.up.Add(10)
+	u.down.Add(20)
+	u.tasks.Add(1)
+
+	var sb strings.Builder
+	err = s.WriteMetrics(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := sb.String()
+	t.Log(result)
+	for _, line := range []string{
+		"# TYPE gt_server_accepted_total counter",
+		"gt_server_accepted_total 3",
+		"gt_server_served_total 2",
+		"# TYPE gt_server_tunnels gauge",
+		"gt_server_tunnels 0",
+		"# TYPE gt_server_tunnels_established_total counter",
+		`gt_client_tunnels{id="id1"} 0`,
+		`gt_client_tcp_listeners{id="id1"} 0`,
+		`gt_client_up_bytes_total{id="id1",prefix="a\"b"} 10`,
+		`gt_client_down_bytes_total{id="id1",prefix="a\"b"} 20`,
+		`gt_client_tasks_total{id="id1",prefix="a\"b"} 1`,
+		`gt_server_auth_failures{ip="127.0.0.1"} 2`,
+		`gt_server_handshake_rejections_total{code="5",error="host conflict"} 2`,
+	} {
+		if !strings.Contains(result, line+"\n") {
+			t.Fatalf("%q does not exist", line)
+		}
+	}
+	if strings.Count(result, "gt_server_handshake_rejections_total{") != 1 {
+		t.Fatal("invalid rejections")
+	}
+}
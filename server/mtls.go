@@ -0,0 +1,257 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+)
+
+const (
+	clientIDFromCN  = "cn"
+	clientIDFromSAN = "san"
+)
+
+// revocationList 保存被吊销的客户端证书的序列号
+type revocationList map[string]struct{}
+
+func (r revocationList) revoked(cert *x509.Certificate) bool {
+	_, ok := r[cert.SerialNumber.Text(16)]
+	return ok
+}
+
+// initClientCA 读取验证客户端证书的 CA 与吊销列表
+func (s *Server) initClientCA() (err error) {
+	if len(s.config.TLSClientCA) == 0 {
+		if len(s.config.TLSClientCRL) > 0 || s.config.TLSClientCertRequired {
+			err = errors.New("-tlsClientCRL and -tlsClientCertRequired options need -tlsClientCA option")
+		}
+		return
+	}
+	switch s.config.TLSClientIDFrom {
+	case clientIDFromCN, clientIDFromSAN:
+	default:
+		return fmt.Errorf("client id source (-tlsClientIDFrom option) '%s' is invalid", s.config.TLSClientIDFrom)
+	}
+	if len(s.config.QuicAddr) > 0 && s.config.OpenBBR {
+		return errors.New("-tlsClientCA option is not supported when -bbr option is set")
+	}
+	s.clientCACerts, err = readCerts(s.config.TLSClientCA)
+	if err != nil {
+		return fmt.Errorf("invalid client ca file (-tlsClientCA option) '%s', cause %s", s.config.TLSClientCA, err.Error())
+	}
+	s.clientCAs = x509.NewCertPool()
+	for _, cert := range s.clientCACerts {
+		s.clientCAs.AddCert(cert)
+	}
+	return s.loadRevocationList()
+}
+
+// loadRevocationList 读取 -tlsClientCRL 文件，在 reload 时重新读取
+func (s *Server) loadRevocationList() (err error) {
+	if len(s.config.TLSClientCRL) == 0 {
+		return
+	}
+	r, err := readRevocationList(s.config.TLSClientCRL, s.clientCACerts)
+	if err != nil {
+		return fmt.Errorf("invalid client crl file (-tlsClientCRL option) '%s', cause %s", s.config.TLSClientCRL, err.Error())
+	}
+	s.revoked.Store(&r)
+	s.Logger.Info().Int("revoked", len(r)).Msg("loaded client crl")
+	return
+}
+
+func readCerts(path string) (certs []*x509.Certificate, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		err = errors.New("no certificate found")
+	}
+	return
+}
+
+// readRevocationList 读取 PEM 或 DER 格式的 CRL，CRL 必须由 CA 签名。
+// 也支持每行一个十六进制序列号的文本文件，# 开头的行为注释
+func readRevocationList(path string, cas []*x509.Certificate) (r revocationList, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	der := content
+	if block, _ := pem.Decode(content); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected pem block '%s'", block.Type)
+		}
+		der = block.Bytes
+	}
+	crl, e := x509.ParseRevocationList(der)
+	if e != nil {
+		return parseSerials(string(content))
+	}
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errors.New("crl is not signed by the client ca")
+	}
+	r = make(revocationList, len(crl.RevokedCertificates))
+	for _, revoked := range crl.RevokedCertificates {
+		r[revoked.SerialNumber.Text(16)] = struct{}{}
+	}
+	return
+}
+
+func parseSerials(content string) (r revocationList, err error) {
+	r = make(revocationList)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(strings.ReplaceAll(strings.ToLower(line), ":", ""), "0x")
+		serial, ok := new(big.Int).SetString(line, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number '%s'", line)
+		}
+		r[serial.Text(16)] = struct{}{}
+	}
+	return
+}
+
+// setClientAuth 使 tlsConfig 验证隧道的客户端证书。tls 隧道使用 predef.TunnelALPN 时才请求客户端证书，
+// 访问者的浏览器不会被要求选择证书
+func (s *Server) setClientAuth(tlsConfig *tls.Config, quic bool) {
+	if s.clientCAs == nil {
+		return
+	}
+	if quic {
+		// quic 只用于隧道
+		s.requireClientCert(tlsConfig)
+		return
+	}
+	tunnelConfig := tlsConfig.Clone()
+	tunnelConfig.GetConfigForClient = nil
+	tunnelConfig.NextProtos = []string{predef.TunnelALPN}
+	s.requireClientCert(tunnelConfig)
+	next := tlsConfig.GetConfigForClient
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if util.Contains(hello.SupportedProtos, predef.TunnelALPN) {
+			return tunnelConfig, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+func (s *Server) requireClientCert(tlsConfig *tls.Config) {
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = s.clientCAs
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		r := s.revoked.Load()
+		if r == nil {
+			return nil
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if r.revoked(cert) {
+					return fmt.Errorf("certificate '%s' with serial number %s is revoked", cert.Subject, cert.SerialNumber.Text(16))
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// clientCert 返回隧道连接出示并通过验证的客户端证书，没有时返回 nil
+func (c *conn) clientCert() *x509.Certificate {
+	var state tls.ConnectionState
+	switch conn := c.Conn.(type) {
+	case *tls.Conn:
+		state = conn.ConnectionState()
+	case *connection.QuicConnection:
+		state = conn.ConnectionState().TLS.ConnectionState
+	default:
+		return nil
+	}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// certMatchesID 判断客户端证书的 subject CN 或者 SAN 是否与 id 相同
+func (s *Server) certMatchesID(cert *x509.Certificate, id string) bool {
+	if s.config.TLSClientIDFrom != clientIDFromSAN {
+		return cert.Subject.CommonName == id
+	}
+	if util.Contains(cert.DNSNames, id) || util.Contains(cert.EmailAddresses, id) {
+		return true
+	}
+	for _, u := range cert.URIs {
+		if u.String() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// authUserWithCert 认证出示了客户端证书的隧道，证书已经证明了 id，不再需要 secret
+func (s *Server) authUserWithCert(id string) (u user, err error) {
+	if value, ok := s.users.Load(id); ok {
+		if u, ok = value.(user); ok && !u.temp {
+			return
+		}
+	}
+	if s.config.AllowAnyClient || s.users.empty() {
+		u = s.newTempUserForAPIServer()
+		return
+	}
+	err = ErrInvalidUser
+	return
+}
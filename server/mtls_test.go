@@ -0,0 +1,260 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+type testClientCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestClientCA(t *testing.T) *testClientCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClientCA{cert: cert, key: key}
+}
+
+func (ca *testClientCA) issue(t *testing.T, serial int64, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testClientCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRevocationList(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestClientCA(t)
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlFile, 2, 0x1a)
+	r, err := readRevocationList(crlFile, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 || !r.revoked(&x509.Certificate{SerialNumber: big.NewInt(0x1a)}) || r.revoked(&x509.Certificate{SerialNumber: big.NewInt(3)}) {
+		t.Fatalf("unexpected revocation list %v", r)
+	}
+	if _, err = readRevocationList(crlFile, []*x509.Certificate{newTestClientCA(t).cert}); err == nil {
+		t.Fatal("crl signed by another ca should be invalid")
+	}
+
+	serialsFile := filepath.Join(dir, "revoked.txt")
+	err = os.WriteFile(serialsFile, []byte("# revoked\n02\n00:1A\n\n0x1b\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = readRevocationList(serialsFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 3 || !r.revoked(&x509.Certificate{SerialNumber: big.NewInt(0x1a)}) {
+		t.Fatalf("unexpected revocation list %v", r)
+	}
+	err = os.WriteFile(serialsFile, []byte("xyz\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readRevocationList(serialsFile, nil); err == nil {
+		t.Fatal("invalid serial should fail")
+	}
+}
+
+func TestCertMatchesID(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.com/id3")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "id1"},
+		DNSNames:       []string{"id2"},
+		EmailAddresses: []string{"id4@example.com"},
+		URIs:           []*url.URL{u},
+	}
+	s := &Server{config: Config{Options: Options{TLSClientIDFrom: clientIDFromCN}}}
+	if !s.certMatchesID(cert, "id1") || s.certMatchesID(cert, "id2") {
+		t.Fatal("unexpected result of cn")
+	}
+	s.config.TLSClientIDFrom = clientIDFromSAN
+	if s.certMatchesID(cert, "id1") || !s.certMatchesID(cert, "id2") ||
+		!s.certMatchesID(cert, "spiffe://example.com/id3") || !s.certMatchesID(cert, "id4@example.com") {
+		t.Fatal("unexpected result of san")
+	}
+}
+
+// handshake 返回服务端是否请求了客户端证书，以及握手后服务端得到的客户端证书
+func handshake(t *testing.T, serverConfig *tls.Config, cert *tls.Certificate, protos []string) (requested bool, peer *x509.Certificate, err error) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type result struct {
+		peer *x509.Certificate
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		err = c.(*tls.Conn).Handshake()
+		var r result
+		if chains := c.(*tls.Conn).ConnectionState().VerifiedChains; len(chains) > 0 {
+			r.peer = chains[0][0]
+		}
+		r.err = err
+		resultCh <- r
+	}()
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         protos,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested = true
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	})
+	if err == nil {
+		_ = c.Close()
+	}
+	r := <-resultCh
+	if r.err != nil {
+		err = r.err
+	}
+	peer = r.peer
+	return
+}
+
+func TestSetClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestClientCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlFile, 3)
+
+	s := &Server{config: defaultConfig()}
+	s.config.TLSClientCA = caFile
+	s.config.TLSClientCRL = crlFile
+	err = s.initClientCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert := ca.issue(t, 10, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}})
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	s.setClientAuth(tlsConfig, false)
+
+	valid := ca.issue(t, 2, &x509.Certificate{Subject: pkix.Name{CommonName: "id1"}})
+	revoked := ca.issue(t, 3, &x509.Certificate{Subject: pkix.Name{CommonName: "id2"}})
+	tunnel := []string{predef.TunnelALPN}
+
+	// 访问者不会被请求客户端证书
+	requested, _, err := handshake(t, tlsConfig, nil, []string{"h2", "http/1.1"})
+	if err != nil || requested {
+		t.Fatalf("visitor should not be asked for a cert: %t %v", requested, err)
+	}
+	requested, peer, err := handshake(t, tlsConfig, &valid, tunnel)
+	if err != nil || !requested || peer == nil || peer.Subject.CommonName != "id1" {
+		t.Fatalf("tunnel cert should be verified: %t %v %v", requested, peer, err)
+	}
+	// 没有证书的隧道依然可以使用 secret
+	if _, peer, err = handshake(t, tlsConfig, nil, tunnel); err != nil || peer != nil {
+		t.Fatalf("tunnel without cert should pass the tls handshake: %v", err)
+	}
+	if _, _, err = handshake(t, tlsConfig, &revoked, tunnel); err == nil {
+		t.Fatal("revoked cert should be rejected")
+	}
+	other := newTestClientCA(t).issue(t, 2, &x509.Certificate{Subject: pkix.Name{CommonName: "id1"}})
+	if _, _, err = handshake(t, tlsConfig, &other, tunnel); err == nil {
+		t.Fatal("cert issued by another ca should be rejected")
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// oidcProviderTTL discovery 文档与 JWKS 的缓存时间
+	oidcProviderTTL = time.Hour
+	// oidcRefreshInterval ID token 使用未知的 kid 时重新获取 JWKS 的最小间隔
+	oidcRefreshInterval = time.Minute
+)
+
+var (
+	errInvalidIDToken = errors.New("invalid id token")
+	errUnknownKey     = errors.New("unknown key of id token")
+)
+
+// oidcProvider 是 OIDC discovery 文档中使用到的字段与 issuer 签名 ID token 的公钥
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys    []oidcKey
+	fetched time.Time
+}
+
+type oidcKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jwk 是 JWKS 中的一个公钥，只支持签名使用的 RSA、EC 与 Ed25519 公钥
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (key crypto.PublicKey, err error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, e := new(big.Int), new(big.Int)
+		var b []byte
+		b, err = decode(k.N)
+		if err != nil {
+			return
+		}
+		n.SetBytes(b)
+		b, err = decode(k.E)
+		if err != nil {
+			return
+		}
+		e.SetBytes(b)
+		if n.Sign() <= 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			err = fmt.Errorf("invalid rsa key '%s'", k.Kid)
+			return
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			err = fmt.Errorf("unsupported curve '%s' of key '%s'", k.Crv, k.Kid)
+			return
+		}
+		var x, y []byte
+		x, err = decode(k.X)
+		if err != nil {
+			return
+		}
+		y, err = decode(k.Y)
+		if err != nil {
+			return
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			err = fmt.Errorf("invalid ec key '%s'", k.Kid)
+			return
+		}
+		key = pub
+	case "OKP":
+		var x []byte
+		x, err = decode(k.X)
+		if err != nil {
+			return
+		}
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			err = fmt.Errorf("unsupported okp key '%s'", k.Kid)
+			return
+		}
+		key = ed25519.PublicKey(x)
+	default:
+		err = fmt.Errorf("unsupported key type '%s' of key '%s'", k.Kty, k.Kid)
+	}
+	return
+}
+
+// parseJWKS 解析 JWKS 中用于签名的公钥，不支持的公钥被忽略
+func parseJWKS(r io.Reader) (keys []oidcKey, err error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.NewDecoder(io.LimitReader(r, 1<<20)).Decode(&set)
+	if err != nil {
+		return
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, e := k.publicKey()
+		if e != nil {
+			continue
+		}
+		keys = append(keys, oidcKey{id: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		err = errors.New("no signing key in jwks")
+	}
+	return
+}
+
+// idTokenMethods 是 ID token 允许使用的签名算法，不接受 none 与 HMAC
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// keyfunc 返回 ID token 的 kid 对应的公钥，ID token 没有 kid 时只能使用唯一的公钥
+func (p *oidcProvider) keyfunc(token *jwt.Token) (key interface{}, err error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if len(p.keys) == 1 {
+			return p.keys[0].key, nil
+		}
+	} else {
+		for _, k := range p.keys {
+			if k.id == kid {
+				return k.key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w '%s'", errUnknownKey, kid)
+}
+
+// parseIDToken 验证 ID token 的签名、issuer、audience 与过期时间
+func (p *oidcProvider) parseIDToken(token, clientID string) (claims *oidcClaims, err error) {
+	claims = &oidcClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, p.keyfunc,
+		jwt.WithValidMethods(idTokenMethods), jwt.WithIssuer(p.Issuer), jwt.WithAudience(clientID))
+	if err == nil && claims.ExpiresAt == nil {
+		err = errInvalidIDToken
+	}
+	return
+}
+
+// newOIDCHTTPClient 返回访问 OIDC provider 使用的 http 客户端，caFile 不为空时只信任其中的 CA
+func newOIDCHTTPClient(caFile string) (client *http.Client, err error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caFile) > 0 {
+		var pem []byte
+		pem, err = os.ReadFile(caFile)
+		if err != nil {
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificate in oidc ca file (-authOIDCCA option) '%s'", caFile)
+			return
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		// 不跟随重定向，避免访问 issuer 之外的地址
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return
+}
+
+// checkOIDCIssuers 检查服务端允许的 issuer，只允许 https
+func checkOIDCIssuers(issuers []string) error {
+	for _, issuer := range issuers {
+		if !isHTTPSURL(issuer) {
+			return fmt.Errorf("oidc issuer (-authOIDCIssuers option) '%s' is invalid, it must be an https url", issuer)
+		}
+	}
+	return nil
+}
+
+func isHTTPSURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// allowOIDCIssuer 判断 issuer 是否在服务端的 -authOIDCIssuers 中
+func (s *Server) allowOIDCIssuer(issuer string) bool {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	for _, allowed := range s.config.AuthOIDCIssuers {
+		if issuer == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcProvider 获取并缓存 issuer 的 discovery 文档与 JWKS。refresh 为 true 时在缓存超过 oidcRefreshInterval 后重新获取
+func (s *Server) oidcProvider(issuer string, refresh bool) (p *oidcProvider, err error) {
+	if !s.allowOIDCIssuer(issuer) {
+		err = fmt.Errorf("oidc issuer '%s' is not allowed", issuer)
+		return
+	}
+	now := time.Now()
+	if value, ok := s.oidcProviders.Load(issuer); ok {
+		p = value.(*oidcProvider)
+		age := now.Sub(p.fetched)
+		if age < oidcProviderTTL && (!refresh || age < oidcRefreshInterval) {
+			return
+		}
+	}
+	p, err = s.fetchOIDCProvider(issuer)
+	if err != nil {
+		return
+	}
+	p.fetched = now
+	s.oidcProviders.Store(issuer, p)
+	return
+}
+
+func (s *Server) fetchOIDCProvider(issuer string) (p *oidcProvider, err error) {
+	resp, err := s.oidcHTTPClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status of oidc discovery: %s", resp.Status)
+		return
+	}
+	p = &oidcProvider{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer || !isHTTPSURL(p.AuthorizationEndpoint) || !isHTTPSURL(p.TokenEndpoint) || !isHTTPSURL(p.JWKSURI) {
+		return nil, fmt.Errorf("invalid oidc discovery of issuer '%s'", issuer)
+	}
+	jwksResp, err := s.oidcHTTPClient.Get(p.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer jwksResp.Body.Close()
+	if jwksResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status of oidc jwks: %s", jwksResp.Status)
+	}
+	p.keys, err = parseJWKS(jwksResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// verifyIDToken 使用 issuer 的 JWKS 验证 ID token，kid 未知时重新获取 JWKS，用于 issuer 轮换公钥的情况
+func (s *Server) verifyIDToken(issuer, clientID, token string) (claims *oidcClaims, err error) {
+	p, err := s.oidcProvider(issuer, false)
+	if err != nil {
+		return
+	}
+	claims, err = p.parseIDToken(token, clientID)
+	if errors.Is(err, errUnknownKey) {
+		p, err = s.oidcProvider(issuer, true)
+		if err != nil {
+			return
+		}
+		claims, err = p.parseIDToken(token, clientID)
+	}
+	return
+}
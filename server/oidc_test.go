@@ -0,0 +1,207 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signTestIDToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.Signer, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func testIDTokenClaims(issuer string) jwt.MapClaims {
+	return jwt.MapClaims{"iss": issuer, "aud": "client1", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func testJWK(kid string, key crypto.PublicKey) map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": encode(k.N.Bytes()), "e": encode(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": encode(k.X.FillBytes(make([]byte, 32))), "y": encode(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": encode(k)}
+	}
+	return nil
+}
+
+func TestParseIDToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{
+		testJWK("rsa", rsaKey.Public()),
+		testJWK("ec", ecKey.Public()),
+		testJWK("ed", edKey.Public()),
+		map[string]string{"kty": "oct", "kid": "oct", "k": "a2V5"},
+	}})
+	keys, err := parseJWKS(strings.NewReader(string(jwks)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	issuer := "https://accounts.example.com"
+	p := &oidcProvider{Issuer: issuer, keys: keys}
+
+	claims := testIDTokenClaims(issuer)
+	for _, token := range []string{
+		signTestIDToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims),
+		signTestIDToken(t, jwt.SigningMethodES256, "ec", ecKey, claims),
+		signTestIDToken(t, jwt.SigningMethodEdDSA, "ed", edKey, claims),
+	} {
+		c, err := p.parseIDToken(token, "client1")
+		if err != nil || c.Issuer != issuer {
+			t.Fatalf("failed to verify %s: %v", token, err)
+		}
+	}
+
+	token := signTestIDToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims)
+	parts := strings.Split(token, ".")
+	tampered, _ := json.Marshal(jwt.MapClaims{"iss": issuer, "aud": "client1", "exp": time.Now().Add(time.Hour).Unix(), "email": "evil@example.com"})
+	parts[1] = base64.RawURLEncoding.EncodeToString(tampered)
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`))
+	hsHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"rsa"}`))
+	mac := hmac.New(sha256.New, rsaKey.N.Bytes())
+	mac.Write([]byte(hsHeader + "." + parts[1]))
+	withClaim := func(name string, value any) jwt.MapClaims {
+		c := testIDTokenClaims(issuer)
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	cases := []string{
+		strings.Join(parts, "."),
+		noneHeader + "." + parts[1] + ".",
+		hsHeader + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+		signTestIDToken(t, jwt.SigningMethodES256, "rsa", ecKey, claims), // alg 与公钥的类型不一致
+		signTestIDToken(t, jwt.SigningMethodEdDSA, "rsa", edKey, claims),
+		signTestIDToken(t, jwt.SigningMethodES256, "ec", ecKey, withClaim("iss", "https://evil.example.com")),
+		signTestIDToken(t, jwt.SigningMethodES256, "ec", ecKey, withClaim("aud", "client2")),
+		signTestIDToken(t, jwt.SigningMethodES256, "ec", ecKey, withClaim("exp", time.Now().Add(-time.Minute).Unix())),
+		signTestIDToken(t, jwt.SigningMethodES256, "ec", ecKey, withClaim("exp", nil)),
+	}
+	for _, c := range cases {
+		if _, err := p.parseIDToken(c, "client1"); err == nil || errors.Is(err, errUnknownKey) {
+			t.Fatalf("id token should be invalid: %s %v", c, err)
+		}
+	}
+	if _, err := p.parseIDToken(signTestIDToken(t, jwt.SigningMethodRS256, "unknown", rsaKey, claims), "client1"); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("id token signed with an unknown key should not be found: %v", err)
+	}
+}
+
+func TestOIDCProvider(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kid atomic.Value
+	kid.Store("1")
+	var discoveries atomic.Int32
+	var issuer string
+	provider := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			discoveries.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/auth",
+				"token_endpoint":         issuer + "/token",
+				"jwks_uri":               issuer + "/jwks",
+			})
+		case "/jwks":
+			_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{testJWK(kid.Load().(string), key.Public())}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer provider.Close()
+	issuer = provider.URL
+
+	s := &Server{oidcHTTPClient: provider.Client()}
+	if _, err = s.oidcProvider(issuer, false); err == nil {
+		t.Fatal("issuer that is not allowed should be rejected")
+	}
+	s.config.AuthOIDCIssuers = []string{issuer}
+	if _, err = s.oidcProvider(issuer, false); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.verifyIDToken(issuer, "client1", signTestIDToken(t, jwt.SigningMethodES256, "1", key, testIDTokenClaims(issuer)))
+	if err != nil || claims.Issuer != issuer {
+		t.Fatalf("failed to verify id token: %v", err)
+	}
+	if discoveries.Load() != 1 {
+		t.Fatalf("discovery should be cached, fetched %d times", discoveries.Load())
+	}
+
+	// 最近获取过 JWKS 时不会因为未知的 kid 重新获取
+	kid.Store("2")
+	if _, err = s.verifyIDToken(issuer, "client1", signTestIDToken(t, jwt.SigningMethodES256, "2", key, testIDTokenClaims(issuer))); err == nil {
+		t.Fatal("id token signed with an unknown key should be invalid")
+	}
+	value, _ := s.oidcProviders.Load(issuer)
+	value.(*oidcProvider).fetched = value.(*oidcProvider).fetched.Add(-oidcRefreshInterval)
+	if _, err = s.verifyIDToken(issuer, "client1", signTestIDToken(t, jwt.SigningMethodES256, "2", key, testIDTokenClaims(issuer))); err != nil {
+		t.Fatalf("jwks should be refreshed for the unknown key: %v", err)
+	}
+	if discoveries.Load() != 2 {
+		t.Fatalf("unexpected discoveries %d", discoveries.Load())
+	}
+
+	if err = checkOIDCIssuers([]string{"http://accounts.example.com"}); err == nil {
+		t.Fatal("http issuer should be invalid")
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+
+	"github.com/isrc-cas/gt/util"
+)
+
+// Reload re-parses the users, tcp and udp ranges and host rules from the config file, the users file and the command line.
+// Connected clients are updated in place, only the clients whose credentials were revoked are disconnected.
+func (s *Server) Reload() (err error) {
+	s.reloadMtx.Lock()
+	defer s.reloadMtx.Unlock()
+
+	args := s.args
+	if len(s.config.Config) > 0 && !util.Contains(args, "-config") {
+		// GT-Web 启动时设置的配置文件路径不在命令行参数中
+		args = append(append([]string{}, args...), "-config", s.config.Config)
+	}
+	conf, err := parseConfig(args)
+	if err != nil {
+		return
+	}
+
+	// 在临时的 Server 上解析，解析失败时不影响正在运行的配置
+	ns := &Server{config: s.config}
+	ns.config.Users = conf.Users
+	ns.config.TCPs = conf.TCPs
+	ns.config.UDPs = conf.UDPs
+	ns.config.Host = conf.Host
+	ns.config.Options.Users = conf.Options.Users
+	ns.config.IDs = conf.IDs
+	ns.config.Secrets = conf.Secrets
+	ns.config.TCPRanges = conf.TCPRanges
+	ns.config.TCPNumber = conf.TCPNumber
+	ns.config.UDPRanges = conf.UDPRanges
+	ns.config.UDPNumber = conf.UDPNumber
+	ns.config.Speed = conf.Speed
+	ns.config.SpeedUp = conf.SpeedUp
+	ns.config.SpeedDown = conf.SpeedDown
+	ns.config.SpeedBurst = conf.SpeedBurst
+	ns.config.GlobalSpeed = conf.GlobalSpeed
+	ns.config.Connections = conf.Connections
+	ns.config.TURNQuota = conf.TURNQuota
+	ns.config.HostNumber = conf.HostNumber
+	ns.config.HostRegex = conf.HostRegex
+	ns.config.HostWithID = conf.HostWithID
+	ns.config.DomainNumber = conf.DomainNumber
+	ns.config.Allow = conf.Allow
+	ns.config.Deny = conf.Deny
+	ns.config.AuthMethods = conf.AuthMethods
+	ns.config.AuthRequired = conf.AuthRequired
+	ns.config.AuthOIDCIssuers = conf.AuthOIDCIssuers
+	err = checkAuthMethods(ns.config.AuthMethods)
+	if err != nil {
+		return
+	}
+	err = checkOIDCIssuers(ns.config.AuthOIDCIssuers)
+	if err != nil {
+		return
+	}
+	err = ns.parseUsers()
+	if err != nil {
+		return
+	}
+
+	// 更新全局 tcp 端口，已经被占用的端口不能再被分配
+	inUse := make(map[uint16]struct{})
+	s.id2Client.Range(func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok && c != nil {
+			c.rangeOpenedTCPPorts(func(port uint16, l *tcpListener) {
+				inUse[port] = struct{}{}
+			})
+		}
+		return true
+	})
+	s.portsManager.portsMtx.Lock()
+	s.portsManager.all = ns.portsManager.all
+	s.portsManager.ports = make(map[uint16]struct{}, len(ns.portsManager.ports))
+	for port := range ns.portsManager.ports {
+		if _, ok := inUse[port]; !ok {
+			s.portsManager.ports[port] = struct{}{}
+		}
+	}
+	s.portsManager.portsMtx.Unlock()
+	if s.authAPI != nil {
+		s.authAPI.reclaimPorts(ns.tcpOwners)
+	} else {
+		s.tcpOwnersMtx.Lock()
+		s.tcpOwners = ns.tcpOwners
+		s.tcpOwnersMtx.Unlock()
+	}
+
+	udpInUse := make(map[uint16]struct{})
+	s.id2Client.Range(func(key, value interface{}) bool {
+		if c, ok := value.(*client); ok && c != nil {
+			c.rangeOpenedUDPPorts(func(port uint16, l *udpListener) {
+				udpInUse[port] = struct{}{}
+			})
+		}
+		return true
+	})
+	s.udpPortsManager.portsMtx.Lock()
+	s.udpPortsManager.all = ns.udpPortsManager.all
+	s.udpPortsManager.ports = make(map[uint16]struct{}, len(ns.udpPortsManager.ports))
+	for port := range ns.udpPortsManager.ports {
+		if _, ok := udpInUse[port]; !ok {
+			s.udpPortsManager.ports[port] = struct{}{}
+		}
+	}
+	s.udpPortsManager.portsMtx.Unlock()
+
+	// 连接的处理过程会并发地读取这些配置
+	s.configRWMtx.Lock()
+	s.config.Users = ns.config.Users
+	s.config.TCPs = ns.config.TCPs
+	s.config.UDPs = ns.config.UDPs
+	s.config.Host = ns.config.Host
+	s.config.Options.Users = ns.config.Options.Users
+	s.config.IDs = ns.config.IDs
+	s.config.Secrets = ns.config.Secrets
+	s.config.TCPRanges = ns.config.TCPRanges
+	s.config.TCPNumber = ns.config.TCPNumber
+	s.config.UDPRanges = ns.config.UDPRanges
+	s.config.UDPNumber = ns.config.UDPNumber
+	s.config.Speed = ns.config.Speed
+	s.config.SpeedUp = ns.config.SpeedUp
+	s.config.SpeedDown = ns.config.SpeedDown
+	s.config.SpeedBurst = ns.config.SpeedBurst
+	s.config.GlobalSpeed = ns.config.GlobalSpeed
+	s.config.Connections = ns.config.Connections
+	s.config.TURNQuota = ns.config.TURNQuota
+	s.config.HostNumber = ns.config.HostNumber
+	s.config.HostRegex = ns.config.HostRegex
+	s.config.HostWithID = ns.config.HostWithID
+	s.config.DomainNumber = ns.config.DomainNumber
+	s.config.Allow = ns.config.Allow
+	s.config.Deny = ns.config.Deny
+	// 认证策略只作用于之后的握手
+	s.config.AuthMethods = ns.config.AuthMethods
+	s.config.AuthRequired = ns.config.AuthRequired
+	s.config.AuthOIDCIssuers = ns.config.AuthOIDCIssuers
+	s.configRWMtx.Unlock()
+
+	s.upLimiter.set(s.config.GlobalSpeed, s.config.SpeedBurst)
+	s.downLimiter.set(s.config.GlobalSpeed, s.config.SpeedBurst)
+	s.acl.Store(ns.acl.Load())
+	if s.clientCAs != nil {
+		if e := s.loadRevocationList(); e != nil {
+			s.Logger.Error().Err(e).Msg("failed to reload client crl")
+		}
+	}
+
+	// 比较新旧 users，只允许配置中的 users 连接时，临时 user 也会被撤销
+	allowTemp := len(s.config.AuthAPI) == 0 && (ns.users.empty() || s.config.AllowAnyClient)
+	var added, updated, removed, revoked int
+	revokedIDs := make(map[string]struct{})
+	s.users.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		old := value.(user)
+		if old.temp && allowTemp {
+			return true
+		}
+		v, ok := ns.users.Load(id)
+		if !ok {
+			s.users.Delete(id)
+			removed++
+			revokedIDs[id] = struct{}{}
+		} else if v.(user).Secret != old.Secret {
+			revokedIDs[id] = struct{}{}
+		}
+		return true
+	})
+	ns.users.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		u := value.(user)
+		if u.portsManager == &ns.portsManager {
+			u.portsManager = &s.portsManager
+		}
+		if u.udpPortsManager == &ns.udpPortsManager {
+			u.udpPortsManager = &s.udpPortsManager
+		}
+		if _, ok := s.users.Load(id); ok {
+			updated++
+		} else {
+			added++
+		}
+		s.users.Store(id, u)
+		return true
+	})
+
+	// 更新已连接的 client，断开凭证被撤销的 client
+	s.id2Client.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		c, ok := value.(*client)
+		if !ok || c == nil {
+			return true
+		}
+		if _, ok := revokedIDs[id]; ok {
+			s.Logger.Info().Str("client", id).Msg("disconnect client because its credential was revoked")
+			revoked++
+			c.close()
+			return true
+		}
+		v, ok := s.users.Load(id)
+		if !ok {
+			return true
+		}
+		u := v.(user)
+		if u.temp {
+			d := s.defaultUser()
+			u.TCPNumber = d.TCPNumber
+			u.UDPNumber = d.UDPNumber
+			u.Speed = d.Speed
+			u.SpeedUp = d.SpeedUp
+			u.SpeedDown = d.SpeedDown
+			u.SpeedBurst = d.SpeedBurst
+			u.Connections = d.Connections
+			u.Host = d.Host
+			s.users.Store(id, u)
+		}
+		c.update(u, &s.portsManager, &s.udpPortsManager)
+		return true
+	})
+
+	s.setAuthUser()
+
+	s.Logger.Info().
+		Int("added", added).
+		Int("updated", updated).
+		Int("removed", removed).
+		Int("revoked", revoked).
+		Msg("reloaded users")
+	return
+}
+
+// update 在原地更新 client 的限制，已经打开的 tcp 与 udp 端口会被重新归属到新的 portsManager
+func (c *client) update(u user, global *portsManager, udpGlobal *portsManager) {
+	c.tunnelsRWMtx.Lock()
+	defer c.tunnelsRWMtx.Unlock()
+	c.host = u.Host
+	c.connections = u.Connections
+	c.portsManager = u.portsManager
+	c.udpPortsManager = u.udpPortsManager
+	c.updateSpeed(u)
+	c.updateACLs(u)
+
+	c.rangeOpenedTCPPorts(func(port uint16, l *tcpListener) {
+		l.pm.Store(reclaimPort(port, u.portsManager, global))
+	})
+	c.rangeOpenedUDPPorts(func(port uint16, l *udpListener) {
+		l.pm.Store(reclaimPort(port, u.udpPortsManager, udpGlobal))
+	})
+}
+
+// reclaimPort 从配置了 port 的第一个 portsManager 中移除已经打开的 port，并返回该 portsManager
+func reclaimPort(port uint16, managers ...*portsManager) (pm *portsManager) {
+	for _, m := range managers {
+		if m == nil {
+			continue
+		}
+		m.portsMtx.Lock()
+		_, ok := m.all[port]
+		if ok {
+			delete(m.ports, port)
+		}
+		m.portsMtx.Unlock()
+		if ok {
+			return m
+		}
+	}
+	return
+}
+
+func (c *client) rangeOpenedTCPPorts(f func(port uint16, l *tcpListener)) {
+	c.tcpListeners.Range(func(key, value interface{}) bool {
+		l, ok := value.(*tcpListener)
+		if ok && l.l != nil {
+			f(uint16(l.l.Addr().(*net.TCPAddr).Port), l)
+		}
+		return true
+	})
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	err := os.WriteFile(usersFile, []byte(`
+id1:
+  secret: secret1
+  speed: 100
+id2:
+  secret: secret2
+id3:
+  secret: secret3
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New([]string{"server", "-users", usersFile, "-tcpRange", "1-2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAuthUser()
+
+	// 创建带有一个隧道连接的 client，隧道连接关闭时 closed 会被关闭
+	newTestClient := func(id string) (c *client, closed chan struct{}) {
+		u, err := s.authUser(id, "secret"+id[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ = s.getOrCreateClient(id, newClient)
+		c.init(id, u, s)
+		local, remote := net.Pipe()
+		c.tunnels[newConn(local, s)] = struct{}{}
+		closed = make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, remote)
+			close(closed)
+		}()
+		return
+	}
+	isClosed := func(closed chan struct{}) bool {
+		select {
+		case <-closed:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+	c1, closed1 := newTestClient("id1")
+	_, closed2 := newTestClient("id2")
+	_, closed3 := newTestClient("id3")
+	if c1.upLimiter.rate != 100 || c1.downLimiter.rate != 100 {
+		t.Fatal("invalid speed")
+	}
+
+	// 配置错误时不影响正在运行的配置
+	err = os.WriteFile(usersFile, []byte("id1: ["), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reload()
+	if err == nil {
+		t.Fatal("reload should fail")
+	}
+	if _, err = s.authUser("id2", "secret2"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(usersFile, []byte(`
+id1:
+  secret: secret1
+  speed: 200
+  speedDown: 50
+  connections: 3
+id3:
+  secret: secret3-rotated
+id4:
+  secret: secret4
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isClosed(closed1) {
+		t.Fatal("client id1 should not be disconnected")
+	}
+	if c1.upLimiter.rate != 200 || c1.downLimiter.rate != 50 || c1.connections != 3 {
+		t.Fatal("limits of client id1 are not updated")
+	}
+	if !isClosed(closed2) {
+		t.Fatal("client id2 should be disconnected")
+	}
+	if !isClosed(closed3) {
+		t.Fatal("client id3 should be disconnected")
+	}
+	if _, err = s.authUser("id2", "secret2"); err == nil {
+		t.Fatal("id2 should be removed")
+	}
+	if _, err = s.authUser("id3", "secret3"); err == nil {
+		t.Fatal("old secret of id3 should be revoked")
+	}
+	for id, secret := range map[string]string{"id1": "secret1", "id3": "secret3-rotated", "id4": "secret4"} {
+		if _, err = s.authUser(id, secret); err != nil {
+			t.Fatal(id, err)
+		}
+	}
+}
+
+// TestReloadConcurrently 在 -race 下检查 Reload 与处理连接时读取配置之间没有数据竞争
+func TestReloadConcurrently(t *testing.T) {
+	s, err := New([]string{"server", "-id", "id1", "-secret", "secret1", "-tcpNumber", "1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.parseUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAuthUser()
+
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if u := s.defaultUser(); *u.TCPNumber != 1 {
+				t.Error("invalid tcp number")
+				return
+			}
+			if _, err := s.authUserFunc()("id1", "secret1"); err != nil {
+				t.Error(err)
+				return
+			}
+			s.allowAuth(&authGate{})
+			s.turnQuota("id1")
+			running := s.RunningConfig()
+			_ = running.Redacted()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		err = s.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	<-read
+}
+
+func TestPortsManagerRelease(t *testing.T) {
+	pm := &portsManager{
+		ports: map[uint16]struct{}{},
+		all:   map[uint16]struct{}{1: {}},
+	}
+	pm.release(1)
+	pm.release(2)
+	if _, ok := pm.ports[1]; !ok {
+		t.Fatal("port 1 should be released")
+	}
+	if _, ok := pm.ports[2]; ok {
+		t.Fatal("port 2 is not configured")
+	}
+}
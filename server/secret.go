@@ -0,0 +1,280 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	stdbufio "bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/isrc-cas/gt/server/sync"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretPlaceholder replaces the secrets in the logs and in the configs returned by GT-Web
+const SecretPlaceholder = "******"
+
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+	hashScrypt   = "scrypt"
+
+	argon2idPrefix = "$argon2id$"
+	scryptPrefix   = "$scrypt$"
+
+	hashSaltSize = 16
+	hashKeySize  = 32
+)
+
+// verifiedSecrets 缓存哈希 secret 最近一次验证通过的 secret 的摘要，避免客户端的每个隧道都重新计算哈希
+// key: 哈希后的 secret(string) value: [sha256.Size]byte
+var verifiedSecrets sync.Map
+
+// isHashedSecret 根据前缀判断 secret 是否是 bcrypt、argon2id 或 scrypt 哈希
+func isHashedSecret(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$") ||
+		strings.HasPrefix(s, argon2idPrefix) || strings.HasPrefix(s, scryptPrefix)
+}
+
+// verifySecret 使用常量时间比较客户端的 secret 与配置中明文或者哈希后的 secret
+func verifySecret(stored, secret string) bool {
+	if !isHashedSecret(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if value, ok := verifiedSecrets.Load(stored); ok {
+		verified := value.([sha256.Size]byte)
+		if subtle.ConstantTimeCompare(verified[:], sum[:]) == 1 {
+			return true
+		}
+	}
+	var ok bool
+	switch {
+	case strings.HasPrefix(stored, argon2idPrefix):
+		ok = verifyArgon2id(stored, secret)
+	case strings.HasPrefix(stored, scryptPrefix):
+		ok = verifyScrypt(stored, secret)
+	default:
+		ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+	}
+	if ok {
+		verifiedSecrets.Store(stored, sum)
+	}
+	return ok
+}
+
+// checkHashedSecret 检查哈希后的 secret 的格式
+func checkHashedSecret(stored string) (err error) {
+	switch {
+	case strings.HasPrefix(stored, argon2idPrefix):
+		_, _, _, _, _, err = parseArgon2id(stored)
+	case strings.HasPrefix(stored, scryptPrefix):
+		_, _, _, _, _, err = parseScrypt(stored)
+	default:
+		_, err = bcrypt.Cost([]byte(stored))
+	}
+	return
+}
+
+// hashSecret 使用 algorithm 哈希 secret，结果可以直接作为 users 配置中的 secret
+func hashSecret(secret, algorithm string) (hash string, err error) {
+	if len(secret) == 0 {
+		return "", errors.New("secret can not be empty")
+	}
+	if algorithm == hashBcrypt || algorithm == "" {
+		var b []byte
+		b, err = bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		return string(b), err
+	}
+	salt := make([]byte, hashSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+	enc := base64.RawStdEncoding
+	switch algorithm {
+	case hashArgon2id:
+		var memory, time uint32 = 64 * 1024, 3
+		var threads uint8 = 4
+		key := argon2.IDKey([]byte(secret), salt, time, memory, threads, hashKeySize)
+		hash = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, memory, time, threads,
+			enc.EncodeToString(salt), enc.EncodeToString(key))
+	case hashScrypt:
+		ln, r, p := 15, 8, 1
+		var key []byte
+		key, err = scrypt.Key([]byte(secret), salt, 1<<ln, r, p, hashKeySize)
+		if err != nil {
+			return
+		}
+		hash = fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, ln, r, p,
+			enc.EncodeToString(salt), enc.EncodeToString(key))
+	default:
+		err = fmt.Errorf("hash algorithm (-hashAlgorithm option) '%s' is invalid", algorithm)
+	}
+	return
+}
+
+// parseArgon2id 解析 $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func parseArgon2id(s string) (memory, time uint32, threads uint8, salt, key []byte, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 {
+		err = errors.New("invalid argon2id hash")
+		return
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return
+	}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2id version %d", version)
+		return
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return
+	}
+	salt, key, err = decodeSaltAndKey(parts[4], parts[5])
+	if err == nil && (memory == 0 || time == 0 || threads == 0) {
+		err = errors.New("invalid argon2id parameters")
+	}
+	return
+}
+
+// parseScrypt 解析 $scrypt$ln=15,r=8,p=1$salt$key
+func parseScrypt(s string) (ln, r, p int, salt, key []byte, err error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 5 {
+		err = errors.New("invalid scrypt hash")
+		return
+	}
+	_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &r, &p)
+	if err != nil {
+		return
+	}
+	salt, key, err = decodeSaltAndKey(parts[3], parts[4])
+	if err == nil && (ln <= 0 || ln >= 32 || r <= 0 || p <= 0) {
+		err = errors.New("invalid scrypt parameters")
+	}
+	return
+}
+
+func decodeSaltAndKey(s, k string) (salt, key []byte, err error) {
+	salt, err = base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(k)
+	if err == nil && len(key) == 0 {
+		err = errors.New("empty key")
+	}
+	return
+}
+
+func verifyArgon2id(stored, secret string) bool {
+	memory, time, threads, salt, key, err := parseArgon2id(stored)
+	if err != nil {
+		return false
+	}
+	actual := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1
+}
+
+func verifyScrypt(stored, secret string) bool {
+	ln, r, p, salt, key, err := parseScrypt(stored)
+	if err != nil {
+		return false
+	}
+	actual, err := scrypt.Key([]byte(secret), salt, 1<<ln, r, p, len(key))
+	return err == nil && subtle.ConstantTimeCompare(actual, key) == 1
+}
+
+// printSecretHash 输出 -hashSecret 的哈希，secret 为 - 时从标准输入读取
+func printSecretHash(secret, algorithm string) (err error) {
+	if secret == "-" {
+		scanner := stdbufio.NewScanner(os.Stdin)
+		if !scanner.Scan() {
+			err = scanner.Err()
+			if err == nil {
+				err = errors.New("no secret is read from stdin")
+			}
+			return
+		}
+		secret = strings.TrimRight(scanner.Text(), "\r")
+	}
+	hash, err := hashSecret(secret, algorithm)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Println(hash)
+	return
+}
+
+// Redacted returns a copy of the config whose secrets are replaced by SecretPlaceholder
+func (c *Config) Redacted() (r Config) {
+	r = *c
+	if c.Users != nil {
+		r.Users = make(map[string]user, len(c.Users))
+		for id, u := range c.Users {
+			if len(u.Secret) > 0 {
+				u.Secret = SecretPlaceholder
+			}
+			r.Users[id] = u
+		}
+	}
+	if c.Secrets != nil {
+		r.Secrets = make([]string, len(c.Secrets))
+		for i := range r.Secrets {
+			r.Secrets[i] = SecretPlaceholder
+		}
+	}
+	for _, s := range []*string{&r.Password, &r.SigningKey, &r.MetricsToken, &r.ClusterSecret, &r.AuthSessionKey, &r.AuthAPISecret, &r.TURNSecret, &r.SentryDSN} {
+		if len(*s) > 0 {
+			*s = SecretPlaceholder
+		}
+	}
+	return
+}
+
+// RestoreSecrets replaces the SecretPlaceholder of users in the config with their secrets in old,
+// so that the config returned by Redacted can be saved again
+func (c *Config) RestoreSecrets(old *Config) {
+	for id, u := range c.Users {
+		if u.Secret != SecretPlaceholder {
+			continue
+		}
+		u.Secret = old.Users[id].Secret
+		c.Users[id] = u
+	}
+	for _, p := range []struct{ s, old *string }{
+		{&c.ClusterSecret, &old.ClusterSecret},
+		{&c.AuthSessionKey, &old.AuthSessionKey},
+		{&c.AuthAPISecret, &old.AuthAPISecret},
+		{&c.TURNSecret, &old.TURNSecret},
+		{&c.SentryDSN, &old.SentryDSN},
+	} {
+		if *p.s == SecretPlaceholder {
+			*p.s = *p.old
+		}
+	}
+}
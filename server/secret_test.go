@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/isrc-cas/gt/predef"
+)
+
+func TestHashSecret(t *testing.T) {
+	for _, algorithm := range []string{hashBcrypt, hashArgon2id, hashScrypt} {
+		hash, err := hashSecret("secret1", algorithm)
+		if err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if !isHashedSecret(hash) {
+			t.Fatalf("%s: '%s' is not detected as hashed secret", algorithm, hash)
+		}
+		if err = checkHashedSecret(hash); err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if !verifySecret(hash, "secret1") {
+			t.Fatalf("%s: secret1 should be verified", algorithm)
+		}
+		// 第二次命中缓存
+		if !verifySecret(hash, "secret1") {
+			t.Fatalf("%s: secret1 should be verified again", algorithm)
+		}
+		if verifySecret(hash, "secret2") {
+			t.Fatalf("%s: secret2 should not be verified", algorithm)
+		}
+	}
+	if _, err := hashSecret("secret1", "md5"); err == nil {
+		t.Fatal("md5 should be invalid")
+	}
+	if _, err := hashSecret("", hashBcrypt); err == nil {
+		t.Fatal("empty secret should be invalid")
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	if !verifySecret("secret1", "secret1") || verifySecret("secret1", "secret") || verifySecret("secret1", "") {
+		t.Fatal("plain secrets are compared incorrectly")
+	}
+	for _, s := range []string{
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=3,p=4$c2FsdA$a2V5",
+		"$scrypt$ln=15,r=8,p=1$c2FsdA$!!",
+		"$scrypt$ln=64,r=8,p=1$c2FsdA$a2V5",
+		"$2a$10$invalid",
+	} {
+		if err := checkHashedSecret(s); err == nil {
+			t.Fatalf("'%s' should be invalid", s)
+		}
+		if verifySecret(s, "secret1") {
+			t.Fatalf("'%s' should not verify any secret", s)
+		}
+	}
+}
+
+func TestUsersVerifyHashedSecret(t *testing.T) {
+	hash, err := hashSecret("secret1", hashBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := users{}
+	u.Store("id1", user{Secret: hash})
+	if err = u.verify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.auth("id1", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.auth("id1", hash); err == nil {
+		t.Fatal("the hash should not be accepted as the secret")
+	}
+	long := strings.Repeat("s", predef.MaxSecretSize+1)
+	u.Store("id2", user{Secret: long})
+	err = u.verify()
+	if err == nil || strings.Contains(err.Error(), long) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := defaultConfig()
+	c.Users = map[string]user{"id1": {Secret: "secret1"}, "id2": {}}
+	c.Secrets = []string{"secret2"}
+	c.Password = "password"
+	c.SigningKey = "signingKey"
+	c.ClusterSecret = "clusterSecret"
+	c.AuthSessionKey = "authSessionKey"
+	c.SentryDSN = "https://key@sentry.example.com/1"
+
+	r := c.Redacted()
+	if r.Users["id1"].Secret != SecretPlaceholder || r.Users["id2"].Secret != "" {
+		t.Fatalf("unexpected users %v", r.Users)
+	}
+	for _, s := range []string{r.Secrets[0], r.Password, r.SigningKey, r.ClusterSecret, r.AuthSessionKey, r.SentryDSN} {
+		if s != SecretPlaceholder {
+			t.Fatalf("'%s' is not redacted", s)
+		}
+	}
+	if c.Users["id1"].Secret != "secret1" || c.Secrets[0] != "secret2" || c.Password != "password" {
+		t.Fatal("the original config should not be changed")
+	}
+
+	r.Users["id3"] = user{Secret: "secret3"}
+	r.RestoreSecrets(&c)
+	if r.Users["id1"].Secret != "secret1" || r.Users["id3"].Secret != "secret3" ||
+		r.ClusterSecret != "clusterSecret" || r.AuthSessionKey != "authSessionKey" || r.SentryDSN != c.SentryDSN {
+		t.Fatalf("secrets are not restored: %v", r)
+	}
+}
@@ -15,9 +15,9 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	connection "github.com/isrc-cas/gt/conn"
@@ -32,14 +32,12 @@ import (
 	"os"
 	"regexp"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	gosync "sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/buger/jsonparser"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/isrc-cas/gt/config"
 	"github.com/isrc-cas/gt/logger"
@@ -52,26 +50,59 @@ import (
 
 // Server is a network agent server.
 type Server struct {
-	config       Config
-	users        users
-	portsManager portsManager
-	Logger       logger.Logger
-	id2Client    sync.Map
-	closing      uint32
-	tlsListener  net.Listener
-	listener     net.Listener
-	sniListener  net.Listener
-	quicListener net.Listener
-	accepted     uint64
-	served       uint64
-	failed       uint64
-	tunneling    uint64
-	apiServer    *api.Server
-	apiListener  net.Listener
-	authUser     func(id string, secret string) (user, error)
-	removeClient func(id string)
-	stunServer   *turn.Server
-	turnListener net.PacketConn
+	config         Config
+	users          users
+	portsManager   portsManager
+	tcpOwnersMtx   gosync.Mutex
+	tcpOwners      map[uint16]string // key: tcp 端口 value: 所属用户的 id，全局配置的端口为空
+	Logger         logger.Logger
+	id2Client      sync.Map
+	closing        uint32
+	tlsListener    net.Listener
+	listener       net.Listener
+	sniListener    net.Listener
+	quicListener   net.Listener
+	accepted       uint64
+	served         uint64
+	failed         uint64
+	tunneling      uint64
+	apiServer      *api.Server
+	apiListener    net.Listener
+	authUser       func(id string, secret string) (user, error)
+	authAPI        *authAPIClient // 未设置 -authAPI 时为 nil
+	removeClient   func(id string)
+	stunServer     *turn.Server
+	turnRelay      *turnRelay // 未设置 -turnRelayIP 时为 nil
+	turnListener   net.PacketConn
+	metrics        metrics
+	acl            atomic.Pointer[acl] // 全局的访问控制列表
+	proxyTrusted   []netip.Prefix      // 发送 PROXY protocol 头部的负载均衡器
+	authKey        []byte              // 签名访问者的 OIDC session
+	oidcProviders  sync.Map            // key: issuer(string) value: *oidcProvider
+	oidcHTTPClient *http.Client        // 访问 OIDC provider 使用的 http 客户端
+	clientCAs      *x509.CertPool      // 验证隧道的客户端证书
+	clientCACerts  []*x509.Certificate // 验证 CRL 的签名
+	revoked        atomic.Pointer[revocationList]
+	args           []string
+	upLimiter      *limiter // 全局的上行限速
+	downLimiter    *limiter // 全局的下行限速
+	reloadMtx      gosync.Mutex
+	configRWMtx    gosync.RWMutex // 保护 Reload 会修改的配置以及 authUser、removeClient 与 handshakeMode
+	usages         sync.Map       // key: id(string) value: *clientUsage
+	usageFile      *os.File
+	usageDone      chan struct{}
+	usageFlushed   chan struct{}
+	usageLast      map[usageKey]UsageCounters // 上次写入 usageFile 时的用量，只在写入的 goroutine 中访问
+	usageSince     time.Time
+	accessLog      *accessLogger
+	acme           *acmeManager
+	cluster        *cluster
+
+	udpPortsManager portsManager // udp 端口与 tcp 端口分别分配
+
+	// 多个 client 的相同 host 前缀或 tcp 端口组成的组
+	groupsMtx gosync.Mutex
+	tcpGroups map[uint16]*backendGroup // key: port
 
 	// 重连限制
 	reconnect        map[string]uint32
@@ -79,20 +110,28 @@ type Server struct {
 
 	hostPrefix2Client    sync.Map // key: hostPrefix(string) value: *client
 	tlsHostPrefix2Client sync.Map // key: hostPrefix(string) value: *client
+	domain2Client        sync.Map // key: domain(string) value: clientWithServiceIndex
+	tlsDomain2Client     sync.Map // key: domain(string) value: clientWithServiceIndex
+
+	// 自定义域名的所有权验证
+	verifiedDomains  sync.Map                           // key: domain(string) value: verifiedDomain
+	failedDomainsMtx gosync.Mutex                       // 保护 failedDomains 与 failedEvicted
+	failedDomains    map[string]map[string]failedDomain // key: id, domain
+	failedEvicted    time.Time                          // 上次删除过期的验证失败结果的时间
+	lookupTXT        func(ctx context.Context, name string) ([]string, error)
+	domainHTTPClient *http.Client
+
+	// SecureHandshake 中要求客户端发送的凭证，对所有的 id 都相同
+	handshakeMode byte
+
+	// 访问者认证失败的次数，限制 bcrypt 的计算
+	authFailuresMtx gosync.Mutex
+	authFailures    map[netip.Prefix]*authFailure
 }
 
 // New parses the command line args and creates a Server. out 用于测试
 func New(args []string, out io.Writer) (s *Server, err error) {
-	var conf Config
-	if predef.IsNoArgs() {
-		conf = defaultConfigWithNoArgs()
-	} else {
-		conf = defaultConfig()
-		if util.Contains(args, "-webAddr") {
-			conf.Config = predef.GetDefaultServerConfigPath()
-		}
-	}
-	err = config.ParseFlags(args, &conf, &conf.Options)
+	conf, err := parseConfig(args)
 	if err != nil {
 		return
 	}
@@ -100,6 +139,13 @@ func New(args []string, out io.Writer) (s *Server, err error) {
 		_, _ = fmt.Println(predef.Version)
 		os.Exit(0)
 	}
+	if len(conf.Options.HashSecret) > 0 {
+		err = printSecretHash(conf.Options.HashSecret, conf.Options.HashAlgorithm)
+		if err != nil {
+			return
+		}
+		os.Exit(0)
+	}
 
 	if len(conf.Options.Signal) > 0 {
 		err = processSignal(conf.Options.Signal)
@@ -126,14 +172,37 @@ func New(args []string, out io.Writer) (s *Server, err error) {
 		return
 	}
 
+	conf.BaseDomains, err = parseBaseDomains(conf.BaseDomains)
+	if err != nil {
+		return
+	}
+
 	s = &Server{
-		config:    conf,
-		Logger:    l,
-		reconnect: make(map[string]uint32),
+		config:           conf,
+		Logger:           l,
+		reconnect:        make(map[string]uint32),
+		args:             args,
+		upLimiter:        newLimiter(conf.GlobalSpeed, conf.SpeedBurst),
+		downLimiter:      newLimiter(conf.GlobalSpeed, conf.SpeedBurst),
+		lookupTXT:        net.DefaultResolver.LookupTXT,
+		domainHTTPClient: newDomainHTTPClient(),
 	}
 	return
 }
 
+func parseConfig(args []string) (conf Config, err error) {
+	if predef.IsNoArgs() {
+		conf = defaultConfigWithNoArgs()
+	} else {
+		conf = defaultConfig()
+		if util.Contains(args, "-webAddr") {
+			conf.Config = predef.GetDefaultServerConfigPath()
+		}
+	}
+	err = config.ParseFlags(args, &conf, &conf.Options)
+	return
+}
+
 func processSignal(signal string) (err error) {
 	switch signal {
 	case "restart":
@@ -154,6 +223,12 @@ func processSignal(signal string) (err error) {
 			os.Exit(1)
 		}
 		os.Exit(0)
+	case "reload":
+		err := sig(syscall.SIGHUP)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	default:
 		err = fmt.Errorf("unknown value of '-s': %q", signal)
 	}
@@ -210,15 +285,23 @@ func sig(sig syscall.Signal) (err error) {
 }
 func (s *Server) tlsListen() (err error) {
 	var tlsConfig *tls.Config
-	tlsConfig, err = newTLSConfig(s.config.CertFile, s.config.KeyFile, s.config.TLSMinVersion)
-	if err != nil {
-		return
+	if s.acme != nil {
+		tlsConfig = s.acme.tlsConfig(s.config.TLSMinVersion)
+	} else {
+		tlsConfig, err = newTLSConfig(s.config.CertFile, s.config.KeyFile, s.config.TLSMinVersion)
+		if err != nil {
+			return
+		}
 	}
-	s.tlsListener, err = tls.Listen("tcp", s.config.TLSAddr, tlsConfig)
+	s.setClientAuth(tlsConfig, false)
+	var l net.Listener
+	l, err = net.Listen("tcp", s.config.TLSAddr)
 	if err != nil {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'tlsAddr'", s.config.TLSAddr, err.Error())
 		return
 	}
+	// PROXY protocol 头部在 TLS 握手之前
+	s.tlsListener = tls.NewListener(s.proxyListener(l), tlsConfig)
 	s.Logger.Info().Str("addr", s.tlsListener.Addr().String()).Msg("Listening TLS")
 	go s.acceptLoop(s.tlsListener, func(c *conn) {
 		c.handle(c.handleHTTP)
@@ -232,6 +315,7 @@ func (s *Server) listen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'addr'", s.config.Addr, err.Error())
 		return
 	}
+	s.listener = s.proxyListener(s.listener)
 	s.Logger.Info().Str("addr", s.listener.Addr().String()).Msg("Listening")
 	go s.acceptLoop(s.listener, func(c *conn) {
 		c.handle(c.handleHTTP)
@@ -249,6 +333,7 @@ func (s *Server) quicListen(openBBR bool) (err error) {
 	if err != nil {
 		return
 	}
+	s.setClientAuth(tlsConfig, true)
 	if openBBR {
 		//s.quicListener, err = connection.QuicBbrListen(s.config.QuicAddr, tlsConfig)
 		//s.quicListener, err = quic.NewListenr(s.config.QuicAddr, 10_000, s.config.KeyFile, s.config.CertFile, "")
@@ -257,7 +342,7 @@ func (s *Server) quicListen(openBBR bool) (err error) {
 		s.quicListener, err = connection.QuicListen(s.config.QuicAddr, tlsConfig)
 	}
 	if err != nil {
-		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'addr'", s.config.QuicAddr, err.Error())
+		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'quicAddr'", s.config.QuicAddr, err.Error())
 		return
 	}
 	s.Logger.Info().Str("QuicAddr", s.quicListener.Addr().String()).Msg("Listening")
@@ -273,6 +358,7 @@ func (s *Server) sniListen() (err error) {
 		err = fmt.Errorf("can not listen on addr '%s', cause %s, please check option 'sniAddr'", s.config.SNIAddr, err.Error())
 		return
 	}
+	s.sniListener = s.proxyListener(s.sniListener)
 	s.Logger.Info().Str("sniAddr", s.sniListener.Addr().String()).Msg("Listening SNI")
 	go s.acceptLoop(s.sniListener, func(c *conn) {
 		c.handle(c.handleSNI)
@@ -280,6 +366,30 @@ func (s *Server) sniListen() (err error) {
 	return
 }
 
+// proxyProtocolTimeout 读取 PROXY protocol 头部的超时时间
+const proxyProtocolTimeout = 10 * time.Second
+
+// proxyListener 开启 proxyProtocol 选项时从 PROXY protocol 头部获取访问者的地址
+func (s *Server) proxyListener(l net.Listener) net.Listener {
+	if !s.config.ProxyProtocol {
+		return l
+	}
+	return connection.NewProxyListener(l, proxyProtocolTimeout, s.proxyTrusted)
+}
+
+// initProxyProtocol 解析发送 PROXY protocol 头部的负载均衡器的地址，信任所有对端会让访问者可以伪造自己的地址
+func (s *Server) initProxyProtocol() (err error) {
+	if !s.config.ProxyProtocol {
+		return
+	}
+	if len(s.config.ProxyProtocolTrusted) == 0 {
+		err = errors.New("-proxyProtocolTrusted option is required by -proxyProtocol option")
+		return
+	}
+	s.proxyTrusted, err = parseIPPrefixes(s.config.ProxyProtocolTrusted)
+	return
+}
+
 func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 	var err error
 	defer func() {
@@ -322,54 +432,56 @@ func (s *Server) acceptLoop(l net.Listener, handle func(*conn)) {
 			return
 		}
 		atomic.AddUint64(&s.accepted, 1)
-		c := newConn(conn, s)
-		go handle(c)
+		go func() {
+			// 开启 proxyProtocol 时 newConn 会读取 PROXY protocol 头部，不能阻塞 acceptLoop
+			handle(newConn(conn, s))
+		}()
 	}
 }
 
 // Start runs the server.
 func (s *Server) Start() (err error) {
 	s.Logger.Info().Msg(predef.Version)
-	err = s.users.mergeUsers(s.config.Users, nil, nil)
+	err = s.parseUsers()
 	if err != nil {
 		return
 	}
-	users := make(map[string]user)
-	err = config.Yaml2Interface(s.config.Options.Users, users)
-	if err != nil {
+
+	if len(s.config.HTTPMUXHeader) <= 0 {
+		err = fmt.Errorf("HTTP multiplexing header (-httpMUXHeader option) '%s' is invalid", s.config.HTTPMUXHeader)
 		return
 	}
-	err = s.users.mergeUsers(users, s.config.IDs, s.config.Secrets)
-	if err != nil {
+
+	switch s.config.GroupBalance {
+	case groupBalanceLeastTasks, groupBalanceWeight:
+	default:
+		err = fmt.Errorf("group balance (-groupBalance option) '%s' is invalid", s.config.GroupBalance)
 		return
 	}
-	err = s.parseTCPs()
+
+	if s.config.RequireSecureHandshake && s.config.PlaintextSecretHandshake {
+		err = errors.New("-plaintextSecretHandshake option can not be used with -requireSecureHandshake option")
+		return
+	}
+
+	err = s.initAuth()
 	if err != nil {
 		return
 	}
-	err = s.parseHost()
+
+	err = s.initClientCA()
 	if err != nil {
 		return
 	}
 
-	if len(s.config.HTTPMUXHeader) <= 0 {
-		err = fmt.Errorf("HTTP multiplexing header (-httpMUXHeader option) '%s' is invalid", s.config.HTTPMUXHeader)
+	err = s.initProxyProtocol()
+	if err != nil {
 		return
 	}
 
+	s.setAuthUser()
 	if len(s.config.AuthAPI) > 0 {
-		s.authUser = nil
-		s.removeClient = s.removeClientOnly
-	} else if s.users.empty() {
-		s.Logger.Warn().Msg("working on -allowAnyClient mode, because no user is configured")
-		s.authUser = s.authUserOrCreateUser
-		s.removeClient = s.removeClientAndUser
-	} else if !s.config.AllowAnyClient {
-		s.authUser = s.authUserWithConfig
-		s.removeClient = s.removeClientOnly
-	} else {
-		s.authUser = s.authUserOrCreateUser
-		s.removeClient = s.removeClientAndTempUser
+		s.authAPI = newAuthAPIClient(s)
 	}
 	if len(s.config.APIAddr) > 0 {
 		if strings.IndexByte(s.config.APIAddr, ':') == -1 {
@@ -380,12 +492,21 @@ func (s *Server) Start() (err error) {
 			s.Logger.With().Str("scope", "api").Logger(),
 			s.users.isIDConflict,
 			s.config.HTTPMUXHeader,
+			s.WriteMetrics,
+			s.config.MetricsToken,
 		)
 		s.apiServer = apiServer
 	}
 
+	if len(s.config.ACMEDomain) > 0 {
+		s.acme, err = newACMEManager(s)
+		if err != nil {
+			return
+		}
+	}
+
 	var listening bool
-	if len(s.config.TLSAddr) > 0 && len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0 {
+	if len(s.config.TLSAddr) > 0 && (s.acme != nil || len(s.config.CertFile) > 0 && len(s.config.KeyFile) > 0) {
 		if strings.IndexByte(s.config.TLSAddr, ':') == -1 {
 			s.config.TLSAddr = ":" + s.config.TLSAddr
 		}
@@ -452,14 +573,85 @@ func (s *Server) Start() (err error) {
 		}
 	}
 
-	conf4log := *s.Config()
-	conf4log.Password = "******"
-	conf4log.SigningKey = "******"
+	if len(s.config.ClusterAddr) > 0 {
+		if strings.IndexByte(s.config.ClusterAddr, ':') == -1 {
+			s.config.ClusterAddr = ":" + s.config.ClusterAddr
+		}
+		s.cluster, err = newCluster(s)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(s.config.UsageFile) > 0 {
+		err = s.startUsageFlush()
+		if err != nil {
+			return
+		}
+	}
+
+	if len(s.config.AccessLogFile) > 0 {
+		err = s.startAccessLog()
+		if err != nil {
+			return
+		}
+	}
+
+	conf4log := s.Config().Redacted()
 
 	s.Logger.Info().Msg(spew.Sdump(conf4log))
 	return
 }
 
+// authUserFunc 返回当前的 authUser，未设置 -authAPI 时不为 nil
+func (s *Server) authUserFunc() func(id string, secret string) (user, error) {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	return s.authUser
+}
+
+// handshakeModeFunc 返回 SecureHandshake 中要求客户端发送的凭证，对所有的 id 都相同
+func (s *Server) handshakeModeFunc() byte {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	return s.handshakeMode
+}
+
+// removeClientFunc 返回当前的 removeClient
+func (s *Server) removeClientFunc() func(id string) {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	return s.removeClient
+}
+
+func (s *Server) setAuthUser() {
+	s.configRWMtx.Lock()
+	defer s.configRWMtx.Unlock()
+	// API 认证需要明文 secret；接受任意客户端时未配置的 id 无法通过 HMAC 验证，以 digest 代替 secret
+	switch {
+	case s.config.PlaintextSecretHandshake || len(s.config.AuthAPI) > 0 && !s.config.RequireSecureHandshake:
+		s.handshakeMode = predef.HandshakeSecret
+	case len(s.config.AuthAPI) == 0 && (!s.users.configured() || s.config.AllowAnyClient):
+		s.handshakeMode = predef.HandshakeDigest
+	default:
+		s.handshakeMode = predef.HandshakeHMAC
+	}
+	if len(s.config.AuthAPI) > 0 {
+		s.authUser = nil
+		s.removeClient = s.removeClientOnly
+	} else if s.users.empty() {
+		s.Logger.Warn().Msg("working on -allowAnyClient mode, because no user is configured")
+		s.authUser = s.authUserOrCreateUser
+		s.removeClient = s.removeClientAndUser
+	} else if !s.config.AllowAnyClient {
+		s.authUser = s.authUserWithConfig
+		s.removeClient = s.removeClientOnly
+	} else {
+		s.authUser = s.authUserOrCreateUser
+		s.removeClient = s.removeClientAndTempUser
+	}
+}
+
 func (s *Server) startSTUNServer() (err error) {
 	if strings.IndexByte(s.config.STUNAddr, ':') == -1 {
 		s.config.STUNAddr = ":" + s.config.STUNAddr
@@ -490,27 +682,61 @@ func (s *Server) startSTUNServer() (err error) {
 		lv = logging.LogLevelTrace
 	}
 	factory.DefaultLogLevel = lv
+
+	var generator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorNone{
+		Address: "0.0.0.0",
+	}
+	authHandler := func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+		return // 未设置 -turnRelayIP 时只提供 STUN 服务
+	}
+	packetConn := s.turnListener
+	var permissionHandler turn.PermissionHandler
+	if len(s.config.TURNRelayIP) > 0 {
+		relayIP := net.ParseIP(s.config.TURNRelayIP)
+		if relayIP == nil {
+			err = fmt.Errorf("invalid turnRelayIP '%s'", s.config.TURNRelayIP)
+			return
+		}
+		var pr util.PortRange
+		pr, err = util.NewPortRangeFromString(s.config.TURNRelayPorts)
+		if err != nil {
+			return
+		}
+		address := "0.0.0.0"
+		if relayIP.To4() == nil {
+			address = "::"
+		}
+		s.turnRelay, err = newTURNRelay(s, &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			MinPort:      pr.Min,
+			MaxPort:      pr.Max,
+			Address:      address,
+		})
+		if err != nil {
+			return
+		}
+		packetConn = s.turnRelay.packetConn(s.turnListener)
+		generator = s.turnRelay
+		authHandler = s.turnRelay.auth
+		permissionHandler = s.turnRelay.permit
+	}
 	server, err := turn.NewServer(turn.ServerConfig{
 		Realm:         "ao.space",
 		LoggerFactory: factory,
-		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
-			value, ok := s.users.Load(username)
-			if ok {
-				key = []byte(value.(string))
-			}
-			return
-		},
+		AuthHandler:   authHandler,
 		PacketConnConfigs: []turn.PacketConnConfig{
 			{
-				PacketConn: s.turnListener,
-				RelayAddressGenerator: &turn.RelayAddressGeneratorNone{
-					Address: "0.0.0.0",
-				},
+				PacketConn:            packetConn,
+				RelayAddressGenerator: generator,
+				PermissionHandler:     permissionHandler,
 			},
 		},
 	})
+	if err != nil {
+		return
+	}
 
-	s.Logger.Info().Str("addr", s.turnListener.LocalAddr().String()).Msg("Listening STUN")
+	s.Logger.Info().Str("addr", s.turnListener.LocalAddr().String()).Str("relayIP", s.config.TURNRelayIP).Msg("Listening STUN")
 	s.stunServer = server
 	return
 }
@@ -523,6 +749,11 @@ func newTLSConfig(cert, key, tlsMinVersion string) (tlsConfig *tls.Config, err e
 	}
 	tlsConfig = &tls.Config{}
 	tlsConfig.Certificates = []tls.Certificate{crt}
+	setTLSMinVersion(tlsConfig, tlsMinVersion)
+	return
+}
+
+func setTLSMinVersion(tlsConfig *tls.Config, tlsMinVersion string) {
 	switch strings.ToLower(tlsMinVersion) {
 	case "tls1.1":
 		tlsConfig.MinVersion = tls.VersionTLS11
@@ -541,7 +772,6 @@ func newTLSConfig(cert, key, tlsMinVersion string) (tlsConfig *tls.Config, err e
 	case "tls1.3":
 		tlsConfig.MinVersion = tls.VersionTLS13
 	}
-	return
 }
 
 func (s *Server) startAPIServer() (err error) {
@@ -580,60 +810,6 @@ func (s *Server) startAPIServer() (err error) {
 	return nil
 }
 
-type authParam struct {
-	NetworkClientId  string   `json:"networkClientId"`
-	NetworkSecretKey string   `json:"networkSecretKey"`
-	AppletTokens     []string `json:"appletTokens"`
-}
-
-func (s *Server) authWithAPI(id string, secret string, prefixes []string) (hostPrefixes map[string]struct{}, ok bool, err error) {
-	var bs bytes.Buffer
-	encoder := json.NewEncoder(&bs)
-	p := &authParam{
-		NetworkClientId:  id,
-		NetworkSecretKey: secret,
-		AppletTokens:     prefixes,
-	}
-	err = encoder.Encode(p)
-	if err != nil {
-		return
-	}
-	req, err := http.NewRequest("POST", s.config.AuthAPI, &bs)
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Request-Id", strconv.FormatInt(time.Now().Unix(), 10))
-	client := http.Client{
-		Timeout: s.config.Timeout.Duration,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	r, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("invalid http status code %d, body: %s", resp.StatusCode, string(r))
-		return
-	}
-	ok, err = jsonparser.GetBoolean(r, "result")
-	if ok {
-		hostPrefixes = make(map[string]struct{})
-		hostPrefixes[id] = struct{}{}
-		_, err = jsonparser.ArrayEach(r, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-			hostPrefixes[string(value)] = struct{}{}
-		}, "appletTokens")
-		if errors.Is(err, jsonparser.KeyPathNotFoundError) {
-			err = nil
-		}
-	}
-	return
-}
-
 // Close stops the server.
 func (s *Server) Close() {
 	if !atomic.CompareAndSwapUint32(&s.closing, 0, 1) {
@@ -656,12 +832,23 @@ func (s *Server) Close() {
 	if s.sniListener != nil {
 		event.AnErr("sniListener", s.sniListener.Close())
 	}
+	if s.quicListener != nil {
+		event.AnErr("quicListener", s.quicListener.Close())
+	}
+	if s.acme != nil {
+		s.acme.close()
+	}
+	if s.cluster != nil {
+		event.AnErr("cluster", s.cluster.close())
+	}
 	s.id2Client.Range(func(key, value interface{}) bool {
 		if c, ok := value.(*client); ok && c != nil {
 			c.close()
 		}
 		return true
 	})
+	event.AnErr("usage", s.stopUsageFlush())
+	event.AnErr("accessLog", s.stopAccessLog())
 	event.Msg("server stopped")
 }
 
@@ -696,6 +883,15 @@ func (s *Server) ShutdownWithoutClosingLogger() {
 	if s.sniListener != nil {
 		event.AnErr("sniListener", s.sniListener.Close())
 	}
+	if s.quicListener != nil {
+		event.AnErr("quicListener", s.quicListener.Close())
+	}
+	if s.acme != nil {
+		s.acme.close()
+	}
+	if s.cluster != nil {
+		event.AnErr("cluster", s.cluster.close())
+	}
 	for {
 		accepted := s.GetAccepted()
 		served := s.GetServed()
@@ -731,6 +927,8 @@ func (s *Server) ShutdownWithoutClosingLogger() {
 		}
 		return true
 	})
+	event.AnErr("usage", s.stopUsageFlush())
+	event.AnErr("accessLog", s.stopAccessLog())
 	event.Msg("server stopped")
 }
 
@@ -748,30 +946,53 @@ func (s *Server) getHostPrefix(hostPrefix string) (c clientWithServiceIndex, ok
 	return
 }
 
-func (s *Server) getOrCreateHostPrefix(hostPrefix string, tls bool, fn func() interface{}) (c clientWithServiceIndex, ok bool) {
-	if !tls {
-		actual, loaded := s.hostPrefix2Client.LoadOrCreate(hostPrefix, fn)
-		return actual.(clientWithServiceIndex), loaded
-	} else {
-		actual, loaded := s.tlsHostPrefix2Client.LoadOrCreate(hostPrefix, fn)
-		return actual.(clientWithServiceIndex), loaded
-	}
+// hostPrefixMap 返回 o 对应的 host 前缀或自定义域名的表
+func (s *Server) hostPrefixMap(o hostPrefixOption) *sync.Map {
+	switch {
+	case o.domain && o.tls:
+		return &s.tlsDomain2Client
+	case o.domain:
+		return &s.domain2Client
+	case o.tls:
+		return &s.tlsHostPrefix2Client
+	}
+	return &s.hostPrefix2Client
 }
 
-func (s *Server) storeHostPrefix(hostPrefix string, tls bool, c clientWithServiceIndex) {
-	if !tls {
-		s.hostPrefix2Client.Store(hostPrefix, c)
-	} else {
-		s.tlsHostPrefix2Client.Store(hostPrefix, c)
+// storeHostPrefix 更新 host 前缀对应的 serviceIndex，属于组时只更新 c 在组中的成员
+func (s *Server) storeHostPrefix(hostPrefix string, o hostPrefixOption, c clientWithServiceIndex) {
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	if o.group.enabled() {
+		value, ok := s.hostPrefixMap(o).Load(hostPrefix)
+		if ok {
+			if g := value.(clientWithServiceIndex).group; g != nil {
+				g.join(c.client, o.serviceIndex, o.group)
+			}
+		}
+		return
 	}
+	s.hostPrefixMap(o).Store(hostPrefix, c)
 }
 
-func (s *Server) removeHostPrefix(hostPrefix string, tls bool) {
-	if !tls {
-		s.hostPrefix2Client.Delete(hostPrefix)
-	} else {
-		s.tlsHostPrefix2Client.Delete(hostPrefix)
+// removeHostPrefix 删除 host 前缀，属于组时 cli 离开组，组没有成员时才删除
+func (s *Server) removeHostPrefix(hostPrefix string, o hostPrefixOption, cli *client) {
+	s.groupsMtx.Lock()
+	defer s.groupsMtx.Unlock()
+	m := s.hostPrefixMap(o)
+	value, ok := m.Load(hostPrefix)
+	if !ok {
+		return
+	}
+	g := value.(clientWithServiceIndex).group
+	if o.group.enabled() != (g != nil) {
+		// 已经被替换为另一种形式
+		return
 	}
+	if g != nil && !g.leave(cli) {
+		return
+	}
+	m.Delete(hostPrefix)
 }
 
 func (s *Server) getTLSHostPrefix(hostPrefix string) (c clientWithServiceIndex, ok bool) {
@@ -822,21 +1043,42 @@ func (s *Server) authUserWithConfig(id string, secret string) (u user, err error
 }
 
 func (s *Server) newTempUserForAPIServer() user {
+	return s.defaultUser()
+}
+
+// defaultUser 返回使用全局限制的 user，tcp 与 udp 端口数量是配置的拷贝，Reload 不会修改它们
+func (s *Server) defaultUser() user {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	tcpNumber := s.config.TCPNumber
+	udpNumber := s.config.UDPNumber
 	return user{
-		TCPNumber:    &s.config.TCPNumber,
-		Speed:        s.config.Speed,
-		Connections:  s.config.Connections,
-		Host:         s.config.Host,
-		portsManager: &s.portsManager,
+		TCPNumber:       &tcpNumber,
+		UDPNumber:       &udpNumber,
+		Speed:           s.config.Speed,
+		SpeedUp:         s.config.speedUp(),
+		SpeedDown:       s.config.speedDown(),
+		SpeedBurst:      s.config.SpeedBurst,
+		Connections:     s.config.Connections,
+		Host:            s.config.Host,
+		portsManager:    &s.portsManager,
+		udpPortsManager: &s.udpPortsManager,
 	}
 }
 
+// RunningConfig returns a copy of the running config, which is safe to read while the server is reloading.
+func (s *Server) RunningConfig() Config {
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	return s.config
+}
+
 func (s *Server) authUserWithAPI(id string, secret string, prefixes []string) (u user, err error) {
 	if len(id) < 1 || len(secret) < 1 {
 		err = ErrInvalidUser
 		return
 	}
-	hostPrefixes, ok, err := s.authWithAPI(id, secret, prefixes)
+	u, ok, err := s.authAPI.auth(id, secret, prefixes)
 	if err != nil {
 		return
 	}
@@ -847,16 +1089,7 @@ func (s *Server) authUserWithAPI(id string, secret string, prefixes []string) (u
 			return
 		}
 		err = ErrInvalidUser
-		return
 	}
-	u = user{
-		TCPNumber:    &s.config.TCPNumber,
-		Speed:        s.config.Speed,
-		Connections:  s.config.Connections,
-		Host:         s.config.Host,
-		portsManager: &s.portsManager,
-	}
-	u.Host.Prefixes = hostPrefixes
 	return
 }
 
@@ -868,15 +1101,10 @@ func (s *Server) authUserOrCreateUser(id, secret string) (u user, err error) {
 	}
 
 	value, _ := s.users.LoadOrCreate(id, func() interface{} {
-		return user{
-			Secret:       secret,
-			TCPNumber:    &s.config.TCPNumber,
-			Speed:        s.config.Speed,
-			Connections:  s.config.Connections,
-			Host:         s.config.Host,
-			temp:         true,
-			portsManager: &s.portsManager,
-		}
+		u := s.defaultUser()
+		u.Secret = secret
+		u.temp = true
+		return u
 	})
 	var ok bool
 	u, ok = value.(user)
@@ -884,7 +1112,7 @@ func (s *Server) authUserOrCreateUser(id, secret string) (u user, err error) {
 		err = ErrInvalidUser
 		return
 	}
-	if u.Secret != secret {
+	if !verifySecret(u.Secret, secret) {
 		err = ErrInvalidUser
 	}
 	return
@@ -912,6 +1140,7 @@ func (s *Server) removeClientAndTempUser(id string) {
 func (s *Server) parseTCPs() (err error) {
 	ports := make(map[uint16]struct{}, 65536)
 	all := make(map[uint16]struct{}, 65536)
+	owners := make(map[uint16]string)
 	for _, tcp := range s.config.TCPs {
 		pr, err := util.NewPortRangeFromString(tcp.Range)
 		if err != nil {
@@ -920,6 +1149,7 @@ func (s *Server) parseTCPs() (err error) {
 		for i := pr.Min; i <= pr.Max; i++ {
 			ports[i] = struct{}{}
 			all[i] = struct{}{}
+			owners[i] = ""
 			if i == math.MaxUint16 {
 				break
 			}
@@ -934,6 +1164,7 @@ func (s *Server) parseTCPs() (err error) {
 		for i := pr.Min; i <= pr.Max; i++ {
 			ports[i] = struct{}{}
 			all[i] = struct{}{}
+			owners[i] = ""
 			if i == math.MaxUint16 {
 				break
 			}
@@ -941,17 +1172,23 @@ func (s *Server) parseTCPs() (err error) {
 	}
 
 	s.portsManager.ports = ports
+	s.portsManager.all = make(map[uint16]struct{}, len(ports))
+	for port := range ports {
+		s.portsManager.all[port] = struct{}{}
+	}
 
 	// 处理用户 tcp
 	s.users.Range(func(key, value interface{}) bool {
 		u := value.(user)
 		if u.TCPNumber == nil {
-			u.TCPNumber = &s.config.TCPNumber
+			tcpNumber := s.config.TCPNumber
+			u.TCPNumber = &tcpNumber
 		}
 		if len(u.TCPs) == 0 { // 如果用户没有设置则使用全局的
 			u.portsManager = &s.portsManager
 		} else {
 			ports := make(map[uint16]struct{})
+			userAll := make(map[uint16]struct{})
 			for _, tcp := range u.TCPs {
 				var pr util.PortRange
 				pr, err = util.NewPortRangeFromString(tcp.Range)
@@ -964,13 +1201,86 @@ func (s *Server) parseTCPs() (err error) {
 						return false
 					}
 					ports[i] = struct{}{}
+					userAll[i] = struct{}{}
+					all[i] = struct{}{}
+					owners[i] = key.(string)
+					if i == math.MaxUint16 {
+						break
+					}
+				}
+			}
+			u.portsManager = &portsManager{ports: ports, all: userAll}
+		}
+		s.users.Store(key, u)
+		return true
+	})
+	if err == nil {
+		s.tcpOwners = owners
+	}
+	return
+}
+
+// udp 相关配置，命令行的优先级高于配置文件。udp 端口与 tcp 端口互不影响
+func (s *Server) parseUDPs() (err error) {
+	ports := make(map[uint16]struct{})
+	ranges := make([]string, 0, len(s.config.UDPs)+len(s.config.UDPRanges))
+	for _, udp := range s.config.UDPs {
+		ranges = append(ranges, udp.Range)
+	}
+	ranges = append(ranges, s.config.UDPRanges...)
+	for _, r := range ranges {
+		pr, err := util.NewPortRangeFromString(r)
+		if err != nil {
+			return err
+		}
+		for i := pr.Min; i <= pr.Max; i++ {
+			ports[i] = struct{}{}
+			if i == math.MaxUint16 {
+				break
+			}
+		}
+	}
+
+	s.udpPortsManager.ports = ports
+	s.udpPortsManager.all = make(map[uint16]struct{}, len(ports))
+	all := make(map[uint16]struct{}, len(ports))
+	for port := range ports {
+		s.udpPortsManager.all[port] = struct{}{}
+		all[port] = struct{}{}
+	}
+
+	// 处理用户 udp
+	s.users.Range(func(key, value interface{}) bool {
+		u := value.(user)
+		if u.UDPNumber == nil {
+			udpNumber := s.config.UDPNumber
+			u.UDPNumber = &udpNumber
+		}
+		if len(u.UDPs) == 0 { // 如果用户没有设置则使用全局的
+			u.udpPortsManager = &s.udpPortsManager
+		} else {
+			ports := make(map[uint16]struct{})
+			userAll := make(map[uint16]struct{})
+			for _, udp := range u.UDPs {
+				var pr util.PortRange
+				pr, err = util.NewPortRangeFromString(udp.Range)
+				if err != nil {
+					return false
+				}
+				for i := pr.Min; i <= pr.Max; i++ {
+					if _, ok := all[i]; ok {
+						err = fmt.Errorf("udp port %d is used by global", i)
+						return false
+					}
+					ports[i] = struct{}{}
+					userAll[i] = struct{}{}
 					all[i] = struct{}{}
 					if i == math.MaxUint16 {
 						break
 					}
 				}
 			}
-			u.portsManager = &portsManager{ports: ports}
+			u.udpPortsManager = &portsManager{ports: ports, all: userAll}
 		}
 		s.users.Store(key, u)
 		return true
@@ -978,6 +1288,37 @@ func (s *Server) parseTCPs() (err error) {
 	return
 }
 
+// parseUsers 解析配置文件、users 文件与命令行中的 users、tcp 与 host 配置
+func (s *Server) parseUsers() (err error) {
+	err = s.users.mergeUsers(s.config.Users, nil, nil)
+	if err != nil {
+		return
+	}
+	users := make(map[string]user)
+	err = config.Yaml2Interface(s.config.Options.Users, users)
+	if err != nil {
+		return
+	}
+	err = s.users.mergeUsers(users, s.config.IDs, s.config.Secrets)
+	if err != nil {
+		return
+	}
+	err = s.parseTCPs()
+	if err != nil {
+		return
+	}
+	err = s.parseUDPs()
+	if err != nil {
+		return
+	}
+	a, err := newACL(s.config.Allow, s.config.Deny)
+	if err != nil {
+		return
+	}
+	s.acl.Store(a)
+	return s.parseHost()
+}
+
 // host 相关配置，命令行的优先级高于配置文件
 func (s *Server) parseHost() (err error) {
 	// 合并 host regex
@@ -1011,12 +1352,30 @@ func (s *Server) parseHost() (err error) {
 	if s.config.Host.WithID == nil {
 		s.config.Host.WithID = &s.config.HostWithID
 	}
+	if s.config.Host.DomainNumber == nil {
+		s.config.Host.DomainNumber = &s.config.DomainNumber
+	}
 
 	// 提前将用户的参数设置为用户设置的值或全局的值，避免在热点代码中重复判断
 	s.users.Range(func(key, value interface{}) bool {
 		u := value.(user)
 
-		// speed
+		// speed，用户的 speed 优先级高于全局的 speedUp 与 speedDown
+		if u.SpeedUp <= 0 {
+			u.SpeedUp = u.Speed
+		}
+		if u.SpeedDown <= 0 {
+			u.SpeedDown = u.Speed
+		}
+		if u.SpeedUp <= 0 {
+			u.SpeedUp = s.config.speedUp()
+		}
+		if u.SpeedDown <= 0 {
+			u.SpeedDown = s.config.speedDown()
+		}
+		if u.SpeedBurst <= 0 {
+			u.SpeedBurst = s.config.SpeedBurst
+		}
 		if u.Speed <= 0 {
 			u.Speed = s.config.Speed
 		}
@@ -1045,6 +1404,19 @@ func (s *Server) parseHost() (err error) {
 		if u.Host.WithID == nil {
 			u.Host.WithID = s.config.Host.WithID
 		}
+		if u.Host.DomainNumber == nil {
+			u.Host.DomainNumber = s.config.Host.DomainNumber
+		}
+
+		// acl
+		u.acl, err = newACL(u.Allow, u.Deny)
+		if err != nil {
+			return false
+		}
+		u.acls, err = newUserACLs(u.ACLs)
+		if err != nil {
+			return false
+		}
 
 		s.users.Store(key, u)
 		return true
@@ -1101,6 +1473,15 @@ func (s *Server) GetAPIListenerAddrPort() (addrPort netip.AddrPort) {
 	return
 }
 
+// GetClusterListenerAddrPort 获取 cluster listener 地址，返回值可能为空
+func (s *Server) GetClusterListenerAddrPort() (addrPort netip.AddrPort) {
+	if s.cluster == nil {
+		return
+	}
+	addrPort = s.cluster.listener.Addr().(*net.TCPAddr).AddrPort()
+	return
+}
+
 // GetSTUNListenerAddrPort 获取 turn listener 地址，返回值可能为空
 func (s *Server) GetSTUNListenerAddrPort() (addrPort netip.AddrPort) {
 	if s.turnListener == nil {
@@ -0,0 +1,362 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/isrc-cas/gt/predef"
+	"github.com/isrc-cas/gt/util"
+	"github.com/pion/stun/v2"
+	"github.com/pion/turn/v3"
+)
+
+// turnCredential 生成 REST 风格的 TURN 凭证，username 为 "过期时间:id"，password 为 TURNSecret 对 username 的
+// HMAC-SHA1 的 base64，与 coturn 的 use-auth-secret 兼容
+func turnCredential(secret string, id string, expiresAt time.Time) (username, password string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + id
+	password = turnPassword(secret, username)
+	return
+}
+
+func turnPassword(secret string, username string) string {
+	h := hmac.New(sha1.New, []byte(secret))
+	h.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// parseTURNUsername 解析 "过期时间:id" 形式的 username
+func parseTURNUsername(username string) (id string, expiresAt time.Time, ok bool) {
+	i := strings.IndexByte(username, ':')
+	if i <= 0 || i == len(username)-1 {
+		return
+	}
+	expiry, err := strconv.ParseInt(username[:i], 10, 64)
+	if err != nil {
+		return
+	}
+	return username[i+1:], time.Unix(expiry, 0), true
+}
+
+// turnPendingTimeout 通过配额检查的 Allocate 请求等待 pion/turn 响应的最长时间，超时后归还预留的配额
+const turnPendingTimeout = 30 * time.Second
+
+// turnRelay 验证 TURN 凭证，按照 Allocate 请求的 username 限制每个用户同时分配的 relay 数量，并拒绝内部地址的对端
+type turnRelay struct {
+	turn.RelayAddressGenerator
+	server    *Server
+	secret    string         // 生成与验证凭证的密钥，未设置 -turnSecret 时随机生成
+	peerAllow []netip.Prefix // 允许的内部地址的对端
+
+	mtx         gosync.Mutex
+	counts      map[string]uint32         // key: id，已经分配与正在分配的 relay 数量
+	pending     map[string]turnAllocation // key: 客户端地址，还没有响应的 Allocate 请求
+	allocations map[string]turnAllocation // key: relay 地址
+	sources     map[string]string         // key: 客户端地址 value: relay 地址
+}
+
+// turnAllocation 是一个用户的 Allocate 请求或者 relay
+type turnAllocation struct {
+	id     string
+	source string    // 客户端地址
+	at     time.Time // 请求通过配额检查的时间
+}
+
+func newTURNRelay(s *Server, generator turn.RelayAddressGenerator) (r *turnRelay, err error) {
+	secret := s.config.TURNSecret
+	if len(secret) == 0 {
+		secret = util.RandomString(predef.DefaultSecretSize)
+	}
+	peerAllow, err := parseIPPrefixes(s.config.TURNPeerAllow)
+	if err != nil {
+		err = fmt.Errorf("turn peer allow (-turnPeerAllow option): %w", err)
+		return
+	}
+	r = &turnRelay{
+		RelayAddressGenerator: generator,
+		server:                s,
+		secret:                secret,
+		peerAllow:             peerAllow,
+		counts:                make(map[string]uint32),
+		pending:               make(map[string]turnAllocation),
+		allocations:           make(map[string]turnAllocation),
+		sources:               make(map[string]string),
+	}
+	return
+}
+
+// credential 生成 id 的 TURN 凭证
+func (r *turnRelay) credential(id string) (username, password string, expiresAt time.Time) {
+	expiresAt = time.Now().Add(r.server.config.TURNCredentialTTL.Duration)
+	username, password = turnCredential(r.secret, id, expiresAt)
+	return
+}
+
+// auth 是 TURN 服务的 AuthHandler，凭证未过期且 id 是已配置或已连接的用户时认证成功
+func (r *turnRelay) auth(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+	id, expiresAt, ok := parseTURNUsername(username)
+	if !ok || !time.Now().Before(expiresAt) || !r.server.turnUserExists(id) {
+		r.server.Logger.Debug().Str("username", username).Str("addr", srcAddr.String()).Msg("invalid TURN credential")
+		return nil, false
+	}
+	key = turn.GenerateAuthKey(username, realm, turnPassword(r.secret, username))
+	return
+}
+
+// packetConn 返回 TURN 服务监听的连接，Allocate 请求在到达 pion/turn 之前按照 username 检查配额，
+// Allocate 的响应中的 relay 地址被记录为该用户的 relay
+func (r *turnRelay) packetConn(conn net.PacketConn) net.PacketConn {
+	return &turnConn{PacketConn: conn, relay: r}
+}
+
+// reserve 为来自 source 的 Allocate 请求预留 id 的配额，source 已经分配 relay 时由 pion/turn 处理重传或者拒绝
+func (r *turnRelay) reserve(id string, source string) (ok bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok = r.sources[source]; ok {
+		return
+	}
+	now := time.Now()
+	for k, p := range r.pending {
+		if now.Sub(p.at) > turnPendingTimeout {
+			r.unpend(k, p)
+		}
+	}
+	if p, ok := r.pending[source]; ok {
+		if p.id == id {
+			return true
+		}
+		r.unpend(source, p)
+	}
+	quota := r.server.turnQuota(id)
+	if quota > 0 && r.counts[id] >= uint32(quota) {
+		return false
+	}
+	r.counts[id]++
+	r.pending[source] = turnAllocation{id: id, source: source, at: now}
+	return true
+}
+
+// allocated 在 Allocate 请求成功时把预留的配额记录为 relay，失败时归还
+func (r *turnRelay) allocated(source string, relay string, ok bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	p, found := r.pending[source]
+	if !found {
+		return
+	}
+	if !ok {
+		r.unpend(source, p)
+		return
+	}
+	delete(r.pending, source)
+	r.allocations[relay] = p
+	r.sources[source] = relay
+	r.server.Logger.Debug().Str("id", p.id).Str("relay", relay).Msg("TURN relay allocated")
+}
+
+func (r *turnRelay) unpend(source string, p turnAllocation) {
+	delete(r.pending, source)
+	r.decrease(p.id)
+}
+
+func (r *turnRelay) decrease(id string) {
+	if r.counts[id] <= 1 {
+		delete(r.counts, id)
+		return
+	}
+	r.counts[id]--
+}
+
+// release 在 relay 被关闭时归还用户的配额
+func (r *turnRelay) release(relay string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	a, ok := r.allocations[relay]
+	if !ok {
+		return
+	}
+	delete(r.allocations, relay)
+	delete(r.sources, a.source)
+	r.decrease(a.id)
+}
+
+// AllocatePacketConn 分配 relay，relay 关闭时归还所属用户的配额
+func (r *turnRelay) AllocatePacketConn(network string, requestedPort int) (conn net.PacketConn, addr net.Addr, err error) {
+	conn, addr, err = r.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return
+	}
+	relay := addr.String()
+	conn = &turnRelayConn{PacketConn: conn, release: func() { r.release(relay) }}
+	return
+}
+
+// permit 是 TURN 服务的 PermissionHandler，拒绝 loopback、私有与 link-local 等内部地址的对端，避免 relay 被用于访问内网，
+// -turnPeerAllow 中的地址除外
+func (r *turnRelay) permit(clientAddr net.Addr, peerIP net.IP) bool {
+	addr, ok := netip.AddrFromSlice(peerIP)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.peerAllow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if util.IsInternalIP(addr) {
+		r.server.Logger.Debug().Str("client", clientAddr.String()).Str("peer", addr.String()).Msg("TURN peer denied")
+		return false
+	}
+	return true
+}
+
+var (
+	turnAllocateRequest = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+	turnAllocateSuccess = stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse)
+	turnAllocateError   = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+)
+
+// turnConn 是 TURN 服务监听的连接，只解析 Allocate 的请求与响应，其他数据原样传递
+type turnConn struct {
+	net.PacketConn
+	relay *turnRelay
+}
+
+func (c *turnConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || c.allow(p[:n], addr) {
+			return
+		}
+	}
+}
+
+// allow 检查 Allocate 请求的 username 中的用户的配额，超过时直接响应 486 Allocation Quota Reached。
+// 没有 username 或者 username 无效的请求由 pion/turn 认证
+func (c *turnConn) allow(p []byte, src net.Addr) bool {
+	m, ok := decodeSTUN(p, turnAllocateRequest)
+	if !ok {
+		return true
+	}
+	var username stun.Username
+	if username.GetFrom(m) != nil {
+		return true
+	}
+	id, _, ok := parseTURNUsername(username.String())
+	if !ok || c.relay.reserve(id, src.String()) {
+		return true
+	}
+	c.relay.server.Logger.Info().Str("id", id).Uint16("quota", c.relay.server.turnQuota(id)).Msg("TURN relay quota reached")
+	resp, err := stun.Build(stun.NewTransactionIDSetter(m.TransactionID), turnAllocateError,
+		stun.CodeAllocQuotaReached, stun.Fingerprint)
+	if err == nil {
+		_, _ = c.PacketConn.WriteTo(resp.Raw, src)
+	}
+	return false
+}
+
+func (c *turnConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if m, ok := decodeSTUN(p, turnAllocateSuccess); ok {
+		var relayed stun.XORMappedAddress
+		if relayed.GetFromAs(m, stun.AttrXORRelayedAddress) == nil {
+			c.relay.allocated(addr.String(), (&net.UDPAddr{IP: relayed.IP, Port: relayed.Port}).String(), true)
+		}
+	} else if _, ok = decodeSTUN(p, turnAllocateError); ok {
+		c.relay.allocated(addr.String(), "", false)
+	}
+	return
+}
+
+// decodeSTUN 解析类型为 t 的 STUN 消息，其他数据不解析
+func decodeSTUN(p []byte, t stun.MessageType) (m *stun.Message, ok bool) {
+	if !stun.IsMessage(p) || binary.BigEndian.Uint16(p) != t.Value() {
+		return
+	}
+	m = &stun.Message{Raw: append([]byte(nil), p...)}
+	ok = m.Decode() == nil
+	return
+}
+
+// turnRelayConn 在 allocation 被删除关闭 relay 时归还用户的配额
+type turnRelayConn struct {
+	net.PacketConn
+	release   func()
+	closeOnce gosync.Once
+}
+
+func (c *turnRelayConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.PacketConn.Close()
+}
+
+func (s *Server) turnUserExists(id string) (ok bool) {
+	if len(id) == 0 {
+		return
+	}
+	_, ok = s.users.Load(id)
+	if !ok {
+		// 认证 API 认证的用户不在 users 中
+		_, ok = s.id2Client.Load(id)
+	}
+	return
+}
+
+// turnQuota 返回用户同时分配的 relay 数量上限，0 表示不限制
+func (s *Server) turnQuota(id string) uint16 {
+	if v, ok := s.users.Load(id); ok {
+		if u := v.(user); u.TURNQuota != nil {
+			return *u.TURNQuota
+		}
+	}
+	s.configRWMtx.RLock()
+	defer s.configRWMtx.RUnlock()
+	return s.config.TURNQuota
+}
+
+// sendTURNCredential 向使用安全握手的客户端发送 TURN 凭证，旧版本的客户端不能解析该信号
+func (c *conn) sendTURNCredential(id string) {
+	if c.server.turnRelay == nil || c.handshake.version != predef.SecureHandshake {
+		return
+	}
+	username, password, expiresAt := c.server.turnRelay.credential(id)
+	err := c.SendInfoTURNCredential(username, password)
+	if err != nil {
+		c.Logger.Warn().Err(err).Msg("failed to send TURN credential")
+		return
+	}
+	c.turnSentAt = time.Now()
+	c.Logger.Debug().Time("expiresAt", expiresAt).Msg("sent TURN credential")
+}
+
+// renewTURNCredential 在凭证的有效期过半时发送新的凭证
+func (c *conn) renewTURNCredential(id string) {
+	if c.turnSentAt.IsZero() || time.Since(c.turnSentAt) < c.server.config.TURNCredentialTTL.Duration/2 {
+		return
+	}
+	c.sendTURNCredential(id)
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v2"
+	"github.com/pion/turn/v3"
+)
+
+type testRelayGenerator struct{}
+
+func (testRelayGenerator) Validate() error {
+	return nil
+}
+
+func (testRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.LocalAddr(), nil
+}
+
+func (testRelayGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("not supported")
+}
+
+func TestTURNCredential(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 0)
+	username, password := turnCredential("secret", "id1", expiresAt)
+	if username != "1700000000:id1" {
+		t.Fatal(username)
+	}
+	if password != turnPassword("secret", username) || password == turnPassword("secret2", username) {
+		t.Fatal("unexpected password", password)
+	}
+	id, e, ok := parseTURNUsername(username)
+	if !ok || id != "id1" || !e.Equal(expiresAt) {
+		t.Fatal(id, e, ok)
+	}
+	id, _, ok = parseTURNUsername("1700000000:id:with:colons")
+	if !ok || id != "id:with:colons" {
+		t.Fatal(id, ok)
+	}
+	for _, username := range []string{"", "id1", ":id1", "1700000000:", "abc:id1"} {
+		if _, _, ok := parseTURNUsername(username); ok {
+			t.Fatalf("%q should be invalid", username)
+		}
+	}
+}
+
+func TestTURNRelayAuth(t *testing.T) {
+	conf := defaultConfig()
+	conf.TURNSecret = "secret"
+	s := &Server{config: conf}
+	s.users.Store("id1", user{Secret: "secret1"})
+	r, err := newTURNRelay(s, testRelayGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	auth := func(id string, expiresAt time.Time) bool {
+		username, password := turnCredential("secret", id, expiresAt)
+		key, ok := r.auth(username, "realm", src)
+		if ok && string(key) != string(turn.GenerateAuthKey(username, "realm", password)) {
+			t.Fatal("unexpected key")
+		}
+		return ok
+	}
+	if auth("id1", time.Now().Add(-time.Second)) {
+		t.Fatal("expired credential should be rejected")
+	}
+	if auth("id3", time.Now().Add(time.Hour)) {
+		t.Fatal("unknown user should be rejected")
+	}
+	if !auth("id1", time.Now().Add(time.Hour)) {
+		t.Fatal("valid credential should be accepted")
+	}
+}
+
+// testRelayedAddress 设置 XOR-RELAYED-ADDRESS，模拟 pion/turn 的 Allocate 成功响应
+type testRelayedAddress struct {
+	stun.XORMappedAddress
+}
+
+func (a testRelayedAddress) AddTo(m *stun.Message) error {
+	return a.AddToAs(m, stun.AttrXORRelayedAddress)
+}
+
+func TestTURNRelayQuota(t *testing.T) {
+	conf := defaultConfig()
+	conf.TURNSecret = "secret"
+	conf.TURNQuota = 1
+	s := &Server{config: conf}
+	two := uint16(2)
+	s.users.Store("id1", user{Secret: "secret1"})
+	s.users.Store("id2", user{Secret: "secret2", TURNQuota: &two})
+	r, err := newTURNRelay(s, testRelayGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn := r.packetConn(l)
+
+	newClient := func() net.PacketConn {
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+	// send 发送 req，返回 req 是否被转发给 pion/turn，没有转发时客户端应该收到 486
+	send := func(client net.PacketConn, req *stun.Message) bool {
+		if _, err := client.WriteTo(req.Raw, l.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		_ = l.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, addr, err := conn.ReadFrom(buf)
+		if err == nil {
+			if !bytes.Equal(buf[:n], req.Raw) || addr.String() != client.LocalAddr().String() {
+				t.Fatal("unexpected request", buf[:n], addr)
+			}
+			return true
+		}
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err = client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &stun.Message{Raw: buf[:n]}
+		var code stun.ErrorCodeAttribute
+		if err = resp.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Type != turnAllocateError || resp.TransactionID != req.TransactionID ||
+			code.GetFrom(resp) != nil || code.Code != stun.CodeAllocQuotaReached {
+			t.Fatal("unexpected response", resp)
+		}
+		return false
+	}
+	request := func(id string) *stun.Message {
+		username, _, _ := r.credential(id)
+		return stun.MustBuild(stun.TransactionID, turnAllocateRequest, stun.NewUsername(username), stun.Fingerprint)
+	}
+	// write 发送 pion/turn 的响应，客户端应该原样收到
+	write := func(client net.PacketConn, resp *stun.Message) {
+		if _, err := conn.WriteTo(resp.Raw, client.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], resp.Raw) {
+			t.Fatal("unexpected response", buf[:n], err)
+		}
+	}
+	// respond 模拟 pion/turn 分配 relay 并响应 req
+	respond := func(client net.PacketConn, req *stun.Message) net.PacketConn {
+		relay, addr, err := r.AllocatePacketConn("udp4", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = relay.Close() })
+		a := addr.(*net.UDPAddr)
+		resp := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), turnAllocateSuccess,
+			testRelayedAddress{stun.XORMappedAddress{IP: a.IP, Port: a.Port}}, stun.Fingerprint)
+		write(client, resp)
+		return relay
+	}
+	reject := func(client net.PacketConn, req *stun.Message) {
+		resp := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), turnAllocateError,
+			stun.CodeInsufficientCapacity, stun.Fingerprint)
+		write(client, resp)
+	}
+
+	// 非 STUN 数据与没有 username 的请求由 pion/turn 处理
+	c1, c2, c3 := newClient(), newClient(), newClient()
+	if !send(c1, &stun.Message{Raw: []byte("data")}) ||
+		!send(c1, stun.MustBuild(stun.TransactionID, turnAllocateRequest, stun.Fingerprint)) {
+		t.Fatal("request without username should be forwarded")
+	}
+
+	// 重传的请求不重复计算配额
+	req1 := request("id1")
+	if !send(c1, req1) || !send(c1, req1) {
+		t.Fatal("request of the first relay should be forwarded")
+	}
+	if send(c2, request("id1")) {
+		t.Fatal("the global quota should be used")
+	}
+	relay1 := respond(c1, req1)
+	if send(c2, request("id1")) {
+		t.Fatal("the allocated relay should be counted")
+	}
+	// 重复关闭只归还一次配额
+	_ = relay1.Close()
+	_ = relay1.Close()
+	req2 := request("id1")
+	if !send(c2, req2) {
+		t.Fatal("the quota should be released after the relay is closed")
+	}
+	// 失败的请求归还配额
+	reject(c2, req2)
+	req3 := request("id1")
+	if !send(c3, req3) {
+		t.Fatal("the quota should be released after the allocation failed")
+	}
+	respond(c3, req3)
+	if send(c1, request("id1")) {
+		t.Fatal("the quota should be reached")
+	}
+
+	c4, c5, c6 := newClient(), newClient(), newClient()
+	for _, c := range []net.PacketConn{c4, c5} {
+		req := request("id2")
+		if !send(c, req) {
+			t.Fatal("the quota of the user should be used")
+		}
+		respond(c, req)
+	}
+	if send(c6, request("id2")) {
+		t.Fatal("the quota of the user should be reached")
+	}
+}
+
+func TestTURNRelayPermit(t *testing.T) {
+	conf := defaultConfig()
+	conf.TURNPeerAllow = []string{"10.1.0.0/16"}
+	s := &Server{config: conf}
+	r, err := newTURNRelay(s, testRelayGenerator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "::ffff:127.0.0.1"} {
+		if r.permit(client, net.ParseIP(ip)) {
+			t.Fatalf("%s should be denied", ip)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "2001:4860:4860::8888", "10.1.2.3"} {
+		if !r.permit(client, net.ParseIP(ip)) {
+			t.Fatalf("%s should be permitted", ip)
+		}
+	}
+
+	s.config.TURNPeerAllow = []string{"invalid"}
+	if _, err = newTURNRelay(s, testRelayGenerator{}); err == nil {
+		t.Fatal("invalid peer allow should be rejected")
+	}
+}
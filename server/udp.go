@@ -0,0 +1,488 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	connection "github.com/isrc-cas/gt/conn"
+	"github.com/isrc-cas/gt/pool"
+	"github.com/isrc-cas/gt/predef"
+)
+
+// udpSessionQueueSize 每个访问者会话缓存的数据报数量，队列满时丢弃新的数据报
+const udpSessionQueueSize = 64
+
+type openUDPOption openTCPOption
+
+// udpListener 客户端的 udp 服务在服务端打开的端口，每个访问者地址对应一个会话，每个会话是隧道中的一个任务
+type udpListener struct {
+	conn *net.UDPConn
+	port openUDPOption
+	pm   atomic.Pointer[portsManager] // 分配端口的 portsManager
+	done chan struct{}
+
+	sessions    map[string]*udpSession // key: 访问者地址
+	sessionsMtx sync.Mutex
+}
+
+func (l *udpListener) releasePort(port uint16) {
+	pm := l.pm.Load()
+	if pm != nil {
+		pm.release(port)
+	}
+}
+
+func (l *udpListener) close() {
+	_ = l.conn.Close()
+	l.sessionsMtx.Lock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.sessionsMtx.Unlock()
+	for _, s := range sessions {
+		_ = s.Close()
+	}
+}
+
+// session 返回访问者地址对应的会话，created 表示会话是新建的
+func (l *udpListener) session(peer *net.UDPAddr) (s *udpSession, created bool) {
+	key := peer.String()
+	l.sessionsMtx.Lock()
+	defer l.sessionsMtx.Unlock()
+	s, ok := l.sessions[key]
+	if ok {
+		return
+	}
+	s = &udpSession{
+		listener:        l,
+		peer:            peer,
+		packets:         make(chan []byte, udpSessionQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}, 1),
+	}
+	s.active()
+	l.sessions[key] = s
+	created = true
+	return
+}
+
+func (l *udpListener) removeSession(s *udpSession) {
+	l.sessionsMtx.Lock()
+	if l.sessions[s.peer.String()] == s {
+		delete(l.sessions, s.peer.String())
+	}
+	l.sessionsMtx.Unlock()
+}
+
+// expireLoop 关闭空闲时间超过 timeout 的会话
+func (l *udpListener) expireLoop(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			var expired []*udpSession
+			l.sessionsMtx.Lock()
+			for _, s := range l.sessions {
+				if now.Sub(time.Unix(0, s.lastActive.Load())) >= timeout {
+					expired = append(expired, s)
+				}
+			}
+			l.sessionsMtx.Unlock()
+			for _, s := range expired {
+				_ = s.Close()
+			}
+		}
+	}
+}
+
+// udpSession 一个访问者地址的 udp 会话，每次 Read 与 Write 一个数据报
+type udpSession struct {
+	listener   *udpListener
+	peer       *net.UDPAddr
+	packets    chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+	lastActive atomic.Int64
+
+	deadline        time.Time
+	deadlineMtx     sync.Mutex
+	deadlineChanged chan struct{}
+}
+
+func (s *udpSession) active() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// push 缓存访问者发送的数据报，队列满时丢弃
+func (s *udpSession) push(p []byte) {
+	s.active()
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case s.packets <- b:
+	default:
+	}
+}
+
+func (s *udpSession) Read(p []byte) (n int, err error) {
+	for {
+		s.deadlineMtx.Lock()
+		dl := s.deadline
+		s.deadlineMtx.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !dl.IsZero() {
+			d := time.Until(dl)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case b := <-s.packets:
+			n = copy(p, b)
+		case <-s.closed:
+			err = io.EOF
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-s.deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return
+	}
+}
+
+func (s *udpSession) Write(p []byte) (n int, err error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	s.active()
+	return s.listener.conn.WriteToUDP(p, s.peer)
+}
+
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.listener.removeSession(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.listener.conn.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.peer
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.deadlineMtx.Lock()
+	s.deadline = t
+	s.deadlineMtx.Unlock()
+	select {
+	case s.deadlineChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline 发送数据报不会阻塞
+func (s *udpSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *client) openUDPPort(serviceIndex uint16, l *udpListener, tunnel *conn) (openedUDPPort uint16, err error) {
+	udpPort := l.port.port
+	random := l.port.random
+
+	c.udpPortsManager.portsMtx.Lock()
+	defer c.udpPortsManager.portsMtx.Unlock()
+	if len(c.udpPortsManager.ports) == 0 {
+		err = errors.New("no available udp port")
+		return
+	}
+
+	if _, ok := c.udpPortsManager.ports[udpPort]; ok {
+		err = c.openSpecifiedUDPPort(serviceIndex, l, udpPort, tunnel)
+		if err == nil {
+			openedUDPPort = udpPort
+			delete(c.udpPortsManager.ports, udpPort)
+			return
+		}
+	}
+	tunnel.Logger.Warn().Err(err).Uint16("port", udpPort).Msg("failed to open the udp port user asked")
+	if !random {
+		err = fmt.Errorf("user disable random udp port when %w", err)
+		return
+	}
+
+	retry := 0
+	for udpPort := range c.udpPortsManager.ports {
+		err = c.openSpecifiedUDPPort(serviceIndex, l, udpPort, tunnel)
+		if err == nil {
+			openedUDPPort = udpPort
+			delete(c.udpPortsManager.ports, udpPort)
+			return
+		}
+		tunnel.Logger.Warn().Err(err).Msg("failed to open udp port")
+		retry++
+		if retry >= 3 {
+			break
+		}
+	}
+	err = errors.New("failed to open random udp port")
+	return
+}
+
+func (c *client) openSpecifiedUDPPort(serviceIndex uint16, l *udpListener, udpPort uint16, tunnel *conn) error {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(udpPort)})
+	if err != nil {
+		return err
+	}
+	tunnel.Logger.Info().Uint16("port", udpPort).Msg("udp port opened")
+	l.conn = udpConn
+	l.done = make(chan struct{})
+	l.sessions = make(map[string]*udpSession)
+	l.pm.Store(c.udpPortsManager)
+
+	s := tunnel.server
+	if timeout := s.config.UDPTimeout.Duration; timeout > 0 {
+		go l.expireLoop(timeout)
+	}
+	go c.udpReadLoop(s, l, serviceIndex, udpPort)
+	return nil
+}
+
+// udpReadLoop 读取访问者发送的数据报，为新的访问者地址创建任务
+func (c *client) udpReadLoop(s *Server, l *udpListener, serviceIndex uint16, udpPort uint16) {
+	logger := c.logger.With().Uint16("serviceIndex", serviceIndex).Uint16("udpPort", udpPort).Logger()
+	logger.Info().Msg("udp forward start")
+	var err error
+	defer func() {
+		if !predef.Debug {
+			if e := recover(); e != nil {
+				logger.Error().Msgf("recovered panic: %#v\n%s", e, debug.Stack())
+			}
+		}
+		if errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+		logger.Info().Err(err).Msg("udp forward stop")
+	}()
+	buf := make([]byte, connection.MaxDatagramSize)
+	for {
+		var n int
+		var peer *net.UDPAddr
+		n, peer, err = l.conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		session, created := l.session(peer)
+		session.push(buf[:n])
+		if created {
+			go c.handleUDPSession(s, session, serviceIndex, udpPort)
+		}
+	}
+}
+
+func (c *client) handleUDPSession(s *Server, session *udpSession, serviceIndex uint16, udpPort uint16) {
+	conn := newConn(connection.NewDatagramConn(session), s)
+	conn.serviceIndex = serviceIndex
+	conn.hostPrefix = "udp:" + strconv.Itoa(int(udpPort))
+	reader := pool.GetReader(conn.Conn)
+	conn.Reader = reader
+	defer func() {
+		conn.Close()
+		pool.PutReader(reader)
+		if !predef.Debug {
+			if e := recover(); e != nil {
+				conn.Logger.Error().Msgf("recovered panic: %#v\n%s", e, debug.Stack())
+			}
+		}
+		conn.Logger.Info().Msg("closed")
+	}()
+	// 被拒绝的访问者在会话过期之前发送的数据报都被丢弃，不会重复记录
+	if !conn.allowVisitor(clientWithServiceIndex{client: c, serviceIndex: serviceIndex}) {
+		_, _ = io.Copy(io.Discard, session)
+		return
+	}
+	// 与 tcp 连接相同，任务开始时至少缓存了 2 字节，即第一个数据报的长度
+	_, err := reader.Peek(2)
+	if err != nil {
+		return
+	}
+	err = c.process(conn)
+	if err != nil {
+		conn.Logger.Error().Err(err).Msg("udp handle")
+	}
+}
+
+func (c *client) closeUDPListeners() {
+	c.udpListeners.Range(func(key, value interface{}) bool {
+		l, ok := value.(*udpListener)
+		if ok && l.conn != nil {
+			port := uint16(l.conn.LocalAddr().(*net.UDPAddr).Port)
+			c.logger.Info().
+				Interface("serviceIndex", key).
+				Uint16("port", port).
+				Msg("close associated udp listener")
+			l.releasePort(port)
+			l.close()
+		}
+		return true
+	})
+}
+
+func (c *client) udpListenersLen() (n int) {
+	c.udpListeners.Range(func(key, value interface{}) bool {
+		l, ok := value.(*udpListener)
+		if ok && l.conn != nil {
+			n++
+		}
+		return true
+	})
+	return
+}
+
+func (c *client) deleteUDPListener(si uint16) {
+	value, loaded := c.udpListeners.LoadAndDelete(si)
+	if !loaded {
+		return
+	}
+	l, ok := value.(*udpListener)
+	if ok && l.conn != nil {
+		port := uint16(l.conn.LocalAddr().(*net.UDPAddr).Port)
+		c.logger.Info().
+			Uint16("serviceIndex", si).
+			Uint16("port", port).
+			Msg("close associated udp listener")
+		l.releasePort(port)
+		l.close()
+	}
+}
+
+func (c *client) rangeOpenedUDPPorts(f func(port uint16, l *udpListener)) {
+	c.udpListeners.Range(func(key, value interface{}) bool {
+		l, ok := value.(*udpListener)
+		if ok && l.conn != nil {
+			f(uint16(l.conn.LocalAddr().(*net.UDPAddr).Port), l)
+		}
+		return true
+	})
+}
+
+func (c *conn) processUDPOptions(o options, cli *client) (err error) {
+	var success []uint16
+	defer func() {
+		if err != nil {
+			for _, si := range success {
+				cli.deleteUDPListener(si)
+			}
+		}
+	}()
+	for si, portOption := range o.udpPorts {
+		v, ok := cli.udpListeners.LoadOrCreate(si, func() interface{} {
+			return &udpListener{
+				port: portOption,
+			}
+		})
+		vl := v.(*udpListener)
+		if ok && vl.conn != nil {
+			port := vl.conn.LocalAddr().(*net.UDPAddr).Port
+			if port == int(portOption.port) || portOption.random {
+				if err := c.SendInfoUDPPortOpened(si, uint16(port)); err != nil {
+					c.Logger.Error().Err(err).Msg("failed to send InfoUDPPortOpened signal")
+				}
+				continue
+			}
+			cli.logger.Info().
+				Uint16("serviceIndex", si).
+				Int("port", port).
+				Msg("close associated udp listener")
+			vl.releasePort(uint16(port))
+			vl.close()
+			vl.port = portOption
+		}
+
+		var openedPort uint16
+		openedPort, err = cli.openUDPPort(si, vl, c)
+		if err == nil {
+			success = append(success, si)
+		} else {
+			c.server.metrics.reject(connection.ErrFailedToOpenUDPPort)
+			c.Logger.Error().Err(err).
+				Uint16("port", portOption.port).
+				Bool("random", portOption.random).
+				AnErr("respErr", c.SendErrorSignalFailedToOpenUDPPort(si)).
+				Msg("failed to open udp port")
+			return err
+		}
+		if err := c.SendInfoUDPPortOpened(si, openedPort); err != nil {
+			c.Logger.Error().Err(err).Msg("failed to send InfoUDPPortOpened signal")
+		}
+	}
+
+	// 关闭不再需要的 udp 端口
+	var oldServiceIndexes []uint16
+	cli.udpListeners.Range(func(key, value any) bool {
+		si := key.(uint16)
+		_, ok := o.udpPorts[si]
+		if !ok {
+			oldServiceIndexes = append(oldServiceIndexes, si)
+		}
+		return true
+	})
+	for _, si := range oldServiceIndexes {
+		cli.deleteUDPListener(si)
+	}
+	return
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUDPSession(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &udpListener{
+		conn:     conn,
+		done:     make(chan struct{}),
+		sessions: make(map[string]*udpSession),
+	}
+	defer l.close()
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	s, created := l.session(peer)
+	if !created {
+		t.Fatal("session should be created")
+	}
+	if s2, created := l.session(peer); created || s2 != s {
+		t.Fatal("session should be reused")
+	}
+
+	s.push([]byte("hello"))
+	buf := make([]byte, 100)
+	n, err := s.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("invalid datagram %q: %v", buf[:n], err)
+	}
+
+	// 读取超时
+	err = s.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("deadline exceeded is expected, but got %v", err)
+	}
+	err = s.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 空闲的会话被关闭并从 listener 中移除
+	go l.expireLoop(100 * time.Millisecond)
+	_, err = s.Read(buf)
+	if err != io.EOF {
+		t.Fatalf("EOF is expected, but got %v", err)
+	}
+	l.sessionsMtx.Lock()
+	sessions := len(l.sessions)
+	l.sessionsMtx.Unlock()
+	if sessions != 0 {
+		t.Fatalf("%d sessions left", sessions)
+	}
+	if _, created = l.session(peer); !created {
+		t.Fatal("a new session should be created after the old one expired")
+	}
+}
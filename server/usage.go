@@ -0,0 +1,293 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/isrc-cas/gt/server/sync"
+)
+
+// usageDurationBuckets 任务耗时直方图各个桶的上界，另有一个 +Inf 桶
+var usageDurationBuckets = [...]time.Duration{
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// usage 记录一个 host 前缀的用量
+type usage struct {
+	up          atomic.Uint64 // 客户端上行，即从 client 发往访问者的数据
+	down        atomic.Uint64 // 客户端下行，即从访问者发往 client 的数据
+	tasks       atomic.Uint64
+	durationSum atomic.Int64 // 单位：纳秒
+	durations   [len(usageDurationBuckets) + 1]atomic.Uint64
+}
+
+func (u *usage) observe(d time.Duration) {
+	u.durationSum.Add(int64(d))
+	i := sort.Search(len(usageDurationBuckets), func(i int) bool {
+		return d <= usageDurationBuckets[i]
+	})
+	u.durations[i].Add(1)
+}
+
+func (u *usage) counters() (c UsageCounters) {
+	c.Up = u.up.Load()
+	c.Down = u.down.Load()
+	c.Tasks = u.tasks.Load()
+	c.DurationSum = time.Duration(u.durationSum.Load()).Seconds()
+	c.DurationBuckets = make([]UsageBucket, 0, len(u.durations))
+	var count uint64
+	for i := range u.durations {
+		count += u.durations[i].Load()
+		le := "+Inf"
+		if i < len(usageDurationBuckets) {
+			le = usageDurationBuckets[i].String()
+		}
+		c.DurationBuckets = append(c.DurationBuckets, UsageBucket{LE: le, Count: count})
+	}
+	return
+}
+
+// clientUsage 记录一个 id 的用量，client 断开重连后继续累加
+type clientUsage struct {
+	prefixes sync.Map // key: hostPrefix(string) value: *usage
+}
+
+func (cu *clientUsage) get(hostPrefix string) *usage {
+	value, _ := cu.prefixes.LoadOrCreate(hostPrefix, func() interface{} {
+		return &usage{}
+	})
+	return value.(*usage)
+}
+
+func (cu *clientUsage) rangePrefixes(f func(hostPrefix string, u *usage)) {
+	var prefixes []string
+	cu.prefixes.Range(func(key, value interface{}) bool {
+		prefixes = append(prefixes, key.(string))
+		return true
+	})
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		value, ok := cu.prefixes.Load(prefix)
+		if ok {
+			f(prefix, value.(*usage))
+		}
+	}
+}
+
+func (s *Server) getOrCreateUsage(id string) *clientUsage {
+	value, _ := s.usages.LoadOrCreate(id, func() interface{} {
+		return &clientUsage{}
+	})
+	return value.(*clientUsage)
+}
+
+func (s *Server) rangeUsages(f func(id string, cu *clientUsage)) {
+	var ids []string
+	s.usages.Range(func(key, value interface{}) bool {
+		ids = append(ids, key.(string))
+		return true
+	})
+	sort.Strings(ids)
+	for _, id := range ids {
+		value, ok := s.usages.Load(id)
+		if ok {
+			f(id, value.(*clientUsage))
+		}
+	}
+}
+
+// UsageBucket is a bucket of the task duration histogram. Count is cumulative.
+type UsageBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// UsageCounters holds the accounting counters since the server started.
+type UsageCounters struct {
+	Up              uint64        `json:"up"`
+	Down            uint64        `json:"down"`
+	Tasks           uint64        `json:"tasks"`
+	DurationSum     float64       `json:"durationSum"` // 单位：秒
+	DurationBuckets []UsageBucket `json:"durationBuckets"`
+}
+
+// sub 返回 c 相对于之前的计数 o 的增量
+func (c *UsageCounters) sub(o UsageCounters) (d UsageCounters) {
+	d.Up = c.Up - o.Up
+	d.Down = c.Down - o.Down
+	d.Tasks = c.Tasks - o.Tasks
+	d.DurationSum = c.DurationSum - o.DurationSum
+	d.DurationBuckets = make([]UsageBucket, len(c.DurationBuckets))
+	copy(d.DurationBuckets, c.DurationBuckets)
+	for i := range o.DurationBuckets {
+		d.DurationBuckets[i].Count -= o.DurationBuckets[i].Count
+	}
+	return
+}
+
+func (c *UsageCounters) isZero() bool {
+	return c.Up == 0 && c.Down == 0 && c.Tasks == 0 && c.DurationSum == 0
+}
+
+func (c *UsageCounters) add(o UsageCounters) {
+	c.Up += o.Up
+	c.Down += o.Down
+	c.Tasks += o.Tasks
+	c.DurationSum += o.DurationSum
+	if c.DurationBuckets == nil {
+		c.DurationBuckets = make([]UsageBucket, len(o.DurationBuckets))
+		copy(c.DurationBuckets, o.DurationBuckets)
+		return
+	}
+	for i := range o.DurationBuckets {
+		c.DurationBuckets[i].Count += o.DurationBuckets[i].Count
+	}
+}
+
+// PrefixUsage is the usage of a host prefix.
+type PrefixUsage struct {
+	Prefix string `json:"prefix"`
+	UsageCounters
+}
+
+// Usage is the usage of a client id and its host prefixes.
+type Usage struct {
+	ID string `json:"id"`
+	UsageCounters
+	Prefixes []PrefixUsage `json:"prefixes"`
+}
+
+// GetUsage returns the usage of the client id, returns the usage of all clients when id is empty.
+func (s *Server) GetUsage(id string) (result []Usage) {
+	s.rangeUsages(func(cid string, cu *clientUsage) {
+		if len(id) > 0 && id != cid {
+			return
+		}
+		u := Usage{ID: cid}
+		cu.rangePrefixes(func(hostPrefix string, pu *usage) {
+			c := pu.counters()
+			u.add(c)
+			u.Prefixes = append(u.Prefixes, PrefixUsage{Prefix: hostPrefix, UsageCounters: c})
+		})
+		result = append(result, u)
+	})
+	return
+}
+
+// usageRecord 是 usageFile 中的一行，记录的是 Since 到 Time 之间的用量增量，
+// 所以把各行相加即可得到总用量，服务端重启也不会重复计算
+type usageRecord struct {
+	Time  time.Time `json:"time"`
+	Since time.Time `json:"since"`
+	Usage
+}
+
+// usageKey 标识一个 id 的一个 host 前缀
+type usageKey struct {
+	id     string
+	prefix string
+}
+
+// startUsageFlush 定期把用量以 JSONL 格式追加到 usageFile 中
+func (s *Server) startUsageFlush() (err error) {
+	s.usageFile, err = os.OpenFile(s.config.UsageFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+	s.usageDone = make(chan struct{})
+	s.usageFlushed = make(chan struct{})
+	s.usageLast = make(map[usageKey]UsageCounters)
+	s.usageSince = time.Now()
+	interval := s.config.UsageFlushInterval.Duration
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		defer close(s.usageFlushed)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flushUsage(); err != nil {
+					s.Logger.Warn().Err(err).Msg("failed to flush usage")
+				}
+			case <-s.usageDone:
+				if err := s.flushUsage(); err != nil {
+					s.Logger.Warn().Err(err).Msg("failed to flush usage")
+				}
+				return
+			}
+		}
+	}()
+	return
+}
+
+// flushUsage 追加上次写入之后的用量增量，没有用量的 id 与 host 前缀会被忽略
+func (s *Server) flushUsage() (err error) {
+	now := time.Now()
+	w := bufio.NewWriter(s.usageFile)
+	encoder := json.NewEncoder(w)
+	last := make(map[usageKey]UsageCounters, len(s.usageLast))
+	for _, u := range s.GetUsage("") {
+		r := usageRecord{Time: now, Since: s.usageSince, Usage: Usage{ID: u.ID}}
+		for _, p := range u.Prefixes {
+			key := usageKey{id: u.ID, prefix: p.Prefix}
+			last[key] = p.UsageCounters
+			d := p.sub(s.usageLast[key])
+			if d.isZero() {
+				continue
+			}
+			r.add(d)
+			r.Prefixes = append(r.Prefixes, PrefixUsage{Prefix: p.Prefix, UsageCounters: d})
+		}
+		if len(r.Prefixes) == 0 {
+			continue
+		}
+		err = encoder.Encode(r)
+		if err != nil {
+			return
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return
+	}
+	// 写入成功后才更新，失败时的增量会在下次写入
+	s.usageLast = last
+	s.usageSince = now
+	return
+}
+
+func (s *Server) stopUsageFlush() (err error) {
+	if s.usageDone == nil {
+		return
+	}
+	close(s.usageDone)
+	<-s.usageFlushed
+	return s.usageFile.Close()
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsage(t *testing.T) {
+	usageFile := filepath.Join(t.TempDir(), "usage.jsonl")
+	s, err := New([]string{"server", "-usageFile", usageFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.startUsageFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := s.getOrCreateClient("id1", newClient)
+	c.init("id1", user{}, s)
+	a := c.usage.get("a")
+	a.up.Add(10)
+	a.down.Add(20)
+	a.tasks.Add(2)
+	a.observe(50 * time.Millisecond)
+	a.observe(2 * time.Second)
+	b := c.usage.get("tcp:8080")
+	b.up.Add(1)
+	b.tasks.Add(1)
+	b.observe(time.Hour)
+
+	// client 重新连接后继续使用之前的用量
+	s.removeClientOnly("id1")
+	c, _ = s.getOrCreateClient("id1", newClient)
+	c.init("id1", user{}, s)
+	if c.usage.get("a") != a {
+		t.Fatal("usage is lost after reconnecting")
+	}
+
+	s.getOrCreateUsage("id2")
+	if len(s.GetUsage("")) != 2 {
+		t.Fatal("invalid usage number")
+	}
+	result := s.GetUsage("id1")
+	if len(result) != 1 {
+		t.Fatal("invalid usage number")
+	}
+	u := result[0]
+	if u.ID != "id1" || u.Up != 11 || u.Down != 20 || u.Tasks != 3 || len(u.Prefixes) != 2 {
+		t.Fatalf("invalid usage %#v", u)
+	}
+	if u.Prefixes[0].Prefix != "a" || u.Prefixes[1].Prefix != "tcp:8080" {
+		t.Fatalf("invalid prefixes %#v", u.Prefixes)
+	}
+	buckets := u.DurationBuckets
+	if len(buckets) != len(usageDurationBuckets)+1 {
+		t.Fatalf("invalid buckets %#v", buckets)
+	}
+	if buckets[0].LE != "100ms" || buckets[0].Count != 1 {
+		t.Fatalf("invalid first bucket %#v", buckets[0])
+	}
+	if buckets[3].LE != "5s" || buckets[3].Count != 2 {
+		t.Fatalf("invalid 5s bucket %#v", buckets[3])
+	}
+	last := buckets[len(buckets)-1]
+	if last.LE != "+Inf" || last.Count != 3 {
+		t.Fatalf("invalid last bucket %#v", last)
+	}
+
+	err = s.flushUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.down.Add(5)
+	err = s.stopUsageFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(usageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []usageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r usageRecord
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	// 每行记录的是增量，没有用量的 id2 不会被记录
+	if len(records) != 2 || records[0].ID != "id1" || records[0].Down != 20 || records[0].Tasks != 3 {
+		t.Fatalf("invalid records %#v", records)
+	}
+	if records[0].Since.IsZero() || records[0].Time.Before(records[0].Since) || len(records[0].Prefixes) != 2 {
+		t.Fatalf("invalid record %#v", records[0])
+	}
+	r := records[1]
+	if r.ID != "id1" || r.Down != 5 || r.Up != 0 || r.Tasks != 0 || len(r.Prefixes) != 1 || r.Prefixes[0].Prefix != "a" {
+		t.Fatalf("invalid delta record %#v", r)
+	}
+	if !r.Since.Equal(records[0].Time) || r.DurationBuckets[len(r.DurationBuckets)-1].Count != 0 {
+		t.Fatalf("invalid delta record %#v", r)
+	}
+}
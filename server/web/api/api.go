@@ -1,6 +1,8 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/isrc-cas/gt/predef"
 	"github.com/isrc-cas/gt/server"
@@ -128,10 +130,44 @@ func GetConnectionInfo(s *server.Server) gin.HandlerFunc {
 	}
 }
 
+// GetUsage returns the usage of clients, the client id can be specified by query 'id'
+func GetUsage(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		usage := s.GetUsage(ctx.Query("id"))
+		response.SuccessWithData(gin.H{"usage": usage}, ctx)
+	}
+}
+
+// GetGroups returns the host prefixes and tcp ports served by several clients and the members of them
+func GetGroups(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response.SuccessWithData(gin.H{"groups": s.GetGroups()}, ctx)
+	}
+}
+
+// GetCluster returns the other nodes of the cluster and the host prefixes held by them
+func GetCluster(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response.SuccessWithData(gin.H{"nodes": s.GetClusterNodes()}, ctx)
+	}
+}
+
+// Metrics returns the metrics of the server in Prometheus text format
+func Metrics(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		ctx.Status(http.StatusOK)
+		if err := s.WriteMetrics(ctx.Writer); err != nil {
+			s.Logger.Warn().Err(err).Msg("failed to write metrics")
+		}
+	}
+}
+
 // GetRunningConfig returns the running config
 func GetRunningConfig(s *server.Server) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		var cfg = s.Config()
+		var running = s.RunningConfig()
+		var cfg = running.Redacted()
 		s.Logger.Info().Msg("get running config")
 		response.SuccessWithData(gin.H{"config": cfg}, ctx)
 	}
@@ -149,7 +185,7 @@ func GetConfigFromFile(s *server.Server) gin.HandlerFunc {
 			GetRunningConfig(s)(ctx)
 			return
 		}
-		response.SuccessWithData(gin.H{"config": cfg}, ctx)
+		response.SuccessWithData(gin.H{"config": cfg.Redacted()}, ctx)
 	}
 }
 
@@ -171,6 +207,8 @@ func SaveConfigToFile(s *server.Server) gin.HandlerFunc {
 			response.FailWithMessage(err.Error(), ctx)
 			return
 		}
+		// 页面上获取到的配置中的 secret 已被隐藏，保存时使用原来的 secret
+		cfg.RestoreSecrets(&oldConfig)
 		fullPath, err := service.SaveConfigToFile(&cfg)
 		if err != nil {
 			response.FailWithMessage(err.Error(), ctx)
@@ -190,6 +228,18 @@ func Restart(ctx *gin.Context) {
 	response.Success(ctx)
 }
 
+// Reload reloads users, tcp ranges and host rules without dropping tunnels
+func Reload(s *server.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := s.Reload()
+		if err != nil {
+			response.FailWithMessage(err.Error(), ctx)
+			return
+		}
+		response.Success(ctx)
+	}
+}
+
 func Stop(ctx *gin.Context) {
 	err := util.SendSignal("stop")
 	if err != nil {
@@ -33,9 +33,7 @@ func ChangeUserInfo(user request.UserInfo, s *server.Server) error {
 	cfg.Password = user.Password
 	cfg.EnablePprof = user.EnablePprof
 
-	conf4Log := cfg
-	conf4Log.Password = "******"
-	conf4Log.SigningKey = "******"
+	conf4Log := cfg.Redacted()
 
 	_, err = SaveConfigToFile(&cfg)
 	if err != nil {
@@ -180,6 +178,8 @@ func InheritImmutableConfigFields(original *server.Config, new *server.Config) (
 	new.WebCertFile = original.WebCertFile
 	new.WebKeyFile = original.WebKeyFile
 	new.EnablePprof = original.EnablePprof
+	new.EnableMetrics = original.EnableMetrics
+	new.MetricsToken = original.MetricsToken
 	new.SigningKey = original.SigningKey
 	new.Admin = original.Admin
 	new.Password = original.Password
@@ -191,7 +191,8 @@ func InheritConfig(s *server.Server) (cfg server.Config, err error) {
 	cfg, err = GetConfigFromFile(s)
 	if err != nil {
 		// Get From Running
-		err = copier.Copy(&cfg, s.Config()) // SigningKey is also copied
+		running := s.RunningConfig()
+		err = copier.Copy(&cfg, &running) // SigningKey is also copied
 		if err != nil {
 			return
 		}
@@ -183,6 +183,7 @@ func setRoutes(s *server.Server, tm *wServer.TokenManager, r *gin.Engine) error
 		{
 			serverGroup.GET("/info", api.GetServerInfo)
 			serverGroup.PUT("/restart", api.Restart)
+			serverGroup.PUT("/reload", api.Reload(s))
 			serverGroup.PUT("/stop", api.Stop)
 			serverGroup.PUT("/kill", api.Kill)
 		}
@@ -192,12 +193,20 @@ func setRoutes(s *server.Server, tm *wServer.TokenManager, r *gin.Engine) error
 			connectionGroup.GET("/list", api.GetConnectionInfo(s))
 		}
 
+		apiGroup.GET("/usage", api.GetUsage(s))
+		apiGroup.GET("/groups", api.GetGroups(s))
+		apiGroup.GET("/cluster", api.GetCluster(s))
+
 		permissionGroup := apiGroup.Group("/permission")
 		{
 			permissionGroup.GET("/menu", api.GetMenu(s))
 		}
 	}
 
+	if s.Config().EnableMetrics {
+		r.GET("/metrics", metricsAuth(s), api.Metrics(s))
+	}
+
 	if s.Config().EnablePprof {
 		pprofGroup := r.Group("/debug/pprof")
 		{
@@ -229,6 +238,18 @@ func setRoutes(s *server.Server, tm *wServer.TokenManager, r *gin.Engine) error
 	return nil
 }
 
+// metricsAuth 允许携带 metricsToken 或者登录 token 的请求读取 metrics
+func metricsAuth(s *server.Server) gin.HandlerFunc {
+	jwtAuth := middleware.JWTAuthMiddleware(s.Config().SigningKey, predef.DefaultTokenDuration)
+	return func(ctx *gin.Context) {
+		if util.ValidBearerToken(ctx.Request, s.Config().MetricsToken) {
+			ctx.Next()
+			return
+		}
+		jwtAuth(ctx)
+	}
+}
+
 func (s *Server) start(serverErr chan<- error) {
 	defer s.logger.Info().Msg("web server stopped")
 	if predef.IsNoArgs() {
@@ -15,17 +15,33 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -34,8 +50,11 @@ import (
 
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/websocket"
+	gtbufio "github.com/isrc-cas/gt/bufio"
 	"github.com/isrc-cas/gt/client"
+	connection "github.com/isrc-cas/gt/conn"
 	"github.com/isrc-cas/gt/server"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // 多线程安全
@@ -531,6 +550,7 @@ func TestAuthAPI(t *testing.T) {
 	defer s.Close()
 	c, err := setupClient([]string{
 		"client",
+		"-allowPlaintextSecret", // API 认证需要明文 secret，测试中的服务端没有 TLS
 		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
 		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
 		"-local", "http://www.baidu.com",
@@ -1021,6 +1041,215 @@ func TestSpeedLimit(t *testing.T) {
 	}
 }
 
+func TestPrefixSpeedLimit(t *testing.T) {
+	t.Parallel()
+
+	// 启动 http 服务
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			_, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case "GET":
+			_, err := w.Write(make([]byte, 4096))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	httpServer := http.Server{
+		Handler: mux,
+	}
+	httpLisener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := httpServer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	go func() {
+		err := httpServer.Serve(httpLisener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 只对 host 前缀的上行进行限速
+	usersFile := t.TempDir() + "/users.yaml"
+	err = os.WriteFile(usersFile, []byte(`
+id1:
+  secret: secret1
+  speedLimits:
+    id1:
+      up: 1024
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 启动服务端、客户端
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-users", usersFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://" + httpLisener.Addr().String() + "/",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+
+	// 下行没有限速
+	startTime := time.Now()
+	resp, err := httpClient.Post("http://id1.example.com/", "application/octet-stream", bytes.NewBuffer(make([]byte, 4096)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals := time.Since(startTime)
+	if intervals > time.Second {
+		t.Fatalf("intervals: %v, intervals > time.Second", intervals)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 下载 4096 字节的内容所需时间应该在 4 到 5 秒
+	startTime = time.Now()
+	resp, err = httpClient.Get("http://id1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals = time.Since(startTime)
+	if intervals < 4*time.Second || intervals > 5*time.Second {
+		t.Fatalf("intervals: %v, intervals < 4*time.Second || intervals > 5*time.Second", intervals)
+	}
+	err = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixSpeedLimitIsolation(t *testing.T) {
+	t.Parallel()
+
+	// 启动 http 服务
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, 2*1024*1024))
+	})
+	httpServer := http.Server{
+		Handler: mux,
+	}
+	httpLisener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+	go func() {
+		err := httpServer.Serve(httpLisener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 只对 slow 的上行进行限速
+	usersFile := t.TempDir() + "/users.yaml"
+	err = os.WriteFile(usersFile, []byte(`
+id1:
+  secret: secret1
+  speedLimits:
+    slow:
+      up: 65536
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-users", usersFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 两个服务共享同一个隧道
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://" + httpLisener.Addr().String() + "/",
+		"-hostPrefix", "slow",
+		"-local", "http://" + httpLisener.Addr().String() + "/",
+		"-hostPrefix", "fast",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteConnections", "1",
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	slowClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	slowResp, err := slowClient.Get("http://slow.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowResp.Body.Close()
+	// 只读取一部分，使受限速的任务持续发送数据
+	_, err = io.ReadFull(slowResp.Body, make([]byte, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 受限速的任务不会阻塞同一隧道上的其他任务
+	fastClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	startTime := time.Now()
+	resp, err := fastClient.Get("http://fast.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || n != 2*1024*1024 {
+		t.Fatalf("unexpected response %d %v", n, err)
+	}
+	if intervals := time.Since(startTime); intervals > 3*time.Second {
+		t.Fatalf("the task of fast is blocked for %v", intervals)
+	}
+}
+
 func TestInvalidIDOrSecret(t *testing.T) {
 	t.Parallel()
 
@@ -1661,3 +1890,1745 @@ func TestHostPrefixConflict(t *testing.T) {
 		t.Fatal("client1 or client2 not host conflict")
 	}
 }
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test", func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusAccepted)
+		_, err := writer.Write([]byte("ok"))
+		if err != nil {
+			panic(err)
+		}
+	})
+	hs := &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := hs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	go func() {
+		err := hs.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	accessLogFile := t.TempDir() + "/access.log"
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-accessLogFile", accessLogFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", fmt.Sprintf("http://%s", l.Addr().String()),
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 同一个访问者连接上的两个请求各记录一条访问日志
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	for i, path := range []string{"/test?hello=world", "/notfound"} {
+		req, err := http.NewRequest("GET", "http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = i == 1
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != []int{http.StatusAccepted, http.StatusNotFound}[i] {
+			t.Fatal("invalid resp")
+		}
+	}
+
+	var lines [][]byte
+	for i := 0; i < 50 && len(lines) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		content, _ := os.ReadFile(accessLogFile)
+		lines = bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+	}
+	if len(lines) != 2 {
+		t.Fatalf("invalid access log: %q", lines)
+	}
+	for i, fields := range [][]string{
+		{`"method":"GET"`, `"path":"/test"`, `"status":202`},
+		{`"method":"GET"`, `"path":"/notfound"`, `"status":404`},
+	} {
+		t.Logf("%s", lines[i])
+		fields = append(fields,
+			`"hostPrefix":"05797ac9-86ae-40b0-b767-7a41e03a5486"`,
+			`"client":"05797ac9-86ae-40b0-b767-7a41e03a5486"`,
+			`"remoteIP":"127.0.0.1"`,
+		)
+		for _, field := range fields {
+			if !bytes.Contains(lines[i], []byte(field)) {
+				t.Fatalf("%s is not in the access log", field)
+			}
+		}
+		if bytes.Contains(lines[i], []byte("hello=world")) {
+			t.Fatal("query should not be in the access log")
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Parallel()
+	// 本地服务从 PROXY protocol 头部中获取访问者的地址并返回
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := gtbufio.NewReader(c)
+				src, _, err := connection.ReadProxyHeader(r)
+				if err != nil {
+					return
+				}
+				req, err := http.ReadRequest(bufio.NewReader(r))
+				if err != nil {
+					return
+				}
+				_ = req.Body.Close()
+				body := src.String()
+				_, _ = fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-proxyProtocol",
+		"-proxyProtocolTrusted", "127.0.0.1/32",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 模拟负载均衡器，客户端的隧道连接也经过负载均衡器
+	lb, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	go func() {
+		for {
+			c, err := lb.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				sc, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+				if err != nil {
+					return
+				}
+				defer sc.Close()
+				src := c.RemoteAddr().(*net.TCPAddr)
+				dst := c.LocalAddr().(*net.TCPAddr)
+				_, err = fmt.Fprintf(sc, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(c, sc)
+					_ = c.Close()
+				}()
+				_, _ = io.Copy(sc, c)
+			}()
+		}
+	}()
+
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", fmt.Sprintf("http://%s", l.Addr().String()),
+		"-localProxyProtocol",
+		"-remote", lb.Addr().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	visitor, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_, err = io.WriteString(visitor, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n"+
+		"GET / HTTP/1.1\r\nHost: 05797ac9-86ae-40b0-b767-7a41e03a5486.example.com\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	all, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all) != "1.2.3.4:1111" {
+		t.Fatalf("invalid visitor address %q", all)
+	}
+
+	// 没有 PROXY protocol 头部的连接被拒绝
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	_, err = httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/")
+	if err == nil {
+		t.Fatal("request without PROXY protocol header should fail")
+	}
+
+	// 不可信的对端不读取头部，使用连接自己的地址，伪造的头部不会生效
+	for _, header := range []string{"", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\n"} {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+		visitor, err := dialer.Dial("tcp", s.GetListenerAddrPort().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(visitor, header+
+			"GET / HTTP/1.1\r\nHost: 05797ac9-86ae-40b0-b767-7a41e03a5486.example.com\r\nConnection: close\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, _ := io.ReadAll(visitor)
+		_ = visitor.Close()
+		if header == "" && !bytes.HasSuffix(all, []byte("\r\n\r\n127.0.0.2:"+strconv.Itoa(visitor.LocalAddr().(*net.TCPAddr).Port))) {
+			t.Fatalf("invalid response %q", all)
+		}
+		if bytes.Contains(all, []byte("1.2.3.4")) {
+			t.Fatalf("spoofed header is used: %q", all)
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		for _, name := range []string{"X-Forwarded-For", "X-Real-IP", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			writer.Header()["Echo-"+name] = request.Header.Values(name)
+		}
+		writer.Header().Set("Echo-Host", request.Host)
+	})
+	hs := &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-useLocalAsHTTPHost",
+		"-forwardedHeaders",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	host := "05797ac9-86ae-40b0-b767-7a41e03a5486.example.com"
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	// 同一个访问者连接上的每个请求都被改写
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://"+host+"/", strings.NewReader("X-Forwarded-For: 6.6.6.6\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 访问者伪造的头部被删除
+		req.Header.Set("X-Forwarded-For", "6.6.6.6")
+		req.Header.Set("Forwarded", "for=6.6.6.6")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{
+			"Echo-X-Forwarded-For":   "127.0.0.1",
+			"Echo-X-Real-Ip":         "127.0.0.1",
+			"Echo-X-Forwarded-Proto": "http",
+			"Echo-X-Forwarded-Host":  host,
+			"Echo-Forwarded":         "for=127.0.0.1;host=" + host + ";proto=http",
+			"Echo-Host":              l.Addr().String(),
+		}
+		for k, v := range expected {
+			if values := resp.Header.Values(k); len(values) != 1 || values[0] != v {
+				t.Fatalf("request %d: invalid %s: %q", i, k, values)
+			}
+		}
+	}
+}
+
+func TestUDP(t *testing.T) {
+	t.Parallel()
+	// 本地 udp 服务在数据报前面加上 echo: 后返回
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := local.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = local.WriteToUDP(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-udpRange", "40000-50000",
+		"-udpNumber", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clientLogWriter, clientLog := newStringWriter()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "udp://" + local.LocalAddr().String(),
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteUDPRandom",
+		"-remoteTimeout", "5s",
+	}, clientLogWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 UDP 端口分配
+
+	// 从客户端的日志中获取 udp 端口
+	match := regexp.MustCompile(`udp port=(\d+)`).FindStringSubmatch(clientLog())
+	if len(match) != 2 {
+		t.Fatal("failed to get udp port from client log")
+	}
+	udpPort := match[1]
+
+	// 两个访问者使用不同的会话，数据报保持边界
+	for i := 0; i < 2; i++ {
+		visitor, err := net.Dial("udp", "127.0.0.1:"+udpPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer visitor.Close()
+		for _, msg := range []string{"", "a", strings.Repeat("b", 1400), fmt.Sprintf("visitor %d", i)} {
+			_, err = visitor.Write([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = visitor.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 65535)
+			n, err := visitor.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "echo:"+msg {
+				t.Fatalf("invalid response %q of %q", buf[:n], msg)
+			}
+		}
+	}
+}
+
+// writeSelfSignedCert 生成 dnsName 的自签名证书，写入 dir 并返回文件路径
+func writeSelfSignedCert(t *testing.T, dir string, dnsName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, dnsName+".crt")
+	keyFile = filepath.Join(dir, dnsName+".key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestLocalTLS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := writeSelfSignedCert(t, dir, "local.internal")
+	clientCertFile, clientKeyFile := writeSelfSignedCert(t, dir, "gt-client.internal")
+
+	// 本地 https 服务要求客户端证书，并在 tls 握手之前读取 PROXY protocol 头部
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		if len(request.TLS.PeerCertificates) < 1 {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		host, _, _ := net.SplitHostPort(request.RemoteAddr)
+		_, _ = fmt.Fprintf(writer, "%s %s %s", request.TLS.ServerName, request.TLS.PeerCertificates[0].Subject.CommonName, host)
+	})
+	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.ServeTLS(connection.NewProxyListener(l, 5*time.Second, nil), "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "https://" + l.Addr().String(),
+		"-localTLS",
+		"-localCA", serverCertFile,
+		"-localServerName", "local.internal",
+		"-localCert", clientCertFile,
+		"-localKey", clientKeyFile,
+		"-localProxyProtocol",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 访问者使用 http 访问服务端，客户端与本地服务建立 tls 连接
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	resp, err := httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "local.internal gt-client.internal 127.0.0.1" {
+		t.Fatalf("invalid response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	t.Parallel()
+	// 两个 client 的本地服务返回各自的名字
+	names := []string{"member1", "member2"}
+	locals := make([]net.Listener, len(names))
+	for i, name := range names {
+		name := name
+		hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			_, _ = io.WriteString(writer, name)
+		})}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		locals[i] = l
+		defer hs.Close()
+		go func() {
+			err := hs.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	_ = l.Close()
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-id", "b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11",
+		"-secret", "0c3c2b77-0f5c-4c5e-9b1f-0f0b3b2a9f6e",
+		"-tcpRange", tcpPort + "-" + tcpPort,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	setupMember := func(id, secret string, local net.Listener) *client.Client {
+		c, err := setupClient([]string{
+			"client",
+			"-id", id,
+			"-secret", secret,
+			"-local", "http://" + local.Addr().String(),
+			"-hostPrefix", "app",
+			"-groupSecret", "group-secret",
+			"-local", "tcp://" + local.Addr().String(),
+			"-remoteTCPPort", tcpPort,
+			"-groupSecret", "group-secret",
+			"-remote", s.GetListenerAddrPort().String(),
+			"-remoteTimeout", "5s",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1 := setupMember("05797ac9-86ae-40b0-b767-7a41e03a5486", "eec1eabf-2c59-4e19-bf10-34707c17ed89", locals[0])
+	defer c1.Close()
+	c2 := setupMember("b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11", "0c3c2b77-0f5c-4c5e-9b1f-0f0b3b2a9f6e", locals[1])
+	defer c2.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 TCP 端口分配
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	get := func(url string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+		var resp *http.Response
+		if strings.Contains(url, "example.com") {
+			resp, err = httpClient.Do(req)
+		} else {
+			resp, err = http.DefaultClient.Do(req)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	urls := []string{"http://app.example.com/", "http://127.0.0.1:" + tcpPort + "/"}
+	for _, url := range urls {
+		counts := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			counts[get(url)]++
+		}
+		if counts["member1"] != 2 || counts["member2"] != 2 {
+			t.Fatalf("tasks of %s are not spread across the group: %v", url, counts)
+		}
+	}
+	if groups := s.GetGroups(); len(groups) != 2 || len(groups[0].Members) != 2 || len(groups[1].Members) != 2 {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+
+	// 成员的隧道断开后，其他成员继续提供服务
+	c1.Close()
+	time.Sleep(100 * time.Millisecond)
+	for _, url := range urls {
+		for i := 0; i < 3; i++ {
+			if name := get(url); name != "member2" {
+				t.Fatalf("unexpected member %q of %s", name, url)
+			}
+		}
+	}
+	if groups := s.GetGroups(); len(groups) != 2 || len(groups[0].Members) != 1 || groups[0].Members[0].ID != "b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+}
+
+func TestRemoteFailover(t *testing.T) {
+	t.Parallel()
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok")
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	setupRemote := func(addr string) *server.Server {
+		s, err := setupServer([]string{
+			"server",
+			"-addr", addr,
+			"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s1 := setupRemote("127.0.0.1:0")
+	addr1 := s1.GetListenerAddrPort().String()
+	s2 := setupRemote("127.0.0.1:0")
+	defer s2.Close()
+	addr2 := s2.GetListenerAddrPort().String()
+
+	// serving 检查服务端是否能通过隧道访问本地服务
+	serving := func(addr string) bool {
+		httpClient := setupHTTPClient(addr, nil)
+		httpClient.Timeout = time.Second
+		resp, err := httpClient.Get("http://05797ac9-86ae-40b0-b767-7a41e03a5486.example.com/")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return err == nil && resp.StatusCode == http.StatusOK && string(body) == "ok"
+	}
+	waitUntil := func(cond func() bool, msg string) {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(msg)
+	}
+
+	c, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-remote", "tcp://" + addr1,
+		"-remote", "tcp://" + addr2,
+		"-remoteStrategy", "failover",
+		"-remoteFailures", "1",
+		"-remoteHealthCheckInterval", "200ms",
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "100ms",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !serving(addr1) || serving(addr2) {
+		t.Fatal("tunnels are expected to connect to the first remote")
+	}
+
+	// 第一个服务端停止后切换到第二个服务端
+	s1.Close()
+	waitUntil(func() bool { return serving(addr2) }, "failed to switch to the second remote")
+
+	// 第一个服务端恢复后切换回来
+	s1 = setupRemote(addr1)
+	defer s1.Close()
+	waitUntil(func() bool { return serving(addr1) && !serving(addr2) }, "failed to fail back to the first remote")
+
+	// all 策略同时保持到所有服务端的隧道
+	c2, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-remote", "tcp://" + addr1,
+		"-remote", "tcp://" + addr2,
+		"-remoteStrategy", "all",
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	waitUntil(func() bool { return serving(addr1) && serving(addr2) }, "tunnels are expected to connect to all remotes")
+}
+
+func TestCluster(t *testing.T) {
+	t.Parallel()
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok")
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 第一个节点作为种子，其他节点通过它发现彼此
+	var nodes []*server.Server
+	var seed string
+	for i := 0; i < 3; i++ {
+		args := []string{
+			"server",
+			"-addr", "127.0.0.1:0",
+			"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+			"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+			"-id", "b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11",
+			"-secret", "0c3c2b77-0f5c-4c5e-9b1f-0f0b3b2a9f6e",
+			"-clusterAddr", "127.0.0.1:0",
+			"-clusterSecret", "cluster-secret",
+			"-clusterGossipInterval", "100ms",
+			"-reconnectTimes", "1",
+		}
+		if i > 0 {
+			args = append(args, "-clusterPeers", seed)
+		}
+		s, err := setupServer(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if i == 0 {
+			seed = s.GetClusterListenerAddrPort().String()
+		}
+		nodes = append(nodes, s)
+	}
+	waitUntil := func(cond func() bool, msg string) {
+		for i := 0; i < 50; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(msg)
+	}
+	waitUntil(func() bool {
+		for _, s := range nodes {
+			n := s.GetClusterNodes()
+			if len(n) != 2 || !n[0].Alive || !n[1].Alive {
+				return false
+			}
+		}
+		return true
+	}, "nodes failed to discover each other")
+
+	c1, err := setupClient([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "eec1eabf-2c59-4e19-bf10-34707c17ed89",
+		"-local", "http://" + l.Addr().String(),
+		"-hostPrefix", "app",
+		"-remote", nodes[0].GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// 访问者连接到没有隧道的节点时被转发到持有隧道的节点
+	serving := func(s *server.Server) bool {
+		httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+		httpClient.Timeout = 3 * time.Second
+		resp, err := httpClient.Get("http://app.example.com/")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return err == nil && resp.StatusCode == http.StatusOK && string(body) == "ok"
+	}
+	for _, s := range nodes {
+		s := s
+		waitUntil(func() bool { return serving(s) }, "failed to forward visitors to the node holding the tunnel")
+	}
+
+	// 其他节点上的 client 不能使用相同的 host 前缀
+	c2, err := client.New([]string{
+		"client",
+		"-id", "b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11",
+		"-secret", "0c3c2b77-0f5c-4c5e-9b1f-0f0b3b2a9f6e",
+		"-local", "http://" + l.Addr().String(),
+		"-hostPrefix", "app",
+		"-remote", nodes[2].GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "100ms",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c2.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.WaitUntilReady(time.Second) == nil {
+		t.Fatal("host prefix conflict is expected")
+	}
+	c2.Close()
+
+	// 一个节点限制的 IP 也不能连接其他节点
+	c3, err := client.New([]string{
+		"client",
+		"-id", "05797ac9-86ae-40b0-b767-7a41e03a5486",
+		"-secret", "invalid-secret-of-the-cluster-test",
+		"-local", "http://" + l.Addr().String(),
+		"-remote", nodes[1].GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+		"-reconnectDelay", "100ms",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c3.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c3.WaitUntilReady(time.Second)
+	c3.Close()
+	time.Sleep(300 * time.Millisecond)
+	c4, err := client.New([]string{
+		"client",
+		"-id", "b7b8aa0a-6a7f-4d1b-9a3e-5f7c1b0f4d11",
+		"-secret", "0c3c2b77-0f5c-4c5e-9b1f-0f0b3b2a9f6e",
+		"-local", "http://" + l.Addr().String(),
+		"-hostPrefix", "other",
+		"-remote", nodes[2].GetListenerAddrPort().String(),
+		"-remoteTimeout", "5s",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c4.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c4.Close()
+	if c4.WaitUntilReady(time.Second) == nil {
+		t.Fatal("the ip is expected to be banned by the cluster")
+	}
+}
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok")
+	})}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(local)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	_ = l.Close()
+	// 本地 udp 服务在数据报前面加上 echo: 后返回
+	localUDP, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localUDP.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := localUDP.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = localUDP.WriteToUDP(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	ul, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpPort := strconv.Itoa(ul.LocalAddr().(*net.UDPAddr).Port)
+	_ = ul.Close()
+
+	// 用户拒绝访问 denied 前缀，服务端全局拒绝的网段不包含 127.0.0.1
+	usersFile := t.TempDir() + "/users.yaml"
+	err = os.WriteFile(usersFile, []byte(`
+id1:
+  secret: secret1
+  acls:
+    denied:
+      deny:
+        - 127.0.0.0/8
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-users", usersFile,
+		"-deny", "10.0.0.0/8",
+		"-tcpRange", tcpPort + "-" + tcpPort,
+		"-udpRange", udpPort + "-" + udpPort,
+		"-udpNumber", "1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + local.Addr().String(),
+		"-hostPrefix", "allowed",
+		"-allow", "127.0.0.1",
+		"-local", "http://" + local.Addr().String(),
+		"-hostPrefix", "denied",
+		"-local", "http://" + local.Addr().String(),
+		"-hostPrefix", "other",
+		"-allow", "192.168.0.0/16",
+		"-local", "tcp://" + local.Addr().String(),
+		"-remoteTCPPort", tcpPort,
+		"-deny", "::1",
+		"-deny", "127.0.0.1/32",
+		"-local", "udp://" + localUDP.LocalAddr().String(),
+		"-remoteUDPPort", udpPort,
+		"-deny", "127.0.0.1/32",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond) // 等待服务端完成 TCP 与 UDP 端口分配
+
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	for prefix, expected := range map[string]int{
+		"allowed": http.StatusOK,
+		"denied":  http.StatusForbidden,
+		"other":   http.StatusForbidden,
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+prefix+".example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s: expected status %d, got %d", prefix, expected, resp.StatusCode)
+		}
+	}
+
+	// 被拒绝的 tcp 访问者的连接会被直接关闭
+	conn, err := net.Dial("tcp", "127.0.0.1:"+tcpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(make([]byte, 1))
+	if n != 0 || !errors.Is(err, io.EOF) {
+		t.Fatalf("tcp visitor should be denied: %d %v", n, err)
+	}
+
+	// 被拒绝的 udp 访问者的数据报会被丢弃
+	visitor, err := net.Dial("udp", "127.0.0.1:"+udpPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	for i := 0; i < 2; i++ {
+		_, err = io.WriteString(visitor, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = visitor.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err = visitor.Read(make([]byte, 100))
+	var ne net.Error
+	if n != 0 || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("udp visitor should be denied: %d %v", n, err)
+	}
+
+	var metrics strings.Builder
+	err = s.WriteMetrics(&metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`gt_server_acl_denied_total{id="id1",prefix="denied"} 1`,
+		`gt_server_acl_denied_total{id="id1",prefix="other"} 1`,
+		`gt_server_acl_denied_total{id="id1",prefix="tcp:` + tcpPort + `"} 1`,
+		`gt_server_acl_denied_total{id="id1",prefix="udp:` + udpPort + `"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Fatalf("metrics should contain %q:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestAuthGate(t *testing.T) {
+	t.Parallel()
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok "+request.URL.Path)
+	})}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(local)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	// 模拟 OIDC provider，登录页面直接重定向到回调地址
+	var nonce atomic.Value
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := httptest.NewTLSServer(nil)
+	defer provider.Close()
+	issuer := provider.URL
+	providerCAFile := filepath.Join(t.TempDir(), "oidc.crt")
+	err = os.WriteFile(providerCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: provider.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Config.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(writer).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+				"jwks_uri":               issuer + "/jwks",
+			})
+		case "/jwks":
+			_ = json.NewEncoder(writer).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "EC",
+				"kid": "key1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(signingKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(signingKey.Y.FillBytes(make([]byte, 32))),
+			}}})
+		case "/authorize":
+			query := request.URL.Query()
+			nonce.Store(query.Get("nonce"))
+			http.Redirect(writer, request, query.Get("redirect_uri")+"?code=code1&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+		case "/token":
+			id, secret, _ := request.BasicAuth()
+			if id != "client1" || secret != "secret1" || request.PostFormValue("code") != "code1" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss":            issuer,
+				"aud":            "client1",
+				"exp":            time.Now().Add(time.Hour).Unix(),
+				"nonce":          nonce.Load(),
+				"email":          "alice@example.com",
+				"email_verified": true,
+			})
+			signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"key1"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+			hash := sha256.Sum256([]byte(signed))
+			r, sigS, err := ecdsa.Sign(rand.Reader, signingKey, hash[:])
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			sigS.FillBytes(sig[32:])
+			_ = json.NewEncoder(writer).Encode(map[string]string{
+				"id_token": signed + "." + base64.RawURLEncoding.EncodeToString(sig),
+			})
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-authRequired",
+		"-authOIDCIssuers", issuer,
+		"-authOIDCCA", providerCAFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", "http://" + local.Addr().String(),
+		"-hostPrefix", "basic",
+		"-authBasic", "user1:password1",
+		"-authBearer", "token1",
+		"-local", "http://" + local.Addr().String(),
+		"-hostPrefix", "oidc",
+		"-authOIDCIssuer", issuer,
+		"-authOIDCClientID", "client1",
+		"-authOIDCClientSecret", "secret1",
+		"-authOIDCEmail", "@example.com",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 只有 *.example.com 发送到服务端，其他地址直接访问
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{
+		Jar: jar,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				if strings.HasSuffix(strings.Split(address, ":")[0], ".example.com") {
+					address = s.GetListenerAddrPort().String()
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			},
+			TLSClientConfig: provider.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+	}
+	get := func(rawURL string, header http.Header) (status int, body string) {
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && len(resp.Header.Values("WWW-Authenticate")) != 2 {
+			t.Fatalf("unexpected WWW-Authenticate %v", resp.Header.Values("WWW-Authenticate"))
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	basicHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("user1:password1"))}}
+	wrongHeader := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("user1:password2"))}}
+	bearerHeader := http.Header{"Authorization": {"Bearer token1"}}
+	for _, c := range []struct {
+		header http.Header
+		status int
+	}{
+		{nil, http.StatusUnauthorized},
+		{wrongHeader, http.StatusUnauthorized},
+		{basicHeader, http.StatusOK},
+		{bearerHeader, http.StatusOK},
+	} {
+		status, _ := get("http://basic.example.com/", c.header)
+		if status != c.status {
+			t.Fatalf("%v: expected status %d, got %d", c.header, c.status, status)
+		}
+	}
+
+	// 连接上的每个请求都需要认证，通过认证的请求复用连接，未通过认证的请求在之前的响应之后被拒绝并关闭连接
+	conn, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: basic.example.com\r\nAuthorization: Bearer token1\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: basic.example.com\r\nAuthorization: Bearer token1\r\n\r\n"+
+		"GET /c HTTP/1.1\r\nHost: basic.example.com\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"ok /a", "ok /b"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK || string(b) != expected || resp.Close {
+			t.Fatalf("unexpected response %d %q %v", resp.StatusCode, b, err)
+		}
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized || !resp.Close {
+		t.Fatalf("request without auth should be rejected: %d", resp.StatusCode)
+	}
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed after the rejection: %v", err)
+	}
+
+	// 重定向到 OIDC provider 登录后回到原来的页面
+	status, body := get("http://oidc.example.com/page?q=1", nil)
+	if status != http.StatusOK || body != "ok /page" {
+		t.Fatalf("unexpected response after oidc login: %d %s", status, body)
+	}
+	u, _ := url.Parse("http://oidc.example.com/")
+	var session string
+	for _, cookie := range jar.Cookies(u) {
+		if cookie.Name == "gt_session" {
+			session = cookie.Value
+		}
+	}
+	if session == "" {
+		t.Fatal("session cookie should be set")
+	}
+	// session 与 host 绑定
+	status, _ = get("http://basic.example.com/", http.Header{"Cookie": {"gt_session=" + session}})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("session should not be valid for other host prefixes: %d", status)
+	}
+	httpClient.Jar = nil
+	status, _ = get("http://oidc.example.com/", http.Header{"Cookie": {"gt_session=" + session}})
+	if status != http.StatusOK {
+		t.Fatalf("session should be valid: %d", status)
+	}
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	status, _ = get("http://oidc.example.com/", nil)
+	if status != http.StatusFound {
+		t.Fatalf("visitor without session should be redirected: %d", status)
+	}
+
+	// 认证失败过多时不再验证新的凭据，已经验证过的凭据不受影响。上面已经失败了一次
+	for i := 1; i < 10; i++ {
+		status, _ := get("http://basic.example.com/", wrongHeader)
+		if status != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", status)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://basic.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = wrongHeader
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", resp.StatusCode)
+	}
+	if status, _ := get("http://basic.example.com/", basicHeader); status != http.StatusOK {
+		t.Fatalf("verified credentials should pass, got %d", status)
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := writeSelfSignedCert(t, dir, "localhost")
+	// 自签名的客户端证书同时作为 CA
+	clientCertFile, clientKeyFile := writeSelfSignedCert(t, dir, "id1")
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok")
+	})}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(local)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	usersFile := filepath.Join(dir, "users.yaml")
+	err = os.WriteFile(usersFile, []byte("id1:\n  secret: secret1\nid2:\n  secret: secret2\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-certFile", serverCertFile,
+		"-keyFile", serverKeyFile,
+		"-users", usersFile,
+		"-tlsClientCA", clientCertFile,
+		"-tlsClientCertRequired",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	remote := "tls://localhost:" + strconv.Itoa(int(s.GetTLSListenerAddrPort().Port()))
+
+	// 客户端不设置 secret，由证书认证
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-remote", remote,
+		"-remoteCert", serverCertFile,
+		"-remoteClientCert", clientCertFile,
+		"-remoteClientKey", clientKeyFile,
+		"-local", "http://" + local.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	resp, err := httpClient.Get("http://id1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("unexpected response %q %v", body, err)
+	}
+
+	// 访问者通过 tlsAddr 访问时不需要客户端证书
+	httpsClient := setupHTTPClient(s.GetTLSListenerAddrPort().String(), &tls.Config{InsecureSkipVerify: true})
+	resp, err = httpsClient.Get("https://id1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// 证书与 id 不匹配，以及要求证书时只有 secret 的隧道都会被拒绝
+	for _, args := range [][]string{
+		{"-id", "id2", "-remoteClientCert", clientCertFile, "-remoteClientKey", clientKeyFile},
+		{"-id", "id2", "-secret", "secret2"},
+	} {
+		args = append([]string{
+			"client",
+			"-remote", remote,
+			"-remoteCert", serverCertFile,
+			"-local", "http://" + local.Addr().String(),
+			"-reconnectDelay", "1h",
+		}, args...)
+		c, err := client.New(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.WaitUntilReady(2 * time.Second)
+		c.Close()
+		if err == nil {
+			t.Fatalf("client should be rejected: %v", args)
+		}
+	}
+}
+
+func TestSecureHandshake(t *testing.T) {
+	t.Parallel()
+	hs := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = io.WriteString(writer, "ok")
+	})}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	go func() {
+		err := hs.Serve(local)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersFile := filepath.Join(t.TempDir(), "users.yaml")
+	err = os.WriteFile(usersFile, []byte("id1:\n  secret: secret1\nid2:\n  secret: "+string(hash)+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-users", usersFile,
+		"-requireSecureHandshake",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 记录客户端发送给服务端的数据
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	sent := &safeBuffer{buf: &bytes.Buffer{}, rwMutex: &sync.RWMutex{}}
+	var target atomic.Value
+	target.Store(s.GetListenerAddrPort().String())
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			remote, err := net.Dial("tcp", target.Load().(string))
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go func() {
+				_, _ = io.Copy(io.MultiWriter(remote, sent), conn)
+				_ = remote.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(conn, remote)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", "tcp://" + proxy.Addr().String(),
+		"-local", "http://" + local.Addr().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	httpClient := setupHTTPClient(s.GetListenerAddrPort().String(), nil)
+	resp, err := httpClient.Get("http://id1.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("unexpected response %q %v", body, err)
+	}
+	sent.rwMutex.RLock()
+	leaked := bytes.Contains(sent.buf.Bytes(), []byte("secret1"))
+	sent.rwMutex.RUnlock()
+	if leaked {
+		t.Fatal("the secret should not be sent")
+	}
+
+	// 旧版本握手发送明文 secret，错误的 HMAC 凭证。存在与不存在的 id 都被要求 HMAC 凭证
+	invalidIDAndSecret := []byte{0xFF, 0xFF, 0xFF, 0xFC, 0x00, 0x01}
+	legacy := []byte{0xF0, 0x01, 3, 'i', 'd', '1', 7, 's', 'e', 'c', 'r', 'e', 't', '1', 0}
+	hmacHandshake := func(id string) func(conn net.Conn) error {
+		return func(conn net.Conn) error {
+			_, err := conn.Write(append([]byte{0xF0, 0x03, byte(len(id))}, id...))
+			if err != nil {
+				return err
+			}
+			challenge := make([]byte, 33)
+			_, err = io.ReadFull(conn, challenge)
+			if err != nil {
+				return err
+			}
+			if challenge[0] != 0 {
+				return fmt.Errorf("unexpected handshake mode %d of %s", challenge[0], id)
+			}
+			credential := append([]byte{32}, make([]byte, 32)...)
+			_, err = conn.Write(append(credential, 0, 1, 0))
+			return err
+		}
+	}
+	handshakes := []func(conn net.Conn) error{
+		func(conn net.Conn) error {
+			_, err := conn.Write(legacy)
+			return err
+		},
+		hmacHandshake("id1"),
+		hmacHandshake("id2"),
+		hmacHandshake("id3"),
+	}
+	for i, handshake := range handshakes {
+		conn, err := net.Dial("tcp", s.GetListenerAddrPort().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err = handshake(conn)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		signal := make([]byte, len(invalidIDAndSecret))
+		_, err = io.ReadFull(conn, signal)
+		_ = conn.Close()
+		if err != nil || !bytes.Equal(signal, invalidIDAndSecret) {
+			t.Fatalf("handshake %d should be rejected: %v %v", i, signal, err)
+		}
+	}
+
+	// 哈希后的 secret 需要服务端设置 -plaintextSecretHandshake。明文 secret 只通过验证过证书的 TLS 发送，
+	// 其它情况需要客户端设置 -allowPlaintextSecret
+	keyFile := filepath.Join(t.TempDir(), "tls.key")
+	certFile := filepath.Join(t.TempDir(), "tls.crt")
+	err = generateTLSKeyAndCert("localhost", keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-tlsAddr", "127.0.0.1:0",
+		"-keyFile", keyFile,
+		"-certFile", certFile,
+		"-users", usersFile,
+		"-plaintextSecretHandshake",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	tlsRemote := fmt.Sprintf("tls://localhost:%v", s2.GetTLSListenerAddrPort().Port())
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-remote", s.GetListenerAddrPort().String()}, false},
+		{[]string{"-remote", s.GetListenerAddrPort().String(), "-allowPlaintextSecret"}, false},
+		{[]string{"-remote", s2.GetListenerAddrPort().String()}, false},
+		{[]string{"-remote", s2.GetListenerAddrPort().String(), "-allowPlaintextSecret"}, true},
+		{[]string{"-remote", tlsRemote, "-remoteCert", certFile}, true},
+		{[]string{"-remote", tlsRemote, "-remoteCertInsecure"}, false},
+		{[]string{"-remote", tlsRemote, "-remoteCertInsecure", "-allowPlaintextSecret"}, true},
+	}
+	for _, tc := range cases {
+		args := append([]string{
+			"client",
+			"-id", "id2",
+			"-secret", "secret2",
+			"-local", "http://" + local.Addr().String(),
+			"-reconnectDelay", "1h",
+		}, tc.args...)
+		c, err := client.New(args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.WaitUntilReady(2 * time.Second)
+		c.Close()
+		if tc.ok != (err == nil) {
+			t.Fatalf("unexpected result of id2 with hashed secret: %v %v", args, err)
+		}
+	}
+
+	// 接受任意客户端时以 digest 代替 secret，不发送明文 secret
+	s3, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	target.Store(s3.GetListenerAddrPort().String())
+	sent.rwMutex.Lock()
+	sent.buf.Reset()
+	sent.rwMutex.Unlock()
+	for i := 0; i < 2; i++ {
+		c3, err := setupClient([]string{
+			"client",
+			"-id", "id3",
+			"-secret", "secret3",
+			"-remote", "tcp://" + proxy.Addr().String(),
+			"-local", "http://" + local.Addr().String(),
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpClient := setupHTTPClient(s3.GetListenerAddrPort().String(), nil)
+		resp, err := httpClient.Get("http://id3.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// 第二个客户端保持连接
+		if i == 0 {
+			c3.Close()
+		} else {
+			defer c3.Close()
+		}
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("unexpected response %q %v", body, err)
+		}
+	}
+	sent.rwMutex.RLock()
+	leaked = bytes.Contains(sent.buf.Bytes(), []byte("secret3"))
+	sent.rwMutex.RUnlock()
+	if leaked {
+		t.Fatal("the secret should not be sent to the server that allows any client")
+	}
+	// 其它客户端不能使用错误的 secret 使用已连接的 id
+	c4, err := client.New([]string{
+		"client",
+		"-id", "id3",
+		"-secret", "wrong",
+		"-remote", s3.GetListenerAddrPort().String(),
+		"-local", "http://" + local.Addr().String(),
+		"-reconnectDelay", "1h",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c4.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c4.WaitUntilReady(2 * time.Second)
+	c4.Close()
+	if err == nil {
+		t.Fatal("id3 with wrong secret should be rejected")
+	}
+}
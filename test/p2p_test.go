@@ -18,7 +18,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -27,12 +30,15 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/isrc-cas/gt/client/std"
 	"github.com/isrc-cas/gt/client/webrtc"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v3"
 )
 
 func TestP2PGetOffer(t *testing.T) {
@@ -552,7 +558,14 @@ func initOffer(t *testing.T, addr string) (*webrtc.PeerConnection, context.Conte
 func TestTCPForward(t *testing.T) {
 	t.Parallel()
 
-	// 启动服务端、客户端
+	// 创建 HTTP echo 服务
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpEchoServer(httpListener)
+
+	// 启动服务端、客户端，client2 启动时会立即向 client1 发起 P2P 连接，所以先启动 client1
 	s, err := setupServer([]string{
 		"server",
 		"-addr", "127.0.0.1:0",
@@ -562,42 +575,39 @@ func TestTCPForward(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer s.Close()
-	cSlice, err := setupClients(clientOption{
-		args: []string{
-			"client",
-			"-id", "id1",
-			"-secret", "secret1",
-			"-remote", s.GetListenerAddrPort().String(),
-			"-local", "http://www.baidu.com/",
-			"-remoteTimeout", "5s",
-			"-useLocalAsHTTPHost",
-			"-remoteSTUN", "stun:" + s.GetSTUNListenerAddrPort().String(),
-		},
-	}, clientOption{
-		args: []string{
-			"client",
-			"-id", "id2",
-			"-secret", "secret2",
-			"-remote", s.GetListenerAddrPort().String(),
-			"-local", "http://www.baidu.com/",
-			"-remoteTimeout", "5s",
-			"-useLocalAsHTTPHost",
-			"-remoteSTUN", "stun:" + s.GetSTUNListenerAddrPort().String(),
-			"-tcpForwardAddr", "127.0.0.1:0",
-			"-tcpForwardHostPrefix", "id1",
-		},
-	})
+	c1, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", fmt.Sprintf("http://%s/", httpListener.Addr().String()),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+		"-remoteSTUN", "stun:" + s.GetSTUNListenerAddrPort().String(),
+	}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		for _, c := range cSlice {
-			c.Close()
-		}
-	}()
+	defer c1.Close()
+	c2, err := setupClient([]string{
+		"client",
+		"-id", "id2",
+		"-secret", "secret2",
+		"-remote", s.GetListenerAddrPort().String(),
+		"-local", fmt.Sprintf("http://%s/", httpListener.Addr().String()),
+		"-remoteTimeout", "5s",
+		"-useLocalAsHTTPHost",
+		"-remoteSTUN", "stun:" + s.GetSTUNListenerAddrPort().String(),
+		"-tcpForwardAddr", "127.0.0.1:0",
+		"-tcpForwardHostPrefix", "id1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
 
 	// 向 client2 的 tcpforward 地址发送 http 请求
-	client2TCPForwardAddrPort := cSlice[1].GetTCPForwardListenerAddrPort()
+	client2TCPForwardAddrPort := c2.GetTCPForwardListenerAddrPort()
 	resp, err := http.Get("http://" + client2TCPForwardAddrPort.String() + "/")
 	if err != nil {
 		t.Fatal(err)
@@ -615,3 +625,185 @@ func TestTCPForward(t *testing.T) {
 	}
 	t.Logf("%s", all)
 }
+
+func TestTURNRelay(t *testing.T) {
+	t.Parallel()
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpEchoServer(httpListener)
+
+	s, err := setupServer([]string{
+		"server",
+		"-addr", "127.0.0.1:0",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-stunAddr", "127.0.0.1:0",
+		"-turnRelayIP", "127.0.0.1",
+		"-turnRelayPorts", "42000-42999",
+		"-turnSecret", "turn secret",
+		"-turnQuota", "1",
+		"-turnPeerAllow", "127.0.0.1/32",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := setupClient([]string{
+		"client",
+		"-id", "id1",
+		"-secret", "secret1",
+		"-local", "http://" + httpListener.Addr().String(),
+		"-remote", s.GetListenerAddrPort().String(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 客户端连接后收到服务端下发的凭证
+	var username, password string
+	for i := 0; i < 50; i++ {
+		var ok bool
+		username, password, ok = c.TURNCredential()
+		if ok {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(username) == 0 {
+		t.Fatal("did not receive the TURN credential")
+	}
+	// 凭证与 coturn 的 use-auth-secret 兼容
+	mac := hmac.New(sha1.New, []byte("turn secret"))
+	mac.Write([]byte(username))
+	if !strings.HasSuffix(username, ":id1") || password != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("unexpected credential %q", username)
+	}
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	restUsername := expiry + ":id1"
+	mac.Reset()
+	mac.Write([]byte(restUsername))
+	restPassword := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	turnAddr := s.GetSTUNListenerAddrPort().String()
+	allocate := func(username, password string) (relay net.PacketConn, close func(), err error) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		tc, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: turnAddr,
+			TURNServerAddr: turnAddr,
+			Conn:           conn,
+			Username:       username,
+			Password:       password,
+			Realm:          "ao.space",
+			LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		})
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		close = func() {
+			tc.Close()
+			_ = conn.Close()
+		}
+		err = tc.Listen()
+		if err == nil {
+			relay, err = tc.Allocate()
+		}
+		if err != nil {
+			close()
+		}
+		return
+	}
+
+	relay, closeRelay, err := allocate(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRelay()
+	if relay.LocalAddr().(*net.UDPAddr).Port < 42000 || relay.LocalAddr().(*net.UDPAddr).Port > 42999 {
+		t.Fatalf("relay address %v is not in the port range", relay.LocalAddr())
+	}
+
+	// 通过 relay 与对端交换数据
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	_, err = relay.WriteTo([]byte("ping"), peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != relay.LocalAddr().String() {
+		t.Fatalf("unexpected %q from %v", buf[:n], from)
+	}
+	_, err = peer.WriteTo([]byte("pong"), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("unexpected %q", buf[:n])
+	}
+	// 不在 -turnPeerAllow 中的内部地址被拒绝
+	_, err = relay.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 80})
+	if err == nil {
+		t.Fatal("internal peer should be denied")
+	}
+
+	// 超过配额
+	_, _, err = allocate(restUsername, restPassword)
+	if err == nil {
+		t.Fatal("the quota should be reached")
+	}
+	// 释放 relay 后可以重新分配，服务端生成的凭证与 REST 风格的凭证都有效
+	_ = relay.Close()
+	for i := 0; i < 20; i++ {
+		var closeRelay2 func()
+		_, closeRelay2, err = allocate(restUsername, restPassword)
+		if err == nil {
+			closeRelay2()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 错误的、过期的与未知用户的凭证
+	_, _, err = allocate(username, restPassword)
+	if err == nil {
+		t.Fatal("wrong password should be rejected")
+	}
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ":id1"
+	mac.Reset()
+	mac.Write([]byte(expired))
+	_, _, err = allocate(expired, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if err == nil {
+		t.Fatal("expired credential should be rejected")
+	}
+	unknown := expiry + ":id2"
+	mac.Reset()
+	mac.Write([]byte(unknown))
+	_, _, err = allocate(unknown, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	if err == nil {
+		t.Fatal("unknown user should be rejected")
+	}
+}
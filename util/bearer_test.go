@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidBearerToken(t *testing.T) {
+	cases := []struct {
+		auth  string
+		token string
+		valid bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Bearer abd", "abc", false},
+		{"Basic abc", "abc", false},
+		{"", "abc", false},
+		{"Bearer ", "", false},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.auth) > 0 {
+			req.Header.Set("Authorization", c.auth)
+		}
+		if ValidBearerToken(req, c.token) != c.valid {
+			t.Fatalf("%q %q should be %v", c.auth, c.token, c.valid)
+		}
+	}
+}
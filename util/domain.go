@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// DomainChallengePrefix is the label prepended to a custom domain to get the name of its TXT record
+const DomainChallengePrefix = "_gt-challenge."
+
+// DomainChallengePath is the path prefix of the HTTP token that verifies the ownership of a custom domain
+const DomainChallengePath = "/.well-known/gt-challenge/"
+
+// NormalizeDomain 将域名转为小写并去掉末尾的点，域名不合法时返回空字符串
+func NormalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !IsValidHostname(domain) || strings.IndexByte(domain, '.') < 0 {
+		return ""
+	}
+	return domain
+}
+
+// IsValidHostname 判断 name 是否为小写的合法主机名
+func IsValidHostname(name string) bool {
+	if len(name) == 0 || len(name) > 253 || strings.Contains(name, "..") || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// DomainToken returns the token that proves the user id owns the custom domain. The token is published
+// as the TXT record DomainChallengePrefix+domain or served at http://domain+DomainChallengePath+token.
+func DomainToken(id, domain string) string {
+	sum := sha256.Sum256([]byte("gt-domain:" + id + ":" + domain))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HandshakeProof 计算隧道握手的凭证：以 secret 为密钥对 nonce、id 与选项的 sha256 摘要计算 HMAC-SHA256
+func HandshakeProof(secret string, nonce []byte, id string, options []byte) []byte {
+	checksum := sha256.Sum256(options)
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(nonce)
+	h.Write([]byte{byte(len(id))})
+	h.Write([]byte(id))
+	h.Write(checksum[:])
+	return h.Sum(nil)
+}
+
+// HandshakeDigest 计算 HandshakeDigest 模式的凭证：以 secret 为密钥对 id 计算 HMAC-SHA256 的 hex，同一个 id 与 secret 的结果不变
+func HandshakeDigest(secret string, id string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("gt handshake digest"))
+	h.Write([]byte{byte(len(id))})
+	h.Write([]byte(id))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshakeProof(t *testing.T) {
+	nonce := bytes.Repeat([]byte{1}, 32)
+	proof := HandshakeProof("secret1", nonce, "id1", []byte{0})
+	if len(proof) != 32 || !bytes.Equal(proof, HandshakeProof("secret1", nonce, "id1", []byte{0})) {
+		t.Fatalf("invalid proof %x", proof)
+	}
+	others := [][]byte{
+		HandshakeProof("secret2", nonce, "id1", []byte{0}),
+		HandshakeProof("secret1", bytes.Repeat([]byte{2}, 32), "id1", []byte{0}),
+		HandshakeProof("secret1", nonce, "id2", []byte{0}),
+		HandshakeProof("secret1", nonce, "id1", []byte{1}),
+	}
+	for i, other := range others {
+		if bytes.Equal(proof, other) {
+			t.Fatalf("proof %d should be different", i)
+		}
+	}
+}
+
+func TestHandshakeDigest(t *testing.T) {
+	digest := HandshakeDigest("secret1", "id1")
+	if len(digest) != 64 || digest != HandshakeDigest("secret1", "id1") {
+		t.Fatalf("invalid digest %s", digest)
+	}
+	if digest == HandshakeDigest("secret2", "id1") || digest == HandshakeDigest("secret1", "id2") {
+		t.Fatal("digest should be different")
+	}
+}
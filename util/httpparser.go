@@ -0,0 +1,298 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// MaxHTTPHeadSize 解析 HTTP 消息时允许的头部的最大长度
+const MaxHTTPHeadSize = 32 * 1024
+
+var (
+	// ErrInvalidHTTPMessage is an error returned when a parsed http request or response is invalid
+	ErrInvalidHTTPMessage = errors.New("invalid http message")
+
+	transferEncoding = []byte("Transfer-Encoding:")
+	contentLength    = []byte("Content-Length:")
+	connectionHeader = []byte("Connection:")
+	upgradeHeader    = []byte("Upgrade:")
+)
+
+// HTTPParser 解析 HTTP/1.x 消息的边界，头部被缓存在 Head 中，body 原样传递
+type HTTPParser struct {
+	Head      []byte
+	state     int
+	remaining int64  // 剩余的 body 或者 chunk 数据的长度
+	line      []byte // 未读完的 chunk size 行或者 trailer 行
+}
+
+const (
+	parsingHead = iota
+	parsingFixedBody
+	parsingChunkSize
+	parsingChunkData
+	parsingChunkEnd
+	parsingTrailer
+	parsingUntilClose
+)
+
+// Reset 准备解析下一个消息
+func (h *HTTPParser) Reset() {
+	h.Head = h.Head[:0]
+	h.state = parsingHead
+	h.remaining = 0
+	h.line = h.line[:0]
+}
+
+// ReadingHead 返回是否正在解析头部
+func (h *HTTPParser) ReadingHead() bool {
+	return h.state == parsingHead
+}
+
+// ReadHead 缓存头部，返回 p 中属于头部的字节数与头部是否完整
+func (h *HTTPParser) ReadHead(p []byte) (n int, done bool, err error) {
+	start := len(h.Head) - 3
+	if start < 0 {
+		start = 0
+	}
+	h.Head = append(h.Head, p...)
+	for i := start; i < len(h.Head); i++ {
+		if h.Head[i] != '\n' {
+			continue
+		}
+		// 头部以空行结束，兼容只使用 \n 的情况
+		if i >= 1 && h.Head[i-1] == '\n' || i >= 2 && h.Head[i-1] == '\r' && h.Head[i-2] == '\n' {
+			n = i + 1 - (len(h.Head) - len(p))
+			h.Head = h.Head[:i+1]
+			done = true
+			return
+		}
+	}
+	if len(h.Head) > MaxHTTPHeadSize {
+		err = ErrInvalidHTTPMessage
+		return
+	}
+	n = len(p)
+	return
+}
+
+// SetBody 根据头部设置 body 的长度，length 小于 0 时 body 持续到连接关闭
+func (h *HTTPParser) SetBody(chunked bool, length int64) {
+	switch {
+	case chunked:
+		h.state = parsingChunkSize
+	case length < 0:
+		h.state = parsingUntilClose
+	default:
+		h.state = parsingFixedBody
+		h.remaining = length
+	}
+}
+
+// SetRequestBody 在请求的头部完整之后设置 body 的长度。upgrade 表示请求升级了协议或者是 CONNECT 请求，
+// 之后的数据不再是 HTTP 消息；done 表示请求没有 body，已经结束
+func (h *HTTPParser) SetRequestBody() (upgrade, done bool, err error) {
+	method, _, _, err := HTTPRequestLine(h.Head)
+	if err != nil {
+		return
+	}
+	if string(method) == "CONNECT" {
+		upgrade = true
+		return
+	}
+	if v, ok := HTTPHeaderValue(h.Head, connectionHeader); ok && HTTPHasToken(v, "upgrade") {
+		if _, ok = HTTPHeaderValue(h.Head, upgradeHeader); ok {
+			upgrade = true
+			return
+		}
+	}
+	chunked, length, err := HTTPBodyOf(h.Head, 0)
+	if err != nil {
+		return
+	}
+	h.SetBody(chunked, length)
+	done = !chunked && length == 0
+	return
+}
+
+// SetResponseBody 在响应的头部完整之后根据状态码与头部设置 body 的长度，headRequest 表示响应的是 HEAD 请求。
+// 1xx 响应之后还有同一个请求的最终响应，101 之后的数据不再是 HTTP 消息；done 表示响应没有 body，已经结束
+func (h *HTTPParser) SetResponseBody(headRequest bool) (status int, done bool, err error) {
+	status, err = HTTPStatus(h.Head)
+	if err != nil {
+		return
+	}
+	switch {
+	case status < 200:
+		return
+	case status == 204 || status == 304 || headRequest:
+		done = true
+		return
+	}
+	chunked, length, err := HTTPBodyOf(h.Head, -1)
+	if err != nil {
+		return
+	}
+	h.SetBody(chunked, length)
+	done = !chunked && length == 0
+	return
+}
+
+// ReadBody 返回 p 中属于 body 的字节数与消息是否结束
+func (h *HTTPParser) ReadBody(p []byte) (n int, done bool, err error) {
+	for {
+		switch h.state {
+		case parsingFixedBody, parsingChunkData:
+			l := int64(len(p) - n)
+			if l > h.remaining {
+				l = h.remaining
+			}
+			n += int(l)
+			h.remaining -= l
+			if h.remaining > 0 {
+				return
+			}
+			if h.state == parsingFixedBody {
+				done = true
+				return
+			}
+			h.state = parsingChunkEnd
+		case parsingUntilClose:
+			n = len(p)
+			return
+		case parsingChunkSize, parsingChunkEnd, parsingTrailer:
+			i := bytes.IndexByte(p[n:], '\n')
+			if i < 0 {
+				h.line = append(h.line, p[n:]...)
+				n = len(p)
+				if len(h.line) > MaxHTTPHeadSize {
+					err = ErrInvalidHTTPMessage
+				}
+				return
+			}
+			h.line = append(h.line, p[n:n+i+1]...)
+			n += i + 1
+			line := bytes.TrimSpace(h.line)
+			h.line = h.line[:0]
+			switch h.state {
+			case parsingChunkSize:
+				if j := bytes.IndexByte(line, ';'); j >= 0 {
+					line = bytes.TrimSpace(line[:j])
+				}
+				var size int64
+				size, err = strconv.ParseInt(string(line), 16, 64)
+				if err != nil || size < 0 {
+					err = ErrInvalidHTTPMessage
+					return
+				}
+				if size == 0 {
+					h.state = parsingTrailer
+				} else {
+					h.state = parsingChunkData
+					h.remaining = size
+				}
+			case parsingChunkEnd:
+				if len(line) > 0 {
+					err = ErrInvalidHTTPMessage
+					return
+				}
+				h.state = parsingChunkSize
+			case parsingTrailer:
+				if len(line) == 0 {
+					done = true
+					return
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+// HTTPRequestLine 解析请求头部的第一行
+func HTTPRequestLine(head []byte) (method, target, proto []byte, err error) {
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	fields := bytes.Fields(head)
+	if len(fields) != 3 {
+		err = ErrInvalidHTTPMessage
+		return
+	}
+	return fields[0], fields[1], fields[2], nil
+}
+
+// HTTPStatus 解析响应头部的状态码
+func HTTPStatus(head []byte) (status int, err error) {
+	if len(head) < 12 || !bytes.HasPrefix(head, []byte("HTTP/")) {
+		err = ErrInvalidHTTPMessage
+		return
+	}
+	i := bytes.IndexByte(head, ' ')
+	if i < 0 || len(head) < i+4 {
+		err = ErrInvalidHTTPMessage
+		return
+	}
+	status, err = strconv.Atoi(string(head[i+1 : i+4]))
+	if err != nil || status < 100 {
+		err = ErrInvalidHTTPMessage
+	}
+	return
+}
+
+// HTTPHeaderValue 返回头部中第一个名字为 name 的值，name 包含冒号
+func HTTPHeaderValue(head []byte, name []byte) (value []byte, ok bool) {
+	for len(head) > 0 {
+		i := bytes.IndexByte(head, '\n')
+		if i < 0 {
+			i = len(head) - 1
+		}
+		line := head[:i+1]
+		head = head[i+1:]
+		if len(line) >= len(name) && bytes.EqualFold(line[:len(name)], name) {
+			return bytes.TrimSpace(line[len(name):]), true
+		}
+	}
+	return
+}
+
+// HTTPHasToken 返回以逗号分隔的头部的值中是否包含 token
+func HTTPHasToken(value []byte, token string) bool {
+	for _, v := range bytes.Split(value, []byte(",")) {
+		if bytes.EqualFold(bytes.TrimSpace(v), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPBodyOf 返回 head 对应消息的 body 是否为 chunked 以及 body 的长度
+func HTTPBodyOf(head []byte, defaultLength int64) (chunked bool, length int64, err error) {
+	if v, ok := HTTPHeaderValue(head, transferEncoding); ok && HTTPHasToken(v, "chunked") {
+		chunked = true
+		return
+	}
+	length = defaultLength
+	if v, ok := HTTPHeaderValue(head, contentLength); ok {
+		length, err = strconv.ParseInt(string(v), 10, 64)
+		if err != nil || length < 0 {
+			err = ErrInvalidHTTPMessage
+		}
+	}
+	return
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHTTPParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		chunked bool
+		length  int64
+		rest    string
+	}{
+		{
+			name:   "content length",
+			data:   "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+			length: 5,
+			rest:   "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			name:    "chunked",
+			data:    "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nTrailer: x\r\n\r\n",
+			chunked: true,
+			rest:    "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			name: "no body",
+			data: "GET / HTTP/1.1\nHost: a\n\n",
+			rest: "GET / HTTP/1.1\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		// 每次写入不同大小的数据，验证跨越边界的解析
+		for size := 1; size <= len(tt.data)+len(tt.rest); size++ {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				var h HTTPParser
+				h.Reset()
+				data := []byte(tt.data + tt.rest)
+				consumed := 0
+				done := false
+				for !done && consumed < len(data) {
+					end := consumed + size
+					if end > len(data) {
+						end = len(data)
+					}
+					p := data[consumed:end]
+					var n int
+					var err error
+					if h.ReadingHead() {
+						var headDone bool
+						n, headDone, err = h.ReadHead(p)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if headDone {
+							chunked, length, err := HTTPBodyOf(h.Head, 0)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if chunked != tt.chunked || length != tt.length {
+								t.Fatalf("unexpected body: %v %v", chunked, length)
+							}
+							h.SetBody(chunked, length)
+							done = !chunked && length == 0
+						}
+					} else {
+						n, done, err = h.ReadBody(p)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+					consumed += n
+				}
+				if !done {
+					t.Fatal("message is not done")
+				}
+				if consumed != len(tt.data) {
+					t.Fatalf("consumed %d bytes, %d is expected", consumed, len(tt.data))
+				}
+			})
+		}
+	}
+}
+
+func TestHTTPParserMessages(t *testing.T) {
+	var h HTTPParser
+	h.Reset()
+	_, done, err := h.ReadHead([]byte("CONNECT a:443 HTTP/1.1\r\n\r\n"))
+	if err != nil || !done {
+		t.Fatal(done, err)
+	}
+	upgrade, _, err := h.SetRequestBody()
+	if err != nil || !upgrade {
+		t.Fatal("CONNECT should upgrade", err)
+	}
+
+	h.Reset()
+	_, _, _ = h.ReadHead([]byte("GET / HTTP/1.1\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	upgrade, _, err = h.SetRequestBody()
+	if err != nil || !upgrade {
+		t.Fatal("websocket should upgrade", err)
+	}
+
+	tests := []struct {
+		head   string
+		isHEAD bool
+		status int
+		done   bool
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false, 200, true},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", true, 200, true},
+		{"HTTP/1.1 304 Not Modified\r\n\r\n", false, 304, true},
+		{"HTTP/1.1 100 Continue\r\n\r\n", false, 100, false},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", false, 200, false},
+	}
+	for _, tt := range tests {
+		h.Reset()
+		_, _, _ = h.ReadHead([]byte(tt.head))
+		status, done, err := h.SetResponseBody(tt.isHEAD)
+		if err != nil || status != tt.status || done != tt.done {
+			t.Fatalf("%q: %v %v %v", tt.head, status, done, err)
+		}
+	}
+}
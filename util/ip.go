@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// ParseIPPrefix parses an IP address or a CIDR like 10.0.0.0/8. An IP address is treated as a prefix
+// that contains only itself. IPv4-mapped IPv6 addresses are converted to IPv4.
+func ParseIPPrefix(s string) (prefix netip.Prefix, err error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, '/') < 0 {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(s)
+		if err != nil {
+			return
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+		return
+	}
+	prefix, err = netip.ParsePrefix(s)
+	if err != nil {
+		return
+	}
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+		if bits < 0 {
+			bits = 0
+		}
+	}
+	prefix = netip.PrefixFrom(addr, bits).Masked()
+	return
+}
+
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),          // this network
+	netip.MustParsePrefix("100.64.0.0/10"),      // shared address space
+	netip.MustParsePrefix("255.255.255.255/32"), // limited broadcast
+}
+
+// IsInternalIP reports whether addr is not a public unicast address: loopback, private, link-local, unspecified,
+// multicast, broadcast or in the shared address space. IPv4-mapped IPv6 addresses are checked as IPv4.
+func IsInternalIP(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Institute of Software, Chinese Academy of Sciences (ISCAS)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseIPPrefix(t *testing.T) {
+	cases := map[string]string{
+		"10.1.2.3/8":          "10.0.0.0/8",
+		" 192.168.1.1 ":       "192.168.1.1/32",
+		"::ffff:10.0.0.1":     "10.0.0.1/32",
+		"::ffff:10.0.0.0/104": "10.0.0.0/8",
+		"2001:db8::1/32":      "2001:db8::/32",
+	}
+	for s, expected := range cases {
+		prefix, err := ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if prefix.String() != expected {
+			t.Fatalf("%q: expected %s, got %s", s, expected, prefix)
+		}
+	}
+	for _, s := range []string{"", "10.0.0.0/33", "example.com", "10.0.0.1/"} {
+		if _, err := ParseIPPrefix(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestIsInternalIP(t *testing.T) {
+	for _, s := range []string{
+		"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "fe80::1", "fc00::1",
+		"0.0.0.0", "::", "0.1.2.3", "100.64.0.1", "224.0.0.1", "ff02::1", "255.255.255.255", "::ffff:127.0.0.1",
+	} {
+		if !IsInternalIP(netip.MustParseAddr(s)) {
+			t.Fatalf("%s should be internal", s)
+		}
+	}
+	for _, s := range []string{"1.1.1.1", "8.8.8.8", "2001:4860:4860::8888", "::ffff:1.1.1.1"} {
+		if IsInternalIP(netip.MustParseAddr(s)) {
+			t.Fatalf("%s should not be internal", s)
+		}
+	}
+	if !IsInternalIP(netip.Addr{}) {
+		t.Fatal("invalid address should be internal")
+	}
+}